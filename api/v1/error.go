@@ -2,6 +2,7 @@ package log_v1
 
 import (
 	"fmt"
+	"time"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
@@ -31,3 +32,91 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrStaleReadReason は ErrStaleRead のステータスに含める ErrorInfo の理由。
+const ErrStaleReadReason = "STALE_READ"
+
+// ErrStaleRead はフォロワーのログが、リクエストで許容された古さの上限を超えて古い可能性があることを表す。
+// 他のサーバであれば読み出せるため、再試行可能なUnavailableとして返却する。
+type ErrStaleRead struct {
+	Staleness    time.Duration
+	MaxStaleness time.Duration
+}
+
+// GRPCStatus はクライアントが古さによる拒否を識別できるよう、理由を設定したステータスを返却する。
+func (e ErrStaleRead) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, fmt.Sprintf(
+		"stale read: replica is %s behind, max staleness %s", e.Staleness, e.MaxStaleness,
+	))
+	std, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: ErrStaleReadReason,
+		Domain: "proglog",
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrStaleRead) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// IsStaleRead はエラーがフォロワーの古さによる読み出しの拒否かどうかを返却する。
+// サーバから受信したエラーはステータスの詳細から判定する。
+func IsStaleRead(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.Unavailable {
+		return false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == ErrStaleReadReason {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrOffsetMismatchReason は ErrOffsetMismatch のステータスに含める ErrorInfo の理由。
+const ErrOffsetMismatchReason = "OFFSET_MISMATCH"
+
+// ErrOffsetMismatch はオフセットを指定した書き込みで、ログの次のオフセットが指定と一致しなかったことを表す。
+// ログの状態が変わらない限り再試行しても成功しないため、FailedPreconditionとして返却する。
+type ErrOffsetMismatch struct {
+	Offset uint64 // 書き込みを指定されたオフセット
+	Next   uint64 // ログが次に書き込むオフセット
+}
+
+// GRPCStatus はクライアントがオフセットの不一致を識別できるよう、理由を設定したステータスを返却する。
+func (e ErrOffsetMismatch) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf(
+		"offset mismatch: requested %d, log will write %d next", e.Offset, e.Next,
+	))
+	std, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: ErrOffsetMismatchReason,
+		Domain: "proglog",
+	})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOffsetMismatch) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// IsOffsetMismatch はエラーがオフセットの不一致による書き込みの拒否かどうかを返却する。
+// サーバから受信したエラーはステータスの詳細から判定する。
+func IsOffsetMismatch(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.FailedPrecondition {
+		return false
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == ErrOffsetMismatchReason {
+			return true
+		}
+	}
+	return false
+}
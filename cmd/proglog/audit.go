@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ac0mz/proglog/internal/audit"
+	"github.com/ac0mz/proglog/internal/log"
+	"github.com/spf13/cobra"
+)
+
+// auditCommand は監査ログを条件で絞り込み、一致したイベントを1行1件のJSONで出力するコマンドを作成する。
+func auditCommand() *cobra.Command {
+	var (
+		dir, since, until string
+		keyringFile       string
+		fromLog           bool
+		filter            audit.Filter
+	)
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Query the audit log.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			if filter.Since, err = parseTime(since); err != nil {
+				return err
+			}
+			if filter.Until, err = parseTime(until); err != nil {
+				return err
+			}
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			print := func(e audit.Event) error {
+				return enc.Encode(e)
+			}
+			if !fromLog {
+				return audit.Query(dir, filter, print)
+			}
+			var c log.Config
+			if keyringFile != "" {
+				if c.Keyring, err = log.LoadKeyring(keyringFile); err != nil {
+					return err
+				}
+			}
+			l, err := log.NewLog(dir, c)
+			if err != nil {
+				return err
+			}
+			defer l.Close()
+			return audit.QueryRecords(l, filter, print)
+		},
+	}
+	cmd.Flags().StringVar(&dir, "audit-dir", "", "Directory of the audit log.")
+	cmd.Flags().BoolVar(&fromLog, "audit-to-log", false, "Read the audit log written as a proglog log.")
+	cmd.Flags().StringVar(&keyringFile, "keyring-file", "", "Path to keyring to decrypt the audit log written as a proglog log.")
+	cmd.Flags().StringVar(&filter.Subject, "subject", "", "Filter by subject.")
+	cmd.Flags().StringVar(&filter.Action, "action", "", "Filter by action.")
+	cmd.Flags().StringVar(&filter.Object, "object", "", "Filter by object prefix.")
+	cmd.Flags().StringVar(&filter.Kind, "kind", "", "Filter by kind (authorization, record, admin).")
+	cmd.Flags().StringVar(&filter.Outcome, "outcome", "", "Filter by outcome (allow, deny, success, failure).")
+	cmd.Flags().StringVar(&since, "since", "", "Show events at or after this time (RFC 3339 or duration such as 1h).")
+	cmd.Flags().StringVar(&until, "until", "", "Show events before this time (RFC 3339 or duration such as 1h).")
+	_ = cmd.MarkFlagRequired("audit-dir")
+	return cmd
+}
+
+// parseTime はRFC 3339形式の時刻、または現在から遡る期間を解釈する。
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/config"
+	"github.com/ac0mz/proglog/internal/log"
+	"github.com/hashicorp/raft"
+	"github.com/spf13/cobra"
+)
+
+// backupCommand はクラスタのログ全体のバックアップを取得するコマンドを作成する。
+// 出力先が .tar で終わる場合はtar、.tar.gz または .tgz で終わる場合はgzipで圧縮したtar、
+// それ以外の場合はディレクトリとして保存する。
+//
+//	proglog backup <出力先>
+func backupCommand() *cobra.Command {
+	var (
+		addr      string
+		tlsConfig config.TLSConfig
+		timeout   time.Duration
+	)
+	cmd := &cobra.Command{
+		Use:   "backup <path>",
+		Short: "Back up the whole log to a directory or tarball.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conn, err := dial(addr, tlsConfig)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			defer cancel()
+			stream, err := api.NewAdminClient(conn).Backup(ctx, &api.BackupRequest{})
+			if err != nil {
+				return err
+			}
+			r := &chunkReader{recv: stream.Recv}
+			if err = writeBackup(args[0], r); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s\t%d bytes\n", args[0], r.n)
+			return nil
+		},
+	}
+	dialFlags(cmd, &addr, &tlsConfig)
+	cmd.Flags().DurationVar(&timeout, "timeout", 10*time.Minute, "Time to wait for the backup to complete.")
+	return cmd
+}
+
+// restoreCommand はバックアップから新たなクラスタを開始するデータディレクトリを作成するコマンドを作成する。
+// 作成したデータディレクトリ、ノード名、RPCのアドレスでサーバを起動すると、バックアップの時点のオフセットを
+// 保ったまま単独のリーダーとなる。他のサーバは空のデータディレクトリで起動し、通常どおりクラスタに参加させる。
+//
+//	proglog restore <バックアップ> --data-dir <ディレクトリ> --node-name <名前> --raft-addr <ホスト:RPCポート>
+func restoreCommand() *cobra.Command {
+	var dataDir, nodeName, raftAddr string
+	cmd := &cobra.Command{
+		Use:   "restore <path>",
+		Short: "Create a data directory that starts a new cluster from a backup.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if nodeName == "" || raftAddr == "" {
+				return errors.New("--node-name and --raft-addr are required")
+			}
+			r, err := readBackup(args[0])
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			meta, err := log.Restore(dataDir, r, raft.ServerID(nodeName), raft.ServerAddress(raftAddr))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "restored index %d (term %d, taken at %s) into %s\n",
+				meta.Index, meta.Term, meta.CreatedAt.Format(time.RFC3339), dataDir)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&dataDir, "data-dir", path.Join(os.TempDir(), "proglog"), "Directory to store log and Raft data.")
+	cmd.Flags().StringVar(&nodeName, "node-name", "", "Server ID of the node to start the cluster.")
+	cmd.Flags().StringVar(&raftAddr, "raft-addr", "", "RPC address (host:rpc-port) the node will listen on.")
+	return cmd
+}
+
+// chunkReader は受信したバックアップの一部を連結して読み出す。
+type chunkReader struct {
+	recv func() (*api.BackupChunk, error)
+	buf  []byte
+	n    int64 // 読み出したバイト数
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		chunk, err := r.recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = chunk.Data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.n += int64(n)
+	return n, nil
+}
+
+// writeBackup はアーカイブを出力先の形式で保存する。
+func writeBackup(dst string, r io.Reader) error {
+	if !isTarball(dst) {
+		return extract(dst, r)
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	var w io.WriteCloser = f
+	if isGzip(dst) {
+		w = gzip.NewWriter(f)
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		f.Close()
+		return err
+	}
+	if w != f {
+		if err = w.Close(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// extract はアーカイブのファイルをディレクトリに展開する。
+func extract(dir string, r io.Reader) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// アーカイブのファイル名でディレクトリの外に書き込まないよう、ファイル名のみを用いる
+		f, err := os.OpenFile(filepath.Join(dir, filepath.Base(hdr.Name)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+	}
+}
+
+// readBackup はディレクトリまたはtarのバックアップを、tarのアーカイブとして読み出す。
+func readBackup(src string) (io.ReadCloser, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(archive(src, pw))
+		}()
+		return pr, nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	if !isGzip(src) {
+		return f, nil
+	}
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gr, f}, nil
+}
+
+// archive はディレクトリに展開したバックアップを、取得時と同じ順序のtarとして書き込む。
+func archive(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, name := range []string{log.BackupMetaFile, log.BackupStateFile} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		if err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func isTarball(name string) bool {
+	return strings.HasSuffix(name, ".tar") || isGzip(name)
+}
+
+func isGzip(name string) bool {
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/agent"
+	"github.com/ac0mz/proglog/internal/config"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+// clusterCommand はSerfのメンバーシップを参照し、クラスタのすべてのノードに操作を指示するコマンドを作成する。
+//
+//	proglog cluster members
+//	proglog cluster snapshot
+func clusterCommand() *cobra.Command {
+	var (
+		addr      string
+		tlsConfig config.TLSConfig
+		conn      *grpc.ClientConn
+		timeout   time.Duration
+	)
+	cmd := &cobra.Command{
+		Use:   "cluster",
+		Short: "Inspect members and run queries across the cluster.",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) (err error) {
+			conn, err = dial(addr, tlsConfig)
+			return err
+		},
+	}
+	dialFlags(cmd, &addr, &tlsConfig)
+	snapshot := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Flush the log and take a raft snapshot on all members.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			res, err := api.NewAdminClient(conn).Query(cmd.Context(), &api.QueryRequest{
+				Name:      agent.SnapshotQuery,
+				TimeoutMs: timeout.Milliseconds(),
+			})
+			if err != nil {
+				return err
+			}
+			for _, r := range res.Results {
+				result := "ok"
+				if r.Error != "" {
+					result = r.Error
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s\n", r.Node, result)
+			}
+			return nil
+		},
+	}
+	snapshot.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "Time to wait for responses from members.")
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "members",
+			Short: "List members of the cluster and their tags.",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				res, err := api.NewLogClient(conn).GetMembers(cmd.Context(), &api.GetMembersRequest{})
+				if err != nil {
+					return err
+				}
+				for _, m := range res.Members {
+					tags := make([]string, 0, len(m.Tags))
+					for k, v := range m.Tags {
+						tags = append(tags, k+"="+v)
+					}
+					sort.Strings(tags)
+					fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s\t%s\t%s\n", m.Name, m.Addr, m.Status, strings.Join(tags, ","))
+				}
+				return nil
+			},
+		},
+		snapshot,
+	)
+	return cmd
+}
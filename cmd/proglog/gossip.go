@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/config"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// gossipKeyCommand はクラスタのゴシップを暗号化する鍵をローテーションするコマンドを作成する。
+//
+// 鍵は次の順でローテーションする。
+//
+//	proglog gossip-key install <新しい鍵>
+//	proglog gossip-key use <新しい鍵>
+//	proglog gossip-key remove <古い鍵>
+func gossipKeyCommand() *cobra.Command {
+	var (
+		addr      string
+		tlsConfig config.TLSConfig
+		client    api.AdminClient
+	)
+	cmd := &cobra.Command{
+		Use:   "gossip-key",
+		Short: "Manage the keys to encrypt Serf gossip across the cluster.",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			conn, err := dial(addr, tlsConfig)
+			if err != nil {
+				return err
+			}
+			client = api.NewAdminClient(conn)
+			return nil
+		},
+	}
+	dialFlags(cmd, &addr, &tlsConfig)
+
+	type changeFunc func(api.AdminClient, context.Context, *api.GossipKeyRequest, ...grpc.CallOption) (*api.GossipKeyResponse, error)
+	change := func(use, short string, fn changeFunc) *cobra.Command {
+		return &cobra.Command{
+			Use:   use + " <key>",
+			Short: short,
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				ctx, cancel := context.WithTimeout(cmd.Context(), 30*time.Second)
+				defer cancel()
+				_, err := fn(client, ctx, &api.GossipKeyRequest{Key: args[0]})
+				return err
+			},
+		}
+	}
+	cmd.AddCommand(
+		change("install", "Install a new key on all members.", api.AdminClient.InstallGossipKey),
+		change("use", "Change the primary key used to encrypt messages.", api.AdminClient.UseGossipKey),
+		change("remove", "Remove a key from all members.", api.AdminClient.RemoveGossipKey),
+		&cobra.Command{
+			Use:   "list",
+			Short: "List the keys in use and the number of members holding each key.",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				ctx, cancel := context.WithTimeout(cmd.Context(), 30*time.Second)
+				defer cancel()
+				res, err := client.ListGossipKeys(ctx, &api.ListGossipKeysRequest{})
+				if err != nil {
+					return err
+				}
+				keys := make([]string, 0, len(res.Keys))
+				for key := range res.Keys {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				for _, key := range keys {
+					fmt.Fprintf(cmd.OutOrStdout(), "%s [%d/%d]\n", key, res.Keys[key], res.NumNodes)
+				}
+				return nil
+			},
+		},
+	)
+	return cmd
+}
+
+// dial はクラスタのサーバに接続する。CAが指定されていない場合はTLSを用いない。
+func dial(addr string, tlsConfig config.TLSConfig) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig.CAFile != "" {
+		c, err := config.SetupTLSConfig(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(c)
+	}
+	return grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+}
+
+// dialFlags はサーバへの接続に用いるフラグを、サブコマンドと共通のフラグとして定義する。
+func dialFlags(cmd *cobra.Command, addr *string, tlsConfig *config.TLSConfig) {
+	cmd.PersistentFlags().StringVar(addr, "addr", ":8400", "Address of a server in the cluster.")
+	cmd.PersistentFlags().StringVar(&tlsConfig.CertFile, "tls-cert-file", "", "Path to client tls cert.")
+	cmd.PersistentFlags().StringVar(&tlsConfig.KeyFile, "tls-key-file", "", "Path to client tls key.")
+	cmd.PersistentFlags().StringVar(&tlsConfig.CAFile, "tls-ca-file", "", "Path to certificate authority.")
+	cmd.PersistentFlags().StringVar(&tlsConfig.ServerAddress, "tls-server-name", "", "Server name to verify the server certificate.")
+}
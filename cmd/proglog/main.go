@@ -6,6 +6,7 @@ import (
 	"os/signal"
 	"path"
 	"syscall"
+	"time"
 
 	"github.com/ac0mz/proglog/internal/agent"
 	"github.com/ac0mz/proglog/internal/config"
@@ -26,6 +27,7 @@ func main() {
 	if err := setupFlags(cmd); err != nil {
 		log.Fatal(err)
 	}
+	cmd.AddCommand(auditCommand(), gossipKeyCommand(), clusterCommand(), backupCommand(), restoreCommand(), mirrorCommand())
 
 	if err := cmd.Execute(); err != nil {
 		log.Fatal(err)
@@ -60,9 +62,48 @@ func setupFlags(cmd *cobra.Command) error {
 	cmd.Flags().Int("prc-port", 8400, "Port for RPC clients (and Raft) connections.")
 	cmd.Flags().StringSlice("start-join-addrs", nil, "Serf addresses to join.")
 	cmd.Flags().Bool("bootstrap", false, "Bootstrap the cluster.")
+	cmd.Flags().Int("raft-max-pool", 5, "Number of connections to pool per raft peer.")
+	cmd.Flags().Duration("raft-timeout", 10*time.Second, "I/O timeout of raft RPCs.")
+	cmd.Flags().Bool("raft-multiplex", false, "Multiplex raft RPCs over a single connection per peer.")
+	cmd.Flags().String("metrics-addr", "", "Address to serve Prometheus metrics on.")
+	cmd.Flags().String("tracing-endpoint", "", "OTLP/HTTP collector URL to export traces to.")
+	cmd.Flags().Float64("tracing-sample-ratio", 0.01, "Ratio of requests to trace (0 to 1).")
+
+	cmd.Flags().String("quota-file", "", "Path to per-client quota config (reloaded on change).")
+	cmd.Flags().Duration("reload-interval", 10*time.Second, "Interval to check config files for changes.")
 
 	cmd.Flags().String("acl-model-file", "", "Path to ACL model.")
 	cmd.Flags().String("acl-policy-file", "", "Path to ACL policy.")
+	cmd.Flags().String("log-name", "default", "Name of the log used as the ACL object (log/<name>).")
+
+	cmd.Flags().String("jwks-file", "", "Path to JWKS used to verify JWT bearer tokens.")
+	cmd.Flags().String("jwt-issuer", "", "Required iss claim of JWT bearer tokens.")
+	cmd.Flags().String("jwt-audience", "", "Required aud claim of JWT bearer tokens.")
+	cmd.Flags().String("api-key-file", "", "Path to subjects and SHA-256 hashes of static API keys.")
+	cmd.Flags().String("spiffe-trust-domain", "", "Trust domain of SPIFFE IDs accepted from client certificates.")
+
+	cmd.Flags().String("audit-dir", "", "Directory to write the audit log to.")
+	cmd.Flags().Int64("audit-max-bytes", 64<<20, "Size of the audit log file to rotate at.")
+	cmd.Flags().Int("audit-max-files", 10, "Number of rotated audit log files to keep.")
+	cmd.Flags().Bool("audit-to-log", false, "Write the audit log as a proglog log instead of files.")
+
+	cmd.Flags().String("gossip-key", "", "Base64 encoded key to encrypt Serf gossip (rotated keys are kept in the data dir).")
+	cmd.Flags().String("cluster-id", "", "Only admit members with this cluster ID into the cluster.")
+	cmd.Flags().String("join-secret-file", "", "Path to secret to sign and verify join tokens of members.")
+	cmd.Flags().String("zone", "", "Availability zone of this node, used for zone-local reads.")
+	cmd.Flags().Duration("tag-interval", 5*time.Second, "Interval to publish raft state and disk usage as member tags.")
+	cmd.Flags().Duration("reconcile-interval", 10*time.Second, "Interval for the leader to reconcile Serf members with the raft configuration.")
+	cmd.Flags().Duration("reap-grace-period", 2*time.Minute, "Time to wait before removing failed servers from the raft configuration.")
+
+	cmd.Flags().String("keyring-file", "", "Path to AES-GCM keyring used to encrypt segments and snapshots (reloaded on change).")
+	cmd.Flags().Uint64("index-interval-bytes", 4096, "Bytes of records between index entries (0 indexes every record).")
+
+	cmd.Flags().String("tier-dir", "", "Directory (e.g. a shared mount) to offload closed segments to.")
+	cmd.Flags().String("tier-s3-endpoint", "", "URL of S3-compatible storage to offload closed segments to. Credentials are read from the AWS environment variables, the shared credentials file or the instance IAM role.")
+	cmd.Flags().String("tier-s3-bucket", "", "Bucket to offload closed segments to.")
+	cmd.Flags().String("tier-s3-region", "us-east-1", "Region of the bucket.")
+	cmd.Flags().Int("tier-local-segments", 2, "Number of closed segments to keep on local disk.")
+	cmd.Flags().Int("tier-cache-segments", 4, "Number of offloaded segments to cache on local disk for reads.")
 
 	cmd.Flags().String("server-tls-cert-file", "", "Path to server tls cert.")
 	cmd.Flags().String("server-tls-key-file", "", "Path to server tls key.")
@@ -71,6 +112,7 @@ func setupFlags(cmd *cobra.Command) error {
 	cmd.Flags().String("peer-tls-cert-file", "", "Path to peer tls cert.")
 	cmd.Flags().String("peer-tls-key-file", "", "Path to peer tls key.")
 	cmd.Flags().String("peer-tls-ca-file", "", "Path to peer certificate authority.")
+	cmd.Flags().String("peer-tls-server-name", "", "Server name to verify peer certificates. Defaults to the peer host name; required when peers are addressed by IP.")
 
 	return viper.BindPFlags(cmd.Flags())
 }
@@ -95,27 +137,65 @@ func (c *cli) setupConfig(cmd *cobra.Command, args []string) error {
 	c.cfg.RPCPort = viper.GetInt("prc-port")
 	c.cfg.StartJoinAddrs = viper.GetStringSlice("start-join-addrs")
 	c.cfg.Bootstrap = viper.GetBool("bootstrap")
+	c.cfg.RaftMaxPool = viper.GetInt("raft-max-pool")
+	c.cfg.RaftTimeout = viper.GetDuration("raft-timeout")
+	c.cfg.RaftMultiplex = viper.GetBool("raft-multiplex")
+	c.cfg.MetricsAddr = viper.GetString("metrics-addr")
+	c.cfg.TracingEndpoint = viper.GetString("tracing-endpoint")
+	c.cfg.TracingSampleRatio = viper.GetFloat64("tracing-sample-ratio")
+	c.cfg.QuotaFile = viper.GetString("quota-file")
+	c.cfg.ReloadInterval = viper.GetDuration("reload-interval")
 	c.cfg.ACLModelFile = viper.GetString("acl-model-file")
-	c.cfg.ACLModelFile = viper.GetString("acl-policy-file")
+	c.cfg.ACLPolicyFile = viper.GetString("acl-policy-file")
+	c.cfg.LogName = viper.GetString("log-name")
+	c.cfg.JWKSFile = viper.GetString("jwks-file")
+	c.cfg.JWTIssuer = viper.GetString("jwt-issuer")
+	c.cfg.JWTAudience = viper.GetString("jwt-audience")
+	c.cfg.APIKeyFile = viper.GetString("api-key-file")
+	c.cfg.SPIFFETrustDomain = viper.GetString("spiffe-trust-domain")
+	c.cfg.AuditDir = viper.GetString("audit-dir")
+	c.cfg.AuditMaxBytes = viper.GetInt64("audit-max-bytes")
+	c.cfg.AuditMaxFiles = viper.GetInt("audit-max-files")
+	c.cfg.AuditToLog = viper.GetBool("audit-to-log")
+	c.cfg.GossipKey = viper.GetString("gossip-key")
+	c.cfg.ClusterID = viper.GetString("cluster-id")
+	c.cfg.JoinSecretFile = viper.GetString("join-secret-file")
+	c.cfg.Zone = viper.GetString("zone")
+	c.cfg.TagInterval = viper.GetDuration("tag-interval")
+	c.cfg.ReconcileInterval = viper.GetDuration("reconcile-interval")
+	c.cfg.ReapGracePeriod = viper.GetDuration("reap-grace-period")
+	c.cfg.KeyringFile = viper.GetString("keyring-file")
+	c.cfg.IndexIntervalBytes = viper.GetUint64("index-interval-bytes")
+	c.cfg.TierLocalSegments = viper.GetInt("tier-local-segments")
+	c.cfg.TierCacheSegments = viper.GetInt("tier-cache-segments")
+	if c.cfg.TierStorage, err = tierStorage(); err != nil {
+		return err
+	}
 	c.cfg.ServerTLSConfig.CertFile = viper.GetString("server-tls-cert-file")
 	c.cfg.ServerTLSConfig.KeyFile = viper.GetString("server-tls-key-file")
 	c.cfg.ServerTLSConfig.CAFile = viper.GetString("server-tls-ca-file")
 	c.cfg.PeerTLSConfig.CertFile = viper.GetString("peer-tls-cert-file")
 	c.cfg.PeerTLSConfig.KeyFile = viper.GetString("peer-tls-key-file")
 	c.cfg.PeerTLSConfig.CAFile = viper.GetString("peer-tls-ca-file")
+	c.cfg.PeerTLSConfig.ServerAddress = viper.GetString("peer-tls-server-name")
 
+	// 証明書のローテーションに再起動せず追従するため、ファイルの変更時に再読み込みするTLS設定を用いる
 	if c.cfg.ServerTLSConfig.CertFile != "" && c.cfg.ServerTLSConfig.KeyFile != "" {
 		c.cfg.ServerTLSConfig.Server = true
-		c.cfg.Config.ServerTLSConfig, err = config.SetupTLSConfig(c.cfg.ServerTLSConfig)
+		r, err := config.NewTLSReloader(c.cfg.ServerTLSConfig)
 		if err != nil {
 			return err
 		}
+		c.cfg.Config.ServerTLSConfig = r.TLSConfig()
+		c.cfg.TLSReloaders = append(c.cfg.TLSReloaders, r)
 	}
 	if c.cfg.PeerTLSConfig.CertFile != "" && c.cfg.PeerTLSConfig.KeyFile != "" {
-		c.cfg.Config.PeerTLSConfig, err = config.SetupTLSConfig(c.cfg.PeerTLSConfig)
+		r, err := config.NewTLSReloader(c.cfg.PeerTLSConfig)
 		if err != nil {
 			return err
 		}
+		c.cfg.Config.PeerTLSConfig = r.TLSConfig()
+		c.cfg.TLSReloaders = append(c.cfg.TLSReloaders, r)
 	}
 	return nil
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ac0mz/proglog/internal/auth"
+	"github.com/ac0mz/proglog/internal/config"
+	"github.com/ac0mz/proglog/internal/mirror"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/credentials"
+)
+
+// mirrorCommand はあるクラスタのログのレコードを、別のクラスタのログに複製し続けるコマンドを作成する。
+// 複製元と複製先のクラスタにはそれぞれ別のTLSの設定で接続し、停止するまで複製を続ける。
+//
+//	proglog mirror --source-addr <アドレス> --target-addr <アドレス> --checkpoint-file <ファイル>
+func mirrorCommand() *cobra.Command {
+	var (
+		cfg                      mirror.Config
+		sourceTLS, targetTLS     config.TLSConfig
+		sourceCreds, targetCreds credentialFiles
+		metricsAddr              string
+	)
+	cmd := &cobra.Command{
+		Use:   "mirror",
+		Short: "Mirror records from the log of a source cluster to a target cluster.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			if cfg.SourceTLSConfig, err = clientTLSConfig(sourceTLS); err != nil {
+				return err
+			}
+			if cfg.TargetTLSConfig, err = clientTLSConfig(targetTLS); err != nil {
+				return err
+			}
+			if cfg.SourceCredentials, err = sourceCreds.load(); err != nil {
+				return err
+			}
+			if cfg.TargetCredentials, err = targetCreds.load(); err != nil {
+				return err
+			}
+			m, err := mirror.New(cfg)
+			if err != nil {
+				return err
+			}
+			if metricsAddr != "" {
+				srv, err := serveMetrics(metricsAddr, m)
+				if err != nil {
+					m.Close()
+					return err
+				}
+				defer srv.Close()
+			}
+			sigc := make(chan os.Signal, 1)
+			signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+			// オフセットが一致せず停止した場合は、エラーとして終了する
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for m.Err() == nil {
+				select {
+				case <-sigc:
+					return m.Close()
+				case <-ticker.C:
+				}
+			}
+			_ = m.Close()
+			return m.Err()
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&cfg.SourceAddr, "source-addr", "", "Comma-separated addresses of servers in the source cluster.")
+	flags.StringVar(&cfg.TargetAddr, "target-addr", "", "Comma-separated addresses of servers in the target cluster.")
+	for _, side := range []struct {
+		name  string
+		tls   *config.TLSConfig
+		creds *credentialFiles
+	}{{"source", &sourceTLS, &sourceCreds}, {"target", &targetTLS, &targetCreds}} {
+		flags.StringVar(&side.tls.CertFile, side.name+"-tls-cert-file", "", "Path to client tls cert for the "+side.name+" cluster.")
+		flags.StringVar(&side.tls.KeyFile, side.name+"-tls-key-file", "", "Path to client tls key for the "+side.name+" cluster.")
+		flags.StringVar(&side.tls.CAFile, side.name+"-tls-ca-file", "", "Path to certificate authority of the "+side.name+" cluster.")
+		flags.StringVar(&side.tls.ServerAddress, side.name+"-tls-server-name", "", "Server name to verify the "+side.name+" server certificate.")
+		flags.StringVar(&side.creds.tokenFile, side.name+"-token-file", "", "Path to a bearer token (JWT) to authenticate to the "+side.name+" cluster.")
+		flags.StringVar(&side.creds.apiKeyFile, side.name+"-api-key-file", "", "Path to an API key to authenticate to the "+side.name+" cluster.")
+	}
+	flags.StringVar(&cfg.Name, "name", "default", "Name of the mirror, used to label metrics and logs.")
+	flags.IntVar(&cfg.MaxInFlight, "max-in-flight", 256, "Maximum number of records sent to the target without acknowledgement.")
+	flags.StringVar(&cfg.CheckpointFile, "checkpoint-file", "", "File to store the next source offset to mirror.")
+	flags.Uint64Var(&cfg.StartOffset, "start-offset", 0, "Source offset to start from when no checkpoint exists.")
+	flags.BoolVar(&cfg.PreserveOffsets, "preserve-offsets", false, "Write each record at the same offset as the source, and stop if they diverge.")
+	flags.StringToStringVar(&cfg.Topics, "topic", nil, "Rename a source topic on the target, as source=target. Can be repeated.")
+	flags.DurationVar(&cfg.LagInterval, "lag-interval", 10*time.Second, "Interval to probe the end of the source log for the lag metric.")
+	flags.StringVar(&metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on /metrics. Empty disables metrics.")
+	return cmd
+}
+
+// clientTLSConfig はCAが指定されている場合にクラスタへの接続に用いるTLSの設定を作成する。
+// 指定されていない場合は暗号化せずに接続するためnilを返却する。
+func clientTLSConfig(c config.TLSConfig) (*tls.Config, error) {
+	if c.CAFile == "" {
+		return nil, nil
+	}
+	return config.SetupTLSConfig(c)
+}
+
+// credentialFiles はクラスタへの認証に用いるトークンまたはAPIキーのファイルである。
+type credentialFiles struct {
+	tokenFile  string
+	apiKeyFile string
+}
+
+// load はファイルからRPCごとの認証情報を作成する。いずれも指定されていない場合はnilを返却する。
+func (c credentialFiles) load() (credentials.PerRPCCredentials, error) {
+	switch {
+	case c.tokenFile != "" && c.apiKeyFile != "":
+		return nil, errors.New("token file and api key file are mutually exclusive")
+	case c.tokenFile != "":
+		b, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return auth.BearerToken(strings.TrimSpace(string(b))), nil
+	case c.apiKeyFile != "":
+		b, err := os.ReadFile(c.apiKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return auth.APIKey(strings.TrimSpace(string(b))), nil
+	}
+	return nil, nil
+}
+
+// serveMetrics はミラーのメトリクスを公開するHTTPサーバを起動する。
+func serveMetrics(addr string, m *mirror.Mirror) (*http.Server, error) {
+	reg := prometheus.NewRegistry()
+	for _, c := range []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	return srv, nil
+}
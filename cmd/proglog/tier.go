@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/ac0mz/proglog/internal/log"
+	"github.com/ac0mz/proglog/internal/objstore"
+	"github.com/spf13/viper"
+)
+
+// tierStorage はクローズ済みのセグメントを移す外部のストレージを作成する。
+// ディレクトリとS3互換のストレージの両方が指定された場合はエラーとする。
+func tierStorage() (log.RemoteStorage, error) {
+	dir, endpoint := viper.GetString("tier-dir"), viper.GetString("tier-s3-endpoint")
+	switch {
+	case dir != "" && endpoint != "":
+		return nil, errors.New("--tier-dir and --tier-s3-endpoint are mutually exclusive")
+	case dir != "":
+		return objstore.NewLocal(dir)
+	case endpoint != "":
+		// 認証情報は環境変数、共有の認証情報ファイル、インスタンスのIAMロールから取得する
+		return objstore.NewS3(objstore.S3Config{
+			Endpoint: endpoint,
+			Region:   viper.GetString("tier-s3-region"),
+			Bucket:   viper.GetString("tier-s3-bucket"),
+		})
+	}
+	return nil, nil
+}
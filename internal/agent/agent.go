@@ -2,19 +2,36 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/audit"
 	"github.com/ac0mz/proglog/internal/auth"
+	"github.com/ac0mz/proglog/internal/config"
 	"github.com/ac0mz/proglog/internal/discovery"
 	"github.com/ac0mz/proglog/internal/log"
+	"github.com/ac0mz/proglog/internal/quota"
 	"github.com/ac0mz/proglog/internal/server"
+	"github.com/ac0mz/proglog/internal/tracing"
 	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/soheilhy/cmux" // 様々なプロトコルに対応した汎用Multiplexer
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -28,6 +45,17 @@ type Agent struct {
 	log        *log.DistributedLog
 	server     *grpc.Server
 	membership *discovery.Membership
+	metrics    *server.Metrics
+	httpServer *http.Server // メトリクスを公開するHTTPサーバ
+	tracer     *sdktrace.TracerProvider
+	quotas     *quota.Quotas
+	authorizer *auth.Authorizer
+	authn      auth.Chain
+	jwt        *auth.JWT
+	apiKeys    *auth.APIKeys
+	watchers   []*config.Watcher // 設定ファイルの変更を検知し、再起動せずに反映する
+	auditor    *audit.Auditor
+	keyring    *log.Keyring
 
 	shutdown     bool
 	shutdownLock sync.Mutex
@@ -41,10 +69,63 @@ type Config struct {
 	BindAddr        string
 	RPCPort         int
 	NodeName        string
+	Zone            string // ノードが配置されたアベイラビリティゾーン。Serfのタグで公開し、クライアントは同じゾーンのフォロワーから読み出す
 	StartJoinAddrs  []string
 	ACLModelFile    string
 	ACLPolicyFile   string
+	LogName         string // ACLで認可の対象とするログの名前
 	Bootstrap       bool
+	// 以下、サーバ間のRaftのトランスポート (未設定の場合はピアごとに5つのコネクションをプールし、10秒でタイムアウトする)
+	RaftMaxPool   int
+	RaftTimeout   time.Duration
+	RaftMultiplex bool // ピアとのコネクションを1つにまとめ、RPCごとのストリームを多重化する
+	// WrapRaftStreamLayer はRaftのストリームレイヤを包む関数。テストでサーバ間の通信に障害を注入するために用いる
+	WrapRaftStreamLayer func(raft.StreamLayer) raft.StreamLayer
+	MetricsAddr         string // Prometheus形式のメトリクスを公開するアドレス (未設定の場合は公開しない)
+	// TracingEndpoint はスパンを送信するOTLP/HTTPのコレクタのURL (未設定の場合はエクスポートしない)
+	TracingEndpoint string
+	// TracingSampleRatio は親スパンを持たないリクエストのトレースをサンプリングする割合 (0〜1)
+	TracingSampleRatio float64
+	// QuotaFile はクライアントごとの上限値を定義するJSONファイルのパス (未設定の場合は制限しない)
+	QuotaFile string
+	// ReloadInterval は設定ファイルの変更を確認する間隔
+	ReloadInterval time.Duration
+
+	// 以下、クライアント証明書のCN以外の認証方式 (未設定の場合は利用しない)
+	JWKSFile          string // JWTの署名を検証する公開鍵を含むJWKSファイルのパス
+	JWTIssuer         string
+	JWTAudience       string
+	APIKeyFile        string // サブジェクトとAPIキーのハッシュを記述したファイルのパス
+	SPIFFETrustDomain string // 受け入れるSPIFFE IDのトラストドメイン
+
+	// 以下、認可の判定と管理操作を記録する監査ログ (AuditDirが未設定の場合は記録しない)
+	AuditDir      string
+	AuditMaxBytes int64 // ローテーションするファイルのサイズ
+	AuditMaxFiles int   // 保持するローテーション済みのファイル数
+	AuditToLog    bool  // ファイルの代わりに、AuditDirに作成するproglogのログに記録する
+
+	// KeyringFile はセグメントとスナップショットを暗号化する鍵ファイルのパス (未設定の場合は暗号化しない)
+	KeyringFile string
+	// IndexIntervalBytes はインデックスのエントリを書き込むストアの間隔 (0の場合はレコードごとに書き込む)
+	IndexIntervalBytes uint64
+	// 以下、クローズ済みのセグメントを外部のストレージに移す階層化 (TierStorageが未設定の場合は移さない)
+	// オブジェクトはノード名を接頭辞として保存するため、クラスタのノードで同じストレージを共有できる
+	TierStorage       log.RemoteStorage
+	TierLocalSegments int // ローカルに残すクローズ済みのセグメント数
+	TierCacheSegments int // 読み出しのために外部から取得して保持するセグメント数
+	// 以下、メンバーシップの保護 (未設定の場合は利用しない)
+	GossipKey      string // ゴシップを暗号化する鍵 (Base64)。ローテーション後の鍵はDataDirに保存される
+	ClusterID      string // 同じクラスタIDのノードのみをクラスタに参加させる
+	JoinSecretFile string // ノードの参加トークンを署名・検証する秘密鍵のファイルのパス
+	// TagInterval はRaftの役割やディスク使用量をメンバーのタグとして公開する間隔 (未設定の場合は5秒)
+	TagInterval time.Duration
+	// ReconcileInterval はリーダーがSerfのメンバーシップとRaftの構成を調整する間隔 (未設定の場合は10秒)
+	ReconcileInterval time.Duration
+	// ReapGracePeriod は障害が発生したサーバをRaftの構成から除去するまでの猶予 (未設定の場合は2分)
+	ReapGracePeriod time.Duration
+
+	// TLSReloaders はServerTLSConfigとPeerTLSConfigの作成元で、証明書ファイルの変更時に再読み込みする
+	TLSReloaders []*config.TLSReloader
 }
 
 // RPCAddr はRPCアドレスを返却する。
@@ -63,10 +144,17 @@ func New(config Config) (*Agent, error) {
 	}
 	setup := []func() error{
 		a.setupLogger,
+		a.setupTracing,
 		a.setupMux,
+		a.setupAuthorizer,
+		a.setupAuthenticator,
+		a.setupKeyring,
+		a.setupAudit,
 		a.setupLog,
+		a.setupMembership, // サーバがゴシップの鍵を管理できるよう、サーバより先に作成する
 		a.setupServer,
-		a.setupMembership,
+		a.setupMetrics,
+		a.setupWatcher,
 	}
 	for _, fn := range setup {
 		if err := fn(); err != nil {
@@ -86,6 +174,98 @@ func (a *Agent) setupLogger() error {
 	return nil
 }
 
+// setupTracing はRPCからRaftの適用、ログへの追加までのスパンを収集するTracerProviderを作成する。
+// エクスポート先が未設定の場合は作成せず、各コンポーネントはグローバルなTracerProviderを利用する。
+func (a *Agent) setupTracing() error {
+	if a.Config.TracingEndpoint == "" {
+		return nil
+	}
+	var err error
+	a.tracer, err = tracing.NewTracerProvider(tracing.Config{
+		ServiceName: "proglog",
+		SampleRatio: a.Config.TracingSampleRatio,
+		Endpoint:    a.Config.TracingEndpoint,
+	})
+	return err
+}
+
+// setupAuthorizer はACLのファイルを読み込むAuthorizerを作成する。
+// 分散ログから複製されたポリシーを受け取るため、分散ログより先に作成する。
+func (a *Agent) setupAuthorizer() error {
+	var err error
+	a.authorizer, err = auth.New(a.Config.ACLModelFile, a.Config.ACLPolicyFile)
+	return err
+}
+
+// setupAuthenticator は設定された認証方式を組み合わせ、RPCのサブジェクトを識別するAuthenticatorを作成する。
+// トークンやAPIキーを明示的に提示したクライアントは、クライアント証明書よりもそれらを優先する。
+func (a *Agent) setupAuthenticator() error {
+	var err error
+	if a.Config.JWKSFile != "" {
+		a.jwt, err = auth.NewJWT(auth.JWTConfig{
+			JWKSFile: a.Config.JWKSFile,
+			Issuer:   a.Config.JWTIssuer,
+			Audience: a.Config.JWTAudience,
+		})
+		if err != nil {
+			return err
+		}
+		a.authn = append(a.authn, a.jwt)
+	}
+	if a.Config.APIKeyFile != "" {
+		a.apiKeys, err = auth.NewAPIKeys(a.Config.APIKeyFile)
+		if err != nil {
+			return err
+		}
+		a.authn = append(a.authn, a.apiKeys)
+	}
+	if a.Config.SPIFFETrustDomain != "" {
+		a.authn = append(a.authn, auth.SPIFFE{TrustDomain: a.Config.SPIFFETrustDomain})
+	}
+	a.authn = append(a.authn, auth.CommonName{})
+	return nil
+}
+
+// setupKeyring は保存するデータを暗号化する鍵を読み込む。
+func (a *Agent) setupKeyring() error {
+	if a.Config.KeyringFile == "" {
+		return nil
+	}
+	var err error
+	a.keyring, err = log.LoadKeyring(a.Config.KeyringFile)
+	return err
+}
+
+// setupAudit は監査イベントを書き込むAuditorを作成する。
+// 監査ログはノードごとに記録するため、Raftで複製しないローカルのファイルまたはログに書き込む。
+func (a *Agent) setupAudit() error {
+	if a.Config.AuditDir == "" {
+		return nil
+	}
+	var sink audit.Sink
+	if a.Config.AuditToLog {
+		auditConfig := log.Config{Keyring: a.keyring}
+		auditConfig.Segment.IndexIntervalBytes = a.Config.IndexIntervalBytes
+		auditLog, err := log.NewLog(a.Config.AuditDir, auditConfig)
+		if err != nil {
+			return err
+		}
+		sink = audit.NewLogSink(auditLog, auditLog.Close)
+	} else {
+		fileSink, err := audit.NewFileSink(audit.FileConfig{
+			Dir:      a.Config.AuditDir,
+			MaxBytes: a.Config.AuditMaxBytes,
+			MaxFiles: a.Config.AuditMaxFiles,
+		})
+		if err != nil {
+			return err
+		}
+		sink = fileSink
+	}
+	a.auditor = audit.New(sink)
+	return nil
+}
+
 // setupMux はRPCアドレスにRaftとgRPCの両方の接続を受け付けるリスナーを作成し、
 // そのリスナーでmuxを作成する。
 // muxはリスナーからの接続を受け付け、設定されたルールに基づいてコネクションを識別する。
@@ -113,14 +293,28 @@ func (a *Agent) setupLog() error {
 			return false
 		}
 		// log.StreamLayer.Dialメソッドで書き込んだRaftコネクションの発信バイトと一致しているかを返却
-		return bytes.Equal(b, []byte{byte(log.RaftRPC)})
+		return b[0] == log.RaftRPC || b[0] == log.RaftMuxRPC
 	})
 	logConfig := log.Config{}
-	logConfig.Raft.StreamLayer = log.NewStreamLayer(
+	logConfig.PolicyHandler = a.authorizer
+	logConfig.Keyring = a.keyring
+	logConfig.Segment.IndexIntervalBytes = a.Config.IndexIntervalBytes
+	logConfig.Tier.Storage = a.Config.TierStorage
+	logConfig.Tier.Prefix = a.Config.NodeName + "/"
+	logConfig.Tier.LocalSegments = a.Config.TierLocalSegments
+	logConfig.Tier.CacheSegments = a.Config.TierCacheSegments
+	if a.tracer != nil {
+		logConfig.TracerProvider = a.tracer
+	}
+	var stream raft.StreamLayer = log.NewStreamLayer(
 		raftLn,
 		a.Config.ServerTLSConfig,
 		a.Config.PeerTLSConfig,
 	)
+	if a.Config.WrapRaftStreamLayer != nil {
+		stream = a.Config.WrapRaftStreamLayer(stream)
+	}
+	logConfig.Raft.StreamLayer = stream
 	rpcAddr, err := a.Config.RPCAddr()
 	if err != nil {
 		return err
@@ -128,6 +322,9 @@ func (a *Agent) setupLog() error {
 	logConfig.Raft.BindAddr = rpcAddr
 	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
 	logConfig.Raft.Bootstrap = a.Config.Bootstrap
+	logConfig.Raft.MaxPool = a.Config.RaftMaxPool
+	logConfig.Raft.TransportTimeout = a.Config.RaftTimeout
+	logConfig.Raft.Multiplex = a.Config.RaftMultiplex
 	a.log, err = log.NewDistributedLog(
 		a.Config.DataDir,
 		logConfig,
@@ -142,15 +339,55 @@ func (a *Agent) setupLog() error {
 }
 
 func (a *Agent) setupServer() error {
-	authorizer := auth.New(a.Config.ACLModelFile, a.Config.ACLPolicyFile)
+	a.metrics = server.NewMetrics()
 	serverConfig := &server.Config{
-		CommitLog:   a.log,
-		Authorizer:  authorizer,
-		GetServerer: a.log,
+		CommitLog:         a.log,
+		Authorizer:        a.authorizer,
+		GetServerer:       &memberServers{log: a.log, membership: a.membership},
+		Metrics:           a.metrics,
+		PolicyManager:     a.log,
+		KeyManager:        a.membership,
+		MemberGetter:      a.membership,
+		Querier:           a.membership,
+		LogName:           a.Config.LogName,
+		Authenticator:     a.authn,
+		Auditor:           a.auditor,
+		StalenessReporter: a.log,
+		Backuper:          logBackuper{a.log},
+		Iterable:          logIterable{a.log},
+		OffsetAppender:    a.log,
+	}
+	if a.tracer != nil {
+		serverConfig.TracerProvider = a.tracer
+	}
+	if a.Config.QuotaFile != "" {
+		quotaConfig, err := quota.LoadConfig(a.Config.QuotaFile)
+		if err != nil {
+			return err
+		}
+		a.quotas = quota.New(quotaConfig)
+		serverConfig.Quotas = a.quotas
 	}
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
-		creds := credentials.NewTLS(a.Config.ServerTLSConfig)
+		tlsConfig := a.Config.ServerTLSConfig
+		if a.jwt != nil || a.apiKeys != nil {
+			// トークンやAPIキーのみで認証するクライアントを受け入れるため、gRPCではクライアント証明書を任意とする
+			// サーバ間のRaftの通信では、引き続きクライアント証明書を必須とする
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if get := tlsConfig.GetConfigForClient; get != nil {
+				// 証明書を再読み込みする設定では、ハンドシェイクごとに作成される設定にも反映する
+				tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+					c, err := get(hello)
+					if c != nil {
+						c.ClientAuth = tls.VerifyClientCertIfGiven
+					}
+					return c, err
+				}
+			}
+		}
+		creds := credentials.NewTLS(tlsConfig)
 		opts = append(opts, grpc.Creds(creds))
 	}
 	var err error
@@ -175,15 +412,214 @@ func (a *Agent) setupMembership() error {
 	if err != nil {
 		return err
 	}
-	a.membership, err = discovery.New(a.log, discovery.Config{
+	membershipConfig := discovery.Config{
 		NodeName: a.Config.NodeName,
 		BindAddr: a.Config.BindAddr,
 		Tags: map[string]string{
 			"rpc_addr": rpcAddr,
+			"zone":     a.Config.Zone,
 		},
 		StartJoinAddrs: a.Config.StartJoinAddrs,
+		KeyringFile:    filepath.Join(a.Config.DataDir, "serf.keyring"),
+		ClusterID:      a.Config.ClusterID,
+		TagsFunc:       a.tags,
+		TagInterval:    a.Config.TagInterval,
+
+		Servers:           a.log,
+		ReconcileInterval: a.Config.ReconcileInterval,
+		ReapGracePeriod:   a.Config.ReapGracePeriod,
+	}
+	if a.Config.GossipKey != "" {
+		if membershipConfig.EncryptKey, err = base64.StdEncoding.DecodeString(a.Config.GossipKey); err != nil {
+			return fmt.Errorf("invalid gossip key: %w", err)
+		}
+	}
+	if a.Config.JoinSecretFile != "" {
+		secret, err := os.ReadFile(a.Config.JoinSecretFile)
+		if err != nil {
+			return err
+		}
+		membershipConfig.JoinSecret = bytes.TrimSpace(secret)
+	}
+	a.membership, err = discovery.New(a.log, membershipConfig)
+	if err != nil {
+		return err
+	}
+	a.membership.HandleQuery(SnapshotQuery, func([]byte) ([]byte, error) {
+		return nil, a.log.Snapshot()
 	})
-	return err
+	return nil
+}
+
+// logIterable は分散ログのイテレータをサーバのイテレータとして返却する。
+type logIterable struct {
+	log *log.DistributedLog
+}
+
+func (i logIterable) Iterate(offset uint64) server.RecordIterator {
+	return i.log.Iterator(offset)
+}
+
+// logBackuper は分散ログのバックアップを取得し、取得した時点のRaftのインデックスを記録する。
+type logBackuper struct {
+	log *log.DistributedLog
+}
+
+func (b logBackuper) Backup(w io.Writer) error {
+	meta, err := b.log.Backup(w)
+	if err != nil {
+		return err
+	}
+	zap.L().Named("agent").Info("backup taken",
+		zap.Uint64("index", meta.Index),
+		zap.Uint64("term", meta.Term),
+		zap.Int64("size", meta.Size),
+	)
+	return nil
+}
+
+// memberServers はRaftの構成に含まれるサーバに、Serfのメンバーシップから得たゾーンと適用済みのインデックス、
+// 稼働状況を付与する。ピッカーはこれらをもとに、遅延したフォロワーや停止したフォロワーを読み出しの対象から除外する。
+type memberServers struct {
+	log        *log.DistributedLog
+	membership *discovery.Membership
+}
+
+func (s *memberServers) GetServers() ([]*api.Server, error) {
+	servers, err := s.log.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string]serf.Member)
+	for _, member := range s.membership.Members() {
+		members[member.Name] = member
+	}
+	for _, server := range servers {
+		member, ok := members[server.Id]
+		if !ok {
+			server.Healthy = false
+			continue
+		}
+		server.Zone = member.Tags["zone"]
+		server.AppliedIndex, _ = strconv.ParseUint(member.Tags["applied_index"], 10, 64)
+		server.Healthy = member.Status == serf.StatusAlive
+	}
+	return servers, nil
+}
+
+// SnapshotQuery はクラスタのすべてのノードにログのフラッシュとRaftのスナップショットを指示するクエリの名前
+const SnapshotQuery = "snapshot"
+
+// tags はメンバーのタグとして公開する、Raftの役割と適用済みのインデックス、データディレクトリの使用量を返却する。
+func (a *Agent) tags() map[string]string {
+	state, applied := a.log.State()
+	tags := map[string]string{
+		"raft_state":    state.String(),
+		"leader":        strconv.FormatBool(state == raft.Leader),
+		"applied_index": strconv.FormatUint(applied, 10),
+	}
+	if usage, err := diskUsage(a.Config.DataDir); err == nil {
+		tags["disk_usage"] = strconv.FormatInt(usage, 10)
+	}
+	return tags
+}
+
+// diskUsage はディレクトリ配下のファイルの合計サイズを返却する。
+func diskUsage(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// 走査中に削除されたセグメント等は無視する
+			return nil
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// setupMetrics はストレージ、Raft、メンバーシップ、RPCの各メトリクスをレジストリに登録し、
+// Prometheusのテキスト形式で公開する /metrics エンドポイントを起動する。
+func (a *Agent) setupMetrics() error {
+	if a.Config.MetricsAddr == "" {
+		return nil
+	}
+	reg := prometheus.NewRegistry()
+	for _, c := range []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		a.metrics,
+		a.membership,
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	if err := a.log.Register(reg); err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", a.Config.MetricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	a.httpServer = &http.Server{Handler: mux}
+	go func() {
+		if err := a.httpServer.Serve(ln); err != http.ErrServerClosed {
+			_ = a.Shutdown()
+		}
+	}()
+	return nil
+}
+
+// setupWatcher はACLや上限値、証明書などの設定ファイルを監視し、変更された場合に再読み込みする。
+// 読み込みに失敗した場合は、変更前の設定を使い続ける。
+func (a *Agent) setupWatcher() error {
+	interval := a.Config.ReloadInterval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+	logger := zap.L().Named("agent")
+	watch := func(name string, reload func() error, paths ...string) {
+		a.watchers = append(a.watchers, config.WatchFiles(interval, func() {
+			if err := reload(); err != nil {
+				logger.Error("failed to reload "+name, zap.Error(err))
+				return
+			}
+			logger.Info("reloaded "+name, zap.Strings("paths", paths))
+		}, paths...))
+	}
+	if a.Config.ACLModelFile != "" && a.Config.ACLPolicyFile != "" {
+		watch("acl", a.authorizer.Reload, a.Config.ACLModelFile, a.Config.ACLPolicyFile)
+	}
+	if a.jwt != nil {
+		watch("jwks", a.jwt.Reload, a.Config.JWKSFile)
+	}
+	if a.apiKeys != nil {
+		watch("api keys", a.apiKeys.Reload, a.Config.APIKeyFile)
+	}
+	for _, r := range a.Config.TLSReloaders {
+		watch("tls certificates", r.Reload, r.Paths()...)
+	}
+	if a.keyring != nil {
+		// 鍵のローテーションは、以降に作成するセグメントとスナップショットに反映される
+		watch("keyring", a.keyring.Reload, a.Config.KeyringFile)
+	}
+	if a.quotas != nil {
+		watch("quota config", func() error {
+			return a.quotas.Reload(a.Config.QuotaFile)
+		}, a.Config.QuotaFile)
+	}
+	return nil
 }
 
 // Shutdown は実行中のエージェントを終了する。
@@ -196,12 +632,32 @@ func (a *Agent) Shutdown() error {
 	a.shutdown = true
 
 	shutdown := []func() error{
+		func() error {
+			for _, w := range a.watchers {
+				_ = w.Close()
+			}
+			return nil
+		},
 		a.membership.Leave, // メンバーシップから離脱することで、ディスカバリのイベント受信を停止
+		func() error {
+			if a.httpServer == nil {
+				return nil
+			}
+			return a.httpServer.Close() // メトリクスの公開を停止
+		},
 		func() error {
 			a.server.GracefulStop() // グレースフルにサーバを停止
 			return nil
 		},
-		a.log.Close, // ログを閉じる
+		a.log.Close,     // ログを閉じる
+		a.auditor.Close, // 停止したサーバの監査ログを閉じる
+		func() error {
+			if a.tracer == nil {
+				return nil
+			}
+			// バッファされているスパンをエクスポートしてから停止
+			return a.tracer.Shutdown(context.Background())
+		},
 	}
 	for _, fn := range shutdown {
 		if err := fn(); err != nil {
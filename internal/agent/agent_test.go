@@ -4,7 +4,10 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
@@ -22,7 +25,8 @@ import (
 // TestAgent はデータを複製(レプリケーション)するエージェントの動作を検証する。
 func TestAgent(t *testing.T) {
 	// クライアントに提供される証明書設定を定義
-	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+	// CLIと同様に、証明書ファイルを再読み込みする設定を用いる
+	serverTLS, err := config.NewTLSReloader(config.TLSConfig{
 		CertFile:      config.ServerCertFile,
 		KeyFile:       config.ServerKeyFile,
 		CAFile:        config.CAFile,
@@ -30,9 +34,10 @@ func TestAgent(t *testing.T) {
 		ServerAddress: "127.0.0.1",
 	})
 	require.NoError(t, err)
+	serverTLSConfig := serverTLS.TLSConfig()
 
 	// サーバ間で提供される証明書設定を定義し、サーバが相互に接続してレプリケーションできるように設定
-	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+	peerTLS, err := config.NewTLSReloader(config.TLSConfig{
 		CertFile:      config.RootClientCertFile,
 		KeyFile:       config.RootClientKeyFile,
 		CAFile:        config.CAFile,
@@ -40,6 +45,7 @@ func TestAgent(t *testing.T) {
 		ServerAddress: "127.0.0.1",
 	})
 	require.NoError(t, err)
+	peerTLSConfig := peerTLS.TLSConfig()
 
 	var agents []*Agent
 	// 以下で3つのノードのクラスタを作成 (2, 3つ目は1つ目に追加)
@@ -47,9 +53,10 @@ func TestAgent(t *testing.T) {
 		// サービスに設定するアドレス2つ(RPCアドレス,Serfアドレス)分のポートと
 		// テスト実行ホストのポートで2つのポート(※)をリスナー無しで取得
 		// ※gRPCログのコネクション用、およびSerfサービスディスカバリのコネクション用
-		ports := dynaport.Get(2)
+		ports := dynaport.Get(3)
 		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
 		rpcPort := ports[1]
+		metricsAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[2])
 
 		dataDir, err := os.MkdirTemp("", "agent-test-log")
 		require.NoError(t, err)
@@ -64,6 +71,7 @@ func TestAgent(t *testing.T) {
 
 		agent, err := New(Config{
 			NodeName:        fmt.Sprintf("%d", i),
+			Zone:            fmt.Sprintf("zone-%d", i%2),
 			StartJoinAddrs:  startJoinAddrs,
 			BindAddr:        bindAddr,
 			RPCPort:         rpcPort,
@@ -73,6 +81,8 @@ func TestAgent(t *testing.T) {
 			ServerTLSConfig: serverTLSConfig,
 			PeerTLSConfig:   peerTLSConfig,
 			Bootstrap:       i == 0,
+			MetricsAddr:     metricsAddr,
+			TLSReloaders:    []*config.TLSReloader{serverTLS, peerTLS},
 		})
 		require.NoError(t, err)
 
@@ -133,6 +143,33 @@ func TestAgent(t *testing.T) {
 	got := status.Code(err)
 	want := codes.OutOfRange
 	require.Equal(t, want, got)
+
+	// Raftの構成に含まれるサーバが、Serfのタグで公開されたゾーンとともに返却されることの検証
+	serversResponse, err := leaderClient.GetServers(context.Background(), &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(serversResponse.Servers))
+	for _, server := range serversResponse.Servers {
+		id, err := strconv.Atoi(server.Id)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("zone-%d", id%2), server.Zone)
+	}
+
+	// リーダーのメトリクスとして、各レイヤのメトリクスが公開されていることの検証
+	res, err := http.Get(fmt.Sprintf("http://%s/metrics", agents[0].Config.MetricsAddr))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	for _, name := range []string{
+		`proglog_log_segments{log="data"}`,
+		`proglog_log_append_duration_seconds_count{log="data"}`,
+		`proglog_raft_commit_index`,
+		`proglog_raft_is_leader 1`,
+		`proglog_serf_members{status="alive"} 3`,
+		`proglog_grpc_requests_total{code="OK",method="/log.v1.Log/Produce"} 1`,
+	} {
+		require.Contains(t, string(b), name)
+	}
 }
 
 // client はサービスのクライアントを生成するヘルパー関数。
@@ -0,0 +1,170 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+// 監査イベントの種別
+const (
+	KindAuthorization = "authorization" // 認可の判定
+	KindRecord        = "record"        // レコードの書き込み・読み出し
+	KindAdmin         = "admin"         // ポリシーの変更などの管理操作
+)
+
+// 監査イベントの結果
+const (
+	OutcomeAllow   = "allow"
+	OutcomeDeny    = "deny"
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Event は誰が、いつ、どこから、何に対して、何を行い、その結果がどうなったかを記録する。
+type Event struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Subject string    `json:"subject"`
+	Peer    string    `json:"peer,omitempty"`
+	Method  string    `json:"method,omitempty"`
+	Action  string    `json:"action,omitempty"`
+	Object  string    `json:"object,omitempty"`
+	Offset  *uint64   `json:"offset,omitempty"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Sink は監査イベントを追記専用で保存する。
+type Sink interface {
+	Write(Event) error
+	Close() error
+}
+
+// Auditor は監査イベントにRPCの情報を付与してSinkに書き込む。
+// nilのAuditorは何も記録しないため、呼び出し側で監査の有無を判定する必要はない。
+type Auditor struct {
+	mu     sync.Mutex
+	sink   Sink
+	logger *zap.Logger
+	now    func() time.Time
+}
+
+// New はSinkに書き込むAuditorを作成する。
+func New(sink Sink) *Auditor {
+	return &Auditor{
+		sink:   sink,
+		logger: zap.L().Named("audit"),
+		now:    time.Now,
+	}
+}
+
+// Record はイベントを書き込む。コンテキストからピアのアドレスとRPCのメソッドを補完する。
+// 書き込みに失敗した場合もRPCは継続し、エラーをログに出力する。
+func (a *Auditor) Record(ctx context.Context, e Event) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = a.now()
+	}
+	if p, ok := peer.FromContext(ctx); ok && e.Peer == "" && p.Addr != nil {
+		e.Peer = p.Addr.String()
+	}
+	if method, ok := grpc.Method(ctx); ok && e.Method == "" {
+		e.Method = method
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.sink.Write(e); err != nil {
+		a.logger.Error("failed to write audit event", zap.Error(err))
+	}
+}
+
+// Close はSinkを閉じる。
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sink.Close()
+}
+
+// Appender はレコードを追加できるログである。
+type Appender interface {
+	Append(*api.Record) (uint64, error)
+}
+
+// LogSink は監査イベントをJSONにエンコードし、proglogのログのレコードとして追記する。
+type LogSink struct {
+	log   Appender
+	close func() error
+}
+
+// NewLogSink はログに書き込むSinkを作成する。closeはSinkを閉じる際に呼び出される (nil可)。
+func NewLogSink(log Appender, close func() error) *LogSink {
+	return &LogSink{log: log, close: close}
+}
+
+func (s *LogSink) Write(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.log.Append(&api.Record{Value: b})
+	return err
+}
+
+func (s *LogSink) Close() error {
+	if s.close == nil {
+		return nil
+	}
+	return s.close()
+}
+
+// RecordReader はオフセットを指定してレコードを読み出せるログである。
+type RecordReader interface {
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	Read(uint64) (*api.Record, error)
+}
+
+// QueryRecords はLogSinkで書き込んだログを古い順に読み出し、条件に一致するイベントごとにfnを呼び出す。
+func QueryRecords(log RecordReader, filter Filter, fn func(Event) error) error {
+	lowest, err := log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	highest, err := log.HighestOffset()
+	if err != nil {
+		return err
+	}
+	for off := lowest; off <= highest; off++ {
+		record, err := log.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			// 空のログ
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var e Event
+		if err = json.Unmarshal(record.Value, &e); err != nil {
+			return fmt.Errorf("invalid audit event at offset %d: %w", off, err)
+		}
+		if !filter.match(e) {
+			continue
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ac0mz/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSink(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewFileSink(FileConfig{Dir: dir, MaxBytes: 200, MaxFiles: 2})
+	require.NoError(t, err)
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	a := New(sink)
+	a.now = sink.now
+
+	subjects := []string{"root", "nobody", "root", "nobody", "root", "nobody"}
+	for _, s := range subjects {
+		a.Record(context.Background(), Event{
+			Kind:    KindAuthorization,
+			Subject: s,
+			Action:  "produce",
+			Object:  "log/default",
+			Outcome: OutcomeAllow,
+		})
+	}
+	require.NoError(t, a.Close())
+
+	// 1ファイルに1件ずつ書き込まれ、古いファイルは保持数を超えた分だけ削除される
+	rotated, err := rotatedFiles(dir)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(rotated))
+	fi, err := os.Stat(filepath.Join(dir, currentFile))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	var events []Event
+	collect := func(e Event) error {
+		events = append(events, e)
+		return nil
+	}
+	require.NoError(t, Query(dir, Filter{}, collect))
+	require.Equal(t, 3, len(events))
+	for i := 1; i < len(events); i++ {
+		require.True(t, events[i-1].Time.Before(events[i].Time))
+	}
+
+	events = nil
+	require.NoError(t, Query(dir, Filter{Subject: "root"}, collect))
+	require.Equal(t, 1, len(events))
+	require.Equal(t, "root", events[0].Subject)
+
+	events = nil
+	require.NoError(t, Query(dir, Filter{Since: firstEvent(t, dir).Time.Add(time.Second)}, collect))
+	require.Equal(t, 2, len(events))
+}
+
+// firstEvent はディレクトリ内の最も古いイベントを返却する。
+func firstEvent(t *testing.T, dir string) Event {
+	t.Helper()
+	var first *Event
+	require.NoError(t, Query(dir, Filter{}, func(e Event) error {
+		if first == nil {
+			first = &e
+		}
+		return nil
+	}))
+	require.NotNil(t, first)
+	return *first
+}
+
+func TestLogSink(t *testing.T) {
+	l, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	var events []Event
+	collect := func(e Event) error {
+		events = append(events, e)
+		return nil
+	}
+	// 空のログ
+	require.NoError(t, QueryRecords(l, Filter{}, collect))
+	require.Equal(t, 0, len(events))
+
+	a := New(NewLogSink(l, nil))
+	offset := uint64(3)
+	a.Record(context.Background(), Event{Kind: KindRecord, Subject: "root", Offset: &offset, Outcome: OutcomeSuccess})
+	a.Record(context.Background(), Event{Kind: KindAdmin, Subject: "root", Outcome: OutcomeFailure, Error: "not leader"})
+	require.NoError(t, a.Close())
+
+	require.NoError(t, QueryRecords(l, Filter{Kind: KindRecord}, collect))
+	require.Equal(t, 1, len(events))
+	require.Equal(t, offset, *events[0].Offset)
+	require.False(t, events[0].Time.IsZero())
+}
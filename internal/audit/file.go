@@ -0,0 +1,205 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	currentFile   = "audit.log"
+	rotatedPrefix = "audit-"
+	rotatedSuffix = ".log"
+)
+
+// FileConfig はファイルへの書き込みとローテーションを設定する。
+type FileConfig struct {
+	Dir      string
+	MaxBytes int64 // 現在のファイルがこのサイズを超えるとローテーションする (0の場合は64MiB)
+	MaxFiles int   // 保持するローテーション済みのファイル数 (0の場合は削除しない)
+}
+
+// FileSink は監査イベントを1行1件のJSONとしてファイルに追記する。
+//
+// 書き込み中のファイルは audit.log とし、サイズの上限を超えると
+// audit-<ローテーション時刻>.log に名前を変更して新たなファイルに切り替える。
+// ファイルは追記モードでのみ開き、書き込み済みのイベントを変更することはない。
+type FileSink struct {
+	config FileConfig
+	file   *os.File
+	size   int64
+	now    func() time.Time
+}
+
+// NewFileSink はディレクトリを作成し、書き込み中のファイルを開く。
+func NewFileSink(config FileConfig) (*FileSink, error) {
+	if config.MaxBytes == 0 {
+		config.MaxBytes = 64 << 20
+	}
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &FileSink{config: config, now: time.Now}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(
+		filepath.Join(s.config.Dir, currentFile),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600,
+	)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.size = fi.Size()
+	return nil
+}
+
+// Write はイベントを追記し、監査の証跡が失われないようストレージに同期する。
+func (s *FileSink) Write(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if s.size > 0 && s.size+int64(len(b)) > s.config.MaxBytes {
+		if err = s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// rotate は書き込み中のファイルの名前を変更し、保持数を超えた古いファイルを削除する。
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s%s%s", rotatedPrefix, s.now().UTC().Format("20060102T150405.000000000"), rotatedSuffix)
+	if err := os.Rename(
+		filepath.Join(s.config.Dir, currentFile),
+		filepath.Join(s.config.Dir, name),
+	); err != nil {
+		return err
+	}
+	if s.config.MaxFiles > 0 {
+		rotated, err := rotatedFiles(s.config.Dir)
+		if err != nil {
+			return err
+		}
+		for len(rotated) > s.config.MaxFiles {
+			if err := os.Remove(rotated[0]); err != nil {
+				return err
+			}
+			rotated = rotated[1:]
+		}
+	}
+	return s.open()
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// rotatedFiles はローテーション済みのファイルを古い順に返却する。
+func rotatedFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, rotatedPrefix) && strings.HasSuffix(name, rotatedSuffix) {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	// ファイル名の時刻は固定長のため、名前順が時刻順となる
+	sort.Strings(files)
+	return files, nil
+}
+
+// Filter は検索するイベントの条件を表す。空の項目は条件としない。
+type Filter struct {
+	Subject string
+	Action  string
+	Object  string // 前方一致
+	Kind    string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+}
+
+func (f Filter) match(e Event) bool {
+	switch {
+	case f.Subject != "" && e.Subject != f.Subject,
+		f.Action != "" && e.Action != f.Action,
+		f.Object != "" && !strings.HasPrefix(e.Object, f.Object),
+		f.Kind != "" && e.Kind != f.Kind,
+		f.Outcome != "" && e.Outcome != f.Outcome,
+		!f.Since.IsZero() && e.Time.Before(f.Since),
+		!f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// Query はディレクトリ内の監査ログを古い順に読み出し、条件に一致するイベントごとにfnを呼び出す。
+func Query(dir string, filter Filter, fn func(Event) error) error {
+	files, err := rotatedFiles(dir)
+	if err != nil {
+		return err
+	}
+	files = append(files, filepath.Join(dir, currentFile))
+	for _, path := range files {
+		if err := queryFile(path, filter, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryFile(path string, filter Filter, fn func(Event) error) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("invalid audit event at %s:%d: %w", path, n, err)
+		}
+		if !filter.match(e) {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
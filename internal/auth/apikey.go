@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// APIKeyHeader は静的なAPIキーを渡すメタデータのキーである。
+const APIKeyHeader = "x-api-key"
+
+// APIKeys はメタデータのAPIキーを照合し、対応するサブジェクトを返却する。
+//
+// キーファイルはポリシーと同様のCSV形式で、1行に1つのサブジェクトとAPIキーのSHA-256ハッシュ(16進数)を記述する。
+// キー自体はファイルに保存しない。
+//
+//	ci, 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+type APIKeys struct {
+	path string
+
+	mu   sync.RWMutex
+	keys map[[sha256.Size]byte]string // ハッシュからサブジェクトへの対応
+}
+
+// NewAPIKeys はキーファイルを読み込み、APIキーのAuthenticatorを作成する。
+func NewAPIKeys(path string) (*APIKeys, error) {
+	a := &APIKeys{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload はキーファイルを読み込み直す。失敗した場合は変更前のキーを使い続ける。
+func (a *APIKeys) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keys := map[[sha256.Size]byte]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		subject, digest, ok := strings.Cut(line, ",")
+		b, err := hex.DecodeString(strings.TrimSpace(digest))
+		if !ok || err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid api key at %s:%d", a.path, n)
+		}
+		var key [sha256.Size]byte
+		copy(key[:], b)
+		keys[key] = strings.TrimSpace(subject)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *APIKeys) Authenticate(ctx context.Context) (string, error) {
+	key := metadataValue(ctx, APIKeyHeader)
+	if key == "" {
+		return "", ErrNoCredentials
+	}
+	digest := sha256.Sum256([]byte(key))
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	// 一致するキーの有無によって処理時間が変わらないよう、すべてのキーと比較する
+	var subject string
+	for k, s := range a.keys {
+		if subtle.ConstantTimeCompare(k[:], digest[:]) == 1 {
+			subject = s
+		}
+	}
+	if subject == "" {
+		return "", status.Error(codes.Unauthenticated, "invalid api key")
+	}
+	return subject, nil
+}
@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// ErrNoCredentials はRPCに当該Authenticatorが扱う認証情報が含まれていないことを表す。
+// Chainは次のAuthenticatorで認証を試みる。
+var ErrNoCredentials = errors.New("no credentials")
+
+// Authenticator はRPCのコンテキストから、認可に用いるサブジェクトを識別する。
+type Authenticator interface {
+	Authenticate(ctx context.Context) (subject string, err error)
+}
+
+// Chain は順にAuthenticatorで認証を試み、最初に識別したサブジェクトを返却する。
+// 認証情報が提示されたものの検証に失敗した場合は、後続を試さずに Unauthenticated エラーを返却する。
+// いずれの認証情報も含まれていない場合は、空のサブジェクトとする。
+type Chain []Authenticator
+
+func (c Chain) Authenticate(ctx context.Context) (string, error) {
+	for _, a := range c {
+		subject, err := a.Authenticate(ctx)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			if _, ok := status.FromError(err); ok {
+				return "", err
+			}
+			return "", status.Error(codes.Unauthenticated, err.Error())
+		}
+		return subject, nil
+	}
+	return "", nil
+}
+
+// CommonName はクライアント証明書のサブジェクトのCNをサブジェクトとする。
+type CommonName struct{}
+
+func (CommonName) Authenticate(ctx context.Context) (string, error) {
+	cert, err := peerCertificate(ctx)
+	if err != nil {
+		return "", err
+	}
+	if cert.Subject.CommonName == "" {
+		return "", ErrNoCredentials
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// SPIFFE はクライアント証明書のURI SANに含まれるSPIFFE ID (spiffe://<trust domain>/<path>) をサブジェクトとする。
+// TrustDomainが設定された場合、そのトラストドメインのIDのみを受け入れる。
+type SPIFFE struct {
+	TrustDomain string
+}
+
+func (s SPIFFE) Authenticate(ctx context.Context) (string, error) {
+	cert, err := peerCertificate(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, uri := range cert.URIs {
+		if uri.Scheme != "spiffe" {
+			continue
+		}
+		if s.TrustDomain != "" && uri.Host != s.TrustDomain {
+			return "", status.Errorf(codes.Unauthenticated, "untrusted spiffe trust domain: %s", uri.Host)
+		}
+		return uri.String(), nil
+	}
+	return "", ErrNoCredentials
+}
+
+// peerCertificate は検証済みのクライアント証明書を返却する。
+func peerCertificate(ctx context.Context) (*x509.Certificate, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.New(codes.Unknown, "couldn't find peer info").Err()
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	return tlsInfo.State.VerifiedChains[0][0], nil
+}
+
+// metadataValue はRPCのメタデータから指定されたキーの最初の値を返却する。
+func metadataValue(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// bearerToken はauthorizationメタデータからBearerトークンを取り出す。
+func bearerToken(ctx context.Context) (string, bool) {
+	v := metadataValue(ctx, "authorization")
+	scheme, token, ok := strings.Cut(v, " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// TestJWT はJWKSの公開鍵による署名の検証と、クレームの検証を行う。
+func TestJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kid": "rsa", "kty": "RSA", "use": "sig",
+			"n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kid": "ed", "kty": "OKP", "crv": "Ed25519", "x": b64(edPub)},
+		{"kid": "enc", "kty": "RSA", "use": "enc"},
+	}})
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, jwks, 0644))
+
+	a, err := NewJWT(JWTConfig{JWKSFile: path, Issuer: "https://issuer", Audience: "proglog"})
+	require.NoError(t, err)
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, claims jwt.RegisteredClaims) context.Context {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		s, err := token.SignedString(key)
+		require.NoError(t, err)
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+s))
+	}
+	valid := jwt.RegisteredClaims{
+		Subject:   "alice",
+		Issuer:    "https://issuer",
+		Audience:  jwt.ClaimStrings{"proglog"},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+
+	subject, err := a.Authenticate(sign(jwt.SigningMethodRS256, "rsa", rsaKey, valid))
+	require.NoError(t, err)
+	require.Equal(t, "alice", subject)
+	subject, err = a.Authenticate(sign(jwt.SigningMethodEdDSA, "ed", edKey, valid))
+	require.NoError(t, err)
+	require.Equal(t, "alice", subject)
+
+	_, err = a.Authenticate(context.Background())
+	require.ErrorIs(t, err, ErrNoCredentials)
+
+	expired := valid
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	wrongAud := valid
+	wrongAud.Audience = jwt.ClaimStrings{"other"}
+	noExp := valid
+	noExp.ExpiresAt = nil
+	for _, ctx := range []context.Context{
+		sign(jwt.SigningMethodRS256, "rsa", rsaKey, expired),
+		sign(jwt.SigningMethodRS256, "rsa", rsaKey, wrongAud),
+		sign(jwt.SigningMethodRS256, "rsa", rsaKey, noExp),
+		sign(jwt.SigningMethodRS256, "unknown", rsaKey, valid),
+		// 公開鍵を共通鍵として用いる署名は受け入れない
+		sign(jwt.SigningMethodHS256, "rsa", []byte("secret"), valid),
+	} {
+		_, err = a.Authenticate(ctx)
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	}
+}
+
+// TestAPIKeys はAPIキーのハッシュによる照合を検証する。
+func TestAPIKeys(t *testing.T) {
+	digest := sha256.Sum256([]byte("s3cret"))
+	path := filepath.Join(t.TempDir(), "api-keys.csv")
+	require.NoError(t, os.WriteFile(path, []byte("# subject, sha256\nci, "+hex.EncodeToString(digest[:])+"\n"), 0644))
+	a, err := NewAPIKeys(path)
+	require.NoError(t, err)
+
+	withKey := func(key string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(APIKeyHeader, key))
+	}
+	subject, err := a.Authenticate(withKey("s3cret"))
+	require.NoError(t, err)
+	require.Equal(t, "ci", subject)
+	_, err = a.Authenticate(withKey("wrong"))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = a.Authenticate(context.Background())
+	require.ErrorIs(t, err, ErrNoCredentials)
+
+	require.NoError(t, os.WriteFile(path, []byte("ci, not-hex\n"), 0644))
+	require.Error(t, a.Reload())
+	_, err = a.Authenticate(withKey("s3cret"))
+	require.NoError(t, err)
+}
+
+// TestChain は証明書によるAuthenticatorと、認証情報を含まない場合の扱いを検証する。
+func TestChain(t *testing.T) {
+	withCert := func(cert *x509.Certificate) context.Context {
+		return peer.NewContext(context.Background(), &peer.Peer{
+			AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}},
+			}},
+		})
+	}
+	id, err := url.Parse("spiffe://example.org/ns/default/sa/producer")
+	require.NoError(t, err)
+	cert := &x509.Certificate{URIs: []*url.URL{id}}
+	cert.Subject.CommonName = "root"
+
+	chain := Chain{SPIFFE{TrustDomain: "example.org"}, CommonName{}}
+	subject, err := chain.Authenticate(withCert(cert))
+	require.NoError(t, err)
+	require.Equal(t, id.String(), subject)
+
+	// SPIFFE IDを含まない証明書はCNで識別する
+	subject, err = chain.Authenticate(withCert(&x509.Certificate{Subject: cert.Subject}))
+	require.NoError(t, err)
+	require.Equal(t, "root", subject)
+
+	_, err = Chain{SPIFFE{TrustDomain: "other.org"}}.Authenticate(withCert(cert))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// TLSを利用しない場合は空のサブジェクトとなる
+	subject, err = chain.Authenticate(peer.NewContext(context.Background(), &peer.Peer{}))
+	require.NoError(t, err)
+	require.Equal(t, "", subject)
+}
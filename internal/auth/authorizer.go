@@ -2,28 +2,52 @@ package auth
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 
+	api "github.com/ac0mz/proglog/api/v1"
 	"github.com/casbin/casbin"
+	fileadapter "github.com/casbin/casbin/persist/file-adapter"
+	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 // New はモデル(ACLファイル)とポリシー(CSVファイル)のパスをCasbinに設定したAuthorizerを返却する。
-func New(model, policy string) *Authorizer {
-	enforcer := casbin.NewEnforcer(model, policy)
-	return &Authorizer{
-		enforcer: enforcer,
+// モデルのマッチャーでは、オブジェクトの前方一致とオフセットの範囲を判定する objectMatch 関数を利用できる。
+func New(model, policy string) (*Authorizer, error) {
+	a := &Authorizer{
+		model:  model,
+		policy: policy,
+		logger: zap.L().Named("auth"),
 	}
+	if err := a.rebuild(); err != nil {
+		return nil, err
+	}
+	return a, nil
 }
 
+// Authorizer はファイルから読み込んだポリシーと、Raftにより複製されたポリシーに基づいて認可を行う。
+//
+//	NOTE:
+//	 ポリシーの変更時は新たなEnforcerを作成してから置き換えるため、
+//	 認可処理は読み込み途中のポリシーを参照することなく、ロックも取得しない。
 type Authorizer struct {
-	enforcer *casbin.Enforcer
+	model  string
+	policy string
+	logger *zap.Logger
+
+	mu         sync.Mutex    // Enforcerの再作成を直列化する
+	replicated []*api.Policy // Raftにより複製されたポリシー
+	enforcer   atomic.Value  // *casbin.Enforcer
 }
 
 // Authorize はACLによる認可を実施し、拒否された場合はエラーを返却する。
 // Casbinで設定したモデルとポリシーに基づき、サブジェクトがオブジェクトに対するアクションの実行を許可されているかを検証する。
 func (a *Authorizer) Authorize(subject, object, action string) error {
-	if !a.enforcer.Enforce(subject, object, action) {
+	enforcer := a.enforcer.Load().(*casbin.Enforcer)
+	if !enforcer.Enforce(subject, object, action) {
 		msg := fmt.Sprintf(
 			"%s not permitted to %s to %s",
 			subject, object, action,
@@ -33,3 +57,90 @@ func (a *Authorizer) Authorize(subject, object, action string) error {
 	}
 	return nil
 }
+
+// Reload はモデルとポリシーのファイルを読み込み直す。
+// 読み込みに失敗した場合はエラーを返却し、変更前のポリシーを使い続ける。
+func (a *Authorizer) Reload() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rebuild()
+}
+
+// SetPolicies はRaftにより複製されたポリシーを置き換える。
+// ファイルから読み込んだポリシーに加えて適用する。
+func (a *Authorizer) SetPolicies(policies []*api.Policy) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.replicated = policies
+	return a.rebuild()
+}
+
+// rebuild はファイルと複製されたポリシーから新たなEnforcerを作成し、置き換える。
+func (a *Authorizer) rebuild() error {
+	enforcer, err := newEnforcer(a.model, a.policy)
+	if err != nil {
+		return err
+	}
+	for _, p := range a.replicated {
+		if err := addPolicy(enforcer, p); err != nil {
+			// 複製済みのポリシーは取り消せないため、適用できないルールは読み飛ばす
+			a.logger.Warn("skipped invalid policy",
+				zap.String("ptype", p.Ptype),
+				zap.String("values", strings.Join(p.Values, ", ")),
+				zap.Error(err),
+			)
+		}
+	}
+	a.enforcer.Store(enforcer)
+	return nil
+}
+
+// newEnforcer はモデルとポリシーのファイルを読み込んだEnforcerを作成する。
+//
+//	NOTE:
+//	 casbin.NewEnforcer はポリシーの読み込みに失敗してもエラーを無視し、空のポリシーとなる。
+//	 再読み込み時にすべてのリクエストを拒否しないよう、読み込みのエラーを返却する。
+func newEnforcer(model, policy string) (enforcer *casbin.Enforcer, err error) {
+	// モデルの読み込みに失敗した場合、Casbinはpanicを起こす
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	enforcer = casbin.NewEnforcer(casbin.NewModel(model, ""))
+	enforcer.AddFunction("objectMatch", objectMatchFunc)
+	enforcer.SetAdapter(fileadapter.NewAdapter(policy))
+	if err = enforcer.LoadPolicy(); err != nil {
+		return nil, err
+	}
+	// ファイルへの書き戻しは行わない
+	enforcer.EnableAutoSave(false)
+	return enforcer, nil
+}
+
+// addPolicy はポリシーの種別に応じて、ポリシーまたはロールの割り当てとして追加する。
+func addPolicy(enforcer *casbin.Enforcer, p *api.Policy) (err error) {
+	// モデルに定義されていない種別の場合、Casbinはpanicを起こす
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	if p.Ptype == "" || len(p.Values) == 0 {
+		return fmt.Errorf("empty policy")
+	}
+	params := make([]interface{}, len(p.Values))
+	for i, v := range p.Values {
+		params[i] = v
+	}
+	sec := p.Ptype[:1]
+	if _, ok := enforcer.GetModel()[sec][p.Ptype]; !ok {
+		return fmt.Errorf("unknown ptype: %s", p.Ptype)
+	}
+	if sec == "g" {
+		enforcer.AddNamedGroupingPolicy(p.Ptype, params...)
+	} else {
+		enforcer.AddNamedPolicy(p.Ptype, params...)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/config"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestObjectMatch はオブジェクトの前方一致とオフセットの範囲の判定を検証する。
+func TestObjectMatch(t *testing.T) {
+	for _, tc := range []struct {
+		obj, pattern string
+		want         bool
+	}{
+		{"log/orders", "log/orders", true},
+		{"log/orders", "log/*", true},
+		{"log/orders", "*", true},
+		{"log/orders", "log/users", false},
+		{"log/orders@5", "log/orders", true},
+		{"log/orders@5", "log/*@0-9", true},
+		{"log/orders@10", "log/*@0-9", false},
+		{"log/orders@10", "log/orders@10-", true},
+		{"log/orders@9", "log/orders@10-", false},
+		{"log/orders", "log/orders@0-9", false},
+		{"admin/policies", "log/*", false},
+	} {
+		require.Equal(t, tc.want, ObjectMatch(tc.obj, tc.pattern), "%s ~ %s", tc.obj, tc.pattern)
+	}
+}
+
+// TestAuthorize はロールの継承と、オフセットの範囲を指定したポリシーによる認可を検証する。
+func TestAuthorize(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.csv")
+	require.NoError(t, os.WriteFile(policy, []byte(`p, reader, log/orders@100-, consume
+p, writer, log/*, produce
+g, alice, reader
+g, alice, writer
+`), 0644))
+	a, err := New(config.ACLModelFile, policy)
+	require.NoError(t, err)
+
+	require.NoError(t, a.Authorize("alice", LogObject("orders"), "produce"))
+	require.NoError(t, a.Authorize("alice", RecordObject("orders", 100), "consume"))
+	err = a.Authorize("alice", RecordObject("orders", 99), "consume")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	err = a.Authorize("bob", LogObject("orders"), "produce")
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 複製されたポリシーでもロールを割り当てられる
+	require.NoError(t, a.SetPolicies([]*api.Policy{
+		{Ptype: "g", Values: []string{"bob", "writer"}},
+		{Ptype: "unknown", Values: []string{"bob"}},
+	}))
+	require.NoError(t, a.Authorize("bob", LogObject("orders"), "produce"))
+}
@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// JWTConfig はJWTの検証に用いる鍵と、受け入れるクレームを定義する。
+type JWTConfig struct {
+	JWKSFile string // 検証用の公開鍵を含むJWKSファイルのパス
+	Issuer   string // 未設定の場合はissを検証しない
+	Audience string // 未設定の場合はaudを検証しない
+}
+
+// JWT はauthorizationメタデータのBearerトークンをJWTとして検証し、subクレームをサブジェクトとする。
+// 署名は、ローカルのJWKSファイルの公開鍵のうちkidが一致するもので検証する。
+type JWT struct {
+	config JWTConfig
+	parser *jwt.Parser
+
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+}
+
+// NewJWT はJWKSファイルを読み込み、JWTのAuthenticatorを作成する。
+func NewJWT(config JWTConfig) (*JWT, error) {
+	j := &JWT{
+		config: config,
+		// 公開鍵で検証できる署名アルゴリズムのみを受け入れる
+		parser: jwt.NewParser(jwt.WithValidMethods([]string{
+			"RS256", "RS384", "RS512",
+			"PS256", "PS384", "PS512",
+			"ES256", "ES384", "ES512",
+			"EdDSA",
+		})),
+	}
+	if err := j.Reload(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Reload はJWKSファイルを読み込み直す。失敗した場合は変更前の鍵を使い続ける。
+func (j *JWT) Reload() error {
+	keys, err := loadJWKS(j.config.JWKSFile)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	return nil
+}
+
+func (j *JWT) Authenticate(ctx context.Context) (string, error) {
+	token, ok := bearerToken(ctx)
+	if !ok {
+		return "", ErrNoCredentials
+	}
+	claims := &jwt.RegisteredClaims{}
+	if _, err := j.parser.ParseWithClaims(token, claims, j.key); err != nil {
+		return "", status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+	}
+	if claims.ExpiresAt == nil {
+		return "", status.Error(codes.Unauthenticated, "invalid token: missing exp")
+	}
+	if j.config.Issuer != "" && !claims.VerifyIssuer(j.config.Issuer, true) {
+		return "", status.Error(codes.Unauthenticated, "invalid token: unexpected iss")
+	}
+	if j.config.Audience != "" && !claims.VerifyAudience(j.config.Audience, true) {
+		return "", status.Error(codes.Unauthenticated, "invalid token: unexpected aud")
+	}
+	if claims.Subject == "" {
+		return "", status.Error(codes.Unauthenticated, "invalid token: missing sub")
+	}
+	return claims.Subject, nil
+}
+
+// key はトークンのヘッダのkidに対応する公開鍵を返却する。
+// kidが省略された場合は、鍵が1つのみの場合に限りその鍵を用いる。
+func (j *JWT) key(token *jwt.Token) (interface{}, error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, nil
+		}
+	}
+	key, ok := j.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid: %q", kid)
+	}
+	return key, nil
+}
+
+// jwk はRFC 7517のJSON Web Keyのうち、公開鍵の検証に必要な項目を表す。
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadJWKS はJWKSファイルからkidごとの公開鍵を読み込む。署名用でない鍵は読み飛ばす。
+func loadJWKS(path string) (map[string]crypto.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks %s: %w", path, err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported crv: %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported crv: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key size: %d", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported kty: %s", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/casbin/casbin/util"
+)
+
+// 認可の対象となるオブジェクトは、リソースのパスと任意のオフセットで表す。
+//
+//	log/<ログ名>             ログへの書き込み
+//	log/<ログ名>@<オフセット>  ログのレコードの読み出し
+//	admin/policies          ACLのポリシーの管理
+//	admin/keyring           ゴシップを暗号化する鍵の管理
+//	admin/queries/<名前>     クラスタのすべてのメンバーへのクエリ
+//	admin/backup            ログ全体のバックアップの取得
+//	cluster/servers         クラスタのサーバの発見
+//	cluster/members         クラスタのメンバーの発見
+//
+// ポリシーのオブジェクトでは、末尾の * による前方一致と、@<開始>-<終了> によるオフセットの範囲を指定できる。
+// 範囲の終了を省略した場合は、開始以降のすべてのオフセットとなる。
+//
+//	p, alice, log/orders, produce
+//	p, bob, log/*@0-999, consume
+const (
+	PolicyObject  = "admin/policies"
+	KeyringObject = "admin/keyring"
+	BackupObject  = "admin/backup"
+	ServersObject = "cluster/servers"
+	MembersObject = "cluster/members"
+)
+
+// QueryObject はクラスタへのクエリを認可する際のオブジェクトを返却する。
+func QueryObject(name string) string {
+	return "admin/queries/" + name
+}
+
+// LogObject はログへの書き込みを認可する際のオブジェクトを返却する。
+func LogObject(name string) string {
+	return "log/" + name
+}
+
+// RecordObject はログのレコードの読み出しを認可する際のオブジェクトを返却する。
+func RecordObject(name string, offset uint64) string {
+	return fmt.Sprintf("%s@%d", LogObject(name), offset)
+}
+
+// ObjectMatch はリクエストのオブジェクトがポリシーのオブジェクトに一致するかを判定する。
+// Casbinのモデルのマッチャーから objectMatch(r.obj, p.obj) として呼び出す。
+func ObjectMatch(obj, pattern string) bool {
+	res, off, hasOff := strings.Cut(obj, "@")
+	pres, prange, hasRange := strings.Cut(pattern, "@")
+	if !util.KeyMatch(res, pres) {
+		return false
+	}
+	if !hasRange {
+		// 範囲を指定しないポリシーは、すべてのオフセットに一致する
+		return true
+	}
+	if !hasOff {
+		return false
+	}
+	offset, err := strconv.ParseUint(off, 10, 64)
+	if err != nil {
+		return false
+	}
+	from, to, _ := strings.Cut(prange, "-")
+	start, err := strconv.ParseUint(from, 10, 64)
+	if err != nil || offset < start {
+		return false
+	}
+	if to == "" {
+		return true
+	}
+	end, err := strconv.ParseUint(to, 10, 64)
+	return err == nil && offset <= end
+}
+
+func objectMatchFunc(args ...interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return false, fmt.Errorf("objectMatch: expected 2 arguments, got %d", len(args))
+	}
+	obj, _ := args[0].(string)
+	pattern, _ := args[1].(string)
+	return ObjectMatch(obj, pattern), nil
+}
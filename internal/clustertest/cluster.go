@@ -0,0 +1,132 @@
+package clustertest
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ac0mz/proglog/internal/log"
+	"github.com/hashicorp/raft"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+// Node はクラスタを構成する1台のサーバ。
+type Node struct {
+	ID   string
+	Addr string              // Raftのアドレス (再起動しても変わらない)
+	Dir  string              // データディレクトリ (再起動しても変わらない)
+	Log  *log.DistributedLog // 停止中はnil
+}
+
+// Cluster はプロセス内で起動した DistributedLog のクラスタ。
+// サーバ間の通信はすべて Network を経由する。
+type Cluster struct {
+	t     testing.TB
+	net   *Network
+	Nodes []*Node
+}
+
+// NewCluster はn台のサーバから構成されるクラスタを起動する。
+// 1台目のサーバでブートストラップし、残りのサーバを投票者として参加させる。
+// クラスタはテストの終了時に停止する。
+func NewCluster(t testing.TB, n int, network *Network) *Cluster {
+	t.Helper()
+	c := &Cluster{t: t, net: network}
+	ports := dynaport.Get(n)
+	for i := 0; i < n; i++ {
+		c.Nodes = append(c.Nodes, &Node{
+			ID:   fmt.Sprintf("%d", i),
+			Addr: fmt.Sprintf("127.0.0.1:%d", ports[i]),
+			Dir:  t.TempDir(),
+		})
+	}
+	t.Cleanup(func() {
+		for i := range c.Nodes {
+			c.Stop(i)
+		}
+	})
+
+	c.start(0, true)
+	if _, err := c.Leader(3 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < n; i++ {
+		c.start(i, false)
+		if err := c.Nodes[0].Log.Join(c.Nodes[i].ID, c.Nodes[i].Addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+// start はサーバを起動する。Raftが素早くリーダーを選出するよう、デフォルトのタイムアウトを短く設定する。
+func (c *Cluster) start(i int, bootstrap bool) {
+	c.t.Helper()
+	node := c.Nodes[i]
+	ln, err := net.Listen("tcp", node.Addr)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	config := log.Config{}
+	config.Raft.StreamLayer = c.net.StreamLayer(node.ID, log.NewStreamLayer(ln, nil, nil))
+	config.Raft.LocalID = raft.ServerID(node.ID)
+	config.Raft.HeartbeatTimeout = 100 * time.Millisecond
+	config.Raft.ElectionTimeout = 100 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 100 * time.Millisecond
+	config.Raft.CommitTimeout = 50 * time.Millisecond
+	config.Raft.TransportTimeout = time.Second
+	config.Raft.BindAddr = node.Addr
+	config.Raft.Bootstrap = bootstrap
+	node.Log, err = log.NewDistributedLog(node.Dir, config)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Stop はi番目のサーバを停止する。データディレクトリは残るため Start で再起動できる。
+func (c *Cluster) Stop(i int) {
+	node := c.Nodes[i]
+	if node.Log == nil {
+		return
+	}
+	if err := node.Log.Close(); err != nil {
+		c.t.Error(err)
+	}
+	node.Log = nil
+}
+
+// Start は停止したi番目のサーバを同じアドレスとデータディレクトリで再起動する。
+// Raftの構成は保存済みの状態から復元するため、改めてクラスタに参加させる必要はない。
+func (c *Cluster) Start(i int) {
+	c.t.Helper()
+	if c.Nodes[i].Log != nil {
+		return
+	}
+	c.start(i, false)
+}
+
+// Leader はリーダーが選出されるか、タイムアウトするまで待機し、リーダーのサーバの番号を返却する。
+// 分断されたかつてのリーダーが役割を降りるまでは複数のサーバがリーダーを名乗るため、
+// リーダーが1台に定まるまで待機する。
+func (c *Cluster) Leader(timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var leaders []int
+		for i, node := range c.Nodes {
+			if node.Log == nil {
+				continue
+			}
+			if state, _ := node.Log.State(); state == raft.Leader {
+				leaders = append(leaders, i)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0], nil
+		}
+		if time.Now().After(deadline) {
+			return -1, fmt.Errorf("clustertest: no single leader within %s", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,208 @@
+package clustertest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPartitionedLeader はリーダーを分断している間も書き込みを続け、分断の解消後に
+// 確認応答したレコードが失われていないことを検証する。
+func TestPartitionedLeader(t *testing.T) {
+	network := NewNetwork(1)
+	c := NewCluster(t, 3, network)
+	h := &History{}
+
+	produce := func(i int, value string) error {
+		_, err := h.Produce([]byte(value), func() (uint64, error) {
+			return c.Nodes[i].Log.Append(&api.Record{Value: []byte(value)})
+		})
+		return err
+	}
+
+	leader, err := c.Leader(3 * time.Second)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, produce(leader, fmt.Sprintf("before-%d", i)))
+	}
+
+	network.Isolate(c.Nodes[leader].ID)
+
+	// 残りのサーバが新たなリーダーを選出し、遅延のある通信でも書き込みを受け付ける
+	newLeader := waitForNewLeader(t, c, leader)
+	for _, node := range c.Nodes {
+		if node.ID != c.Nodes[leader].ID && node.ID != c.Nodes[newLeader].ID {
+			network.Delay(c.Nodes[newLeader].ID, node.ID, time.Millisecond, 20*time.Millisecond)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		require.NoError(t, produce(newLeader, fmt.Sprintf("after-%d", i)))
+	}
+
+	network.Heal()
+	leader, err = c.Leader(5 * time.Second)
+	require.NoError(t, err)
+	for off := uint64(0); off < 10; off++ {
+		_, err := h.Consume(off, func() (*api.Record, error) {
+			return c.Nodes[leader].Log.Read(off)
+		})
+		require.NoError(t, err)
+	}
+
+	// 分断されていたサーバを含むすべてのサーバが、確認応答したレコードを保持している
+	for _, node := range c.Nodes {
+		require.NoError(t, h.Check(eventually(node)))
+	}
+}
+
+// TestDivergentLeader は分断されたリーダーが複製できなかったエントリを保持したまま復帰した場合に、
+// 新たなリーダーのログで上書きされ、確認応答したレコードと矛盾しないことを検証する。
+func TestDivergentLeader(t *testing.T) {
+	network := NewNetwork(1)
+	c := NewCluster(t, 3, network)
+	h := &History{}
+
+	produce := func(i int, value string) error {
+		_, err := h.Produce([]byte(value), func() (uint64, error) {
+			return c.Nodes[i].Log.Append(&api.Record{Value: []byte(value)})
+		})
+		return err
+	}
+
+	leader, err := c.Leader(3 * time.Second)
+	require.NoError(t, err)
+	require.NoError(t, produce(leader, "before"))
+
+	// 分断されたリーダーへの書き込みは過半数に複製できないため確認応答されない
+	network.Isolate(c.Nodes[leader].ID)
+	require.Error(t, produce(leader, "isolated"))
+
+	newLeader := waitForNewLeader(t, c, leader)
+	require.NoError(t, produce(newLeader, "after"))
+
+	network.Heal()
+	require.NoError(t, h.Check(eventually(c.Nodes[leader])))
+}
+
+// TestDivergentLeaderAcrossSegments は分断されたリーダーが、Raftのログの複数のセグメントにわたって
+// 複製できなかったエントリを保持したまま復帰した場合も、新たなリーダーのより短いログで上書きされることを検証する。
+func TestDivergentLeaderAcrossSegments(t *testing.T) {
+	network := NewNetwork(1)
+	c := NewCluster(t, 3, network)
+	h := &History{}
+
+	produce := func(i int, value string) error {
+		_, err := h.Produce([]byte(value), func() (uint64, error) {
+			return c.Nodes[i].Log.Append(&api.Record{Value: []byte(value)})
+		})
+		return err
+	}
+
+	leader, err := c.Leader(3 * time.Second)
+	require.NoError(t, err)
+	require.NoError(t, produce(leader, "before"))
+
+	// 役割を降りるまでに、分断されたリーダーのRaftのログに多数のエントリを追加する
+	network.Isolate(c.Nodes[leader].ID)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = produce(leader, fmt.Sprintf("isolated-%d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	newLeader := waitForNewLeader(t, c, leader)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, produce(newLeader, fmt.Sprintf("after-%d", i)))
+	}
+
+	network.Heal()
+	for _, node := range c.Nodes {
+		require.NoError(t, h.Check(eventually(node)))
+	}
+	// 復帰したサーバも、新たなリーダーのログに続けて書き込まれたレコードを複製する
+	leader, err = c.Leader(5 * time.Second)
+	require.NoError(t, err)
+	require.NoError(t, produce(leader, "healed"))
+	for _, node := range c.Nodes {
+		require.NoError(t, h.Check(eventually(node)))
+	}
+}
+
+// TestRestart はサーバを停止して再起動した後も、クラスタに復帰してレコードを複製することを検証する。
+func TestRestart(t *testing.T) {
+	c := NewCluster(t, 3, NewNetwork(1))
+	h := &History{}
+
+	leader, err := c.Leader(3 * time.Second)
+	require.NoError(t, err)
+	follower := (leader + 1) % len(c.Nodes)
+	c.Stop(follower)
+	for i := 0; i < 3; i++ {
+		value := []byte(fmt.Sprintf("record-%d", i))
+		_, err := h.Produce(value, func() (uint64, error) {
+			return c.Nodes[leader].Log.Append(&api.Record{Value: value})
+		})
+		require.NoError(t, err)
+	}
+	c.Start(follower)
+
+	require.NoError(t, h.Check(eventually(c.Nodes[follower])))
+}
+
+// TestStaleness は分断されたフォロワーの古さが、リーダーから最後に連絡を受けてからの経過時間とともに増加することを検証する。
+func TestStaleness(t *testing.T) {
+	network := NewNetwork(1)
+	c := NewCluster(t, 3, network)
+
+	leader, err := c.Leader(3 * time.Second)
+	require.NoError(t, err)
+	follower := c.Nodes[(leader+1)%len(c.Nodes)]
+	require.Equal(t, time.Duration(0), c.Nodes[leader].Log.Staleness())
+	require.Eventually(t, func() bool {
+		return follower.Log.Staleness() < 500*time.Millisecond
+	}, 3*time.Second, 10*time.Millisecond)
+
+	network.Isolate(follower.ID)
+	require.Eventually(t, func() bool {
+		return follower.Log.Staleness() > time.Second
+	}, 3*time.Second, 10*time.Millisecond)
+
+	network.Heal()
+	require.Eventually(t, func() bool {
+		return follower.Log.Staleness() < 500*time.Millisecond
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+// waitForNewLeader は分断されたリーダーが役割を降り、別のサーバがリーダーに選出されるまで待機する。
+func waitForNewLeader(t *testing.T, c *Cluster, old int) int {
+	t.Helper()
+	leader := old
+	require.Eventually(t, func() bool {
+		var err error
+		leader, err = c.Leader(time.Second)
+		return err == nil && leader != old
+	}, 5*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+// eventually はサーバが複製に追いつくまで、読み出しを再試行する関数を返却する。
+func eventually(node *Node) func(uint64) (*api.Record, error) {
+	return func(off uint64) (*api.Record, error) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			record, err := node.Log.Read(off)
+			if err == nil || time.Now().After(deadline) {
+				return record, err
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
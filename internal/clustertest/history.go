@@ -0,0 +1,179 @@
+package clustertest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OpKind は履歴に記録する操作の種類。
+type OpKind int
+
+const (
+	Produce OpKind = iota
+	Consume
+)
+
+// Op は履歴に記録した1つの操作。
+type Op struct {
+	Kind   OpKind
+	Value  []byte // Produceでは書き込んだ値、Consumeでは読み出した値
+	Offset uint64 // Produceでは応答されたオフセット、Consumeでは読み出したオフセット
+	Ok     bool   // Produceでは書き込みが確認応答されたか、Consumeではレコードが見つかったか
+	Start  time.Time
+	End    time.Time
+}
+
+// History はクライアントから見た操作の履歴を記録し、ログの一貫性を検証する。
+// 複数のゴルーチンから並行して記録してよい。
+type History struct {
+	mu  sync.Mutex
+	ops []Op
+}
+
+// Produce はvalueの書き込みを行うproduceを実行し、その結果を記録する。
+// エラーとなった書き込みは、ログに追加されたかどうか不確定な操作として扱う。
+func (h *History) Produce(value []byte, produce func() (uint64, error)) (uint64, error) {
+	op := Op{Kind: Produce, Value: value, Start: time.Now()}
+	off, err := produce()
+	op.End = time.Now()
+	op.Offset, op.Ok = off, err == nil
+	h.add(op)
+	return off, err
+}
+
+// Consume はoffsetの読み出しを行うconsumeを実行し、その結果を記録する。
+// オフセットが範囲外でレコードが見つからなかった場合もエラーを返却せずに記録し、それ以外のエラーは記録しない。
+//
+// 緩やかな一貫性の読み出しは最新の書き込みを反映しないことがあるため、リーダーからの読み出しのように
+// 線形化可能であるべき読み出しのみを記録すること。
+func (h *History) Consume(offset uint64, consume func() (*api.Record, error)) (*api.Record, error) {
+	op := Op{Kind: Consume, Offset: offset, Start: time.Now()}
+	record, err := consume()
+	op.End = time.Now()
+	switch {
+	case err == nil:
+		op.Value, op.Ok = record.Value, true
+	case status.Code(err) == codes.OutOfRange:
+		err = nil
+	default:
+		return nil, err
+	}
+	h.add(op)
+	return record, err
+}
+
+func (h *History) add(op Op) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ops = append(h.ops, op)
+}
+
+// Ops は記録した操作を開始時刻の順に返却する。
+func (h *History) Ops() []Op {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ops := append([]Op(nil), h.ops...)
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Start.Before(ops[j].Start) })
+	return ops
+}
+
+// Check は履歴と、障害の収束後にreadで読み出したログの内容とを照合し、一貫性の違反を返却する。
+// 違反がない場合はnilを返却する。検証する性質は以下のとおり。
+//   - 確認応答された書き込みは失われず、応答したオフセットに同じ値が残っている
+//   - 確認応答された書き込みのオフセットは重複しない
+//   - ある書き込みの応答後に開始した書き込みは、より大きなオフセットに追加される
+//   - 読み出した値は、そのオフセットに書き込まれ得た値である
+//   - 書き込みの応答後に開始した同じオフセットの読み出しは、レコードを見つける
+func (h *History) Check(read func(offset uint64) (*api.Record, error)) error {
+	ops := h.Ops()
+	var violations []string
+	violate := func(format string, args ...interface{}) {
+		violations = append(violations, fmt.Sprintf(format, args...))
+	}
+
+	var acked []Op
+	for _, op := range ops {
+		if op.Kind == Produce && op.Ok {
+			acked = append(acked, op)
+		}
+	}
+
+	written := make(map[uint64]Op)
+	for _, op := range acked {
+		if prev, ok := written[op.Offset]; ok {
+			violate("offset %d acknowledged twice: %q and %q", op.Offset, prev.Value, op.Value)
+			continue
+		}
+		written[op.Offset] = op
+		record, err := read(op.Offset)
+		if err != nil {
+			violate("acknowledged record %q at offset %d lost: %v", op.Value, op.Offset, err)
+			continue
+		}
+		if !bytes.Equal(record.Value, op.Value) {
+			violate("offset %d holds %q, want acknowledged %q", op.Offset, record.Value, op.Value)
+		}
+	}
+
+	for _, a := range acked {
+		for _, b := range acked {
+			if a.End.Before(b.Start) && a.Offset >= b.Offset {
+				violate("%q acknowledged at offset %d before %q started, but %q got offset %d",
+					a.Value, a.Offset, b.Value, b.Value, b.Offset)
+			}
+		}
+	}
+
+	// 不確定な書き込みもログに追加された可能性があるため、読み出した値の候補に含める
+	candidates := make(map[string]bool)
+	for _, op := range ops {
+		if op.Kind == Produce {
+			candidates[string(op.Value)] = true
+		}
+	}
+	for _, op := range ops {
+		if op.Kind != Consume {
+			continue
+		}
+		if !op.Ok {
+			if w, ok := written[op.Offset]; ok && w.End.Before(op.Start) {
+				violate("read at offset %d found nothing after %q was acknowledged", op.Offset, w.Value)
+			}
+			continue
+		}
+		if w, ok := written[op.Offset]; ok {
+			if !bytes.Equal(op.Value, w.Value) {
+				violate("read %q at offset %d, want acknowledged %q", op.Value, op.Offset, w.Value)
+			}
+		} else if !candidates[string(op.Value)] {
+			violate("read %q at offset %d, which was never produced", op.Value, op.Offset)
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return &Violations{Messages: violations}
+}
+
+// Violations は Check が検出した一貫性の違反の一覧。
+type Violations struct {
+	Messages []string
+}
+
+func (v *Violations) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "clustertest: %d consistency violation(s)", len(v.Messages))
+	for _, m := range v.Messages {
+		buf.WriteString("\n\t")
+		buf.WriteString(m)
+	}
+	return buf.String()
+}
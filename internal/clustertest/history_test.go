@@ -0,0 +1,116 @@
+package clustertest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryCheck(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, h *History, log map[uint64]string){
+		"linearizable history passes":    testLinearizable,
+		"lost acknowledged record":       testLostRecord,
+		"duplicate acknowledged offset":  testDuplicateOffset,
+		"acknowledged writes reordered":  testReordered,
+		"stale read after acknowledge":   testStaleRead,
+		"read of a value never produced": testPhantomRead,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t, &History{}, make(map[uint64]string))
+		})
+	}
+}
+
+// at は基準時刻からの経過時間で操作の開始と終了を表す。
+func at(start, end int) (time.Time, time.Time) {
+	base := time.Unix(0, 0)
+	return base.Add(time.Duration(start) * time.Second), base.Add(time.Duration(end) * time.Second)
+}
+
+func produced(h *History, value string, off uint64, ok bool, start, end int) {
+	s, e := at(start, end)
+	h.add(Op{Kind: Produce, Value: []byte(value), Offset: off, Ok: ok, Start: s, End: e})
+}
+
+func consumed(h *History, value string, off uint64, ok bool, start, end int) {
+	s, e := at(start, end)
+	h.add(Op{Kind: Consume, Value: []byte(value), Offset: off, Ok: ok, Start: s, End: e})
+}
+
+func reader(log map[uint64]string) func(uint64) (*api.Record, error) {
+	return func(off uint64) (*api.Record, error) {
+		value, ok := log[off]
+		if !ok {
+			return nil, api.ErrOffsetOutOfRange{Offset: off}
+		}
+		return &api.Record{Value: []byte(value), Offset: off}, nil
+	}
+}
+
+func requireViolations(t *testing.T, err error, n int) {
+	t.Helper()
+	var v *Violations
+	require.True(t, errors.As(err, &v), "%v", err)
+	require.Len(t, v.Messages, n, v.Error())
+}
+
+func testLinearizable(t *testing.T, h *History, log map[uint64]string) {
+	log[0], log[1], log[2] = "a", "b", "c"
+	produced(h, "a", 0, true, 0, 1)
+	// 並行した書き込みはどちらの順序でもよい
+	produced(h, "c", 2, true, 2, 4)
+	produced(h, "b", 1, true, 3, 5)
+	// 不確定な書き込みは失われてもよく、読み出されてもよい
+	produced(h, "d", 0, false, 6, 7)
+	consumed(h, "b", 1, true, 8, 9)
+	consumed(h, "", 3, false, 8, 9)
+	// 書き込みの応答前に開始した読み出しは、レコードを見つけなくてもよい
+	consumed(h, "", 2, false, 2, 3)
+	require.NoError(t, h.Check(reader(log)))
+
+	log[3] = "d"
+	consumed(h, "d", 3, true, 10, 11)
+	require.NoError(t, h.Check(reader(log)))
+}
+
+func testLostRecord(t *testing.T, h *History, log map[uint64]string) {
+	log[0] = "a"
+	produced(h, "a", 0, true, 0, 1)
+	produced(h, "b", 1, true, 2, 3)
+	requireViolations(t, h.Check(reader(log)), 1)
+
+	log[1] = "x"
+	requireViolations(t, h.Check(reader(log)), 1)
+}
+
+func testDuplicateOffset(t *testing.T, h *History, log map[uint64]string) {
+	log[0] = "a"
+	produced(h, "a", 0, true, 0, 2)
+	produced(h, "b", 0, true, 1, 3)
+	requireViolations(t, h.Check(reader(log)), 1)
+}
+
+func testReordered(t *testing.T, h *History, log map[uint64]string) {
+	log[0], log[1] = "b", "a"
+	produced(h, "a", 1, true, 0, 1)
+	produced(h, "b", 0, true, 2, 3)
+	requireViolations(t, h.Check(reader(log)), 1)
+}
+
+func testStaleRead(t *testing.T, h *History, log map[uint64]string) {
+	log[0] = "a"
+	produced(h, "a", 0, true, 0, 1)
+	consumed(h, "", 0, false, 2, 3)
+	requireViolations(t, h.Check(reader(log)), 1)
+}
+
+func testPhantomRead(t *testing.T, h *History, log map[uint64]string) {
+	log[0] = "a"
+	produced(h, "a", 0, true, 0, 1)
+	consumed(h, "a", 0, true, 2, 3)
+	consumed(h, "z", 1, true, 2, 3)
+	requireViolations(t, h.Check(reader(log)), 1)
+}
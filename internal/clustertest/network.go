@@ -0,0 +1,255 @@
+// Package clustertest はプロセス内で複数のサーバを起動し、サーバ間の通信に障害を注入して
+// 分散ログの振る舞いを検証するためのテスト用の部品を提供する。
+package clustertest
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// ErrLinkDown はネットワークの分断によりコネクションを切断したことを表す。
+var ErrLinkDown = errors.New("clustertest: link down")
+
+// ErrDropped は障害の注入によりメッセージを破棄し、コネクションを切断したことを表す。
+var ErrDropped = errors.New("clustertest: message dropped")
+
+// link はサーバ間の一方向の経路。
+type link struct {
+	from, to string
+}
+
+// delay はメッセージの送信を遅延させる範囲。
+type delay struct {
+	min, max time.Duration
+}
+
+// Network はサーバ間のRaftの通信に注入する障害を管理する。
+//
+// 障害はサーバのIDの組ごとに設定する。遅延と破棄の判定は生成時のシードによる乱数で決まるため、
+// 同じシードと同じ操作の順序であれば同じ判定が再現される。
+//
+//	NOTE:
+//	 TCPのストリーム上ではメッセージの一部だけを失うとプロトコルが壊れるため、破棄はコネクションの切断として表す。
+//	 Raftのトランスポートはコネクションを張り直して再送する。
+//	 また、ストリーム内の順序は保たれるため、入れ替わりは遅延の揺らぎにより異なるコネクション
+//	 (ハートビートとAppendEntries、プールされた複数のコネクションなど) の間で発生する。
+type Network struct {
+	mu      sync.Mutex
+	rand    *rand.Rand
+	nodes   map[string]string // RaftのアドレスからサーバのIDへの対応
+	blocked map[link]bool
+	delays  map[link]delay
+	drops   map[link]float64
+	conns   map[*conn]struct{}
+}
+
+// NewNetwork は与えられたシードで障害の判定を行う Network を作成する。
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		rand:    rand.New(rand.NewSource(seed)),
+		nodes:   make(map[string]string),
+		blocked: make(map[link]bool),
+		delays:  make(map[link]delay),
+		drops:   make(map[link]float64),
+		conns:   make(map[*conn]struct{}),
+	}
+}
+
+// StreamLayer はIDのサーバが使うストリームレイヤを包み、障害を注入するストリームレイヤを返却する。
+// 包む前のストリームレイヤのアドレスは、他のサーバからの発信先を特定するために登録する。
+func (n *Network) StreamLayer(id string, inner raft.StreamLayer) raft.StreamLayer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[inner.Addr().String()] = id
+	return &streamLayer{StreamLayer: inner, id: id, net: n}
+}
+
+// Partition はサーバを与えられたグループに分け、異なるグループのサーバ間の通信を双方向に遮断する。
+// いずれのグループにも含まれないサーバの通信は変更しない。
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	for i, g := range groups {
+		for j, h := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range g {
+				for _, to := range h {
+					n.blocked[link{from, to}] = true
+				}
+			}
+		}
+	}
+	n.mu.Unlock()
+	n.closeBlocked()
+}
+
+// Isolate はIDのサーバと他のすべてのサーバとの通信を双方向に遮断する。
+func (n *Network) Isolate(id string) {
+	n.mu.Lock()
+	for _, other := range n.nodes {
+		if other == id {
+			continue
+		}
+		n.blocked[link{id, other}] = true
+		n.blocked[link{other, id}] = true
+	}
+	n.mu.Unlock()
+	n.closeBlocked()
+}
+
+// Heal は注入したすべての障害を取り除く。
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.blocked = make(map[link]bool)
+	n.delays = make(map[link]delay)
+	n.drops = make(map[link]float64)
+}
+
+// Delay はfromからtoへのメッセージの送信を、minからmaxの範囲のランダムな時間だけ遅延させる。
+func (n *Network) Delay(from, to string, min, max time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.delays[link{from, to}] = delay{min: min, max: max}
+}
+
+// Drop はfromからtoへのメッセージをrateの確率 (0から1) で破棄する。
+func (n *Network) Drop(from, to string, rate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.drops[link{from, to}] = rate
+}
+
+// closeBlocked は遮断された経路上の既存のコネクションを切断する。
+func (n *Network) closeBlocked() {
+	n.mu.Lock()
+	var conns []*conn
+	for c := range n.conns {
+		if n.blocked[link{c.from, c.to}] || n.blocked[link{c.to, c.from}] {
+			conns = append(conns, c)
+		}
+	}
+	n.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// fault はfromからtoへのメッセージに対する障害を判定し、送信前に待機する時間を返却する。
+func (n *Network) fault(from, to string) (time.Duration, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	l := link{from, to}
+	if n.blocked[l] {
+		return 0, ErrLinkDown
+	}
+	if rate := n.drops[l]; rate > 0 && n.rand.Float64() < rate {
+		return 0, ErrDropped
+	}
+	d, ok := n.delays[l]
+	if !ok {
+		return 0, nil
+	}
+	wait := d.min
+	if d.max > d.min {
+		wait += time.Duration(n.rand.Int63n(int64(d.max - d.min)))
+	}
+	return wait, nil
+}
+
+func (n *Network) isBlocked(from, to string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.blocked[link{from, to}]
+}
+
+func (n *Network) lookup(addr string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.nodes[addr]
+}
+
+func (n *Network) track(c *conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.conns[c] = struct{}{}
+}
+
+func (n *Network) untrack(c *conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.conns, c)
+}
+
+var _ raft.StreamLayer = (*streamLayer)(nil)
+
+// streamLayer は発信コネクションに障害を注入するストリームレイヤ。
+//
+// 受信コネクションからは発信元のサーバを特定できないため、発信側のコネクションで双方向の障害を扱う。
+// 書き込みには発信元から発信先への障害を、読み出しには発信先から発信元への障害を適用する。
+type streamLayer struct {
+	raft.StreamLayer
+	id  string
+	net *Network
+}
+
+func (s *streamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	to := s.net.lookup(string(addr))
+	if s.net.isBlocked(s.id, to) {
+		return nil, ErrLinkDown
+	}
+	inner, err := s.StreamLayer.Dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{Conn: inner, from: s.id, to: to, net: s.net}
+	s.net.track(c)
+	return c, nil
+}
+
+// conn は障害を注入する発信コネクション。
+type conn struct {
+	net.Conn
+	from, to string
+	net      *Network
+	once     sync.Once
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	wait, err := c.net.fault(c.from, c.to)
+	if err != nil {
+		c.Close()
+		return 0, err
+	}
+	time.Sleep(wait)
+	return c.Conn.Write(b)
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		return n, err
+	}
+	wait, ferr := c.net.fault(c.to, c.from)
+	if ferr != nil {
+		c.Close()
+		return 0, ferr
+	}
+	time.Sleep(wait)
+	return n, nil
+}
+
+func (c *conn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.net.untrack(c)
+		err = c.Conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,113 @@
+package clustertest
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ac0mz/proglog/internal/log"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetwork(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, n *Network, a, b raft.StreamLayer){
+		"partition refuses dials and closes connections": testPartition,
+		"drop closes the connection":                     testDrop,
+		"delay holds messages back":                      testDelay,
+		"heal removes faults":                            testHeal,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			n := NewNetwork(1)
+			a, b := setupStreamLayer(t, n, "a"), setupStreamLayer(t, n, "b")
+			fn(t, n, a, b)
+		})
+	}
+}
+
+func setupStreamLayer(t *testing.T, n *Network, id string) raft.StreamLayer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := n.StreamLayer(id, log.NewStreamLayer(ln, nil, nil))
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// connect はfromからtoへ発信し、toが受け入れたコネクションと組にして返却する。
+func connect(t *testing.T, from, to raft.StreamLayer) (net.Conn, net.Conn) {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := to.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	dialed, err := from.Dial(raft.ServerAddress(to.Addr().String()), time.Second)
+	require.NoError(t, err)
+	// 受信側はコネクション種別を識別するバイトを読み出すまで受け入れを完了しない
+	_, err = dialed.Write([]byte("ping"))
+	require.NoError(t, err)
+	conn := <-accepted
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+	return dialed, conn
+}
+
+func testPartition(t *testing.T, n *Network, a, b raft.StreamLayer) {
+	dialed, _ := connect(t, a, b)
+	n.Partition([]string{"a"}, []string{"b"})
+
+	_, err := dialed.Write([]byte("x"))
+	require.Error(t, err)
+	_, err = a.Dial(raft.ServerAddress(b.Addr().String()), time.Second)
+	require.ErrorIs(t, err, ErrLinkDown)
+}
+
+func testDrop(t *testing.T, n *Network, a, b raft.StreamLayer) {
+	dialed, _ := connect(t, a, b)
+	n.Drop("a", "b", 1)
+
+	_, err := dialed.Write([]byte("x"))
+	require.ErrorIs(t, err, ErrDropped)
+	// 逆方向の経路には影響しないが、bからの発信に対するaの応答は破棄する
+	dialed, conn := connect(t, b, a)
+	_, err = conn.Write([]byte("pong"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(dialed, make([]byte, 4))
+	require.ErrorIs(t, err, ErrDropped)
+}
+
+func testDelay(t *testing.T, n *Network, a, b raft.StreamLayer) {
+	dialed, conn := connect(t, a, b)
+	n.Delay("a", "b", 50*time.Millisecond, 60*time.Millisecond)
+	n.Delay("b", "a", 50*time.Millisecond, 60*time.Millisecond)
+
+	start := time.Now()
+	_, err := dialed.Write([]byte("x"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 1))
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// 応答の読み出しには発信先から発信元への遅延を適用する
+	start = time.Now()
+	_, err = conn.Write([]byte("y"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(dialed, make([]byte, 1))
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func testHeal(t *testing.T, n *Network, a, b raft.StreamLayer) {
+	n.Isolate("b")
+	_, err := a.Dial(raft.ServerAddress(b.Addr().String()), time.Second)
+	require.ErrorIs(t, err, ErrLinkDown)
+
+	n.Heal()
+	connect(t, a, b)
+}
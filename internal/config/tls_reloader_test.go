@@ -0,0 +1,202 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTLSReloader は証明書とCAを差し替えた後のハンドシェイクに、新たな証明書とCAが用いられることを検証する。
+func TestTLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	server := TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		Server:   true,
+	}
+	client := TLSConfig{
+		CertFile:      filepath.Join(dir, "client.pem"),
+		KeyFile:       filepath.Join(dir, "client-key.pem"),
+		CAFile:        filepath.Join(dir, "ca.pem"),
+		ServerAddress: "127.0.0.1",
+	}
+	issue := func(ca *testCA) {
+		ca.write(t, server.CAFile)
+		ca.issue(t, "server", server.CertFile, server.KeyFile)
+		ca.issue(t, "client", client.CertFile, client.KeyFile)
+	}
+
+	oldCA := newTestCA(t, "old")
+	issue(oldCA)
+	serverReloader, err := NewTLSReloader(server)
+	require.NoError(t, err)
+	clientReloader, err := NewTLSReloader(client)
+	require.NoError(t, err)
+	serverConfig, clientConfig := serverReloader.TLSConfig(), clientReloader.TLSConfig()
+	// 再読み込みしない従来の設定
+	staticClientConfig, err := SetupTLSConfig(client)
+	require.NoError(t, err)
+
+	cs, err := handshake(serverConfig, clientConfig)
+	require.NoError(t, err)
+	require.Equal(t, "client", cs.VerifiedChains[0][0].Subject.CommonName)
+	require.Equal(t, "old", cs.VerifiedChains[0][1].Subject.CommonName)
+
+	newCA := newTestCA(t, "new")
+	issue(newCA)
+	// 再読み込みするまでは変更前の証明書を使い続ける
+	_, err = handshake(serverConfig, clientConfig)
+	require.NoError(t, err)
+
+	require.NoError(t, serverReloader.Reload())
+	require.NoError(t, clientReloader.Reload())
+	cs, err = handshake(serverConfig, clientConfig)
+	require.NoError(t, err)
+	require.Equal(t, "new", cs.VerifiedChains[0][1].Subject.CommonName)
+	// 変更前のCAのみを信頼するクライアントは、新たなサーバ証明書を検証できない
+	_, err = handshake(serverConfig, staticClientConfig)
+	require.Error(t, err)
+
+	// 読み込みに失敗した場合は変更前の証明書を使い続ける
+	require.NoError(t, os.WriteFile(server.CertFile, []byte("invalid"), 0600))
+	require.Error(t, serverReloader.Reload())
+	_, err = handshake(serverConfig, clientConfig)
+	require.NoError(t, err)
+}
+
+// TestTLSReloaderServerName はサーバ証明書を接続先の名前に対して検証し、名前が分からない場合は接続を拒否することを検証する。
+func TestTLSReloaderServerName(t *testing.T) {
+	dir := t.TempDir()
+	server := TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		Server:   true,
+	}
+	ca := newTestCA(t, "ca")
+	ca.write(t, server.CAFile)
+	ca.issue(t, "server", server.CertFile, server.KeyFile)
+	ca.issue(t, "client", filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+	serverReloader, err := NewTLSReloader(server)
+	require.NoError(t, err)
+	serverConfig := serverReloader.TLSConfig()
+
+	clientConfig := func(serverAddress string) *tls.Config {
+		r, err := NewTLSReloader(TLSConfig{
+			CertFile:      filepath.Join(dir, "client.pem"),
+			KeyFile:       filepath.Join(dir, "client-key.pem"),
+			CAFile:        server.CAFile,
+			ServerAddress: serverAddress,
+		})
+		require.NoError(t, err)
+		return r.TLSConfig()
+	}
+
+	// IPアドレスの名前も検証する
+	_, err = handshake(serverConfig, clientConfig("127.0.0.1"))
+	require.NoError(t, err)
+	_, err = handshake(serverConfig, clientConfig("127.0.0.2"))
+	require.Error(t, err)
+
+	// 名前が未設定の場合は、同じCAが発行した証明書であっても受け入れない
+	unnamed := clientConfig("")
+	_, err = handshake(serverConfig, unnamed)
+	require.Error(t, err)
+
+	// 接続先のホスト名を設定した複製は、その名前で検証する
+	named := unnamed.Clone()
+	named.ServerName = "localhost"
+	_, err = handshake(serverConfig, named)
+	require.NoError(t, err)
+	named.ServerName = "example.com"
+	_, err = handshake(serverConfig, named)
+	require.Error(t, err)
+}
+
+// handshake はメモリ上のコネクションでハンドシェイクし、サーバ側の接続状態を返却する。
+func handshake(serverConfig, clientConfig *tls.Config) (tls.ConnectionState, error) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	srv, cli := tls.Server(serverConn, serverConfig), tls.Client(clientConn, clientConfig)
+	errc := make(chan error, 1)
+	go func() {
+		err := cli.Handshake()
+		if err != nil {
+			clientConn.Close()
+		}
+		errc <- err
+	}()
+	serverErr := srv.Handshake()
+	if serverErr != nil {
+		serverConn.Close()
+	}
+	if err := <-errc; err != nil {
+		return tls.ConnectionState{}, err
+	}
+	return srv.ConnectionState(), serverErr
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, der: der}
+}
+
+func (ca *testCA) write(t *testing.T, path string) {
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}), 0600))
+}
+
+// issue はサーバ・クライアントの両方の用途に使える証明書を発行し、ファイルに書き込む。
+func (ca *testCA) issue(t *testing.T, name, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Watcher は指定されたファイルを定期的に確認し、いずれかが変更された場合にコールバックを呼び出す。
+//
+//	NOTE:
+//	 KubernetesのConfigMapやSecretはシンボリックリンクの差し替えで更新されるため、
+//	 inotify等のイベントではなく、更新日時とサイズの変化をポーリングで検知する。
+type Watcher struct {
+	paths    []string
+	interval time.Duration
+	onChange func()
+
+	state     map[string]fileState
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// WatchFiles はファイルの監視を開始する。Closeを呼び出すまで監視を続ける。
+func WatchFiles(interval time.Duration, onChange func(), paths ...string) *Watcher {
+	w := &Watcher{
+		paths:    paths,
+		interval: interval,
+		onChange: onChange,
+		state:    map[string]fileState{},
+		done:     make(chan struct{}),
+	}
+	// 開始時点で存在しないファイルは空の状態とし、後から作成された場合に変更として検知する
+	for _, path := range paths {
+		w.state[path] = fileState{}
+	}
+	w.changed() // 現在の状態を記録
+	go w.run()
+	return w
+}
+
+func (w *Watcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if w.changed() {
+				w.onChange()
+			}
+		}
+	}
+}
+
+// changed は前回の確認以降にいずれかのファイルが変更されたかを判定する。
+// 一時的に存在しないファイルは変更とみなさず、存在しなかったファイルの作成は変更とみなす。
+func (w *Watcher) changed() bool {
+	changed := false
+	for _, path := range w.paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		st := fileState{modTime: fi.ModTime(), size: fi.Size()}
+		if w.state[path] != st {
+			changed = true
+		}
+		w.state[path] = st
+	}
+	return changed
+}
+
+// Close はファイルの監視を停止する。
+func (w *Watcher) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	return nil
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestWatchFiles は監視の開始時に存在しなかったファイルの作成と、既存のファイルの更新を変更として検知することを検証する。
+func TestWatchFiles(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.json")
+	missing := filepath.Join(dir, "missing.json")
+	require.NoError(t, os.WriteFile(existing, []byte("{}"), 0644))
+
+	changes := make(chan struct{}, 10)
+	w := WatchFiles(10*time.Millisecond, func() { changes <- struct{}{} }, existing, missing)
+	defer w.Close()
+
+	requireChange := func() {
+		t.Helper()
+		select {
+		case <-changes:
+		case <-time.After(time.Second):
+			t.Fatal("change was not detected")
+		}
+	}
+	requireNoChange := func() {
+		t.Helper()
+		select {
+		case <-changes:
+			t.Fatal("unexpected change")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	requireNoChange()
+	require.NoError(t, os.WriteFile(missing, []byte("{}"), 0644))
+	requireChange()
+	requireNoChange()
+	require.NoError(t, os.WriteFile(existing, []byte(`{"a": 1}`), 0644))
+	requireChange()
+}
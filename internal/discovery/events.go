@@ -0,0 +1,171 @@
+package discovery
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// QueryHandler はクエリのペイロードを処理し、応答を返却する。
+type QueryHandler func(payload []byte) ([]byte, error)
+
+// EventHandler はユーザーイベントのペイロードを処理する。
+type EventHandler func(payload []byte)
+
+// クエリの応答の先頭に付与し、処理の成否を区別する
+const (
+	queryOK    byte = 0
+	queryError byte = 1
+)
+
+// HandleQuery は名前を指定されたクエリを受信した際に呼び出すハンドラを登録する。
+func (m *Membership) HandleQuery(name string, h QueryHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queryHandlers[name] = h
+}
+
+// HandleEvent は名前を指定されたユーザーイベントを受信した際に呼び出すハンドラを登録する。
+func (m *Membership) HandleEvent(name string, h EventHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.eventHandlers[name] = h
+}
+
+// Query はクラスタのすべてのメンバー (自身を含む) にクエリを送信し、タイムアウトするまでに得られた応答をメンバーの名前順に返却する。
+// timeoutが0の場合はSerfの既定値とする。
+func (m *Membership) Query(name string, payload []byte, timeout time.Duration) ([]*api.QueryResult, error) {
+	resp, err := m.serf.Query(name, payload, &serf.QueryParam{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	var results []*api.QueryResult
+	for r := range resp.ResponseCh() {
+		if len(r.Payload) == 0 {
+			continue
+		}
+		res := &api.QueryResult{Node: r.From}
+		if r.Payload[0] == queryError {
+			res.Error = string(r.Payload[1:])
+		} else {
+			res.Payload = r.Payload[1:]
+		}
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Node < results[j].Node })
+	return results, nil
+}
+
+// UserEvent はクラスタのすべてのメンバーにユーザーイベントを送信する。
+// coalesceがtrueの場合、短時間に送信された同名のイベントは最新のもののみ配送される。
+func (m *Membership) UserEvent(name string, payload []byte, coalesce bool) error {
+	return m.serf.UserEvent(name, payload, coalesce)
+}
+
+// handleQuery はクエリを処理して応答する。未登録のクエリには応答しない。
+func (m *Membership) handleQuery(q *serf.Query) {
+	m.mu.Lock()
+	h, ok := m.queryHandlers[q.Name]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+	// 時間のかかる処理でも後続のイベントを妨げないよう、ゴルーチンで処理する
+	go func() {
+		payload, err := h(q.Payload)
+		resp := append([]byte{queryOK}, payload...)
+		if err != nil {
+			resp = append([]byte{queryError}, err.Error()...)
+		}
+		if err := q.Respond(resp); err != nil {
+			// 期限を過ぎた応答もエラーとなる
+			m.logger.Warn("failed to respond to query", zap.Error(err), zap.String("query", q.Name))
+		}
+	}()
+}
+
+// handleUserEvent はユーザーイベントを処理する。
+func (m *Membership) handleUserEvent(e serf.UserEvent) {
+	m.mu.Lock()
+	h, ok := m.eventHandlers[e.Name]
+	m.mu.Unlock()
+	if ok {
+		go h(e.Payload)
+	}
+}
+
+// publishTags はTagsFuncが返却するタグを定期的にメンバーのタグに反映する。
+// タグが変化した場合のみSerfに設定し、ゴシップの量を抑える。
+func (m *Membership) publishTags() {
+	ticker := time.NewTicker(m.TagInterval)
+	defer ticker.Stop()
+	var last map[string]string
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			dynamic := m.TagsFunc()
+			if equalTags(last, dynamic) {
+				continue
+			}
+			if err := m.SetTags(dynamic); err != nil {
+				m.logger.Error("failed to set tags", zap.Error(err))
+				continue
+			}
+			last = dynamic
+		}
+	}
+}
+
+// SetTags は固定のタグ (RPCアドレスや参加トークン) に動的なタグを加えて、メンバーのタグを更新する。
+// 固定のタグと同名のタグは無視する。
+func (m *Membership) SetTags(dynamic map[string]string) error {
+	tags := m.admissionTags()
+	for k, v := range dynamic {
+		if _, ok := tags[k]; !ok {
+			tags[k] = v
+		}
+	}
+	return m.serf.SetTags(tags)
+}
+
+func equalTags(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// GetMembers はメンバーシップから見たクラスタのメンバーを、名前順に返却する。
+// 参加トークンはクライアントに公開しない。
+func (m *Membership) GetMembers() ([]*api.Member, error) {
+	members := m.Members()
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	res := make([]*api.Member, 0, len(members))
+	for _, member := range members {
+		tags := make(map[string]string, len(member.Tags))
+		for k, v := range member.Tags {
+			if k != joinTokenTag {
+				tags[k] = v
+			}
+		}
+		res = append(res, &api.Member{
+			Name:   member.Name,
+			Addr:   net.JoinHostPort(member.Addr.String(), strconv.Itoa(int(member.Port))),
+			Status: member.Status.String(),
+			Tags:   tags,
+		})
+	}
+	return res, nil
+}
@@ -2,9 +2,12 @@ package discovery
 
 import (
 	"net"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
@@ -15,6 +18,20 @@ type Membership struct {
 	serf    *serf.Serf
 	events  chan serf.Event
 	logger  *zap.Logger
+	done    chan struct{} // Leaveで閉じ、タグの公開を停止する
+
+	closeOnce sync.Once
+
+	mu            sync.Mutex
+	queryHandlers map[string]QueryHandler
+	eventHandlers map[string]EventHandler
+
+	eventsTotal *prometheus.CounterVec // 受信したSerfイベントの種別ごとの件数
+
+	reconcileMu    sync.Mutex
+	downSince      map[string]time.Time   // Raftの構成に含まれるサーバが稼働中でないことを最初に観測した時刻
+	driftGauge     *prometheus.GaugeVec   // 直近の調整で観測した差分の件数
+	reconcileTotal *prometheus.CounterVec // 調整によりRaftの構成を変更した回数
 }
 
 func New(handler Handler, config Config) (*Membership, error) {
@@ -22,6 +39,24 @@ func New(handler Handler, config Config) (*Membership, error) {
 		Config:  config,
 		handler: handler,
 		logger:  zap.L().Named("membership"),
+		done:    make(chan struct{}),
+
+		queryHandlers: map[string]QueryHandler{},
+		eventHandlers: map[string]EventHandler{},
+		eventsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proglog_serf_events_total",
+			Help: "Number of Serf events received by the membership.",
+		}, []string{"type"}),
+
+		downSince: map[string]time.Time{},
+		driftGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proglog_membership_drift",
+			Help: "Number of members differing between Serf and the Raft configuration at the last reconciliation.",
+		}, []string{"kind"}),
+		reconcileTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proglog_membership_reconcile_total",
+			Help: "Number of changes to the Raft configuration made by reconciliation.",
+		}, []string{"action"}),
 	}
 	if err := c.setupSerf(); err != nil {
 		return nil, err
@@ -35,6 +70,26 @@ type Config struct {
 	BindAddr       string
 	Tags           map[string]string
 	StartJoinAddrs []string
+
+	// EncryptKey はゴシップを暗号化する主鍵 (16, 24, 32バイト)。未設定かつKeyringFileが存在しない場合は暗号化しない。
+	EncryptKey []byte
+	// KeyringFile は鍵のローテーションで変更された鍵を保存するファイルのパス
+	KeyringFile string
+	// ClusterID が設定された場合、同じクラスタIDのメンバーのみをクラスタに参加させる
+	ClusterID string
+	// JoinSecret が設定された場合、この秘密鍵で署名された参加トークンを持つメンバーのみをクラスタに参加させる
+	JoinSecret []byte
+
+	// TagsFunc はRaftの役割やディスク使用量など、ノードの状態を表す動的なタグを返却する。
+	// TagIntervalごとに呼び出し、変化した場合にメンバーのタグに反映する。未設定の場合、タグはTagsのみとする。
+	TagsFunc    func() map[string]string
+	TagInterval time.Duration
+
+	// Servers が設定された場合、リーダーはReconcileIntervalごとにSerfのメンバーシップとRaftの構成を調整する。
+	// 障害が発生したメンバーは即座に除去せず、ReapGracePeriodを超えて復旧しない場合に除去する。
+	Servers           ServerLister
+	ReconcileInterval time.Duration
+	ReapGracePeriod   time.Duration
 }
 
 // setupSerf はSerfインスタンスの作成と設定を行い、Serfイベントを処理するハンドラを別ゴルーチンで起動する。
@@ -49,13 +104,31 @@ func (m *Membership) setupSerf() (err error) {
 	config.MemberlistConfig.BindPort = addr.Port        // Serfのゴシッププロトコルで使用するポート
 	m.events = make(chan serf.Event)
 	config.EventCh = m.events           // ノードがクラスタに参加・離脱した時にSerfイベントを受信する手段
-	config.Tags = m.Tags                // ノードの処理方法をクラスタに伝えるメタデータ(RPCアドレスや定数値など)
+	config.Tags = m.admissionTags()     // ノードの処理方法をクラスタに伝えるメタデータ(RPCアドレスや定数値など)
 	config.NodeName = m.Config.NodeName // Serfクラスタ全体におけるノードの一意な識別子(未設定の場合はホスト名がデフォルト値)
+	if err = m.setupKeyring(config); err != nil {
+		return err
+	}
 	m.serf, err = serf.Create(config)
 	if err != nil {
 		return err
 	}
 	go m.eventHandler()
+	if m.TagsFunc != nil {
+		if m.TagInterval == 0 {
+			m.TagInterval = 5 * time.Second
+		}
+		go m.publishTags()
+	}
+	if m.Servers != nil {
+		if m.ReconcileInterval == 0 {
+			m.ReconcileInterval = 10 * time.Second
+		}
+		if m.ReapGracePeriod == 0 {
+			m.ReapGracePeriod = 2 * time.Minute
+		}
+		go m.reconcile()
+	}
 	if m.StartJoinAddrs != nil {
 		// StartJoinAddrsフィールドは、新規ノードが既存クラスタに参加するよう設定する仕組みで用いられる。
 		// クラスタ内ノードのアドレスを設定すると、Serfがノードをクラスタに参加させる。
@@ -77,6 +150,7 @@ type Handler interface {
 // 受信した各イベントをイベントの種別に応じて処理する。
 func (m *Membership) eventHandler() {
 	for e := range m.events {
+		m.eventsTotal.WithLabelValues(e.EventType().String()).Inc()
 		switch e.EventType() {
 		case serf.EventMemberJoin:
 			// Serfは複数メンバーの更新を1つのイベントにまとめて送信する可能性があるため、
@@ -89,18 +163,36 @@ func (m *Membership) eventHandler() {
 				m.handleJoin(member)
 			}
 		case serf.EventMemberLeave, serf.EventMemberFailed:
+			if e.EventType() == serf.EventMemberFailed && m.Servers != nil {
+				// 一時的な障害で除去しないよう、猶予期間を経てReconcileで除去する
+				continue
+			}
 			for _, member := range e.(serf.MemberEvent).Members {
 				if m.isLocal(member) {
-					return
+					continue
 				}
 				m.handleLeave(member)
 			}
+		case serf.EventUser:
+			m.handleUserEvent(e.(serf.UserEvent))
+		case serf.EventQuery:
+			m.handleQuery(e.(*serf.Query))
 		}
 	}
 }
 
 // handleJoin はクラスタへの参加イベントを処理する。
+// Serfのポートに到達できるだけのノードがRaftの投票者とならないよう、参加を許可されたメンバーのみを扱う。
 func (m *Membership) handleJoin(member serf.Member) {
+	if err := m.admit(member); err != nil {
+		m.logger.Warn(
+			"rejected member",
+			zap.Error(err),
+			zap.String("name", member.Name),
+			zap.String("rpc_addr", member.Tags["rpc_addr"]),
+		)
+		return
+	}
 	if err := m.handler.Join(member.Name, member.Tags["rpc_addr"]); err != nil {
 		m.logError(err, "failed to join", member)
 	}
@@ -123,8 +215,44 @@ func (m *Membership) Members() []serf.Member {
 	return m.serf.Members()
 }
 
+var membersDesc = prometheus.NewDesc(
+	"proglog_serf_members",
+	"Number of Serf members known to this node by status.",
+	[]string{"status"}, nil,
+)
+
+var _ prometheus.Collector = (*Membership)(nil)
+
+// Describe はメンバーシップが収集するメトリクスの記述子を送信する。
+func (m *Membership) Describe(ch chan<- *prometheus.Desc) {
+	ch <- membersDesc
+	m.eventsTotal.Describe(ch)
+	m.driftGauge.Describe(ch)
+	m.reconcileTotal.Describe(ch)
+}
+
+// Collect はスクレイプ時点でのメンバー数をステータスごとに送信する。
+func (m *Membership) Collect(ch chan<- prometheus.Metric) {
+	counts := map[serf.MemberStatus]int{
+		serf.StatusAlive:   0,
+		serf.StatusLeaving: 0,
+		serf.StatusLeft:    0,
+		serf.StatusFailed:  0,
+	}
+	for _, member := range m.Members() {
+		counts[member.Status]++
+	}
+	for status, n := range counts {
+		ch <- prometheus.MustNewConstMetric(membersDesc, prometheus.GaugeValue, float64(n), status.String())
+	}
+	m.eventsTotal.Collect(ch)
+	m.driftGauge.Collect(ch)
+	m.reconcileTotal.Collect(ch)
+}
+
 // Leave はメンバーがクラスタから離脱することを指示する。
 func (m *Membership) Leave() error {
+	m.closeOnce.Do(func() { close(m.done) })
 	return m.serf.Leave()
 }
 
@@ -1,10 +1,16 @@
 package discovery
 
 import (
+	"encoding/base64"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
@@ -88,3 +94,275 @@ func (h *handler) Leave(id string) error {
 	}
 	return nil
 }
+
+// TestAdmission はクラスタIDと参加トークンを持たないメンバーが、Raftのクラスタに参加しないことを検証する。
+func TestAdmission(t *testing.T) {
+	secret := []byte("secret")
+	setup := func(members []*Membership, h *handler, name, clusterID string, secret []byte) *Membership {
+		addr := fmt.Sprintf("%s:%d", "127.0.0.1", dynaport.Get(1)[0])
+		c := Config{
+			NodeName:   name,
+			BindAddr:   addr,
+			Tags:       map[string]string{"rpc_addr": addr},
+			ClusterID:  clusterID,
+			JoinSecret: secret,
+		}
+		if len(members) > 0 {
+			c.StartJoinAddrs = []string{members[0].BindAddr}
+		}
+		m, err := New(h, c)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = m.Leave() })
+		return m
+	}
+	h := &handler{joins: make(chan map[string]string, 3)}
+	leader := setup(nil, h, "leader", "prod", secret)
+	members := []*Membership{leader}
+	setup(members, &handler{}, "other-cluster", "dev", secret)
+	setup(members, &handler{}, "forged", "prod", []byte("guess"))
+	setup(members, &handler{}, "admitted", "prod", secret)
+
+	require.Eventually(t, func() bool {
+		return len(leader.Members()) == 4
+	}, 3*time.Second, 250*time.Millisecond)
+	join := <-h.joins
+	require.Equal(t, "admitted", join["id"])
+	require.Equal(t, 0, len(h.joins))
+}
+
+// TestGossipEncryption は鍵を持たないノードが参加できないこと、
+// および鍵をローテーションした後もメンバーがゴシップを続けられることを検証する。
+func TestGossipEncryption(t *testing.T) {
+	key := make([]byte, 32)
+	newKey := make([]byte, 32)
+	newKey[0] = 1
+	setup := func(members []*Membership, name string, key []byte) (*Membership, error) {
+		addr := fmt.Sprintf("%s:%d", "127.0.0.1", dynaport.Get(1)[0])
+		c := Config{
+			NodeName:    name,
+			BindAddr:    addr,
+			Tags:        map[string]string{"rpc_addr": addr},
+			EncryptKey:  key,
+			KeyringFile: filepath.Join(t.TempDir(), "keyring"),
+		}
+		if len(members) > 0 {
+			c.StartJoinAddrs = []string{members[0].BindAddr}
+		}
+		m, err := New(&handler{}, c)
+		if err == nil {
+			t.Cleanup(func() { _ = m.Leave() })
+		}
+		return m, err
+	}
+	first, err := setup(nil, "0", key)
+	require.NoError(t, err)
+	second, err := setup([]*Membership{first}, "1", key)
+	require.NoError(t, err)
+	_, err = setup([]*Membership{first}, "plaintext", nil)
+	require.Error(t, err)
+
+	encoded := base64.StdEncoding.EncodeToString(newKey)
+	require.NoError(t, first.InstallKey(encoded))
+	require.NoError(t, first.UseKey(encoded))
+	require.NoError(t, first.RemoveKey(base64.StdEncoding.EncodeToString(key)))
+	keys, numNodes, err := first.ListKeys()
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{encoded: 2}, keys)
+	require.Equal(t, 2, numNodes)
+
+	// ローテーションした鍵は保存され、再起動後に読み込まれる
+	b, err := os.ReadFile(second.KeyringFile)
+	require.NoError(t, err)
+	saved, err := decodeKeyring(b)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{newKey}, saved)
+	// 古い鍵のみを持つノードは参加できない
+	_, err = setup([]*Membership{first}, "stale", key)
+	require.Error(t, err)
+}
+
+// TestTagsAndQueries は動的なタグがメンバーに伝播すること、クエリとユーザーイベントが
+// すべてのメンバーで処理されることを検証する。
+func TestTagsAndQueries(t *testing.T) {
+	setup := func(members []*Membership, name string) *Membership {
+		addr := fmt.Sprintf("%s:%d", "127.0.0.1", dynaport.Get(1)[0])
+		c := Config{
+			NodeName:    name,
+			BindAddr:    addr,
+			Tags:        map[string]string{"rpc_addr": addr},
+			JoinSecret:  []byte("secret"),
+			TagsFunc:    func() map[string]string { return map[string]string{"leader": name} },
+			TagInterval: 50 * time.Millisecond,
+		}
+		if len(members) > 0 {
+			c.StartJoinAddrs = []string{members[0].BindAddr}
+		}
+		m, err := New(&handler{}, c)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = m.Leave() })
+		return m
+	}
+	a := setup(nil, "a")
+	b := setup([]*Membership{a}, "b")
+
+	require.Eventually(t, func() bool {
+		members, err := a.GetMembers()
+		require.NoError(t, err)
+		return len(members) == 2 && members[1].Tags["leader"] == "b"
+	}, 3*time.Second, 50*time.Millisecond)
+	members, err := a.GetMembers()
+	require.NoError(t, err)
+	require.Equal(t, "a", members[0].Name)
+	require.Equal(t, "alive", members[0].Status)
+	require.Equal(t, a.Tags["rpc_addr"], members[0].Tags["rpc_addr"])
+	// 参加トークンは公開しない
+	require.NotContains(t, members[0].Tags, joinTokenTag)
+
+	a.HandleQuery("echo", func(payload []byte) ([]byte, error) { return payload, nil })
+	b.HandleQuery("echo", func([]byte) ([]byte, error) { return nil, fmt.Errorf("failed") })
+	results, err := a.Query("echo", []byte("hello"), time.Second)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(results))
+	require.Equal(t, "a", results[0].Node)
+	require.Equal(t, []byte("hello"), results[0].Payload)
+	require.Equal(t, "b", results[1].Node)
+	require.Equal(t, "failed", results[1].Error)
+
+	events := make(chan string, 1)
+	b.HandleEvent("flush", func(payload []byte) { events <- string(payload) })
+	require.NoError(t, a.UserEvent("flush", []byte("now"), false))
+	select {
+	case payload := <-events:
+		require.Equal(t, "now", payload)
+	case <-time.After(3 * time.Second):
+		t.Fatal("user event was not delivered")
+	}
+}
+
+// TestReconcile はリーダーでない間に取りこぼしたメンバーをRaftの構成に追加し、
+// 稼働中でないサーバを猶予期間の経過後に除去することを検証する。
+func TestReconcile(t *testing.T) {
+	setup := func(members []*Membership, name string, c *cluster) *Membership {
+		addr := fmt.Sprintf("%s:%d", "127.0.0.1", dynaport.Get(1)[0])
+		config := Config{
+			NodeName: name,
+			BindAddr: addr,
+			Tags:     map[string]string{"rpc_addr": addr},
+		}
+		if c != nil {
+			config.Servers = c
+			config.ReconcileInterval = time.Hour // テストではReconcileを直接呼び出す
+			config.ReapGracePeriod = 100 * time.Millisecond
+		}
+		if len(members) > 0 {
+			config.StartJoinAddrs = []string{members[0].BindAddr}
+		}
+		h := c
+		if h == nil {
+			h = &cluster{}
+		}
+		m, err := New(h, config)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = m.Leave() })
+		return m
+	}
+	// リーダーでない間のイベントは処理されない
+	c := &cluster{servers: map[string]string{}, leader: "0", notLeader: true}
+	leader := setup(nil, "0", c)
+	c.servers["0"] = leader.Tags["rpc_addr"]
+	c.servers["ghost"] = "127.0.0.1:0"
+	follower := setup([]*Membership{leader}, "1", nil)
+	require.Eventually(t, func() bool {
+		return len(leader.Members()) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	_, err := leader.Reconcile()
+	require.Equal(t, raft.ErrNotLeader, err)
+
+	c.setNotLeader(false)
+	drift, err := leader.Reconcile()
+	require.NoError(t, err)
+	require.Equal(t, []string{"1"}, drift.Missing)
+	require.Equal(t, []string{"1"}, drift.Joined)
+	require.Equal(t, []string{"ghost"}, drift.Stale)
+	// 猶予期間の間は除去しない
+	require.Empty(t, drift.Reaped)
+	require.Equal(t, follower.Tags["rpc_addr"], c.get("1"))
+
+	time.Sleep(150 * time.Millisecond)
+	drift, err = leader.Reconcile()
+	require.NoError(t, err)
+	require.Empty(t, drift.Missing)
+	require.Equal(t, []string{"ghost"}, drift.Reaped)
+	require.Equal(t, "", c.get("ghost"))
+
+	// グレースフルに離脱したサーバは猶予期間を待たずに除去する
+	c.setNotLeader(true)
+	require.NoError(t, follower.Leave())
+	require.Eventually(t, func() bool {
+		for _, m := range leader.Members() {
+			if m.Name == "1" {
+				return m.Status == serf.StatusLeft
+			}
+		}
+		return false
+	}, 3*time.Second, 50*time.Millisecond)
+	c.setNotLeader(false)
+	drift, err = leader.Reconcile()
+	require.NoError(t, err)
+	require.Equal(t, []string{"1"}, drift.Reaped)
+	require.Equal(t, "", c.get("1"))
+}
+
+// cluster はRaftの構成を保持する Handler と ServerLister の偽物である。
+// notLeaderの場合、構成の変更は ErrNotLeader となる。
+type cluster struct {
+	mu        sync.Mutex
+	servers   map[string]string
+	leader    string
+	notLeader bool
+}
+
+func (c *cluster) setNotLeader(notLeader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notLeader = notLeader
+}
+
+func (c *cluster) get(id string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.servers[id]
+}
+
+func (c *cluster) Join(id, addr string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.notLeader {
+		return raft.ErrNotLeader
+	}
+	if c.servers != nil {
+		c.servers[id] = addr
+	}
+	return nil
+}
+
+func (c *cluster) Leave(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.notLeader {
+		return raft.ErrNotLeader
+	}
+	delete(c.servers, id)
+	return nil
+}
+
+func (c *cluster) GetServers() ([]*api.Server, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var servers []*api.Server
+	for id, addr := range c.servers {
+		servers = append(servers, &api.Server{Id: id, RpcAddr: addr, IsLeader: id == c.leader && !c.notLeader})
+	}
+	return servers, nil
+}
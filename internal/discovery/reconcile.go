@@ -0,0 +1,141 @@
+package discovery
+
+import (
+	"sort"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// ServerLister はRaftの構成に含まれるサーバを返却する。
+type ServerLister interface {
+	GetServers() ([]*api.Server, error)
+}
+
+// Drift はSerfのメンバーシップとRaftの構成の差分を保持する。
+type Drift struct {
+	Missing []string // Serfで稼働中だが、Raftの構成に含まれない (またはアドレスが異なる) メンバー
+	Stale   []string // Raftの構成に含まれるが、Serfで稼働中でないサーバ
+	Joined  []string // 調整によりRaftの構成に追加したメンバー
+	Reaped  []string // 調整によりRaftの構成から除去したサーバ
+}
+
+// reconcile はReconcileIntervalごとにメンバーシップとRaftの構成を調整する。
+func (m *Membership) reconcile() {
+	ticker := time.NewTicker(m.ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			drift, err := m.Reconcile()
+			if err != nil {
+				if err != raft.ErrNotLeader {
+					m.logger.Error("failed to reconcile", zap.Error(err))
+				}
+				continue
+			}
+			if len(drift.Missing) > 0 || len(drift.Stale) > 0 {
+				m.logger.Info(
+					"membership drift",
+					zap.Strings("missing", drift.Missing),
+					zap.Strings("stale", drift.Stale),
+					zap.Strings("joined", drift.Joined),
+					zap.Strings("reaped", drift.Reaped),
+				)
+			}
+		}
+	}
+}
+
+// Reconcile はSerfのメンバーシップとRaftの構成を比較し、差分を解消する。リーダーでない場合は ErrNotLeader を返却する。
+//
+// リーダーでないノードが受信したイベントや、リーダーの交代中に発生したイベントは処理されないため、
+// 両者は次第に食い違う。Reconcileは稼働中で参加を許可されたメンバーのうちRaftの構成に含まれないものを追加し、
+// Raftの構成に含まれるが稼働中でないサーバを除去する。グレースフルに離脱したサーバは即座に除去し、
+// 障害が発生したサーバやSerfから刈り取られたサーバは、ReapGracePeriodを超えて稼働中でない場合に除去する。
+func (m *Membership) Reconcile() (*Drift, error) {
+	servers, err := m.Servers.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	local := m.serf.LocalMember().Name
+	inRaft := make(map[string]string, len(servers))
+	leader := false
+	for _, srv := range servers {
+		inRaft[srv.Id] = srv.RpcAddr
+		if srv.Id == local && srv.IsLeader {
+			leader = true
+		}
+	}
+	if !leader {
+		return nil, raft.ErrNotLeader
+	}
+
+	m.reconcileMu.Lock()
+	defer m.reconcileMu.Unlock()
+	drift := &Drift{}
+	now := time.Now()
+	members := make(map[string]serf.Member)
+	for _, member := range m.Members() {
+		members[member.Name] = member
+		if member.Name == local || member.Status != serf.StatusAlive {
+			continue
+		}
+		if addr, ok := inRaft[member.Name]; ok && addr == member.Tags["rpc_addr"] {
+			continue
+		}
+		if m.admit(member) != nil {
+			// 参加を拒否したメンバーは差分として扱わない
+			continue
+		}
+		drift.Missing = append(drift.Missing, member.Name)
+		if err := m.handler.Join(member.Name, member.Tags["rpc_addr"]); err != nil {
+			m.logError(err, "failed to join", member)
+			continue
+		}
+		drift.Joined = append(drift.Joined, member.Name)
+		m.reconcileTotal.WithLabelValues("join").Inc()
+	}
+	for id, addr := range inRaft {
+		member, ok := members[id]
+		if id == local || (ok && (member.Status == serf.StatusAlive || member.Status == serf.StatusLeaving)) {
+			delete(m.downSince, id)
+			continue
+		}
+		drift.Stale = append(drift.Stale, id)
+		if !ok || member.Status == serf.StatusFailed {
+			since, seen := m.downSince[id]
+			if !seen {
+				m.downSince[id] = now
+				continue
+			}
+			if now.Sub(since) < m.ReapGracePeriod {
+				continue
+			}
+		}
+		if err := m.handler.Leave(id); err != nil {
+			m.logError(err, "failed to leave", serf.Member{Name: id, Tags: map[string]string{"rpc_addr": addr}})
+			continue
+		}
+		delete(m.downSince, id)
+		drift.Reaped = append(drift.Reaped, id)
+		m.reconcileTotal.WithLabelValues("reap").Inc()
+	}
+	for id := range m.downSince {
+		if _, ok := inRaft[id]; !ok {
+			// 他の経路で除去されたサーバ
+			delete(m.downSince, id)
+		}
+	}
+	sort.Strings(drift.Missing)
+	sort.Strings(drift.Stale)
+	sort.Strings(drift.Reaped)
+	m.driftGauge.WithLabelValues("missing").Set(float64(len(drift.Missing)))
+	m.driftGauge.WithLabelValues("stale").Set(float64(len(drift.Stale)))
+	return drift, nil
+}
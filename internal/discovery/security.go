@@ -0,0 +1,171 @@
+package discovery
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+)
+
+// メンバーの参加を検証するためのタグ
+const (
+	clusterIDTag = "cluster_id"
+	joinTokenTag = "join_token"
+)
+
+var (
+	errClusterMismatch  = errors.New("cluster id mismatch")
+	errInvalidJoinToken = errors.New("invalid join token")
+)
+
+// setupKeyring はゴシップを暗号化する鍵を設定する。
+//
+// KeyringFileが存在する場合は、鍵のローテーションで保存された鍵を読み込み、EncryptKeyは無視する。
+// 存在しない場合はEncryptKeyを主鍵とし、以降の鍵の変更をKeyringFileに保存する。
+func (m *Membership) setupKeyring(config *serf.Config) error {
+	var keys [][]byte
+	if m.KeyringFile != "" {
+		b, err := os.ReadFile(m.KeyringFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if keys, err = decodeKeyring(b); err != nil {
+				return fmt.Errorf("invalid keyring %s: %w", m.KeyringFile, err)
+			}
+		}
+		config.KeyringFile = m.KeyringFile
+	}
+	if keys == nil && m.EncryptKey != nil {
+		keys = [][]byte{m.EncryptKey}
+		if m.KeyringFile != "" {
+			if err := writeKeyring(m.KeyringFile, keys); err != nil {
+				return err
+			}
+		}
+	}
+	if keys == nil {
+		return nil
+	}
+	keyring, err := memberlist.NewKeyring(keys, keys[0])
+	if err != nil {
+		return err
+	}
+	config.MemberlistConfig.Keyring = keyring
+	return nil
+}
+
+// decodeKeyring はSerfがKeyringFileに保存する形式 (Base64でエンコードした鍵のJSON配列) を読み込む。
+// 先頭の鍵を主鍵とする。
+func decodeKeyring(b []byte) ([][]byte, error) {
+	var encoded []string
+	if err := json.Unmarshal(b, &encoded); err != nil {
+		return nil, err
+	}
+	if len(encoded) == 0 {
+		return nil, errors.New("no keys")
+	}
+	keys := make([][]byte, len(encoded))
+	for i, s := range encoded {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+func writeKeyring(path string, keys [][]byte) error {
+	encoded := make([]string, len(keys))
+	for i, key := range keys {
+		encoded[i] = base64.StdEncoding.EncodeToString(key)
+	}
+	b, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+// admissionTags はローカルのメンバーのタグに、クラスタIDと参加トークンを付与する。
+func (m *Membership) admissionTags() map[string]string {
+	tags := make(map[string]string, len(m.Tags)+2)
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+	if m.ClusterID != "" {
+		tags[clusterIDTag] = m.ClusterID
+	}
+	if m.JoinSecret != nil {
+		tags[joinTokenTag] = joinToken(m.JoinSecret, m.NodeName, tags["rpc_addr"], m.ClusterID)
+	}
+	return tags
+}
+
+// joinToken はノード名とRPCアドレス、クラスタIDに対する署名を返却する。
+// 他のノードのトークンを流用しても、異なるノード名やアドレスでは参加できない。
+func joinToken(secret []byte, name, rpcAddr, clusterID string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{name, rpcAddr, clusterID}, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// admit はメンバーをRaftのクラスタに参加させてよいかを検証する。
+// ClusterIDが設定されている場合はクラスタIDの一致を、JoinSecretが設定されている場合は参加トークンの署名を検証する。
+func (m *Membership) admit(member serf.Member) error {
+	if m.ClusterID != "" && member.Tags[clusterIDTag] != m.ClusterID {
+		return errClusterMismatch
+	}
+	if m.JoinSecret != nil {
+		expected := joinToken(m.JoinSecret, member.Name, member.Tags["rpc_addr"], m.ClusterID)
+		if !hmac.Equal([]byte(member.Tags[joinTokenTag]), []byte(expected)) {
+			return errInvalidJoinToken
+		}
+	}
+	return nil
+}
+
+// InstallKey はクラスタのすべてのメンバーにゴシップを暗号化する鍵を追加する。
+// 鍵のローテーションは、InstallKeyで新たな鍵を配布し、UseKeyで主鍵を切り替え、RemoveKeyで古い鍵を削除する順に行う。
+func (m *Membership) InstallKey(key string) error {
+	return keyResponseError(m.serf.KeyManager().InstallKey(key))
+}
+
+// UseKey はクラスタのすべてのメンバーで、暗号化に用いる主鍵を切り替える。
+func (m *Membership) UseKey(key string) error {
+	return keyResponseError(m.serf.KeyManager().UseKey(key))
+}
+
+// RemoveKey はクラスタのすべてのメンバーから鍵を削除する。主鍵は削除できない。
+func (m *Membership) RemoveKey(key string) error {
+	return keyResponseError(m.serf.KeyManager().RemoveKey(key))
+}
+
+// ListKeys はクラスタで用いられている鍵ごとに、その鍵を保持するメンバー数と応答したメンバー数を返却する。
+func (m *Membership) ListKeys() (map[string]int, int, error) {
+	resp, err := m.serf.KeyManager().ListKeys()
+	if err = keyResponseError(resp, err); err != nil {
+		return nil, 0, err
+	}
+	return resp.Keys, resp.NumNodes, nil
+}
+
+// keyResponseError は鍵の操作に失敗したメンバーのエラーをまとめる。
+func keyResponseError(resp *serf.KeyResponse, err error) error {
+	if resp == nil || len(resp.Messages) == 0 {
+		return err
+	}
+	msgs := make([]string, 0, len(resp.Messages))
+	for node, msg := range resp.Messages {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", node, msg))
+	}
+	return fmt.Errorf("%d/%d nodes failed: %s", resp.NumErr, resp.NumNodes, strings.Join(msgs, "; "))
+}
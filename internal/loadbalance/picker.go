@@ -1,10 +1,11 @@
 package loadbalance
 
 import (
-	"strings"
+	"math/rand"
 	"sync"
-	"sync/atomic"
+	"time"
 
+	api "github.com/ac0mz/proglog/api/v1"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
 )
@@ -12,16 +13,42 @@ import (
 var _ base.PickerBuilder = (*Picker)(nil)
 
 // Picker はRPCをバランスさせる処理 (リゾルバが発見したサーバアドレスの中から各RPCを処理するサーバを選択) を行う。
-// Consume, ConsumeStream のRPCをフォロワーサーバに、Produce, ProduceStream のRPCをリーダーサーバに送信する。
+// Consume, ConsumeStream のRPCをフォロワーサーバに、その他のRPCをリーダーサーバに送信する。
+//
+// 読み出しは稼働中かつリーダーからの遅延がMaxLag以内のフォロワーに送信し、応答時間の短いフォロワーほど多く選択する。
+// クライアントのゾーンが指定されている場合は同じゾーンのフォロワーを優先し、存在しない場合は他のゾーンのフォロワーに送信する。
+// 条件を満たすフォロワーが存在しない場合は、最新の状態を持つリーダーから読み出す。
+// 古さの上限を超えたとして読み出しを拒否したフォロワーは、StalePenaltyの間は選択しない。
 //
 //	NOTE:
 //	 ピッカーの役割として呼び出しの送信先決定を行うが、gRPCにはデフォルトのバランサ (※) があるため、今回は独自実装が不要となる。
 //	 ※サブコネクションを管理し、接続状態を収集および集約する balancer.Balancer のこと。
 type Picker struct {
+	// MaxLag は読み出しの対象とするフォロワーの、リーダーとの適用済みのインデックスの差の上限
+	MaxLag uint64
+	// StalePenalty は古さを理由に読み出しを拒否したフォロワーを選択しない期間
+	StalePenalty time.Duration
+
 	mu        sync.RWMutex
 	leader    balancer.SubConn
 	followers []balancer.SubConn
-	current   uint64
+	local     []balancer.SubConn // クライアントと同じゾーンのフォロワー
+
+	latencies latencies
+	staleMu   sync.Mutex
+	stale     map[balancer.SubConn]time.Time // 古さを理由に拒否したフォロワーと、再び選択できるようになる時刻
+}
+
+// DefaultMaxLag はMaxLagが未設定の場合の上限
+const DefaultMaxLag = 1000
+
+// DefaultStalePenalty はStalePenaltyが未設定の場合の期間
+const DefaultStalePenalty = time.Second
+
+// フォロワーから読み出すRPC
+var followerMethods = map[string]bool{
+	"/log.v1.Log/Consume":       true,
+	"/log.v1.Log/ConsumeStream": true,
 }
 
 // Build は引数のサブコネクションから取得したフォロワーの集合を設定したピッカーを生成する。
@@ -32,16 +59,49 @@ func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	var followers []balancer.SubConn
+	maxLag := p.MaxLag
+	if maxLag == 0 {
+		maxLag = DefaultMaxLag
+	}
+	var latest uint64
+	for _, scInfo := range buildInfo.ReadySCs {
+		if applied, _ := scInfo.Address.Attributes.Value(appliedIndexKey).(uint64); applied > latest {
+			latest = applied
+		}
+	}
+	p.leader = nil
+	var followers, local []balancer.SubConn
 	for sc, scInfo := range buildInfo.ReadySCs {
-		isLeader := scInfo.Address.Attributes.Value("is_leader").(bool)
+		attrs := scInfo.Address.Attributes
+		isLeader := attrs.Value(isLeaderKey).(bool)
 		if isLeader {
 			p.leader = sc
 			continue
 		}
+		// 稼働状況を報告しないリゾルバのアドレスは稼働中とみなす
+		if healthy, ok := attrs.Value(healthyKey).(bool); ok && !healthy {
+			continue
+		}
+		if applied, _ := attrs.Value(appliedIndexKey).(uint64); latest-applied > maxLag {
+			continue
+		}
 		followers = append(followers, sc)
+		zone, _ := attrs.Value(zoneKey).(string)
+		clientZone, _ := attrs.Value(clientZoneKey).(string)
+		if clientZone != "" && zone == clientZone {
+			local = append(local, sc)
+		}
 	}
 	p.followers = followers
+	p.local = local
+	p.latencies.retain(buildInfo.ReadySCs)
+	p.staleMu.Lock()
+	for sc := range p.stale {
+		if _, ok := buildInfo.ReadySCs[sc]; !ok {
+			delete(p.stale, sc)
+		}
+	}
+	p.staleMu.Unlock()
 	return p
 }
 
@@ -58,28 +118,158 @@ func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	defer p.mu.RUnlock()
 
 	var result balancer.PickResult
-	if strings.Contains(info.FullMethodName, "Produce") || len(p.followers) == 0 {
-		result.SubConn = p.leader
-	} else if strings.Contains(info.FullMethodName, "Consume") {
+	if followerMethods[info.FullMethodName] {
 		// フォロワー間でRPC呼び出しをバランスさせる
 		result.SubConn = p.nextFollower()
 	}
+	if result.SubConn == nil {
+		// 書き込みやクラスタの発見などその他のRPCはリーダーに送信する
+		result.SubConn = p.leader
+	}
 	if result.SubConn == nil {
 		return result, balancer.ErrNoSubConnAvailable
 	}
+	if followerMethods[info.FullMethodName] {
+		sc, start := result.SubConn, time.Now()
+		unary := info.FullMethodName == "/log.v1.Log/Consume"
+		result.Done = func(di balancer.DoneInfo) {
+			switch {
+			case api.IsStaleRead(di.Err):
+				p.markStale(sc)
+			case di.Err == nil && unary:
+				// ストリームの所要時間は応答時間を表さないため、単項RPCのみ計測する
+				p.latencies.observe(sc, time.Since(start))
+			}
+		}
+	}
 	return result, nil
 }
 
-// nextFollower は次のフォロワーをラウンドロビン方式で選択して返却する。
+// nextFollower は応答時間の逆数に比例する確率でフォロワーを選択して返却する。
+// 同じゾーンのフォロワーが存在する場合は、その中から選択する。
+// 古さを理由に拒否したフォロワーを除き、選択できるフォロワーが存在しない場合はnilを返却する。
 func (p *Picker) nextFollower() balancer.SubConn {
-	cur := atomic.AddUint64(&p.current, uint64(1))
-	len := uint64(len(p.followers))
-	idx := int(cur % len)
-	return p.followers[idx]
+	followers := p.fresh(p.local)
+	if len(followers) == 0 {
+		followers = p.fresh(p.followers)
+	}
+	if len(followers) == 0 {
+		return nil
+	}
+	return p.latencies.choose(followers)
+}
+
+// fresh は古さを理由に拒否してから StalePenalty が経過していないフォロワーを除いて返却する。
+func (p *Picker) fresh(scs []balancer.SubConn) []balancer.SubConn {
+	p.staleMu.Lock()
+	defer p.staleMu.Unlock()
+	if len(p.stale) == 0 {
+		return scs
+	}
+	now := time.Now()
+	var fresh []balancer.SubConn
+	for _, sc := range scs {
+		if until, ok := p.stale[sc]; ok && now.Before(until) {
+			continue
+		}
+		fresh = append(fresh, sc)
+	}
+	return fresh
+}
+
+// markStale はフォロワーを StalePenalty の間は選択しないよう記録する。
+func (p *Picker) markStale(sc balancer.SubConn) {
+	penalty := p.StalePenalty
+	if penalty == 0 {
+		penalty = DefaultStalePenalty
+	}
+	p.staleMu.Lock()
+	defer p.staleMu.Unlock()
+	if p.stale == nil {
+		p.stale = make(map[balancer.SubConn]time.Time)
+	}
+	p.stale[sc] = time.Now().Add(penalty)
+}
+
+// latencies はサブコネクションごとの応答時間の指数移動平均を保持する。
+type latencies struct {
+	mu   sync.Mutex
+	ewma map[balancer.SubConn]time.Duration
+}
+
+// 直近の応答時間を反映する割合
+const latencyDecay = 0.3
+
+func (l *latencies) observe(sc balancer.SubConn, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ewma == nil {
+		l.ewma = make(map[balancer.SubConn]time.Duration)
+	}
+	if prev, ok := l.ewma[sc]; ok {
+		d = time.Duration(latencyDecay*float64(d) + (1-latencyDecay)*float64(prev))
+	}
+	l.ewma[sc] = d
+}
+
+// retain は利用できなくなったサブコネクションの応答時間を破棄する。
+func (l *latencies) retain(ready map[balancer.SubConn]base.SubConnInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for sc := range l.ewma {
+		if _, ok := ready[sc]; !ok {
+			delete(l.ewma, sc)
+		}
+	}
+}
+
+// choose は応答時間の逆数を重みとしてサブコネクションを選択する。
+// 応答時間を計測していないサブコネクションは、計測済みのうち最短の応答時間とみなして選択の機会を与える。
+func (l *latencies) choose(scs []balancer.SubConn) balancer.SubConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var fastest time.Duration
+	for _, sc := range scs {
+		if d, ok := l.ewma[sc]; ok && (fastest == 0 || d < fastest) {
+			fastest = d
+		}
+	}
+	if fastest == 0 {
+		return scs[rand.Intn(len(scs))]
+	}
+	weights := make([]float64, len(scs))
+	var total float64
+	for i, sc := range scs {
+		d, ok := l.ewma[sc]
+		if !ok || d <= 0 {
+			d = fastest
+		}
+		weights[i] = 1 / float64(d)
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return scs[i]
+		}
+		r -= w
+	}
+	return scs[len(scs)-1]
+}
+
+// builder はクライアントコネクションごとに個別のピッカーを持つバランサを作成する。
+// ピッカーはサブコネクションと応答時間を保持するため、同じプロセスの複数のクライアントコネクションで共有すると、
+// 別のクラスタのサブコネクションを選択してしまう。
+type builder struct{}
+
+func (builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	return base.NewBalancerBuilder(Name, &Picker{}, base.Config{}).Build(cc, opts)
+}
+
+func (builder) Name() string {
+	return Name
 }
 
 func init() {
-	balancer.Register(
-		base.NewBalancerBuilder(Name, &Picker{}, base.Config{}),
-	)
+	balancer.Register(builder{})
 }
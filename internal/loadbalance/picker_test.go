@@ -2,17 +2,21 @@ package loadbalance
 
 import (
 	"testing"
+	"time"
 
+	api "github.com/ac0mz/proglog/api/v1"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
 	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
 )
 
 const (
-	methodNameProduce = "/log.vX.Log/Produce"
-	methodNameConsume = "/log.vX.Log/Consume"
+	methodNameProduce    = "/log.v1.Log/Produce"
+	methodNameConsume    = "/log.v1.Log/Consume"
+	methodNameGetServers = "/log.v1.Log/GetServers"
 )
 
 // Test_Picker_NoSubConnAvailable はリゾルバがサーバを発見し、利用可能なサブコネクションで
@@ -50,17 +54,173 @@ func Test_Picker_ProducesToLeader(t *testing.T) {
 }
 
 // Test_Picker_ConsumesFromFollowers はピッカーがConsume呼び出しのために
-// ラウンドロビンでフォロワーのサブコネクションを選択することを検証する。
+// フォロワーのサブコネクションに分散して選択し、その他の呼び出しはリーダーを選択することを検証する。
 func Test_Picker_ConsumesFromFollowers(t *testing.T) {
 	picker, subConns := setupTest(t)
 	info := balancer.PickInfo{
 		FullMethodName: methodNameConsume,
 	}
-	for i := range make([]struct{}, 5) {
+	picked := map[balancer.SubConn]bool{}
+	for range make([]struct{}, 20) {
 		gotPick, err := picker.Pick(info)
 		require.NoError(t, err)
-		require.Equal(t, subConns[i%2+1], gotPick.SubConn)
+		require.NotSame(t, subConns[0], gotPick.SubConn)
+		picked[gotPick.SubConn] = true
 	}
+	require.Equal(t, 2, len(picked))
+
+	// メソッド名の一部がConsumeに一致しても、フォロワーには送信しない
+	gotPick, err := picker.Pick(balancer.PickInfo{FullMethodName: methodNameGetServers})
+	require.NoError(t, err)
+	require.Same(t, subConns[0], gotPick.SubConn)
+}
+
+// Test_Picker_SkipsLaggingFollowers はピッカーが停止したフォロワーと遅延したフォロワーを読み出しの対象から除外し、
+// 対象のフォロワーが存在しない場合はリーダーを選択することを検証する。
+func Test_Picker_SkipsLaggingFollowers(t *testing.T) {
+	build := func(followers ...*api.Server) (*Picker, []*mockSubConn) {
+		buildInfo := base.PickerBuildInfo{
+			ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+		}
+		servers := append([]*api.Server{{IsLeader: true, AppliedIndex: 100, Healthy: true}}, followers...)
+		var subConns []*mockSubConn
+		for _, srv := range servers {
+			sc := &mockSubConn{}
+			addr := resolver.Address{
+				Attributes: attributes.New(isLeaderKey, srv.IsLeader).
+					WithValue(appliedIndexKey, srv.AppliedIndex).
+					WithValue(healthyKey, srv.Healthy),
+			}
+			buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+			subConns = append(subConns, sc)
+		}
+		picker := &Picker{MaxLag: 10}
+		picker.Build(buildInfo)
+		return picker, subConns
+	}
+	info := balancer.PickInfo{FullMethodName: methodNameConsume}
+
+	picker, subConns := build(
+		&api.Server{AppliedIndex: 95, Healthy: true},
+		&api.Server{AppliedIndex: 50, Healthy: true},
+		&api.Server{AppliedIndex: 100, Healthy: false},
+	)
+	for range make([]struct{}, 5) {
+		gotPick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Same(t, subConns[1], gotPick.SubConn)
+	}
+
+	picker, subConns = build(&api.Server{AppliedIndex: 50, Healthy: true})
+	gotPick, err := picker.Pick(info)
+	require.NoError(t, err)
+	require.Same(t, subConns[0], gotPick.SubConn)
+}
+
+// Test_Picker_WeightsByLatency はピッカーがDoneで報告された応答時間の短いフォロワーを多く選択することを検証する。
+func Test_Picker_WeightsByLatency(t *testing.T) {
+	picker, subConns := setupTest(t)
+	picker.latencies.observe(subConns[1], time.Millisecond)
+	picker.latencies.observe(subConns[2], 100*time.Millisecond)
+
+	info := balancer.PickInfo{FullMethodName: methodNameConsume}
+	counts := map[balancer.SubConn]int{}
+	for range make([]struct{}, 1000) {
+		gotPick, err := picker.Pick(info)
+		require.NoError(t, err)
+		counts[gotPick.SubConn]++
+	}
+	require.Greater(t, counts[subConns[1]], 900)
+	require.Greater(t, counts[subConns[2]], 0)
+
+	// Doneで報告された応答時間が反映される
+	gotPick, err := picker.Pick(info)
+	require.NoError(t, err)
+	require.NotNil(t, gotPick.Done)
+	gotPick.Done(balancer.DoneInfo{})
+	picker.latencies.mu.Lock()
+	defer picker.latencies.mu.Unlock()
+	require.Less(t, picker.latencies.ewma[gotPick.SubConn], 100*time.Millisecond)
+}
+
+// Test_Picker_AvoidsStaleFollowers はピッカーが古さを理由に読み出しを拒否したフォロワーを一定期間選択せず、
+// すべてのフォロワーが拒否した場合はリーダーを選択することを検証する。
+func Test_Picker_AvoidsStaleFollowers(t *testing.T) {
+	picker, subConns := setupTest(t)
+	picker.StalePenalty = 50 * time.Millisecond
+	info := balancer.PickInfo{FullMethodName: methodNameConsume}
+	staleErr := status.Convert(api.ErrStaleRead{Staleness: 2 * time.Second, MaxStaleness: time.Second}).Err()
+
+	reject := func(sc balancer.SubConn) {
+		for {
+			gotPick, err := picker.Pick(info)
+			require.NoError(t, err)
+			if gotPick.SubConn == sc {
+				gotPick.Done(balancer.DoneInfo{Err: staleErr})
+				return
+			}
+		}
+	}
+	reject(subConns[1])
+	for range make([]struct{}, 20) {
+		gotPick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Same(t, subConns[2], gotPick.SubConn)
+	}
+
+	reject(subConns[2])
+	gotPick, err := picker.Pick(info)
+	require.NoError(t, err)
+	require.Same(t, subConns[0], gotPick.SubConn)
+
+	// 期間が経過すると再びフォロワーから読み出す
+	time.Sleep(picker.StalePenalty)
+	gotPick, err = picker.Pick(info)
+	require.NoError(t, err)
+	require.NotSame(t, subConns[0], gotPick.SubConn)
+}
+
+// Test_Picker_ConsumesFromLocalZone はピッカーがConsume呼び出しのために、クライアントと同じゾーンの
+// フォロワーを優先し、存在しない場合は他のゾーンのフォロワーを選択することを検証する。
+func Test_Picker_ConsumesFromLocalZone(t *testing.T) {
+	build := func(clientZone string) (*Picker, []*mockSubConn) {
+		buildInfo := base.PickerBuildInfo{
+			ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+		}
+		var subConns []*mockSubConn
+		for i, zone := range []string{"a", "a", "b"} {
+			sc := &mockSubConn{}
+			addr := resolver.Address{
+				Attributes: attributes.New(isLeaderKey, i == 0).
+					WithValue(zoneKey, zone).
+					WithValue(clientZoneKey, clientZone),
+			}
+			buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+			subConns = append(subConns, sc)
+		}
+		picker := &Picker{}
+		picker.Build(buildInfo)
+		return picker, subConns
+	}
+	info := balancer.PickInfo{FullMethodName: methodNameConsume}
+
+	picker, subConns := build("b")
+	for range make([]struct{}, 5) {
+		gotPick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Same(t, subConns[2], gotPick.SubConn)
+	}
+
+	// 同じゾーンにフォロワーがない場合は、ゾーンをまたいでフォロワーに分散する
+	picker, subConns = build("c")
+	picked := map[balancer.SubConn]bool{}
+	for range make([]struct{}, 50) {
+		gotPick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.NotSame(t, subConns[0], gotPick.SubConn)
+		picked[gotPick.SubConn] = true
+	}
+	require.Equal(t, 2, len(picked))
 }
 
 // setupTest はモックのサブコネクションを持つテスト用ピッカーを作成する。
@@ -75,7 +235,7 @@ func setupTest(t *testing.T) (*Picker, []*mockSubConn) {
 	for i := 0; i < 3; i++ {
 		sc := &mockSubConn{}
 		addr := resolver.Address{
-			Attributes: attributes.New("is_leader", i == 0),
+			Attributes: attributes.New(isLeaderKey, i == 0),
 		}
 		// 0
 		sc.UpdateAddresses([]resolver.Address{addr})
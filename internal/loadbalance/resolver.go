@@ -3,62 +3,129 @@ package loadbalance
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	api "github.com/ac0mz/proglog/api/v1"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
 )
 
 // Resolver はgRPCの resolver.Builder インタフェースと resolver.Resolver インタフェースを実装する。
+//
+// リゾルバはサーバの WatchServers を購読し、サーバの構成や状態が変化するたびにクライアントコネクションを更新する。
+// 購読先のサーバが停止した場合は、シードのエンドポイントと発見済みのサーバを順に試して購読し直す。
+// WatchServers を提供しないサーバからは、GetServers を定期的に呼び出して解決する。
 type Resolver struct {
 	mu            sync.Mutex
 	clientConn    resolver.ClientConn // ユーザのクライアントコネクション (gRPCがリゾルバにコネクションを渡し、リゾルバが発見したサーバで更新する)
-	resolverConn  *grpc.ClientConn    // リゾルバ自身のコネクション (GetServers APIを呼び出す)
+	dialOpts      []grpc.DialOption   // リゾルバ自身のコネクション (GetServers, WatchServers APIを呼び出す) のオプション
 	serviceConfig *serviceconfig.ParseResult
+	zone          string   // クライアントが配置されたゾーン (ターゲットのクエリ zone で指定する)
+	seeds         []string // ターゲットで指定されたエンドポイント
+	discovered    []string // 直近に発見したサーバのアドレス
+	next          int      // 次に接続を試みるエンドポイントの添字
+	resolveNow    chan struct{}
+	cancel        context.CancelFunc
+	done          chan struct{}
 	logger        *zap.Logger
 }
 
+// アドレスの属性のキー
+const (
+	isLeaderKey     = "is_leader"
+	zoneKey         = "zone"          // サーバが配置されたゾーン
+	clientZoneKey   = "client_zone"   // クライアントが配置されたゾーン
+	appliedIndexKey = "applied_index" // サーバがFSMに適用済みのインデックス
+	healthyKey      = "healthy"       // サーバが稼働中であるか
+)
+
+// リゾルバの動作に関する時間
+var (
+	resolveTimeout  = 5 * time.Second  // GetServers の呼び出しのタイムアウト
+	refreshInterval = 30 * time.Second // 購読中も GetServers で解決し直す間隔
+	retryInterval   = time.Second      // 購読が失敗した後、次のエンドポイントを試すまでの待機時間
+)
+
 var _ resolver.Builder = (*Resolver)(nil)
 
+// NewResolver はリゾルバ自身のコネクションにダイヤルオプションを追加するリゾルバのビルダーを作成する。
+//
+// GetServers と WatchServers は認可の対象となるため、クライアント証明書ではなくトークンやAPIキーで認証するクライアントは
+// grpc.WithPerRPCCredentials を渡したビルダーを grpc.WithResolvers でコネクションに登録する。
+// 登録したビルダーは、init で登録したビルダーよりも優先される。
+func NewResolver(opts ...grpc.DialOption) *Resolver {
+	return &Resolver{dialOpts: opts}
+}
+
 // Build はサーバを発見できるリゾルバ構築に必要なデータと、リゾルバが発見したサーバで更新するクライアントコネクション
-// を受け取り、リゾルバが GetServers API を呼び出せるように、サーバへのクライアントコネクションを設定する。
+// を受け取り、クライアントコネクションごとにサーバの変化を購読するリゾルバを作成する。
+//
+// ターゲットのエンドポイントにはカンマ区切りで複数のサーバを指定でき、いずれかに接続できればクラスタを発見できる。
 func (r *Resolver) Build(
 	target resolver.Target,
 	cc resolver.ClientConn,
 	opts resolver.BuildOptions,
 ) (resolver.Resolver, error) {
-	r.logger = zap.L().Named("resolver")
-	r.clientConn = cc
-	var dialOpts []grpc.DialOption
+	res := &Resolver{
+		clientConn: cc,
+		dialOpts:   append([]grpc.DialOption{}, r.dialOpts...),
+		zone:       target.URL.Query().Get("zone"),
+		resolveNow: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		logger:     zap.L().Named("resolver"),
+	}
 	if opts.DialCreds != nil {
-		dialOpts = append(dialOpts, grpc.WithTransportCredentials(opts.DialCreds))
+		res.dialOpts = append(res.dialOpts, grpc.WithTransportCredentials(opts.DialCreds))
 	}
-	r.serviceConfig = r.clientConn.ParseServiceConfig(
-		fmt.Sprintf(`{ "loadBalancingConfig": [{ "%s": {} }] }`, Name),
-	)
-	var err error
+	res.serviceConfig = cc.ParseServiceConfig(fmt.Sprintf(serviceConfig, Name))
 	// WARNING:
 	//  target.Endpoint が deprecated だが、推奨の target.URL.Path を使用すると agent_test.go のテスト実行が永遠に完了しなくなる
-	r.resolverConn, err = grpc.Dial(target.Endpoint, dialOpts...)
-	if err != nil {
-		return nil, err
+	for _, endpoint := range strings.Split(target.Endpoint, ",") {
+		if endpoint != "" {
+			res.seeds = append(res.seeds, endpoint)
+		}
+	}
+	if len(res.seeds) == 0 {
+		return nil, fmt.Errorf("no endpoint in target: %q", target.Endpoint)
 	}
-	r.ResolveNow(resolver.ResolveNowOptions{})
-	return r, nil
+	var ctx context.Context
+	ctx, res.cancel = context.WithCancel(context.Background())
+	go res.run(ctx)
+	return res, nil
 }
 
 const Name = "proglog"
 
+// serviceConfig はピッカーを利用し、フォロワーが古さを理由に拒否した読み出しを他のサーバで再試行するサービス設定。
+// ピッカーは拒否したフォロワーを一定時間選択しないため、再試行は他のフォロワーかリーダーに送信される。
+const serviceConfig = `{
+	"loadBalancingConfig": [{ "%s": {} }],
+	"methodConfig": [{
+		"name": [{ "service": "log.v1.Log", "method": "Consume" }],
+		"retryPolicy": {
+			"maxAttempts": 3,
+			"initialBackoff": "0.01s",
+			"maxBackoff": "0.1s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}]
+}`
+
 // Scheme はリゾルバのスキーム識別子を返却する。
 //
 //	NOTE:
 //	 gRPC.Dial を呼び出すと、gRPCは与えられたターゲットアドレスからスキームを解析し、一致するリゾルバ (※) を探す。
 //	 ※デフォルトはDNSリゾルバ
 //	 当該システムの場合、ターゲットアドレスの形式は proglog://own-service-address のようになる。
+//	 proglog:///own-service-address?zone=us-east-1a のようにゾーンを指定すると、同じゾーンのフォロワーから読み出す。
 func (r *Resolver) Scheme() string {
 	return Name
 }
@@ -69,37 +136,161 @@ func init() {
 
 var _ resolver.Resolver = (*Resolver)(nil)
 
-// ResolveNow はターゲットを解決し、サーバを発見し、ロードバランサが選択できるサーバを知らせるために
-// サーバとのクライアントコネクションを更新する。
+// ResolveNow はサーバを発見し直すよう指示する。
+// gRPCはサブコネクションの接続に失敗した場合などに当該メソッドを呼び出すため、指示は1つにまとめて非同期に処理する。
 func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
-	// gRPCは当該メソッドを並列に呼び出す可能性があるため、ロックしてゴルーチン間のアクセスを保護
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	client := api.NewLogClient(r.resolverConn)
-	// クラスタを取得してClientConnの状態を更新する
-	ctx := context.Background()
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+// run はリゾルバが閉じられるまで、エンドポイントを順に試してサーバの変化を購読する。
+func (r *Resolver) run(ctx context.Context) {
+	defer close(r.done)
+	for {
+		endpoint := r.nextEndpoint()
+		err := r.serve(ctx, endpoint)
+		if ctx.Err() != nil {
+			return
+		}
+		r.logger.Error("failed to resolve server", zap.Error(err), zap.String("endpoint", endpoint))
+		// gRPCはエラーを受けて ResolveNow をバックオフしながら呼び出す
+		r.clientConn.ReportError(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// serve はエンドポイントに接続してサーバを解決し、接続が失敗するまでサーバの変化を購読する。
+func (r *Resolver) serve(ctx context.Context, endpoint string) error {
+	conn, err := grpc.Dial(endpoint, r.dialOpts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+	if err := r.resolve(ctx, client); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchErr := make(chan error, 1)
+	go func() { watchErr <- r.watch(ctx, client) }()
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-watchErr:
+			if err != nil {
+				return err
+			}
+			// WatchServers を提供しないサーバは定期的な解決のみとする
+			watchErr = nil
+		case <-ticker.C:
+			if err := r.resolve(ctx, client); err != nil {
+				return err
+			}
+		case <-r.resolveNow:
+			if err := r.resolve(ctx, client); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// resolve は GetServers を呼び出してクライアントコネクションを更新する。
+func (r *Resolver) resolve(ctx context.Context, client api.LogClient) error {
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
 	res, err := client.GetServers(ctx, &api.GetServersRequest{})
 	if err != nil {
-		r.logger.Error("failed to resolve server", zap.Error(err))
-		return
+		return err
+	}
+	r.update(res.Servers)
+	return nil
+}
+
+// watch は WatchServers を購読し、受信するたびにクライアントコネクションを更新する。
+// サーバが WatchServers を提供しない場合は nil を返却する。
+func (r *Resolver) watch(ctx context.Context, client api.LogClient) error {
+	stream, err := client.WatchServers(ctx, &api.WatchServersRequest{})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if status.Code(err) == codes.Unimplemented {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r.update(res.Servers)
 	}
+}
+
+// update は発見したサーバで、ロードバランサが選択できるサーバを知らせるためにクライアントコネクションを更新する。
+func (r *Resolver) update(servers []*api.Server) {
+	// 購読と定期的な解決は並行して行われるため、ロックしてゴルーチン間のアクセスを保護
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	var addrs []resolver.Address
-	for _, server := range res.Servers {
+	discovered := make([]string, 0, len(servers))
+	for _, server := range servers {
 		addrs = append(addrs, resolver.Address{
-			Addr:       server.RpcAddr,
-			Attributes: attributes.New("is_leader", server.IsLeader), // ロードバランサ用の様々なデータを含むマップ。どのサーバがリーダーorフォロワーかをピッカーに伝える
+			Addr: server.RpcAddr,
+			// ロードバランサ用の様々なデータを含むマップ。どのサーバがリーダーorフォロワーか、どのゾーンにあり、どの程度遅延しているかをピッカーに伝える
+			Attributes: attributes.New(isLeaderKey, server.IsLeader).
+				WithValue(zoneKey, server.Zone).
+				WithValue(clientZoneKey, r.zone).
+				WithValue(appliedIndexKey, server.AppliedIndex).
+				WithValue(healthyKey, server.Healthy),
 		})
+		discovered = append(discovered, server.RpcAddr)
 	}
+	r.discovered = discovered
 
-	r.clientConn.UpdateState(resolver.State{
+	if err := r.clientConn.UpdateState(resolver.State{
 		Addresses:     addrs,
 		ServiceConfig: r.serviceConfig,
-	})
+	}); err != nil {
+		r.logger.Warn("failed to update state", zap.Error(err))
+	}
 }
 
-// Close はBuildで作成したサーバへのコネクション (リゾルバ) を閉じる。
-func (r *Resolver) Close() {
-	if err := r.resolverConn.Close(); err != nil {
-		r.logger.Error("failed to close conn", zap.Error(err))
+// nextEndpoint は次に接続を試みるエンドポイントを、シードと発見済みのサーバから順に選択する。
+func (r *Resolver) nextEndpoint() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	endpoints := append([]string{}, r.seeds...)
+	for _, addr := range r.discovered {
+		if !contains(endpoints, addr) {
+			endpoints = append(endpoints, addr)
+		}
 	}
+	endpoint := endpoints[r.next%len(endpoints)]
+	r.next++
+	return endpoint
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Close はサーバの購読を停止し、サーバへのコネクションを閉じる。
+func (r *Resolver) Close() {
+	r.cancel()
+	<-r.done
 }
@@ -1,18 +1,30 @@
 package loadbalance
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/auth"
 	"github.com/ac0mz/proglog/internal/config"
 	"github.com/ac0mz/proglog/internal/server"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
 )
 
 func TestResolver(t *testing.T) {
@@ -29,8 +41,13 @@ func TestResolver(t *testing.T) {
 	})
 	require.NoError(t, err)
 	serverCreds := credentials.NewTLS(tlsConfig)
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+	servers := &mockGetServers{}
 	srv, err := server.NewGRPCServer(&server.Config{
-		GetServerer: &mockGetServers{},
+		GetServerer:   servers,
+		Authorizer:    authorizer,
+		WatchInterval: 10 * time.Millisecond,
 	}, grpc.Creds(serverCreds))
 	require.NoError(t, err)
 
@@ -50,63 +67,189 @@ func TestResolver(t *testing.T) {
 	opts := resolver.BuildOptions{DialCreds: clientCreds}
 	// テスト用リゾルバの作成
 	// リゾルバはGetServersを呼び出してサーバを解決し、サーバのアドレスでクライアントコネクションを更新する
-	r := &Resolver{}
-	_, err = r.Build(
+	// 先頭のエンドポイントには接続できないため、次のエンドポイントから解決する
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, dead.Close())
+	endpoint := dead.Addr().String() + "," + l.Addr().String()
+	r, err := (&Resolver{}).Build(
 		resolver.Target{
-			Endpoint: l.Addr().String(),
+			Endpoint: endpoint,
+			URL:      url.URL{Scheme: Name, Path: "/" + endpoint, RawQuery: "zone=b"},
 		},
 		conn,
 		opts,
 	)
+	require.NoError(t, err)
+	defer r.Close()
 
 	wantState := resolver.State{
 		Addresses: []resolver.Address{{
-			Addr:       "localhost:9001",
-			Attributes: attributes.New("is_leader", true),
+			Addr: "localhost:9001",
+			Attributes: attributes.New(isLeaderKey, true).
+				WithValue(zoneKey, "a").
+				WithValue(clientZoneKey, "b").
+				WithValue(appliedIndexKey, uint64(10)).
+				WithValue(healthyKey, true),
 		}, {
-			Addr:       "localhost:9002",
-			Attributes: attributes.New("is_leader", false),
+			Addr: "localhost:9002",
+			Attributes: attributes.New(isLeaderKey, false).
+				WithValue(zoneKey, "b").
+				WithValue(clientZoneKey, "b").
+				WithValue(appliedIndexKey, uint64(8)).
+				WithValue(healthyKey, true),
 		}},
 	}
 	// リゾルバが2つのサーバ情報を保持していることの確認 (9001番ポートをリーダーと認識)
-	require.Equal(t, wantState, conn.state)
+	require.Eventually(t, func() bool {
+		return reflect.DeepEqual(wantState.Addresses, conn.addresses())
+	}, 5*time.Second, 10*time.Millisecond)
+	// 接続できなかったエンドポイントのエラーを報告していることの確認
+	require.NotEmpty(t, conn.errors())
+
+	// サーバの変化が購読により反映されることの確認
+	servers.setLeader("localhost:9002")
+	require.Eventually(t, func() bool {
+		addrs := conn.addresses()
+		return len(addrs) == 2 && addrs[1].Attributes.Value(isLeaderKey).(bool)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// TestResolverPerRPCCredentials はクライアント証明書を持たず、APIキーのみで認証するクライアントが
+// NewResolver に渡した認証情報でクラスタを発見できることを検証する。
+func TestResolverPerRPCCredentials(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.ServerCertFile,
+		KeyFile:  config.ServerKeyFile,
+		CAFile:   config.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	digest := sha256.Sum256([]byte("root-key"))
+	keyFile := filepath.Join(t.TempDir(), "api-keys.csv")
+	require.NoError(t, os.WriteFile(keyFile, []byte("root, "+hex.EncodeToString(digest[:])+"\n"), 0644))
+	apiKeys, err := auth.NewAPIKeys(keyFile)
+	require.NoError(t, err)
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+	srv, err := server.NewGRPCServer(&server.Config{
+		GetServerer:   &mockGetServers{},
+		Authorizer:    authorizer,
+		Authenticator: auth.Chain{apiKeys, auth.CommonName{}},
+	}, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	// クライアント証明書を提示しない
+	tlsConfig, err = config.SetupTLSConfig(config.TLSConfig{
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	opts := resolver.BuildOptions{DialCreds: credentials.NewTLS(tlsConfig)}
+	target := resolver.Target{
+		Endpoint: l.Addr().String(),
+		URL:      url.URL{Scheme: Name, Path: "/" + l.Addr().String()},
+	}
 
-	conn.state.Addresses = nil
-	r.ResolveNow(resolver.ResolveNowOptions{})
-	// リゾルバがサーバ情報を保持していないことの確認
-	require.Equal(t, wantState, conn.state)
+	// 認証情報がない場合は GetServers を認可されず、サーバを発見できない
+	conn := &mockClientConn{}
+	r, err := (&Resolver{}).Build(target, conn, opts)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(conn.errors()) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, codes.PermissionDenied, status.Code(conn.errors()[0]))
+	require.Empty(t, conn.addresses())
+	r.Close()
+
+	conn = &mockClientConn{}
+	r, err = NewResolver(grpc.WithPerRPCCredentials(auth.APIKey("root-key"))).Build(target, conn, opts)
+	require.NoError(t, err)
+	defer r.Close()
+	require.Eventually(t, func() bool {
+		return len(conn.addresses()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Empty(t, conn.errors())
 }
 
 // mockGetServers は server.GetServerer インタフェースを実装する構造体。
-type mockGetServers struct{}
+type mockGetServers struct {
+	mu     sync.Mutex
+	leader string // 未設定の場合は9001番ポートのサーバをリーダーとする
+}
+
+func (m *mockGetServers) setLeader(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.leader = addr
+}
 
 // GetServers は DistributedLog.GetServers() のモック。
 // 既知のサーバ情報の集合を返却する。
 func (m *mockGetServers) GetServers() ([]*api.Server, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	leader := m.leader
+	if leader == "" {
+		leader = "localhost:9001"
+	}
 	return []*api.Server{{
-		Id:       "leader",
-		RpcAddr:  "localhost:9001",
-		IsLeader: true,
+		Id:           "leader",
+		RpcAddr:      "localhost:9001",
+		IsLeader:     leader == "localhost:9001",
+		Zone:         "a",
+		AppliedIndex: 10,
+		Healthy:      true,
 	}, {
-		Id:       "follower",
-		RpcAddr:  "localhost:9002",
-		IsLeader: false,
+		Id:           "follower",
+		RpcAddr:      "localhost:9002",
+		IsLeader:     leader == "localhost:9002",
+		Zone:         "b",
+		AppliedIndex: 8,
+		Healthy:      true,
 	}}, nil
 }
 
 // mockClientConn は resolver.ClientConn を実装する構造体。
+// リゾルバは別のゴルーチンから更新するため、ロックしてアクセスを保護する。
 type mockClientConn struct {
 	resolver.ClientConn
+	mu    sync.Mutex
 	state resolver.State
+	errs  []error
 }
 
 // UpdateState はクライアントコネクションの状態更新のみ行う。
 func (c *mockClientConn) UpdateState(state resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.state = state
 	return nil
 }
 
-func (c *mockClientConn) ReportError(error) {}
+func (c *mockClientConn) addresses() []resolver.Address {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state.Addresses
+}
+
+// ReportError はリゾルバが報告したエラーを記録する。
+func (c *mockClientConn) ReportError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, err)
+}
+
+func (c *mockClientConn) errors() []error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.errs
+}
 
 func (c *mockClientConn) NewAddress([]resolver.Address) {}
 
@@ -0,0 +1,187 @@
+package log
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// バックアップのアーカイブに含めるファイル
+const (
+	BackupMetaFile  = "backup.json" // バックアップを取得した時点のRaftの状態
+	BackupStateFile = "state.snap"  // FSMのスナップショット (ポリシーとすべてのレコード)
+)
+
+// backupVersion はバックアップの形式のバージョン
+const backupVersion = 1
+
+// keyCurrentTerm はRaftが安定ストアに現在のタームを保存するキー
+var keyCurrentTerm = []byte("CurrentTerm")
+
+// BackupMeta はバックアップを取得した時点のRaftの状態を保持する。
+type BackupMeta struct {
+	Version   int            `json:"version"`
+	Index     uint64         `json:"index"` // スナップショットに含まれる最後のRaftのインデックス
+	Term      uint64         `json:"term"`
+	Servers   []BackupServer `json:"servers"` // 取得した時点のクラスタの構成 (復元には用いない)
+	Size      int64          `json:"size"`    // BackupStateFile のバイト数
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// BackupServer はバックアップを取得した時点のクラスタを構成するサーバ。
+type BackupServer struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// Backup はログ全体の point-in-time のコピーを、tar形式のアーカイブとしてwに書き込む。
+//
+// Raftのスナップショットを作成し、その時点で適用済みのポリシーとレコード (クローズ済みのセグメントと
+// アクティブセグメントの末尾) をRaftのインデックスとタームとともに書き込む。スナップショットはFSMの状態を
+// 一括して取得するため、取得中に追加されたレコードは含まれない。
+// ログを暗号化している場合、スナップショットは暗号化されたまま書き込むため、復元には同じ鍵が必要となる。
+//
+//	NOTE:
+//	 フォロワーで取得した場合、リーダーに対して遅れている可能性がある。
+func (l *DistributedLog) Backup(w io.Writer) (*BackupMeta, error) {
+	if err := l.Snapshot(); err != nil {
+		return nil, err
+	}
+	snapshots, err := l.snapshots.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, errors.New("no snapshot to back up")
+	}
+	snapshot, rc, err := l.snapshots.Open(snapshots[0].ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	meta := &BackupMeta{
+		Version:   backupVersion,
+		Index:     snapshot.Index,
+		Term:      snapshot.Term,
+		Size:      snapshot.Size,
+		CreatedAt: time.Now().UTC(),
+	}
+	for _, srv := range snapshot.Configuration.Servers {
+		meta.Servers = append(meta.Servers, BackupServer{
+			ID:      string(srv.ID),
+			Address: string(srv.Address),
+		})
+	}
+	b, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	tw := tar.NewWriter(w)
+	if err = tw.WriteHeader(&tar.Header{
+		Name:    BackupMetaFile,
+		Mode:    0600,
+		Size:    int64(len(b)),
+		ModTime: meta.CreatedAt,
+	}); err != nil {
+		return nil, err
+	}
+	if _, err = tw.Write(b); err != nil {
+		return nil, err
+	}
+	if err = tw.WriteHeader(&tar.Header{
+		Name:    BackupStateFile,
+		Mode:    0600,
+		Size:    snapshot.Size,
+		ModTime: meta.CreatedAt,
+	}); err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(tw, rc); err != nil {
+		return nil, err
+	}
+	return meta, tw.Close()
+}
+
+// Restore はtar形式のバックアップから、新たなクラスタを開始するデータディレクトリを作成する。
+//
+// バックアップのスナップショットを、idとaddrのサーバのみを投票者とする構成でスナップショットストアに保存する。
+// 作成したディレクトリで DistributedLog を起動すると、スナップショットからオフセットを保ったまま
+// ログを復元し、ブートストラップせずに単独でリーダーとなる。他のサーバは通常どおりJoinで追加する。
+// 既存のRaftの状態を上書きしないよう、dataDirにRaftの状態が存在する場合はエラーを返却する。
+func Restore(dataDir string, backup io.Reader, id raft.ServerID, addr raft.ServerAddress) (*BackupMeta, error) {
+	raftDir := filepath.Join(dataDir, "raft")
+	if entries, err := os.ReadDir(raftDir); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("data directory already contains raft state: %s", raftDir)
+	}
+	if err := os.MkdirAll(raftDir, 0755); err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(backup)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != BackupMetaFile {
+		return nil, fmt.Errorf("unexpected file in backup: %s", hdr.Name)
+	}
+	meta := &BackupMeta{}
+	if err = json.NewDecoder(tr).Decode(meta); err != nil {
+		return nil, err
+	}
+	if meta.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version: %d", meta.Version)
+	}
+	if hdr, err = tr.Next(); err != nil {
+		return nil, err
+	}
+	if hdr.Name != BackupStateFile {
+		return nil, fmt.Errorf("unexpected file in backup: %s", hdr.Name)
+	}
+
+	// 復元したサーバがスナップショットより古いタームで選出されないよう、タームを引き継ぐ
+	stable, err := raftboltdb.NewBoltStore(filepath.Join(raftDir, "stable"))
+	if err != nil {
+		return nil, err
+	}
+	err = stable.SetUint64(keyCurrentTerm, meta.Term)
+	if cerr := stable.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := raft.NewFileSnapshotStore(raftDir, 1, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	// スナップショットのメタデータに旧形式のピアを記録するためだけに用いる
+	_, trans := raft.NewInmemTransport(addr)
+	defer trans.Close()
+	configuration := raft.Configuration{
+		Servers: []raft.Server{{Suffrage: raft.Voter, ID: id, Address: addr}},
+	}
+	sink, err := store.Create(raft.SnapshotVersionMax, meta.Index, meta.Term, configuration, meta.Index, trans)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(sink, tr); err != nil {
+		_ = sink.Cancel()
+		return nil, err
+	}
+	if err = sink.Close(); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
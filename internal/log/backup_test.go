@@ -0,0 +1,94 @@
+package log_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/log"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+// Test_BackupRestore はバックアップから新たなクラスタを開始し、オフセットを保ったままレコードを読み出せること、
+// 復元後に参加したサーバにもレコードが複製されることを検証する。
+func Test_BackupRestore(t *testing.T) {
+	ports := dynaport.Get(3)
+	src := startNode(t, "src", ports[0], t.TempDir(), true)
+	for i := 0; i < 3; i++ {
+		off, err := src.Append(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	var backup bytes.Buffer
+	meta, err := src.Backup(&backup)
+	require.NoError(t, err)
+	require.NotZero(t, meta.Index)
+	require.Equal(t, "src", meta.Servers[0].ID)
+	require.NoError(t, src.Close())
+
+	dir := t.TempDir()
+	addr := fmt.Sprintf("127.0.0.1:%d", ports[1])
+	restored, err := log.Restore(dir, bytes.NewReader(backup.Bytes()), "restored", raft.ServerAddress(addr))
+	require.NoError(t, err)
+	require.Equal(t, meta.Index, restored.Index)
+	// 復元したディレクトリを上書きしない
+	_, err = log.Restore(dir, bytes.NewReader(backup.Bytes()), "restored", raft.ServerAddress(addr))
+	require.Error(t, err)
+
+	// ブートストラップの指定に関わらず、スナップショットの構成で単独のリーダーとなる
+	leader := startNode(t, "restored", ports[1], dir, true)
+	require.NoError(t, leader.WaitForLeader(3*time.Second))
+	for i := 0; i < 3; i++ {
+		record, err := leader.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record-%d", i), string(record.Value))
+	}
+	off, err := leader.Append(&api.Record{Value: []byte("record-3")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	follower := startNode(t, "follower", ports[2], t.TempDir(), false)
+	require.NoError(t, leader.Join("follower", fmt.Sprintf("127.0.0.1:%d", ports[2])))
+	off, err = leader.Append(&api.Record{Value: []byte("record-4")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		for i := uint64(0); i <= off; i++ {
+			record, err := follower.Read(i)
+			if err != nil || string(record.Value) != fmt.Sprintf("record-%d", i) {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// startNode はRaftのタイムアウトを短く設定したサーバを起動する。サーバはテストの終了時に停止する。
+func startNode(t *testing.T, id string, port int, dir string, bootstrap bool) *log.DistributedLog {
+	t.Helper()
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+
+	config := log.Config{}
+	config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = raft.ServerID(id)
+	config.Raft.HeartbeatTimeout = 100 * time.Millisecond
+	config.Raft.ElectionTimeout = 100 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 100 * time.Millisecond
+	config.Raft.CommitTimeout = 50 * time.Millisecond
+	config.Raft.BindAddr = ln.Addr().String()
+	config.Raft.Bootstrap = bootstrap
+
+	l, err := log.NewDistributedLog(dir, config)
+	require.NoError(t, err)
+	if bootstrap {
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+	}
+	// 停止済みのサーバを再び停止した場合のエラーは無視する
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
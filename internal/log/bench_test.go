@@ -0,0 +1,160 @@
+package log
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// ベンチマークのデータ
+const (
+	benchRecords     = 10000 // 事前に書き込むレコード数
+	benchRecordBytes = 256   // レコードの値のバイト数
+)
+
+var benchValue = make([]byte, benchRecordBytes)
+
+// setupBenchStore は benchRecords 件のレコードを書き込んだストアと、各レコードの位置を返却する。
+func setupBenchStore(b *testing.B) (*store, []uint64) {
+	b.Helper()
+	f, err := os.Create(filepath.Join(b.TempDir(), "bench.store"))
+	require.NoError(b, err)
+	s, err := newStore(f)
+	require.NoError(b, err)
+	b.Cleanup(func() { s.Close() })
+	positions := make([]uint64, benchRecords)
+	for i := range positions {
+		_, positions[i], err = s.Append(benchValue)
+		require.NoError(b, err)
+	}
+	return s, positions
+}
+
+// setupBenchLog は benchRecords 件のレコードを、複数のセグメントに分けて書き込んだログを返却する。
+func setupBenchLog(b *testing.B) *Log {
+	b.Helper()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 256 * 1024
+	c.Segment.MaxIndexBytes = 1024 * entWidth
+	log, err := NewLog(b.TempDir(), c)
+	require.NoError(b, err)
+	b.Cleanup(func() { log.Close() })
+	for i := 0; i < benchRecords; i++ {
+		_, err := log.Append(&api.Record{Value: benchValue})
+		require.NoError(b, err)
+	}
+	return log
+}
+
+func BenchmarkStoreAppend(b *testing.B) {
+	f, err := os.Create(filepath.Join(b.TempDir(), "bench.store"))
+	require.NoError(b, err)
+	s, err := newStore(f)
+	require.NoError(b, err)
+	defer s.Close()
+	b.SetBytes(benchRecordBytes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := s.Append(benchValue); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkStoreRead は複数の読み出しが並行してストアのランダムな位置のレコードを読み出す。
+// active は書き込み中のストア、sealed はメモリにマップしたクローズ済みのストアから読み出す。
+func BenchmarkStoreRead(b *testing.B) {
+	for _, sealed := range []bool{false, true} {
+		name := "active"
+		if sealed {
+			name = "sealed"
+		}
+		b.Run(name, func(b *testing.B) {
+			s, positions := setupBenchStore(b)
+			if sealed {
+				require.NoError(b, s.seal())
+			}
+			b.SetBytes(benchRecordBytes)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					if _, err := s.Read(positions[r.Intn(len(positions))]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkStoreReadWhileAppending は書き込みと並行して、複数の読み出しがストアのレコードを読み出す。
+func BenchmarkStoreReadWhileAppending(b *testing.B) {
+	s, positions := setupBenchStore(b)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, _, err := s.Append(benchValue); err != nil {
+				panic(err)
+			}
+		}
+	}()
+	b.SetBytes(benchRecordBytes)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if _, err := s.Read(positions[r.Intn(len(positions))]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+}
+
+// BenchmarkLogRead は複数の読み出しが並行して、ログのランダムなオフセットのレコードを読み出す。
+func BenchmarkLogRead(b *testing.B) {
+	log := setupBenchLog(b)
+	b.SetBytes(benchRecordBytes)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if _, err := log.Read(uint64(r.Intn(benchRecords))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkIterator はログの先頭から順にレコードを読み出す。
+func BenchmarkIterator(b *testing.B) {
+	log := setupBenchLog(b)
+	b.SetBytes(benchRecordBytes)
+	b.ResetTimer()
+	var it *Iterator
+	for i := 0; i < b.N; i++ {
+		if i%benchRecords == 0 {
+			it = log.Iterator(0)
+		}
+		if _, err := it.Next(); err != nil {
+			b.Fatal(fmt.Sprintf("offset %d: %v", i%benchRecords, err))
+		}
+	}
+}
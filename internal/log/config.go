@@ -1,19 +1,54 @@
 package log
 
 import (
+	"time"
+
 	"github.com/hashicorp/raft"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Config struct {
+	// TracerProvider はRaft経由で複製されたコマンドをFSMに適用する際のスパンを作成する。
+	// 未設定の場合はグローバルなTracerProviderを利用する。
+	TracerProvider trace.TracerProvider
+	// PolicyHandler はRaftにより複製されたACLのポリシーを受け取る。
+	// 未設定の場合、ポリシーはFSMで保持するのみとする。
+	PolicyHandler PolicyHandler
+	// Keyring は新たなセグメントのレコードとスナップショットを暗号化する鍵を保持する。
+	// 未設定の場合は暗号化しない。
+	Keyring *Keyring
+
 	Raft struct {
 		raft.Config
-		BindAddr    string
-		StreamLayer *StreamLayer
+		BindAddr string
+		// StreamLayer はサーバ間のコネクションを提供する。通常は NewStreamLayer で作成し、
+		// テストでは障害を注入するストリームレイヤで包むことができる。
+		StreamLayer raft.StreamLayer
 		Bootstrap   bool
+		// 以下、サーバ間のトランスポートの設定
+		MaxPool          int           // ピアごとにプールするコネクション数 (未設定の場合は5)
+		TransportTimeout time.Duration // RPCの入出力のタイムアウト (未設定の場合は10秒)
+		Multiplex        bool          // ピアとのコネクションを1つにまとめ、RPCごとのストリームを多重化する
 	}
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// IndexIntervalBytes はインデックスのエントリを書き込むストアの間隔 (バイト数) である。
+		// エントリのないレコードは直前のエントリから順にたどって読み出す。
+		// 0の場合はレコードごとに書き込む (密なインデックス)。
+		IndexIntervalBytes uint64
+	}
+	// Tier はクローズ済みのセグメントを外部のストレージに移す階層化の設定である。
+	Tier struct {
+		// Storage はセグメントを移す外部のストレージである。未設定の場合は階層化しない。
+		Storage RemoteStorage
+		// Prefix はオブジェクトの名前の接頭辞である。同じストレージを共有するログごとに異なる値とする。
+		// スナップショットに含めるため、1024バイトまでとする。
+		Prefix string
+		// LocalSegments は外部に移さずローカルに残すクローズ済みのセグメント数である。
+		LocalSegments int
+		// CacheSegments は読み出しのために外部から取得して保持するセグメント数である。未設定の場合は4とする。
+		CacheSegments int
 	}
 }
@@ -2,31 +2,55 @@ package log
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"net"
+	"math"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/tracing"
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/proto"
 )
 
 // DistributedLog は分散ログサーバが保持するログ情報を管理する。
 type DistributedLog struct {
-	config  Config
-	log     *Log      // 単一サーバでの複製を行わないログ
-	raftLog *logStore // raftで作成した分散複製ログ
-	raft    *raft.Raft
+	config    Config
+	log       *Log      // 単一サーバでの複製を行わないログ
+	raftLog   *logStore // raftで作成した分散複製ログ
+	stable    *raftboltdb.BoltStore
+	snapshots *raft.FileSnapshotStore
+	raft      *raft.Raft
+	fsm       *fsm
+	caughtUp  atomic.Int64 // 受信済みのエントリをすべて適用していた時点での、リーダーからの最後の連絡時刻(UnixNano)
+
+	applyLatency       prometheus.Histogram     // Raftによる複製からFSMへの適用までのレイテンシ
+	replicationLatency *prometheus.HistogramVec // リーダーからフォロワーへのAppendEntriesのピアごとのレイテンシ
 }
 
 func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
 	l := &DistributedLog{
 		config: config,
+		applyLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "proglog_raft_apply_duration_seconds",
+			Help:    "Latency of replicating a command through Raft and applying it to the FSM.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		replicationLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proglog_raft_replication_duration_seconds",
+			Help:    "Latency of AppendEntries RPCs from the leader to each follower.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"peer"}),
 	}
 	if err := l.setupLog(dataDir); err != nil {
 		return nil, err
@@ -59,7 +83,16 @@ func (l *DistributedLog) setupLog(dataDir string) error {
 //     必要なときに効率的にデータを復旧する
 //   - 他のRaftサーバと接続するために使うネットワークトランスポート
 func (l *DistributedLog) setupRaft(dataDir string) (err error) {
-	fsm := &fsm{log: l.log}
+	tp := l.config.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	l.fsm = &fsm{
+		log:      l.log,
+		tracer:   tp.Tracer("github.com/ac0mz/proglog/internal/log"),
+		policies: newPolicySet(),
+		handler:  l.config.PolicyHandler,
+	}
 
 	logDir := filepath.Join(dataDir, "raft", "log")
 	if err = os.MkdirAll(logDir, 0755); err != nil {
@@ -67,6 +100,7 @@ func (l *DistributedLog) setupRaft(dataDir string) (err error) {
 	}
 	logConfig := l.config
 	logConfig.Segment.InitialOffset = 1 // raftの要件に従い、初期オフセットを1に設定
+	logConfig.Tier.Storage = nil        // Raftのログはスナップショット後に切り詰めるため、外部に移さない
 	l.raftLog, err = newLogStore(logDir, logConfig)
 	if err != nil {
 		return err
@@ -78,6 +112,7 @@ func (l *DistributedLog) setupRaft(dataDir string) (err error) {
 	if err != nil {
 		return err
 	}
+	l.stable = stableStore
 
 	retain := 1 // 1つのスナップショットを保持する
 	snapshotStore, err := raft.NewFileSnapshotStore(
@@ -88,15 +123,28 @@ func (l *DistributedLog) setupRaft(dataDir string) (err error) {
 	if err != nil {
 		return err
 	}
+	l.snapshots = snapshotStore
 
-	maxPool := 5
-	timeout := 10 * time.Second
-	transport := raft.NewNetworkTransport(
-		l.config.Raft.StreamLayer,
-		maxPool,
-		timeout,
-		os.Stderr,
-	)
+	maxPool := l.config.Raft.MaxPool
+	if maxPool == 0 {
+		maxPool = 5
+	}
+	timeout := l.config.Raft.TransportTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	if stream, ok := l.config.Raft.StreamLayer.(*StreamLayer); ok {
+		stream.multiplex = l.config.Raft.Multiplex
+	}
+	transport := &replicationTransport{
+		Transport: raft.NewNetworkTransport(
+			l.config.Raft.StreamLayer,
+			maxPool,
+			timeout,
+			os.Stderr,
+		),
+		latency: l.replicationLatency,
+	}
 
 	config := raft.DefaultConfig()
 	config.LocalID = l.config.Raft.LocalID // サーバの一意なIDで設定必須
@@ -116,7 +164,7 @@ func (l *DistributedLog) setupRaft(dataDir string) (err error) {
 
 	l.raft, err = raft.NewRaft(
 		config,
-		fsm,
+		l.fsm,
 		l.raftLog,
 		stableStore,
 		snapshotStore,
@@ -147,7 +195,14 @@ func (l *DistributedLog) setupRaft(dataDir string) (err error) {
 
 // Append はログにレコードを追加する。
 func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	return l.AppendContext(context.Background(), record)
+}
+
+// AppendContext はログにレコードを追加する。
+// コンテキストのトレース情報はRaftのログエントリを経由してFSMまで引き継がれる。
+func (l *DistributedLog) AppendContext(ctx context.Context, record *api.Record) (uint64, error) {
 	res, err := l.apply(
+		ctx,
 		AppendRequestType,
 		&api.ProduceRequest{Record: record},
 	)
@@ -157,11 +212,30 @@ func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
 	return res.(*api.ProduceResponse).Offset, nil
 }
 
+// AppendAtContext はレコードをオフセットoffに書き込む。
+// 次のオフセットの確認と書き込みはFSMで行うため、他の書き込みと競合しても指定と異なるオフセットには書き込まない。
+// 一致しない場合は api.ErrOffsetMismatch を返却する。
+func (l *DistributedLog) AppendAtContext(ctx context.Context, record *api.Record, off uint64) (uint64, error) {
+	res, err := l.apply(
+		ctx,
+		AppendRequestType,
+		&api.ProduceRequest{Record: record, Offset: &off},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
 // apply はRaftのAPIにリクエストを適用し、そのレスポンスを返却する。
 func (l *DistributedLog) apply(
+	ctx context.Context,
 	reqType RequestType,
 	req proto.Message,
 ) (interface{}, error) {
+	ctx, span := tracing.Start(ctx, "DistributedLog.apply")
+	defer span.End()
+
 	var buf bytes.Buffer // Raftが複製するレコードのデータ
 
 	if _, err := buf.Write([]byte{byte(reqType)}); err != nil {
@@ -176,16 +250,25 @@ func (l *DistributedLog) apply(
 	}
 
 	timeout := 10 * time.Second
-	future := l.raft.Apply(buf.Bytes(), timeout) // レコードを複製し、リーダーのログにレコード追加
+	start := time.Now()
+	// レコードを複製し、リーダーのログにレコード追加
+	// トレース情報はコマンドのデータとは別に、ミドルウェア用の拡張領域で引き渡す
+	future := l.raft.ApplyLog(raft.Log{
+		Data:       buf.Bytes(),
+		Extensions: tracing.Inject(ctx),
+	}, timeout)
 	// 結果（エラーか正常終了か）が分かるまで待機
 	// ※エラーのパターンは、Raftが処理するコマンドに時間が掛かっている場合、サーバがシャットダウンした場合
-	if future.Error() != nil {
+	if err := future.Error(); err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
+	l.applyLatency.Observe(time.Since(start).Seconds())
 	// FSMのApplyメソッドの結果を返却
 	res := future.Response()
 	// Raftは単一の値を返却するため、型アサーションで検査
 	if err, ok := res.(error); ok {
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
 	return res, nil
@@ -201,6 +284,12 @@ func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
 	return l.log.Read(offset)
 }
 
+// Iterator はサーバのログからオフセットの順にレコードを読み出すイテレータを返却する。
+// Read と同じく、Raftを経由せずに読み出す。
+func (l *DistributedLog) Iterator(offset uint64) *Iterator {
+	return l.log.Iterator(offset)
+}
+
 // Join はRaftクラスタにサーバを追加する。（すべてのサーバは投票者として追加される）
 //
 //	NOTE:
@@ -258,12 +347,62 @@ func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
 	}
 }
 
-// Close はRaftインスタンスをシャットダウンし、Raftのログストア及びローカルのログを閉じる。
+// State はRaftにおける当該サーバの役割と、FSMに適用済みのインデックスを返却する。
+func (l *DistributedLog) State() (state raft.RaftState, applied uint64) {
+	return l.raft.State(), l.raft.AppliedIndex()
+}
+
+// Staleness はローカルのログから読み出すレコードが、リーダーに対してどれだけ古い可能性があるかを返却する。
+//
+// リーダーは最新の状態を持つため0を返却する。フォロワーは受信済みのエントリをすべて適用していれば、
+// リーダーから最後に連絡を受けてからの経過時間を返却する。適用中のエントリがある場合は、
+// 最後にすべてを適用していた時点での連絡からの経過時間を返却する。
+// リーダーを認識していない場合や、まだ一度も追いついていない場合は、古さを見積もれないため上限の値を返却する。
+func (l *DistributedLog) Staleness() time.Duration {
+	if l.raft.State() == raft.Leader {
+		return 0
+	}
+	last := l.raft.LastContact()
+	if l.raft.Leader() == "" || last.IsZero() {
+		return math.MaxInt64
+	}
+	// 連絡時刻を先に取得しているため、この時点で追いついていれば連絡時点でコミット済みのエントリは適用されている
+	if l.raft.AppliedIndex() >= l.raft.LastIndex() {
+		l.caughtUp.Store(last.UnixNano())
+		return time.Since(last)
+	}
+	if caughtUp := l.caughtUp.Load(); caughtUp != 0 {
+		return time.Since(time.Unix(0, caughtUp))
+	}
+	return math.MaxInt64
+}
+
+// Snapshot はローカルのログとRaftのログをストレージに同期し、Raftのスナップショットを作成する。
+// 前回のスナップショット以降に適用されたログがない場合は何もしない。
+func (l *DistributedLog) Snapshot() error {
+	if err := l.log.Sync(); err != nil {
+		return err
+	}
+	if err := l.raftLog.Sync(); err != nil {
+		return err
+	}
+	err := l.raft.Snapshot().Error()
+	if errors.Is(err, raft.ErrNothingNewToSnapshot) {
+		return nil
+	}
+	return err
+}
+
+// Close はRaftインスタンスをシャットダウンし、Raftの安定ストアとログストア及びローカルのログを閉じる。
+// 安定ストアのファイルロックを解放するため、同じプロセス内で同じデータディレクトリから再作成できる。
 func (l *DistributedLog) Close() error {
 	f := l.raft.Shutdown()
 	if err := f.Error(); err != nil {
 		return err
 	}
+	if err := l.stable.Close(); err != nil {
+		return err
+	}
 	if err := l.raftLog.Log.Close(); err != nil {
 		return nil
 	}
@@ -288,6 +427,8 @@ func (l *DistributedLog) GetServers() ([]*api.Server, error) {
 			Id:       string(server.ID),
 			RpcAddr:  string(server.Address),
 			IsLeader: l.raft.Leader() == server.Address,
+			// Raftの構成からは稼働状況が分からないため稼働中とみなす
+			Healthy: true,
 		})
 	}
 	return servers, nil
@@ -297,34 +438,56 @@ var _ raft.FSM = (*fsm)(nil)
 
 // fsm は有限ステートマシン (finite-state machine) として操作する対象のログを管理する。
 type fsm struct {
-	log *Log
+	log    *Log
+	tracer trace.Tracer
+
+	policies *policySet    // Raftにより複製されたACLのポリシー
+	handler  PolicyHandler // ポリシーの変更を通知する先 (nilの場合は通知しない)
 }
 
 type RequestType uint8
 
 const (
-	AppendRequestType RequestType = 0
+	AppendRequestType       RequestType = 0
+	AddPolicyRequestType    RequestType = 1
+	RemovePolicyRequestType RequestType = 2
 )
 
 // Apply はログエントリをコミット後にRaftから呼び出される。
 func (f *fsm) Apply(record *raft.Log) interface{} {
+	// リーダーがコマンドに埋め込んだトレース情報が存在する場合のみ、そのトレースの子スパンを記録
+	ctx := tracing.Extract(context.Background(), record.Extensions)
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		var span trace.Span
+		ctx, span = f.tracer.Start(ctx, "fsm.Apply")
+		defer span.End()
+	}
+
 	buf := record.Data
 	reqType := RequestType(buf[0])
 	// リクエスト種別でどのコマンドを実行する (ロジックを含む対応メソッドを呼び出す) かを切り分け
 	switch reqType {
 	case AppendRequestType:
-		return f.applyAppend(buf[1:])
+		return f.applyAppend(ctx, buf[1:])
+	case AddPolicyRequestType, RemovePolicyRequestType:
+		return f.applyPolicy(reqType, buf[1:])
 	}
 	return nil
 }
 
-// applyAppend はローカルのログにレコードを追加する。
-func (f *fsm) applyAppend(b []byte) interface{} {
+// applyAppend はローカルのログにレコードを追加する。オフセットが指定された場合はそのオフセットに書き込む。
+func (f *fsm) applyAppend(ctx context.Context, b []byte) interface{} {
 	var req api.ProduceRequest
 	if err := proto.Unmarshal(b, &req); err != nil {
 		return err
 	}
-	offset, err := f.log.Append(req.Record)
+	var offset uint64
+	var err error
+	if req.Offset != nil {
+		offset, err = f.log.AppendAtContext(ctx, req.Record, *req.Offset)
+	} else {
+		offset, err = f.log.AppendContext(ctx, req.Record)
+	}
 	if err != nil {
 		return err
 	}
@@ -341,7 +504,19 @@ func (f *fsm) applyAppend(b []byte) interface{} {
 //   - 1つはRaftがすでに適用したコマンドのログを保存しないよう、Raftのログをコンパクトにする
 //   - リーダーがログ全体を何度も複製させずに、Raftが新規でサーバを起動できるようにする
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	r := f.log.Reader()
+	// ポリシーはログのレコードより前に、目印となるフレームで区別して保存する
+	p, err := f.policies.frame()
+	if err != nil {
+		return nil, err
+	}
+	// Persist はレコードの適用と並行して呼び出されるため、この時点までのレコードに限る
+	// 外部に移したセグメントはレコードを含めず、同じストレージを共有するサーバが付け直せるよう参照のみを含める
+	r := io.MultiReader(bytes.NewReader(p), f.log.recordsReader())
+	if keyring := f.log.Config.Keyring; keyring != nil {
+		// セグメントは復号して読み出すため、スナップショット全体を改めて暗号化する
+		id, aead := keyring.Active()
+		r = newSnapshotEncrypter(r, id, aead)
+	}
 	return &snapshot{reader: r}, nil
 }
 
@@ -372,16 +547,41 @@ func (s *snapshot) Release() {}
 //	NOTE:
 //	 あるサーバが失われた後に新たなサーバを追加した場合、失ったサーバのFSMを復元する状況において
 //	 FSMの状態がリーダーの複製された状態と一致するよう、既存の状態を破棄する必要がある。
-func (f *fsm) Restore(snapshot io.ReadCloser) error {
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	snapshot, err := snapshotReader(rc, f.log.Config.Keyring)
+	if err != nil {
+		return err
+	}
 	b := make([]byte, lenWidth)
 	var buf bytes.Buffer
-	for i := 0; ; i++ {
+	var policies []*api.Policy
+	reset := false // 既存の状態を破棄したか
+	for {
 		_, err := io.ReadFull(snapshot, b)
 		if err == io.EOF {
 			break // すべて読み出し終えたらループを抜ける
 		} else if err != nil {
 			return err
 		}
+		switch enc.Uint64(b) {
+		case policyFrameMarker:
+			// ポリシーのフレームはログのレコードとして数えない
+			if policies, err = readPolicyFrame(snapshot); err != nil {
+				return err
+			}
+			continue
+		case remoteFrameMarker:
+			// 外部に移したセグメントは参照のみを含むため、付け直した後にその続きのレコードを追加する
+			refs, err := readRemoteFrame(snapshot)
+			if err != nil {
+				return err
+			}
+			if err = f.log.restoreRemote(refs); err != nil {
+				return err
+			}
+			reset = true
+			continue
+		}
 		size := int64(enc.Uint64(b))
 		if _, err = io.CopyN(&buf, snapshot, size); err != nil {
 			return err
@@ -392,20 +592,29 @@ func (f *fsm) Restore(snapshot io.ReadCloser) error {
 		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
 			return err
 		}
-		if i == 0 {
+		if !reset {
 			// 1件目のレコードの場合、初期オフセットとしてレコードのオフセットを設定し、
 			// 既存の状態を破棄 (初期オフセットを用いて新規セグメントを作成)
 			f.log.Config.Segment.InitialOffset = record.Offset
 			if err := f.log.Reset(); err != nil {
 				return err
 			}
+			reset = true
 		}
 		if _, err = f.log.Append(record); err != nil {
 			return err
 		}
 		buf.Reset()
 	}
-	return nil
+	if !reset {
+		// レコードも外部のセグメントも含まないスナップショットの場合も、既存の状態を破棄する
+		if err := f.log.Reset(); err != nil {
+			return err
+		}
+	}
+	// ポリシーを含まない以前の形式のスナップショットの場合、複製されたポリシーは空となる
+	f.policies.replace(policies)
+	return f.notifyPolicies()
 }
 
 var _ raft.LogStore = (*logStore)(nil)
@@ -433,8 +642,12 @@ func (l *logStore) LastIndex() (uint64, error) {
 }
 
 // GetLog はRaftから呼び出され、indexを元にレコードを取得し、outに値を設定する。
+// レコードが存在しない場合、Raftがスナップショットの送信に切り替えられるよう raft.ErrLogNotFound を返却する。
 func (l *logStore) GetLog(index uint64, out *raft.Log) error {
 	in, err := l.Read(index)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		return raft.ErrLogNotFound
+	}
 	if err != nil {
 		return err
 	}
@@ -452,6 +665,11 @@ func (l *logStore) StoreLog(record *raft.Log) error {
 
 // StoreLogs はRaftから呼び出され、ログにレコードを追加する。
 func (l *logStore) StoreLogs(records []*raft.Log) error {
+	if len(records) > 0 {
+		if err := l.alignTo(records[0].Index); err != nil {
+			return err
+		}
+	}
 	for _, record := range records {
 		if _, err := l.Append(&api.Record{
 			Value: record.Data,
@@ -464,86 +682,48 @@ func (l *logStore) StoreLogs(records []*raft.Log) error {
 	return nil
 }
 
-// DeleteRange は古いレコードを削除する。
-//
-//	NOTE:
-//	 本来DeleteRangeメソッドはオフセット間のレコードを削除する。
-//	 古いレコードやスナップショットに保存されているレコードを削除するためにRaftから呼び出される。
-func (l *logStore) DeleteRange(min, max uint64) error {
-	return l.Truncate(max)
-}
-
-var _ raft.StreamLayer = (*StreamLayer)(nil)
-
-// StreamLayer はRaftサーバと接続するにあたって低レベルなストリーム抽象化を提供するための、
-// トランスポートのStreamLayerインタフェースを満たすメソッドを実装する。
-type StreamLayer struct {
-	ln              net.Listener
-	serverTLSConfig *tls.Config // サーバ間の暗号化通信における受信コネクションを受け入れるためのTLS設定
-	peerTLSConfig   *tls.Config // サーバ間の暗号化通信における送信コネクションを作成するためのTLS設定
-}
-
-func NewStreamLayer(ln net.Listener, serverTLSConfig, peerTLSConfig *tls.Config) *StreamLayer {
-	return &StreamLayer{
-		ln:              ln,
-		serverTLSConfig: serverTLSConfig,
-		peerTLSConfig:   peerTLSConfig,
-	}
-}
-
-const RaftRPC = 1
-
-// Dial はRaftクラスタ内における他サーバへの新たな発信コネクションを作成する。
-//
-//	NOTE:
-//	 サーバ接続の際、コネクション種別を識別するためにRaftRPCバイトを書き込み、
-//	 ログのgRPCリクエストと同じポートでRaftを多重化できる。
-//	 ストリームレイヤをピアTLSで設定することで、TLSクライアント側の接続が行われる。
-func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
-	dialer := &net.Dialer{Timeout: timeout}
-	conn, err := dialer.Dial("tcp", string(addr))
+// alignTo はログが空の場合に、indexから追加を開始するようログを作り直す。
+// バックアップから復元したサーバや、スナップショットを受け取ったサーバのログは空のまま
+// スナップショットの次のインデックスから追加されるため、オフセットをRaftのインデックスに揃える。
+func (l *logStore) alignTo(index uint64) error {
+	lowest, err := l.LowestOffset()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// Raft RPC であることを特定する
-	_, err = conn.Write([]byte{byte(RaftRPC)})
+	highest, err := l.HighestOffset()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if s.peerTLSConfig != nil {
-		conn = tls.Client(conn, s.peerTLSConfig)
+	if highest+1 != lowest || lowest == index {
+		return nil
 	}
-	return conn, nil
+	l.Config.Segment.InitialOffset = index
+	return l.Reset()
 }
 
-// Accept はDialメソッドに対応し、入ってくるコネクションを受け入れ、
-// コネクション種別を識別するバイトを読み出し、サーバ側のTLS接続を作成する。
-func (s *StreamLayer) Accept() (net.Conn, error) {
-	conn, err := s.ln.Accept()
+// DeleteRange はRaftから呼び出され、minからmaxまでのレコードを削除する。
+//
+//	NOTE:
+//	 Raftは次の2つの場合に呼び出す。
+//	 - スナップショットに保存したレコードを削除する場合は、最古のレコードからの範囲を指定する。
+//	   この場合はmax以前のレコードのみからなるセグメントを削除する (セグメントの途中のレコードは残る)。
+//	 - リーダーの交代によりフォロワーのログの末尾が新たなリーダーのログと矛盾する場合は、最新のレコードまでの範囲を指定する。
+//	   この場合はmin以降のレコードをすべて削除し、新たなリーダーのレコードをminから書き込めるようにする。
+//	 ログの途中の範囲の削除には対応しない。
+func (l *logStore) DeleteRange(min, max uint64) error {
+	first, err := l.LowestOffset()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	b := make([]byte, 1)
-	_, err = conn.Read(b)
+	last, err := l.HighestOffset()
 	if err != nil {
-		return nil, err
-	}
-
-	if !bytes.Equal([]byte{byte(RaftRPC)}, b) {
-		return nil, fmt.Errorf("not a raft rpc")
+		return err
 	}
-	if s.serverTLSConfig != nil {
-		return tls.Server(conn, s.serverTLSConfig), nil
+	switch {
+	case min <= first:
+		return l.Truncate(max)
+	case max >= last:
+		return l.TruncateSuffix(min)
 	}
-	return conn, nil
-}
-
-// Close はリスナーをクローズする。
-func (s *StreamLayer) Close() error {
-	return s.ln.Close()
-}
-
-// Addr はリスナーのアドレスを返却する。
-func (s *StreamLayer) Addr() net.Addr {
-	return s.ln.Addr()
+	return fmt.Errorf("cannot delete range %d-%d in the middle of the log %d-%d", min, max, first, last)
 }
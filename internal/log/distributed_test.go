@@ -1,18 +1,23 @@
 package log_test
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	api "github.com/ac0mz/proglog/api/v1"
 	"github.com/ac0mz/proglog/internal/log"
 	"github.com/hashicorp/raft"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // Test_MultipleNodes は分散ログの検証を行う。
@@ -21,7 +26,10 @@ import (
 func Test_MultipleNodes(t *testing.T) {
 	var logs []*log.DistributedLog
 	nodeCount := 3
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
 	ports := dynaport.Get(nodeCount)
+	var handlers []*policyHandler
 
 	// 3つのサーバから構成されるクラスタを設定
 	for i := 0; i < nodeCount; i++ {
@@ -43,6 +51,10 @@ func Test_MultipleNodes(t *testing.T) {
 		config.Raft.LeaderLeaseTimeout = 100 * time.Millisecond
 		config.Raft.CommitTimeout = 50 * time.Millisecond
 		config.Raft.BindAddr = ln.Addr().String()
+		config.TracerProvider = tp
+		handler := &policyHandler{}
+		handlers = append(handlers, handler)
+		config.PolicyHandler = handler
 
 		if i == 0 {
 			// クラスタをブートストラップしてリーダになる
@@ -90,6 +102,59 @@ func Test_MultipleNodes(t *testing.T) {
 		}, 500*time.Millisecond, 50*time.Millisecond)
 	}
 
+	// トレース情報がRaftの適用を経由してログへの追加まで引き継がれることの検証
+	ctx, root := tp.Tracer("test").Start(context.Background(), "produce")
+	_, err := logs[0].AppendContext(ctx, &api.Record{Value: []byte("traced")})
+	require.NoError(t, err)
+	root.End()
+	spans := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == root.SpanContext().TraceID() {
+			spans[span.Name()] = true
+		}
+	}
+	for _, name := range []string{"DistributedLog.apply", "fsm.Apply", "Log.Append"} {
+		require.True(t, spans[name], name)
+	}
+
+	// オフセットを指定した書き込みは、次のオフセットと一致する場合のみすべてのサーバに書き込まれることの検証
+	_, err = logs[0].AppendAtContext(context.Background(), &api.Record{Value: []byte("conflict")}, 2)
+	require.Equal(t, api.ErrOffsetMismatch{Offset: 2, Next: 3}, err)
+	off, err := logs[0].AppendAtContext(context.Background(), &api.Record{Value: []byte("at")}, 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			if got, err := logs[j].Read(off); err != nil || string(got.Value) != "at" {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	// ACLのポリシーがすべてのサーバに複製されることの検証
+	policy := &api.Policy{Ptype: "p", Values: []string{"alice", "*", "produce"}}
+	require.NoError(t, logs[0].AddPolicy(context.Background(), policy))
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			if len(handlers[j].get()) != 1 || len(logs[j].ListPolicies()) != 1 {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	require.NoError(t, logs[0].RemovePolicy(context.Background(), policy))
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			if len(handlers[j].get()) != 0 {
+				return false
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	// フォロワーはポリシーを変更できない
+	require.Error(t, logs[1].AddPolicy(context.Background(), policy))
+
 	servers, err := logs[0].GetServers()
 	require.NoError(t, err)
 	require.Equal(t, 3, len(servers))
@@ -108,7 +173,7 @@ func Test_MultipleNodes(t *testing.T) {
 	require.True(t, servers[0].IsLeader)
 	require.False(t, servers[1].IsLeader)
 
-	off, err := logs[0].Append(&api.Record{
+	off, err = logs[0].Append(&api.Record{
 		Value: []byte("third"),
 	})
 	require.NoError(t, err)
@@ -126,3 +191,90 @@ func Test_MultipleNodes(t *testing.T) {
 	require.Equal(t, []byte("third"), record.Value)
 	require.Equal(t, off, record.Offset)
 }
+
+// policyHandler は複製されたポリシーを保持する。
+type policyHandler struct {
+	mu       sync.Mutex
+	policies []*api.Policy
+}
+
+func (h *policyHandler) SetPolicies(policies []*api.Policy) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.policies = policies
+	return nil
+}
+
+func (h *policyHandler) get() []*api.Policy {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.policies
+}
+
+// Test_MultiplexedTransport は多重化したトランスポートのサーバと多重化しないサーバが混在するクラスタで
+// レコードが複製され、ピアごとの複製のレイテンシが記録されることを検証する。
+func Test_MultiplexedTransport(t *testing.T) {
+	var logs []*log.DistributedLog
+	nodeCount := 3
+	ports := dynaport.Get(nodeCount)
+	for i := 0; i < nodeCount; i++ {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 100 * time.Millisecond
+		config.Raft.ElectionTimeout = 100 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 100 * time.Millisecond
+		config.Raft.CommitTimeout = 50 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = i == 0
+		config.Raft.Multiplex = i != 1
+		config.Raft.MaxPool = 2
+		config.Raft.TransportTimeout = time.Second
+
+		l, err := log.NewDistributedLog(t.TempDir(), config)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String()))
+		}
+		logs = append(logs, l)
+	}
+
+	for _, value := range []string{"first", "second", "third"} {
+		off, err := logs[0].Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			for _, l := range logs {
+				got, err := l.Read(off)
+				if err != nil || string(got.Value) != value {
+					return false
+				}
+			}
+			return true
+		}, time.Second, 50*time.Millisecond)
+	}
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, logs[0].Register(reg))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	peers := map[string]bool{}
+	for _, family := range families {
+		if family.GetName() != "proglog_raft_replication_duration_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "peer" && m.GetHistogram().GetSampleCount() > 0 {
+					peers[label.GetValue()] = true
+				}
+			}
+		}
+	}
+	require.Equal(t, map[string]bool{"1": true, "2": true}, peers)
+}
@@ -0,0 +1,250 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// keyFrameMarker は暗号化されたストアの先頭に置く、鍵IDのフレームの目印である。
+	// 平文のストアの先頭はレコード長のため、取り得ない値を目印とする。
+	keyFrameMarker uint64 = math.MaxUint64 - 1
+	// snapshotFrameMarker は暗号化されたスナップショットの先頭に置く、鍵IDのフレームの目印である。
+	snapshotFrameMarker uint64 = math.MaxUint64 - 2
+
+	snapshotChunkSize = 64 * 1024 // スナップショットを暗号化する単位
+)
+
+// writeKeyFrame は空のストアの先頭に鍵IDのフレームを書き込む。
+func writeKeyFrame(s *store, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := binary.Write(s.buf, enc, keyFrameMarker); err != nil {
+		return err
+	}
+	if err := binary.Write(s.buf, enc, uint64(len(id))); err != nil {
+		return err
+	}
+	if _, err := s.buf.WriteString(id); err != nil {
+		return err
+	}
+	s.size += 2*lenWidth + uint64(len(id))
+	return nil
+}
+
+// readKeyFrame はストアの先頭から鍵IDを読み出す。平文のストアの場合はokをfalseとする。
+// 最初のレコードの位置も返却する。
+func readKeyFrame(s *store) (id string, pos uint64, ok bool, err error) {
+	b := make([]byte, lenWidth)
+	if _, err = s.ReadAt(b, 0); err != nil {
+		return "", 0, false, err
+	}
+	if enc.Uint64(b) != keyFrameMarker {
+		return "", 0, false, nil
+	}
+	p, err := s.Read(lenWidth)
+	if err != nil {
+		return "", 0, false, err
+	}
+	return string(p), 2*lenWidth + uint64(len(p)), true, nil
+}
+
+// seal はレコードを暗号化し、ナンスを先頭に付与して返却する。
+// 別のオフセットへのレコードの差し替えを検知できるよう、オフセットを追加データとして認証する。
+func seal(aead cipher.AEAD, p []byte, off uint64) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(p)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, p, offsetData(off)), nil
+}
+
+// open はsealで暗号化したレコードを復号する。
+func open(aead cipher.AEAD, b []byte, off uint64) ([]byte, error) {
+	if len(b) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted record at offset %d is too short", off)
+	}
+	nonce, ciphertext := b[:aead.NonceSize()], b[aead.NonceSize():]
+	p, err := aead.Open(nil, nonce, ciphertext, offsetData(off))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt record at offset %d: %w", off, err)
+	}
+	return p, nil
+}
+
+func offsetData(off uint64) []byte {
+	b := make([]byte, 8)
+	enc.PutUint64(b, off)
+	return b
+}
+
+// plaintextReader は暗号化されたセグメントのレコードを復号し、
+// 平文のストアと同じくレコード長を付与した形式で読み出す。
+type plaintextReader struct {
+	segment *segment
+	pos     uint64
+	off     uint64
+	buf     bytes.Buffer
+}
+
+func (r *plaintextReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.off >= r.segment.nextOffset {
+			return 0, io.EOF
+		}
+		b, err := r.segment.store.Read(r.pos)
+		if err != nil {
+			return 0, err
+		}
+		r.pos += lenWidth + uint64(len(b))
+		if b, err = open(r.segment.aead, b, r.off); err != nil {
+			return 0, err
+		}
+		r.off++
+		_ = binary.Write(&r.buf, enc, uint64(len(b)))
+		r.buf.Write(b)
+	}
+	return r.buf.Read(p)
+}
+
+// snapshotEncrypter はスナップショットを一定の大きさのチャンクごとに暗号化して読み出す。
+//
+// 先頭に目印と鍵IDのフレームを置き、続く各チャンクはレコード長と同じ形式の長さ、
+// 最後のチャンクかを表すフラグ、暗号文の順に並べる。チャンクの順序と最後のチャンクであることを
+// 追加データとして認証し、チャンクの並べ替えやスナップショットの切り詰めを検知する。
+type snapshotEncrypter struct {
+	src   io.Reader
+	aead  cipher.AEAD
+	chunk uint64
+	done  bool
+	buf   bytes.Buffer
+}
+
+func newSnapshotEncrypter(src io.Reader, id string, aead cipher.AEAD) *snapshotEncrypter {
+	e := &snapshotEncrypter{src: src, aead: aead}
+	_ = binary.Write(&e.buf, enc, snapshotFrameMarker)
+	_ = binary.Write(&e.buf, enc, uint64(len(id)))
+	e.buf.WriteString(id)
+	return e
+}
+
+func (e *snapshotEncrypter) Read(p []byte) (int, error) {
+	for e.buf.Len() == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, snapshotChunkSize)
+		n, err := io.ReadFull(e.src, chunk)
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			e.done = true
+		case err != nil:
+			return 0, err
+		}
+		final := byte(0)
+		if e.done {
+			final = 1
+		}
+		nonce := make([]byte, e.aead.NonceSize())
+		if _, err = rand.Read(nonce); err != nil {
+			return 0, err
+		}
+		sealed := e.aead.Seal(nonce, nonce, chunk[:n], chunkData(e.chunk, final))
+		e.chunk++
+		_ = binary.Write(&e.buf, enc, uint64(1+len(sealed)))
+		e.buf.WriteByte(final)
+		e.buf.Write(sealed)
+	}
+	return e.buf.Read(p)
+}
+
+// snapshotDecrypter はsnapshotEncrypterで暗号化したスナップショットを復号して読み出す。
+type snapshotDecrypter struct {
+	src   io.Reader
+	aead  cipher.AEAD
+	chunk uint64
+	done  bool
+	buf   bytes.Buffer
+}
+
+func (d *snapshotDecrypter) Read(p []byte) (int, error) {
+	for d.buf.Len() == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		b := make([]byte, lenWidth)
+		if _, err := io.ReadFull(d.src, b); err != nil {
+			if err == io.EOF {
+				return 0, errors.New("encrypted snapshot is truncated")
+			}
+			return 0, err
+		}
+		size := enc.Uint64(b)
+		if size < 1+uint64(d.aead.NonceSize()) || size > 1+uint64(d.aead.NonceSize()+d.aead.Overhead())+snapshotChunkSize {
+			return 0, fmt.Errorf("invalid encrypted snapshot chunk size: %d", size)
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(d.src, frame); err != nil {
+			return 0, err
+		}
+		final, nonce, ciphertext := frame[0], frame[1:1+d.aead.NonceSize()], frame[1+d.aead.NonceSize():]
+		chunk, err := d.aead.Open(nil, nonce, ciphertext, chunkData(d.chunk, final))
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt snapshot chunk %d: %w", d.chunk, err)
+		}
+		d.chunk++
+		d.done = final == 1
+		d.buf.Write(chunk)
+	}
+	return d.buf.Read(p)
+}
+
+func chunkData(chunk uint64, final byte) []byte {
+	b := make([]byte, 9)
+	enc.PutUint64(b, chunk)
+	b[8] = final
+	return b
+}
+
+// snapshotReader はスナップショットが暗号化されている場合、復号するReaderを返却する。
+// 平文のスナップショットはそのまま読み出す。
+func snapshotReader(r io.Reader, keyring *Keyring) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	b, err := br.Peek(lenWidth)
+	if err != nil || enc.Uint64(b) != snapshotFrameMarker {
+		// 空のスナップショットのエラーは、呼び出し元の読み出しで扱う
+		return br, nil
+	}
+	if _, err = br.Discard(lenWidth); err != nil {
+		return nil, err
+	}
+	// Peek の結果はバッファを指すため、長さは別の領域に読み出す
+	b = make([]byte, lenWidth)
+	if _, err = io.ReadFull(br, b); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot key id: %w", err)
+	}
+	// 長さは検証してから確保する (壊れたスナップショットで巨大な領域を確保しないため)
+	size := enc.Uint64(b)
+	if size > math.MaxUint8 {
+		return nil, fmt.Errorf("invalid snapshot key id length: %d", size)
+	}
+	id := make([]byte, size)
+	if _, err = io.ReadFull(br, id); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot key id: %w", err)
+	}
+	if keyring == nil {
+		return nil, fmt.Errorf("snapshot is encrypted with key %q but no keyring is configured", id)
+	}
+	aead, err := keyring.Key(string(id))
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotDecrypter{src: br, aead: aead}, nil
+}
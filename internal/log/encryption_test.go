@@ -0,0 +1,162 @@
+package log
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// writeKeyring は鍵IDごとにランダムな鍵を生成し、鍵ファイルに書き込む。既存の鍵は引き継ぐ。
+func writeKeyring(t *testing.T, path, active string, ids ...string) {
+	t.Helper()
+	file := struct {
+		Active string            `json:"active"`
+		Keys   map[string]string `json:"keys"`
+	}{Active: active, Keys: map[string]string{}}
+	if b, err := os.ReadFile(path); err == nil {
+		require.NoError(t, json.Unmarshal(b, &file))
+		file.Active = active
+	}
+	for _, id := range ids {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		require.NoError(t, err)
+		file.Keys[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	b, err := json.Marshal(file)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b, 0600))
+}
+
+// TestEncryptedLog はレコードが暗号化して保存されること、
+// および鍵をローテーションしても古いセグメントを読み出せることを検証する。
+func TestEncryptedLog(t *testing.T) {
+	dir := t.TempDir()
+	keyringPath := filepath.Join(t.TempDir(), "keyring.json")
+	writeKeyring(t, keyringPath, "1", "1")
+	keyring, err := LoadKeyring(keyringPath)
+	require.NoError(t, err)
+
+	c := Config{Keyring: keyring}
+	c.Segment.MaxStoreBytes = 128 // 1つのセグメントにつき、2つのレコードまで書き込み可能
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	value := []byte("hello world")
+	for i := 0; i < 2; i++ {
+		_, err = log.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+	}
+	// 新たなセグメントから新たな鍵で暗号化する
+	writeKeyring(t, keyringPath, "2", "2")
+	require.NoError(t, keyring.Reload())
+	for i := 0; i < 2; i++ {
+		_, err = log.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, len(log.segments))
+	require.Equal(t, "1", log.segments[0].keyID)
+	require.Equal(t, "2", log.segments[1].keyID)
+
+	// Readerは平文のレコードを読み出す
+	b, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+	for off := uint64(0); off < 4; off++ {
+		size := enc.Uint64(b[:lenWidth])
+		record := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[lenWidth:lenWidth+size], record))
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, value, record.Value)
+		b = b[lenWidth+size:]
+	}
+	require.Equal(t, 0, len(b))
+	require.NoError(t, log.Close())
+
+	for _, s := range log.segments {
+		b, err := os.ReadFile(s.store.Name())
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(b, value))
+	}
+
+	// 既存のセグメントは記録された鍵IDの鍵で読み出す
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	for off := uint64(0); off < 4; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, value, record.Value)
+	}
+	require.NoError(t, log.Close())
+
+	// 鍵がない場合は読み出せない
+	_, err = NewLog(dir, Config{})
+	require.Error(t, err)
+}
+
+// TestEncryptedSnapshot はスナップショットが暗号化され、改ざんや切り詰めを検知できることを検証する。
+func TestEncryptedSnapshot(t *testing.T) {
+	keyringPath := filepath.Join(t.TempDir(), "keyring.json")
+	writeKeyring(t, keyringPath, "1", "1")
+	keyring, err := LoadKeyring(keyringPath)
+	require.NoError(t, err)
+	newFSM := func(keyring *Keyring) *fsm {
+		log, err := NewLog(t.TempDir(), Config{Keyring: keyring})
+		require.NoError(t, err)
+		return &fsm{log: log, policies: newPolicySet(), handler: &policyRecorder{}}
+	}
+
+	src := newFSM(keyring)
+	value := []byte("hello world")
+	for i := 0; i < 3; i++ {
+		_, err = src.log.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+	}
+	snap, err := src.Snapshot()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, snap.(*snapshot).Persist(&sink{Buffer: &buf}))
+	data := buf.Bytes()
+	require.False(t, bytes.Contains(data, value))
+
+	dst := newFSM(keyring)
+	require.NoError(t, dst.Restore(io.NopCloser(bytes.NewReader(data))))
+	for off := uint64(0); off < 3; off++ {
+		record, err := dst.log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, value, record.Value)
+	}
+
+	// 鍵がない場合
+	require.Error(t, newFSM(nil).Restore(io.NopCloser(bytes.NewReader(data))))
+	// 改ざんされた場合
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-1] ^= 1
+	require.Error(t, newFSM(keyring).Restore(io.NopCloser(bytes.NewReader(tampered))))
+	// 最後のチャンクが切り詰められた場合
+	require.Error(t, newFSM(keyring).Restore(io.NopCloser(bytes.NewReader(data[:len(data)-1]))))
+
+	// 鍵IDのフレームが壊れている場合は、確保や読み出しの前にエラーとする
+	frame := func(size uint64, id string) []byte {
+		b := make([]byte, 2*lenWidth)
+		enc.PutUint64(b, snapshotFrameMarker)
+		enc.PutUint64(b[lenWidth:], size)
+		return append(b, id...)
+	}
+	for _, corrupt := range [][]byte{
+		frame(1, "1")[:lenWidth+3], // 鍵IDの長さが切り詰められている
+		frame(math.MaxUint64, ""),  // 鍵IDの長さが巨大
+		frame(4, "1"),              // 鍵IDが切り詰められている
+	} {
+		require.Error(t, newFSM(keyring).Restore(io.NopCloser(bytes.NewReader(corrupt))))
+	}
+}
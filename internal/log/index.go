@@ -1,19 +1,38 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"syscall"
 )
 
 // インデックスエントリを構成するバイト数を定義
 const (
-	offWidth uint64 = 4                   // オフセット番号(レコードID)の領域
+	offWidth uint64 = 8                   // オフセット番号(レコードID)の領域
 	posWidth uint64 = 8                   // ストアファイル内レコード位置の領域
 	entWidth uint64 = offWidth + posWidth // インデックスエントリのサイズ
 )
 
-// index はストアファイル内の各レコードへのインデックス情報を保持する。
+// インデックスのファイルの形式
+//
+// バージョン2のインデックスは、目印とバージョンからなるヘッダの後に、64ビットの相対オフセットと
+// ストア内の位置からなるエントリを並べる。エントリはすべてのレコードではなく、
+// Config.Segment.IndexIntervalBytes ごとのレコードにのみ書き込む (疎なインデックス)。
+// ヘッダを持たないバージョン1のインデックス (32ビットの相対オフセットで、レコードごとにエントリを書き込む) は、
+// セグメントを開く際に migrateIndex でバージョン2に移行する。
+const (
+	indexMagic         uint32 = 0x70696478 // "pidx"
+	indexVersion       uint32 = 2
+	indexHeaderWidth   uint64 = 8
+	v1OffWidth         uint64 = 4
+	v1EntWidth         uint64 = v1OffWidth + posWidth
+	indexMigrateSuffix        = ".migrate" // 移行中のインデックスのファイル名の接尾辞
+)
+
+// index はストアファイル内のレコードへのインデックス情報を保持する。
 type index struct {
 	file *os.File // 永続化されたファイル
 	mmap []byte   // メモリマップされたファイル
@@ -21,6 +40,7 @@ type index struct {
 }
 
 // newIndex は指定されたファイルからindexを作成する。
+// 空のファイルの場合はヘッダを書き込む。バージョン2以外のファイルはエラーとする。
 func newIndex(f *os.File, c Config) (*index, error) {
 	idx := &index{
 		file: f,
@@ -34,19 +54,48 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	// ファイルサイズを最大のインデックスサイズまで空領域で増やす
 	// ※一度メモリマップした領域は後からサイズ変更できないため
 	// ※空領域の追加により最後のエントリがファイルの最後ではなくなるため、Closeにて切り詰め処理を実行
-	if err = os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
+	// ※移行したインデックスが最大のサイズを超える場合は、エントリを失わないようファイルのサイズとする
+	max := c.Segment.MaxIndexBytes
+	if max < idx.size {
+		max = idx.size
+	}
+	if max < indexHeaderWidth {
+		return nil, fmt.Errorf("max index bytes %d is smaller than the index header", max)
+	}
+	if err = os.Truncate(f.Name(), int64(max)); err != nil {
 		return nil, err
 	}
 	// ファイルをメモリにマッピング
 	if idx.mmap, err = syscall.Mmap(
 		int(idx.file.Fd()),
 		0,
-		int(c.Segment.MaxIndexBytes),
+		int(max),
 		syscall.PROT_READ|syscall.PROT_WRITE,
 		syscall.MAP_SHARED,
 	); err != nil {
 		return nil, err
 	}
+	if idx.size == 0 {
+		enc.PutUint32(idx.mmap[0:4], indexMagic)
+		enc.PutUint32(idx.mmap[4:indexHeaderWidth], indexVersion)
+		idx.size = indexHeaderWidth
+		return idx, nil
+	}
+	if idx.size < indexHeaderWidth || enc.Uint32(idx.mmap[0:4]) != indexMagic {
+		_ = syscall.Munmap(idx.mmap)
+		return nil, fmt.Errorf("index %s has no header", f.Name())
+	}
+	if v := enc.Uint32(idx.mmap[4:indexHeaderWidth]); v != indexVersion {
+		_ = syscall.Munmap(idx.mmap)
+		return nil, fmt.Errorf("unsupported index version %d: %s", v, f.Name())
+	}
+	// 閉じずに停止した場合、ファイルは切り詰められずに空領域が残っているため、
+	// 最初のエントリ以外で相対オフセットが0のエントリ以降を空領域とみなす
+	n := (idx.size - indexHeaderWidth) / entWidth
+	n = uint64(sort.Search(int(n), func(k int) bool {
+		return k > 0 && idx.entry(uint64(k)) == 0
+	}))
+	idx.size = indexHeaderWidth + n*entWidth
 	return idx, nil
 }
 
@@ -68,43 +117,86 @@ func (i *index) Close() error {
 	return i.file.Close()
 }
 
-// Read はオフセットを受け取り、ストア内の関連したオフセットとレコードの位置を返却する。
-// オフセットはセグメントのベースオフセットからの相対的な値で、0は常にインデックスの最初のエントリとなる。
-// -1をオフセットとして渡した場合、インデックス最後のエントリとして扱う。
-func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
-	if i.size == 0 {
+// entries はインデックスのエントリ数を返却する。
+func (i *index) entries() uint64 {
+	return (i.size - indexHeaderWidth) / entWidth
+}
+
+// entry はk番目のエントリの相対オフセットを返却する。
+func (i *index) entry(k uint64) uint64 {
+	pos := indexHeaderWidth + k*entWidth
+	return enc.Uint64(i.mmap[pos : pos+offWidth])
+}
+
+// Read はエントリの番号を受け取り、そのエントリのオフセットとストア内のレコードの位置を返却する。
+// オフセットはセグメントのベースオフセットからの相対的な値である。
+// -1をエントリの番号として渡した場合、インデックス最後のエントリとして扱う。
+func (i *index) Read(in int64) (out uint64, pos uint64, err error) {
+	n := i.entries()
+	if n == 0 {
 		return 0, 0, io.EOF
 	}
+	k := uint64(in)
 	if in == -1 {
-		out = uint32((i.size / entWidth) - 1)
-	} else {
-		out = uint32(in)
+		k = n - 1
 	}
-	// エントリ位置の算出
-	pos = uint64(out) * entWidth
-	if i.size < pos+entWidth {
+	if in < -1 || k >= n {
 		return 0, 0, io.EOF
 	}
 	// オフセットと位置をデコードして、メモリマップされたファイルから読み出す
-	out = enc.Uint32(i.mmap[pos : pos+offWidth])          // エントリ位置からオフセット領域末尾まで
-	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth]) // 現在のオフセット領域末尾からエントリ領域末尾まで
+	at := indexHeaderWidth + k*entWidth
+	out = enc.Uint64(i.mmap[at : at+offWidth])
+	pos = enc.Uint64(i.mmap[at+offWidth : at+entWidth])
 	return out, pos, nil
 }
 
+// Find は相対オフセットoff以下で最大のオフセットのエントリを二分探索し、そのオフセットと位置を返却する。
+// 疎なインデックスでは、返却した位置からストアを順にたどってoffのレコードを求める。
+func (i *index) Find(off uint64) (out uint64, pos uint64, err error) {
+	n := int(i.entries())
+	k := sort.Search(n, func(k int) bool { return i.entry(uint64(k)) > off })
+	if k == 0 {
+		return 0, 0, io.EOF
+	}
+	return i.Read(int64(k - 1))
+}
+
 // Write は渡されたオフセットとレコード位置をインデックスに追加する。
-func (i *index) Write(off uint32, pos uint64) error {
+func (i *index) Write(off uint64, pos uint64) error {
 	// 空き領域のチェック
 	if i.isMaxed() {
 		return io.EOF
 	}
 	// オフセットと位置をエンコードして、メモリマップされたファイルに書き込み
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)          // 現在の書き込み位置からオフセット領域末尾まで
+	enc.PutUint64(i.mmap[i.size:i.size+offWidth], off)          // 現在の書き込み位置からオフセット領域末尾まで
 	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos) // 現在のオフセット領域末尾からエントリ領域末尾まで
 	// 次の書き込みが行われる位置を進める
 	i.size += uint64(entWidth)
 	return nil
 }
 
+// truncate は相対オフセットoff以上のエントリを削除する。
+// 閉じずに停止した場合に削除したエントリを読み出さないよう、削除した領域は空領域に戻す。
+func (i *index) truncate(off uint64) {
+	k := uint64(sort.Search(int(i.entries()), func(k int) bool { return i.entry(uint64(k)) >= off }))
+	size := indexHeaderWidth + k*entWidth
+	for j := size; j < i.size; j++ {
+		i.mmap[j] = 0
+	}
+	i.size = size
+}
+
+// truncatePos はストアにおける位置がpos以上のエントリを削除する。
+func (i *index) truncatePos(pos uint64) {
+	k := uint64(sort.Search(int(i.entries()), func(k int) bool {
+		_, p, _ := i.Read(int64(k))
+		return p >= pos
+	}))
+	if k < i.entries() {
+		i.truncate(i.entry(k))
+	}
+}
+
 // isMaxed はインデックスにエントリを書き込む領域が存在するかを判定する。
 func (i *index) isMaxed() bool {
 	// 最大のインデックスサイズより現在のファイルサイズの方が大きい場合はtrue
@@ -115,3 +207,76 @@ func (i *index) isMaxed() bool {
 func (i *index) Name() string {
 	return i.file.Name()
 }
+
+// migrateIndex はバージョン1のインデックスのファイルをバージョン2に移行する。
+// 移行したファイルを別名で書き込んで同期してから置き換えるため、途中で停止しても元のファイルか
+// 移行後のファイルのいずれかが残る。エントリは IndexIntervalBytes ごとのレコードのみ残す。
+// 空のファイルやバージョン2のファイルは変更しない。
+func migrateIndex(name string, c Config) error {
+	tmp := name + indexMigrateSuffix
+	// 前回の移行の途中で停止した場合は、元のファイルから移行し直す
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	b, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 || (uint64(len(b)) >= indexHeaderWidth && enc.Uint32(b[0:4]) == indexMagic) {
+		return nil
+	}
+
+	out := make([]byte, indexHeaderWidth, indexHeaderWidth+uint64(len(b))/v1EntWidth*entWidth)
+	enc.PutUint32(out[0:4], indexMagic)
+	enc.PutUint32(out[4:indexHeaderWidth], indexVersion)
+	var last uint64
+	for k := uint64(0); (k+1)*v1EntWidth <= uint64(len(b)); k++ {
+		e := b[k*v1EntWidth : (k+1)*v1EntWidth]
+		off := uint64(enc.Uint32(e[:v1OffWidth]))
+		pos := enc.Uint64(e[v1OffWidth:])
+		if k > 0 && off == 0 {
+			break // 閉じずに停止した場合の空領域
+		}
+		if k > 0 && pos-last < c.Segment.IndexIntervalBytes {
+			continue
+		}
+		var ent [entWidth]byte
+		enc.PutUint64(ent[:offWidth], off)
+		enc.PutUint64(ent[offWidth:], pos)
+		out = append(out, ent[:]...)
+		last = pos
+	}
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(out)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+// syncDir はディレクトリを同期し、ファイルの名前の変更を永続化する。
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -3,6 +3,8 @@ package log
 import (
 	"io"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -24,7 +26,7 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, f.Name(), idx.Name())
 
 	entries := []struct {
-		Off uint32
+		Off uint64
 		Pos uint64
 	}{
 		{Off: 0, Pos: 0},
@@ -53,6 +55,117 @@ func TestIndex(t *testing.T) {
 	// 既存ファイルにエントリが書き込まれている状態で読み出す場合はエラーとならない
 	off, pos, err := idx.Read(-1)
 	require.NoError(t, err)
-	require.Equal(t, uint32(1), off)
+	require.Equal(t, uint64(1), off)
 	require.Equal(t, entries[1].Pos, pos)
+	_ = idx.Close()
+}
+
+// TestIndexFind は疎なインデックスから、オフセット以下で直近のエントリを取得できることを検証する。
+// 32ビットを超える相対オフセットも扱えること、閉じずに停止した場合の空領域をエントリとしないことも検証する。
+func TestIndexFind(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "index_find_test")
+	require.NoError(t, err)
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+
+	entries := []struct {
+		Off uint64
+		Pos uint64
+	}{
+		{Off: 0, Pos: 0},
+		{Off: 10, Pos: 4096},
+		{Off: 1 << 40, Pos: 8192},
+	}
+	for _, e := range entries {
+		require.NoError(t, idx.Write(e.Off, e.Pos))
+	}
+	for _, tc := range []struct {
+		in, off, pos uint64
+	}{
+		{in: 0, off: 0, pos: 0},
+		{in: 9, off: 0, pos: 0},
+		{in: 10, off: 10, pos: 4096},
+		{in: 1<<40 - 1, off: 10, pos: 4096},
+		{in: 1<<40 + 5, off: 1 << 40, pos: 8192},
+	} {
+		off, pos, err := idx.Find(tc.in)
+		require.NoError(t, err)
+		require.Equal(t, tc.off, off, tc.in)
+		require.Equal(t, tc.pos, pos, tc.in)
+	}
+
+	// 閉じずに停止した場合を再現するため、空領域を残したまま開き直す
+	require.NoError(t, syscall.Munmap(idx.mmap))
+	require.NoError(t, f.Close())
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(1024), fi.Size())
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(entries)), idx.entries())
+	require.NoError(t, idx.Close())
+}
+
+// TestIndexMigration はバージョン1のインデックスを、エントリを間引いてバージョン2に移行することを検証する。
+func TestIndexMigration(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "0.index")
+	// バージョン1のエントリは32ビットの相対オフセットと位置からなり、レコードごとに書き込まれている
+	var v1 []byte
+	for off := uint32(0); off < 10; off++ {
+		e := make([]byte, v1EntWidth)
+		enc.PutUint32(e[:v1OffWidth], off)
+		enc.PutUint64(e[v1OffWidth:], uint64(off)*100)
+		v1 = append(v1, e...)
+	}
+	require.NoError(t, os.WriteFile(name, v1, 0600))
+	// 前回の移行の途中で停止した場合のファイルは破棄する
+	require.NoError(t, os.WriteFile(name+indexMigrateSuffix, []byte("partial"), 0600))
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexIntervalBytes = 250
+	require.NoError(t, migrateIndex(name, c))
+	_, err := os.Stat(name + indexMigrateSuffix)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	migrated, err := os.ReadFile(name)
+	require.NoError(t, err)
+	// 移行済みのインデックスは変更しない
+	require.NoError(t, migrateIndex(name, c))
+	again, err := os.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, migrated, again)
+
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+	// 位置が直前のエントリから250バイト以上離れたエントリのみ残る
+	require.Equal(t, uint64(4), idx.entries())
+	for k, want := range []uint64{0, 3, 6, 9} {
+		off, pos, err := idx.Read(int64(k))
+		require.NoError(t, err)
+		require.Equal(t, want, off)
+		require.Equal(t, want*100, pos)
+	}
+}
+
+// TestIndexUnsupportedVersion は未知のバージョンのインデックスを開けないことを検証する。
+func TestIndexUnsupportedVersion(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "0.index")
+	b := make([]byte, indexHeaderWidth)
+	enc.PutUint32(b[0:4], indexMagic)
+	enc.PutUint32(b[4:], indexVersion+1)
+	require.NoError(t, os.WriteFile(name, b, 0600))
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	defer f.Close()
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	_, err = newIndex(f, c)
+	require.ErrorContains(t, err, "unsupported index version 3")
 }
@@ -0,0 +1,250 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	iteratorChunkBytes = 64 * 1024 // イテレータがストアから一度に読み込むバイト数
+)
+
+// Iterator はあるオフセットから順にレコードを読み出す。
+// 最初の読み出し時にセグメントを二分探索で特定してインデックスから位置を求め、
+// 以降はインデックスを引かずにストアを先頭から順に、使い回すバッファへまとめて読み込む。
+// 位置を求めた時点で書き込み済みのレコードはログのロックを獲得せずに読み出し、
+// 読み出し中にセグメントが入れ替わった場合 (log.gen が変化した場合) は位置を求め直して読み出し直す。
+// 並行して利用することはできない。
+type Iterator struct {
+	log *Log
+	off uint64 // 次に読み出すレコードのオフセット
+	gen uint64 // 位置を求めた時点の log.gen
+	end uint64 // ロックを獲得せずに読み出せるレコードの終わりのオフセット (このオフセットは含まない)
+
+	remote bool   // 外部に移したセグメントを読み出し中か
+	base   uint64 // 読み出し中の外部に移したセグメントのベースオフセット
+
+	seg *segment // 読み出し中のセグメント (未特定の場合はnil)
+	i   int      // segのlog.segmentsにおける位置
+	pos uint64   // offのレコードのストアにおける位置
+
+	buf    []byte // ストアから読み込んだバイトデータ
+	bufPos uint64 // bufの先頭のストアにおける位置
+	bufLen int    // bufのうち読み込み済みのバイト数
+}
+
+// Iterator はオフセットoffから順にレコードを読み出すイテレータを返却する。
+func (l *Log) Iterator(off uint64) *Iterator {
+	return &Iterator{log: l, off: off}
+}
+
+// Next は次のレコードを返却する。レコードが未書き込みの場合は api.ErrOffsetOutOfRange を返却し、
+// 再び呼び出すと同じオフセットから読み出す。
+// 外部のストレージに移したセグメントのレコードは、Read と同じくキャッシュを経由して読み出す。
+func (it *Iterator) Next() (*api.Record, error) {
+	b, err := it.next()
+	if err != nil {
+		return nil, err
+	}
+	record := &api.Record{}
+	if err = proto.Unmarshal(b, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// next は次のレコードを平文のバイトデータとして返却する。返却値は次の呼び出しまで有効である。
+func (it *Iterator) next() ([]byte, error) {
+	for {
+		if it.off >= it.end || it.gen != it.log.gen.Load() {
+			if err := it.locate(); err != nil {
+				return nil, err
+			}
+		}
+		b, size, err := it.read()
+		if it.gen != it.log.gen.Load() {
+			// 読み出し中に削除や切り詰めが行われた場合は、読み出した内容を破棄して位置を求め直す
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		it.pos += size
+		it.off++
+		return b, nil
+	}
+}
+
+// locate はロックを獲得して、オフセットのレコードを含むセグメントと、ロックなしで読み出せる範囲を求める。
+// セグメントが入れ替わっていない場合は、求めた位置から続けて読み出す。
+func (it *Iterator) locate() error {
+	l := it.log
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if base, ok := l.remoteSegmentOf(it.off); ok {
+		// 外部に移したセグメントの範囲は、次のセグメントのベースオフセットの直前までとなる
+		i := sort.Search(len(l.remote), func(i int) bool { return l.remote[i] > base })
+		it.end = l.segments[0].baseOffset
+		if i < len(l.remote) {
+			it.end = l.remote[i]
+		}
+		it.remote, it.base, it.seg = true, base, nil
+		it.gen = l.gen.Load()
+		return nil
+	}
+	it.remote = false
+
+	// Truncate や TruncateSuffix などによりセグメントが入れ替わった場合は位置を求め直す
+	if it.seg == nil || it.gen != l.gen.Load() {
+		it.end = 0
+		if err := it.position(); err != nil {
+			return err
+		}
+	}
+	for it.off >= it.seg.nextOffset {
+		if it.i+1 >= len(l.segments) {
+			it.end = it.off
+			return api.ErrOffsetOutOfRange{Offset: it.off}
+		}
+		// 次のセグメントは最初のレコードから読み出す
+		it.i++
+		it.seg = l.segments[it.i]
+		it.pos = it.seg.pos
+		it.bufLen = 0
+	}
+	it.end = it.seg.nextOffset
+	it.gen = l.gen.Load()
+	return nil
+}
+
+// read は現在のオフセットのレコードと、ストアにおけるレコードのサイズを返却する。位置は進めない。
+func (it *Iterator) read() ([]byte, uint64, error) {
+	if it.remote {
+		record, err := it.log.readRemote(it.base, it.off)
+		if err != nil {
+			return nil, 0, err
+		}
+		b, err := proto.Marshal(record)
+		return b, 0, err
+	}
+	b, err := it.peek(lenWidth)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := enc.Uint64(b)
+	if b, err = it.peek(lenWidth + size); err != nil {
+		return nil, 0, err
+	}
+	b = b[lenWidth:]
+	if it.seg.aead != nil {
+		if b, err = open(it.seg.aead, b, it.off); err != nil {
+			return nil, 0, err
+		}
+	}
+	return b, lenWidth + size, nil
+}
+
+// position はオフセットのレコードを含むセグメントを二分探索で特定し、ストアの位置を求める。
+// 呼び出し元でロックを獲得すること。
+func (it *Iterator) position() error {
+	segments := it.log.segments
+	i := sort.Search(len(segments), func(i int) bool { return segments[i].nextOffset > it.off })
+	if i == len(segments) || it.off < segments[i].baseOffset {
+		it.seg = nil
+		return api.ErrOffsetOutOfRange{Offset: it.off}
+	}
+	s := segments[i]
+	pos, err := s.position(it.off)
+	if err != nil {
+		return err
+	}
+	it.seg, it.i, it.pos, it.bufLen = s, i, pos, 0
+	return nil
+}
+
+// peek はストアの現在の位置からnバイトを返却する。バッファに含まれていない場合はストアから読み込み直す。
+// バッファへの読み込みはストアのファイルに書き込み済みの範囲までとし、ストアのバッファを書き込ませない。
+func (it *Iterator) peek(n uint64) ([]byte, error) {
+	if it.pos < it.bufPos || it.pos+n > it.bufPos+uint64(it.bufLen) {
+		store := it.seg.store
+		// ロックなしで読み出すため、切り詰められたストアの壊れた長さで確保しないよう末尾と比べる
+		if it.pos+n < it.pos || it.pos+n > store.end.Load() {
+			it.bufLen = 0
+			return nil, io.ErrUnexpectedEOF
+		}
+		size := uint64(iteratorChunkBytes)
+		if committed := store.committed.Load(); it.pos+size > committed {
+			size = 0
+			if committed > it.pos {
+				size = committed - it.pos
+			}
+		}
+		if size < n {
+			size = n
+		}
+		if uint64(cap(it.buf)) < size {
+			it.buf = make([]byte, size)
+		}
+		it.buf = it.buf[:size]
+		k, err := store.ReadAt(it.buf, int64(it.pos))
+		if uint64(k) < n {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			it.bufLen = 0
+			return nil, err
+		}
+		it.bufPos, it.bufLen = it.pos, k
+	}
+	start := it.pos - it.bufPos
+	return it.buf[start : start+n], nil
+}
+
+// recordsReader は呼び出した時点のログの全レコードを、レコード長を付与した平文の形式で読み出すio.Readerを返却する。
+// Reader と異なり、呼び出した後に追加されたレコードは含まない。
+// 外部に移したセグメントはレコードを読み出さず、セグメントを参照するフレームとして先頭に含める。
+func (l *Log) recordsReader() io.Reader {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	lowest := l.segments[0].baseOffset
+	var frame []byte
+	if len(l.remote) > 0 {
+		frame = remoteRefs{
+			prefix: l.Config.Tier.Prefix,
+			bases:  append([]uint64{}, l.remote...),
+			next:   lowest,
+		}.frame()
+	}
+	return io.MultiReader(
+		bytes.NewReader(frame),
+		&recordReader{it: l.Iterator(lowest), end: l.segments[len(l.segments)-1].nextOffset},
+	)
+}
+
+// recordReader はイテレータで読み出したレコードを、endの直前までレコード長を付与した平文の形式で読み出す。
+type recordReader struct {
+	it  *Iterator
+	end uint64
+	buf bytes.Buffer
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.it.off >= r.end {
+			return 0, io.EOF
+		}
+		b, err := r.it.next()
+		if err != nil {
+			return 0, err
+		}
+		_ = binary.Write(&r.buf, enc, uint64(len(b)))
+		r.buf.Write(b)
+	}
+	return r.buf.Read(p)
+}
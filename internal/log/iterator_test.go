@@ -0,0 +1,169 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIterator はイテレータがセグメントをまたいでレコードを順に読み出し、
+// 未書き込みのレコードやセグメントの入れ替わりの後も続きから読み出せることを検証する。
+func TestIterator(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"iterate across segments":   testIterate,
+		"resume after new records":  testIterateResume,
+		"reposition after truncate": testIterateTruncate,
+		"reposition after reset":    testIterateReset,
+		"records reader":            testRecordsReader,
+		"read without log lock":     testIterateWithoutLock,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32 // 1つのセグメントにつき、2つのレコードまで書き込み可能
+			log, err := NewLog(t.TempDir(), c)
+			require.NoError(t, err)
+			defer log.Close()
+			appendRecords(t, log, 0, 5)
+
+			fn(t, log)
+		})
+	}
+}
+
+// appendRecords はログに値が record-<オフセット> のレコードを[from, to)の範囲で書き込む。
+func appendRecords(t *testing.T, log *Log, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		off, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+}
+
+// requireNext はイテレータが次に読み出すレコードのオフセットと値を検証する。
+func requireNext(t *testing.T, it *Iterator, off uint64) {
+	t.Helper()
+	record, err := it.Next()
+	require.NoError(t, err)
+	require.Equal(t, off, record.Offset)
+	require.Equal(t, fmt.Sprintf("record-%d", off), string(record.Value))
+}
+
+func testIterate(t *testing.T, log *Log) {
+	it := log.Iterator(1)
+	for off := uint64(1); off < 5; off++ {
+		requireNext(t, it, off)
+	}
+	_, err := it.Next()
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5}, err)
+
+	_, err = log.Iterator(10).Next()
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 10}, err)
+}
+
+func testIterateResume(t *testing.T, log *Log) {
+	it := log.Iterator(3)
+	requireNext(t, it, 3)
+	requireNext(t, it, 4)
+	_, err := it.Next()
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	// アクティブセグメントへの追記と、新たなセグメントのいずれも続きから読み出す
+	appendRecords(t, log, 5, 8)
+	for off := uint64(5); off < 8; off++ {
+		requireNext(t, it, off)
+	}
+}
+
+func testIterateTruncate(t *testing.T, log *Log) {
+	it := log.Iterator(0)
+	requireNext(t, it, 0)
+	requireNext(t, it, 1)
+	requireNext(t, it, 2)
+	// 読み出し中のセグメントより前のセグメントが削除されても、同じ位置から読み出す
+	require.NoError(t, log.Truncate(1))
+	requireNext(t, it, 3)
+	requireNext(t, it, 4)
+
+	// 読み出す前に削除されたレコードは範囲外とする
+	it = log.Iterator(2)
+	require.NoError(t, log.Truncate(3))
+	_, err := it.Next()
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 2}, err)
+}
+
+func testIterateReset(t *testing.T, log *Log) {
+	it := log.Iterator(0)
+	requireNext(t, it, 0)
+	require.NoError(t, log.Reset())
+	appendRecords(t, log, 0, 3)
+	requireNext(t, it, 1)
+	requireNext(t, it, 2)
+}
+
+func testRecordsReader(t *testing.T, log *Log) {
+	r := log.recordsReader()
+	// 作成した後に追加されたレコードは含まない
+	appendRecords(t, log, 5, 6)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	all, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+	require.Less(t, len(b), len(all))
+	require.True(t, bytes.HasPrefix(all, b))
+}
+
+func testIterateWithoutLock(t *testing.T, log *Log) {
+	it := log.Iterator(0)
+	requireNext(t, it, 0)
+	// 位置を求めた時点で書き込み済みのレコードは、書き込み中 (ログのロックを獲得中) でも待たずに読み出す
+	log.mu.Lock()
+	done := make(chan *api.Record, 1)
+	go func() {
+		record, _ := it.Next()
+		done <- record
+	}()
+	var record *api.Record
+	select {
+	case record = <-done:
+	case <-time.After(time.Second):
+	}
+	log.mu.Unlock()
+	require.NotNil(t, record, "iterator waited for the log lock")
+	require.Equal(t, uint64(1), record.Offset)
+
+	// ストアのファイルに書き込み済みの範囲のみを読み込み、バッファに残るレコードを書き込ませない
+	store := log.activeSegment.store
+	require.NoError(t, store.flush())
+	appendRecords(t, log, 5, 6)
+	buffered := store.buf.Buffered()
+	require.NotZero(t, buffered)
+	requireNext(t, log.Iterator(4), 4)
+	require.Equal(t, buffered, store.buf.Buffered())
+}
+
+// TestEncryptedIterator はイテレータが暗号化されたセグメントのレコードを復号して読み出すことを検証する。
+func TestEncryptedIterator(t *testing.T) {
+	keyringPath := filepath.Join(t.TempDir(), "keyring.json")
+	writeKeyring(t, keyringPath, "1", "1")
+	keyring, err := LoadKeyring(keyringPath)
+	require.NoError(t, err)
+	c := Config{Keyring: keyring}
+	c.Segment.MaxStoreBytes = 128
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendRecords(t, log, 0, 6)
+	require.Greater(t, len(log.segments), 1)
+
+	it := log.Iterator(0)
+	for off := uint64(0); off < 6; off++ {
+		requireNext(t, it, off)
+	}
+}
@@ -0,0 +1,94 @@
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+)
+
+// Keyring はストアとスナップショットを暗号化するAES-GCMの鍵を、鍵IDごとに保持する。
+//
+// 鍵ファイルは次の形式のJSONで、鍵はBase64でエンコードした16, 24, 32バイト(AES-128, 192, 256)とする。
+// 新たなセグメントとスナップショットはactiveの鍵で暗号化し、鍵IDを先頭に記録する。
+// 鍵をローテーションする場合は新たな鍵を追加してactiveを変更し、古い鍵は読み出し用に残しておく。
+//
+//	{"active": "2", "keys": {"1": "<base64>", "2": "<base64>"}}
+type Keyring struct {
+	path string
+
+	mu     sync.RWMutex
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// LoadKeyring は鍵ファイルを読み込み、Keyringを作成する。
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload は鍵ファイルを読み込み直す。失敗した場合は変更前の鍵を使い続ける。
+func (k *Keyring) Reload() error {
+	b, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Active string            `json:"active"`
+		Keys   map[string]string `json:"keys"`
+	}
+	if err = json.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("invalid keyring %s: %w", k.path, err)
+	}
+	keys := make(map[string]cipher.AEAD, len(file.Keys))
+	for id, encoded := range file.Keys {
+		if id == "" || len(id) > math.MaxUint8 {
+			return fmt.Errorf("invalid key id in keyring %s: %q", k.path, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("invalid key %q in keyring %s: %w", id, k.path, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("invalid key %q in keyring %s: %w", id, k.path, err)
+		}
+		if keys[id], err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+	}
+	if _, ok := keys[file.Active]; !ok {
+		return fmt.Errorf("active key %q not found in keyring %s", file.Active, k.path)
+	}
+	k.mu.Lock()
+	k.active = file.Active
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// Active は新たに暗号化する際に用いる鍵とその鍵IDを返却する。
+func (k *Keyring) Active() (string, cipher.AEAD) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active, k.keys[k.active]
+}
+
+// Key は鍵IDに対応する鍵を返却する。
+func (k *Keyring) Key(id string) (cipher.AEAD, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %q not found in keyring %s", id, k.path)
+	}
+	return aead, nil
+}
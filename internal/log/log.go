@@ -1,6 +1,8 @@
 package log
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"os"
 	"path"
@@ -8,8 +10,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/tracing"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // Log はセグメントの集合体であるsegmentsと書き込み対象のactiveSegmentを保持する。
@@ -22,6 +28,18 @@ type Log struct {
 
 	activeSegment *segment
 	segments      []*segment
+	// gen はセグメントを削除、切り詰め、またはクローズした回数である。ロックを獲得してから変更に先立って増やす。
+	// イテレータはロックを獲得せずに読み出した後にこの値を比べ、変化していれば位置を求め直す
+	gen atomic.Uint64
+
+	// 以下、Config.Tier.Storage を設定した場合の外部のストレージに移したセグメント
+	remote      []uint64      // 外部に移したセグメントのベースオフセット (古い順、いずれもsegmentsより古い)
+	cache       *segmentCache // 外部から取得したセグメント
+	offloadMu   sync.Mutex    // Offload を直列化する
+	offloadc    chan struct{}
+	stopOffload func()
+
+	metrics *logMetrics
 }
 
 // NewLog はLogインスタンスを作成する。引数のConfigの値が未指定の場合はデフォルト値を設定する。
@@ -32,9 +50,13 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if len(c.Tier.Prefix) > maxRemotePrefixBytes {
+		return nil, fmt.Errorf("tier prefix is too long: %d bytes", len(c.Tier.Prefix))
+	}
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:     dir,
+		Config:  c,
+		metrics: newLogMetrics(),
 	}
 	return l, l.setup()
 }
@@ -48,6 +70,10 @@ func (l *Log) setup() error {
 	}
 	var baseOffsets []uint64
 	for _, file := range files {
+		// 外部から取得したセグメントのディレクトリなど、セグメント以外のファイルは除く
+		if ext := path.Ext(file.Name()); file.IsDir() || (ext != ".store" && ext != ".index") {
+			continue
+		}
 		// 各セグメントのファイル名からベースオフセットの値を導出してスライスに格納
 		offStr := strings.TrimSuffix(
 			file.Name(),
@@ -68,18 +94,35 @@ func (l *Log) setup() error {
 		// baseOffsetsはインデックスとストアの2つの重複を含んでいるため、重複しているものをスキップ
 		i++
 	}
+	if err = l.setupRemote(); err != nil {
+		return err
+	}
 	if l.segments == nil {
 		// 既存セグメントが存在しない場合、最初のセグメントを作成
-		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
+		// 外部に移したセグメントのみが存在する場合は、その続きから書き込む
+		off := l.Config.Segment.InitialOffset
+		if len(l.remote) > 0 {
+			if off, err = l.remoteEnd(); err != nil {
+				return err
+			}
+		}
+		if err = l.newSegment(off); err != nil {
 			return err
 		}
 	}
+	l.startOffload()
 	return nil
 }
 
 // newSegment は新たなセグメントを作成し、アクティブセグメントとする。
 // 新規作成されたセグメントはセグメントのスライス末尾に追加される。
+// それまでのアクティブセグメントは以降書き込まれないため、ストアをメモリにマップして読み出す。
 func (l *Log) newSegment(off uint64) error {
+	if l.activeSegment != nil {
+		if err := l.activeSegment.seal(); err != nil {
+			return err
+		}
+	}
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
 		return err
@@ -95,16 +138,30 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 	// NOTE: 当該実装を最適化すれば、セグメント毎にロックを獲得することも可能
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.append(record)
+}
+
+// append は Append と同じ処理を行う。呼び出し元でロックを獲得すること。
+func (l *Log) append(record *api.Record) (uint64, error) {
+	start := time.Now()
+	defer func() {
+		l.metrics.appendLatency.Observe(time.Since(start).Seconds())
+	}()
 
 	highestOffset, err := l.highestOffset()
 	if err != nil {
 		return 0, err
 	}
 	if l.activeSegment.isMaxed() {
+		// 以降は書き込まれないセグメントとなるため、ストレージに同期してから新たなセグメントを作成
+		if err = l.sync(l.activeSegment); err != nil {
+			return 0, err
+		}
 		err = l.newSegment(highestOffset + 1)
 		if err != nil {
 			return 0, err
 		}
+		l.notifyOffload()
 	}
 
 	off, err := l.activeSegment.Append(record)
@@ -114,9 +171,78 @@ func (l *Log) Append(record *api.Record) (uint64, error) {
 	return off, nil
 }
 
+// AppendContext はコンテキストのトレースにスパンを記録しながら、ログにレコードを追加する。
+func (l *Log) AppendContext(ctx context.Context, record *api.Record) (uint64, error) {
+	_, span := tracing.Start(ctx, "Log.Append")
+	defer span.End()
+	off, err := l.Append(record)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return off, err
+}
+
+// AppendAt はレコードをオフセットoffに書き込む。
+// ログが空の場合はoffから書き込みを開始し、空でない場合は次のオフセットがoffと一致しなければ
+// 書き込まずに api.ErrOffsetMismatch を返却する。
+func (l *Log) AppendAt(record *api.Record, off uint64) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if next := l.activeSegment.nextOffset; next != off {
+		if len(l.remote) > 0 || len(l.segments) > 1 || l.activeSegment.baseOffset != next {
+			return 0, api.ErrOffsetMismatch{Offset: off, Next: next}
+		}
+		// 空のログは、offから始まるセグメントを作成し直す
+		l.gen.Add(1)
+		if err := l.activeSegment.Remove(); err != nil {
+			return 0, err
+		}
+		l.segments, l.activeSegment = nil, nil
+		if err := l.newSegment(off); err != nil {
+			return 0, err
+		}
+	}
+	return l.append(record)
+}
+
+// AppendAtContext はコンテキストのトレースにスパンを記録しながら、レコードをオフセットoffに書き込む。
+func (l *Log) AppendAtContext(ctx context.Context, record *api.Record, off uint64) (uint64, error) {
+	_, span := tracing.Start(ctx, "Log.AppendAt")
+	defer span.End()
+	offset, err := l.AppendAt(record, off)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return offset, err
+}
+
+// Sync はアクティブセグメントをストレージに同期する。
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sync(l.activeSegment)
+}
+
+// sync はセグメントをストレージに同期し、その所要時間を記録する。
+func (l *Log) sync(s *segment) error {
+	start := time.Now()
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	l.metrics.fsyncLatency.Observe(time.Since(start).Seconds())
+	return nil
+}
+
 // Read は指定されたオフセットに保存されているレコードをセグメントから読み出す。
+// 外部のストレージに移したセグメントのレコードは、セグメントを取得してキャッシュしてから読み出す。
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
+	if base, ok := l.remoteSegmentOf(off); ok {
+		// 取得中に書き込みを妨げないよう、ロックを解放してから読み出す
+		l.mu.RUnlock()
+		return l.readRemote(base, off)
+	}
 	defer l.mu.RUnlock()
 
 	var s *segment
@@ -134,10 +260,20 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 	return s.Read(off)
 }
 
-// Close はセグメントをすべて閉じる。
+// Close はセグメントをすべて閉じる。外部への移動中の場合は中断する。
 func (l *Log) Close() error {
+	if l.stopOffload != nil {
+		l.stopOffload()
+		l.stopOffload, l.offloadc = nil, nil
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.gen.Add(1)
+	if l.cache != nil {
+		if err := l.cache.close(); err != nil {
+			return err
+		}
+	}
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
@@ -146,11 +282,25 @@ func (l *Log) Close() error {
 	return nil
 }
 
-// Remove はログを閉じて、そのログのデータを削除する。
+// Remove はログを閉じて、そのログのデータを削除する。外部のストレージに移したセグメントも削除する。
 func (l *Log) Remove() error {
 	if err := l.Close(); err != nil {
 		return err
 	}
+	if storage := l.Config.Tier.Storage; storage != nil {
+		ctx := context.Background()
+		// 移動の途中で停止したセグメントも含め、ログのオブジェクトをすべて削除する
+		names, err := storage.List(ctx, l.Config.Tier.Prefix)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err = storage.Delete(ctx, name); err != nil {
+				return err
+			}
+		}
+		l.remote = nil
+	}
 	return os.RemoveAll(l.Dir)
 }
 
@@ -159,13 +309,21 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	// 閉じたセグメントを破棄し、初期オフセットから新たなセグメントを作成する
+	l.segments, l.activeSegment = nil, nil
 	return l.setup()
 }
 
-// LowestOffset は最古のオフセットを返却する。
+// LowestOffset は外部のストレージに移したセグメントを含め、最古のオフセットを返却する。
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if len(l.remote) > 0 {
+		return l.remote[0], nil
+	}
 	return l.segments[0].baseOffset, nil
 }
 
@@ -186,34 +344,105 @@ func (l *Log) highestOffset() (uint64, error) {
 }
 
 // Truncate は最大オフセットがlowestよりも小さいセグメントをすべて削除する。
-// ディスク容量を空けるためのメンテナンス用途として使用が想定される。
+// ディスク容量を空けるためのメンテナンス用途として使用が想定される。外部のストレージに移したセグメントも対象とする。
 func (l *Log) Truncate(lowest uint64) error {
+	bases, err := l.truncate(lowest)
+	// 外部のストレージからの削除は時間がかかるため、ロックを解放してから行う。
+	// 削除に失敗したセグメントは、次の起動時に外部のストレージから読み込まれて再び削除の対象となる
+	ctx, cancel := context.WithTimeout(context.Background(), remoteDeleteTimeout)
+	defer cancel()
+	for _, base := range bases {
+		if err := l.deleteRemote(ctx, base); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// truncate はロックを獲得してセグメントを削除し、外部のストレージから削除すべきベースオフセットを返却する。
+func (l *Log) truncate(lowest uint64) ([]uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	l.gen.Add(1)
+
+	// 外部に移したセグメントの範囲は、次のセグメントのベースオフセットの直前までとなる
+	var bases []uint64
+	for len(l.remote) > 0 {
+		next := l.segments[0].baseOffset
+		if len(l.remote) > 1 {
+			next = l.remote[1]
+		}
+		if next > lowest+1 {
+			break
+		}
+		bases = append(bases, l.remote[0])
+		l.remote = l.remote[1:]
+	}
 
 	var segments []*segment
 	for _, s := range l.segments {
 		if s.nextOffset <= lowest+1 {
 			if err := s.Remove(); err != nil {
-				return err
+				return bases, err
 			}
 			continue
 		}
 		segments = append(segments, s)
 	}
 	l.segments = segments
-	return nil
+	if len(segments) == 0 {
+		// アクティブセグメントも削除した場合は、削除したレコードの続きから書き込む
+		l.activeSegment = nil
+		return bases, l.newSegment(lowest + 1)
+	}
+	return bases, nil
+}
+
+// TruncateSuffix はオフセットoff以降のレコードをすべて削除し、次のレコードをoffから書き込むようにする。
+// Raftのリーダーが交代し、フォロワーのログの末尾が新たなリーダーのログと矛盾する場合に利用する。
+// off以降から始まるセグメントは削除し、offを含むセグメントはストアとインデックスを切り詰めて
+// アクティブセグメントとする。外部のストレージに移したセグメントのレコードは削除できない。
+func (l *Log) TruncateSuffix(off uint64) error {
+	// 移動中のセグメントを切り詰めないよう、外部への移動と直列化する
+	l.offloadMu.Lock()
+	defer l.offloadMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if off >= l.activeSegment.nextOffset {
+		return nil
+	}
+	if len(l.remote) > 0 && off < l.segments[0].baseOffset {
+		return fmt.Errorf("cannot truncate offset %d in offloaded segments", off)
+	}
+	l.gen.Add(1)
+	for len(l.segments) > 0 && l.segments[len(l.segments)-1].baseOffset >= off {
+		if err := l.segments[len(l.segments)-1].Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+	}
+	if len(l.segments) == 0 {
+		l.activeSegment = nil
+		return l.newSegment(off)
+	}
+	l.activeSegment = l.segments[len(l.segments)-1]
+	return l.activeSegment.truncate(off)
 }
 
 // Reader はログ全体を読み込むためのio.Readerを返却する。
 // 合意形成の連携においてスナップショット、およびログの復旧ををサポートする場合に利用する。
+// 外部のストレージに移したセグメントは、読み出す順番が来た時点で取得する。
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	readers := make([]io.Reader, len(l.segments))
-	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+	readers := make([]io.Reader, 0, len(l.remote)+len(l.segments))
+	for _, base := range l.remote {
+		readers = append(readers, &remoteReader{log: l, base: base})
+	}
+	for _, segment := range l.segments {
+		readers = append(readers, segment.reader())
 	}
 	// セグメントのストアを連結
 	return io.MultiReader(readers...)
@@ -222,13 +451,17 @@ func (l *Log) Reader() io.Reader {
 // originReader は次の理由からストアを保持する。
 // 1. io.Readerインタフェースを満たし、それをio.MultiReader呼び出し時に渡すため。
 // 2. ストアの最初から読み込みを開始し、そのファイル全体を読み込むことを保証するため。
+//
+//	NOTE:
+//	 ストアを埋め込むと *os.File の WriteTo が昇格し、io.Copy がファイルの現在位置から
+//	 コピーしてしまうため、フィールドとして保持する。
 type originReader struct {
-	*store
-	off int64
+	store *store
+	off   int64
 }
 
-func (o originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
+func (o *originReader) Read(p []byte) (int, error) {
+	n, err := o.store.ReadAt(p, o.off)
 	o.off += int64(n)
 	return n, err
 }
@@ -1,9 +1,13 @@
 package log
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	api "github.com/ac0mz/proglog/api/v1"
 	"github.com/stretchr/testify/require"
@@ -18,6 +22,13 @@ func TestLog(t *testing.T) {
 		"init with existing segments":      testInitExisting,
 		"reader":                           testReader,
 		"truncate":                         testTruncate,
+		"truncate all segments":            testTruncateAll,
+		"truncate suffix":                  testTruncateSuffix,
+		"truncate suffix at boundary":      testTruncateSuffixBoundary,
+		"truncate suffix of whole log":     testTruncateSuffixAll,
+		"reset":                            testReset,
+		"dense index by default":           testDenseIndex,
+		"append at offset":                 testAppendAt,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := os.MkdirTemp("", "store-test")
@@ -34,6 +45,30 @@ func TestLog(t *testing.T) {
 	}
 }
 
+// testAppendAt は空のログには指定したオフセットから書き込み、以降は次のオフセットと一致する場合のみ書き込むことを検証する。
+func testAppendAt(t *testing.T, log *Log) {
+	off, err := log.AppendAt(&api.Record{Value: []byte("first")}, 10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	off, err = log.AppendAt(&api.Record{Value: []byte("second")}, 11)
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), off)
+
+	for _, off := range []uint64{11, 13, 0} {
+		_, err = log.AppendAt(&api.Record{Value: []byte("conflict")}, off)
+		require.Equal(t, api.ErrOffsetMismatch{Offset: off, Next: 12}, err)
+	}
+	record, err := log.Read(10)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), record.Value)
+	_, err = log.Read(0)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), lowest)
+	require.NoError(t, log.Close())
+}
+
 // testAppendRead は正常系で、ログに対する書き込みと読み出しを検証する。
 func testAppendRead(t *testing.T, log *Log) {
 	input := &api.Record{
@@ -49,6 +84,17 @@ func testAppendRead(t *testing.T, log *Log) {
 	require.NoError(t, log.Close())
 }
 
+// testDenseIndex は IndexIntervalBytes が未設定の場合、レコードごとにインデックスのエントリを書き込むことを検証する。
+func testDenseIndex(t *testing.T, log *Log) {
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(0), log.Config.Segment.IndexIntervalBytes)
+	require.Equal(t, uint64(2), log.activeSegment.index.entries())
+	require.NoError(t, log.Close())
+}
+
 // testOutOfRangeErr はログに保存されているオフセットの範囲外であるオフセット読み取り時エラーを検証する。
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
@@ -126,3 +172,160 @@ func testTruncate(t *testing.T, log *Log) {
 	require.Error(t, err)
 	require.NoError(t, log.Close())
 }
+
+// testTruncateAll はアクティブセグメントを含むすべてのセグメントを削除した後も、続きのオフセットから書き込めることを検証する。
+func testTruncateAll(t *testing.T, log *Log) {
+	appendRecords(t, log, 0, 5)
+	require.NoError(t, log.Truncate(4))
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), lowest)
+	off, err := log.Append(&api.Record{Value: []byte("record-5")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.Close())
+}
+
+// testTruncateSuffix はセグメントの途中からレコードを削除し、削除したオフセットから書き直せることを検証する。
+// 切り詰めたセグメントは再作成後も、切り詰めた状態から再開する。
+func testTruncateSuffix(t *testing.T, log *Log) {
+	// オフセット0, 2, 4 から始まる3つのセグメントのうち、2つ目のセグメントの途中から削除する
+	appendRecords(t, log, 0, 5)
+	it := log.Iterator(2)
+	requireNext(t, it, 2)
+	requireNext(t, it, 3)
+	require.NoError(t, log.TruncateSuffix(3))
+
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+	_, err = log.Read(3)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	require.Len(t, log.segments, 2)
+
+	// 切り詰めたセグメントに書き直したレコードを読み出す
+	off, err := log.Append(&api.Record{Value: []byte("rewritten-3")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	record, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, "rewritten-3", string(record.Value))
+	appendRecords(t, log, 4, 6)
+	// 削除した範囲を読み出したイテレータも、書き直したレコードから読み出す
+	it = log.Iterator(3)
+	record, err = it.Next()
+	require.NoError(t, err)
+	require.Equal(t, "rewritten-3", string(record.Value))
+	requireNext(t, it, 4)
+	requireNext(t, it, 5)
+	require.NoError(t, log.Close())
+
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	highest, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), highest)
+	record, err = n.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, "rewritten-3", string(record.Value))
+}
+
+// testTruncateSuffixBoundary はセグメントの先頭から削除した場合に、直前のセグメントの続きから書き込めることを検証する。
+func testTruncateSuffixBoundary(t *testing.T, log *Log) {
+	appendRecords(t, log, 0, 5)
+	require.NoError(t, log.TruncateSuffix(2))
+
+	require.Len(t, log.segments, 1)
+	// 直前のセグメントはクローズ済みとしてメモリにマップされていたが、再び書き込める
+	appendRecords(t, log, 2, 3)
+	require.Len(t, log.segments, 2)
+	for off := uint64(0); off < 3; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record-%d", off), string(record.Value))
+	}
+	// 最新のレコードより後のオフセットを指定した場合は何もしない
+	require.NoError(t, log.TruncateSuffix(10))
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+	require.NoError(t, log.Close())
+}
+
+// testTruncateSuffixAll は最古のレコードから削除した場合に、空のログとして削除したオフセットから書き込めることを検証する。
+func testTruncateSuffixAll(t *testing.T, log *Log) {
+	appendRecords(t, log, 0, 5)
+	require.NoError(t, log.Truncate(1))
+	require.NoError(t, log.TruncateSuffix(1))
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), lowest)
+	off, err := log.Append(&api.Record{Value: []byte("record-1")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.NoError(t, log.Close())
+}
+
+// testReset はログを削除した後、初期オフセットから新たなレコードを書き込めることを検証する。
+func testReset(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	log.Config.Segment.InitialOffset = 10
+	require.NoError(t, log.Reset())
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), lowest)
+	_, err = log.Read(0)
+	require.Error(t, err)
+}
+
+// TestLogReaderDuringTruncate はメモリにマップしたストアを読み出している間に切り詰めても、
+// 読み出しがマップの解除されたメモリにアクセスしないことを検証する。-race で実行すること。
+func TestLogReaderDuringTruncate(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 16 << 10
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	// 読み出しとマップの解除が重なりやすいよう、大きなセグメントを多数作成する
+	const records = 500
+	value := bytes.Repeat([]byte("a"), 1024)
+	for i := 0; i < records; i++ {
+		_, err := log.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// 削除されたセグメントの読み出しはエラーとなるため、エラーは確認しない
+				_, _ = io.Copy(io.Discard, log.Reader())
+			}
+		}()
+	}
+	for lowest := uint64(0); lowest < records; lowest += 10 {
+		require.NoError(t, log.Truncate(lowest))
+		// 読み出しが切り詰めと重なるよう、少しずつ切り詰める
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+}
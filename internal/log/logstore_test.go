@@ -0,0 +1,81 @@
+package log
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLogStoreDeleteRange はRaftのログの先頭と末尾の範囲を削除できることを検証する。
+// 末尾の削除は、リーダーの交代により矛盾したフォロワーのログを新たなリーダーのログで書き直す場合を再現する。
+func TestLogStoreDeleteRange(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 1
+	ls, err := newLogStore(t.TempDir(), c)
+	require.NoError(t, err)
+	defer ls.Close()
+
+	storeLogs := func(term uint64, from, to int) {
+		t.Helper()
+		var logs []*raft.Log
+		for i := from; i <= to; i++ {
+			logs = append(logs, &raft.Log{
+				Index: uint64(i),
+				Term:  term,
+				Type:  raft.LogCommand,
+				Data:  []byte(fmt.Sprintf("term-%d-%d", term, i)),
+			})
+		}
+		require.NoError(t, ls.StoreLogs(logs))
+	}
+	requireLog := func(index, term uint64) {
+		t.Helper()
+		var out raft.Log
+		require.NoError(t, ls.GetLog(index, &out))
+		require.Equal(t, index, out.Index)
+		require.Equal(t, term, out.Term)
+		require.Equal(t, fmt.Sprintf("term-%d-%d", term, index), string(out.Data))
+	}
+	requireRange := func(first, last uint64) {
+		t.Helper()
+		got, err := ls.FirstIndex()
+		require.NoError(t, err)
+		require.Equal(t, first, got)
+		got, err = ls.LastIndex()
+		require.NoError(t, err)
+		require.Equal(t, last, got)
+	}
+
+	// 古いリーダー(term 1)から複製された10件のうち、7件目以降は新たなリーダー(term 2)のログと矛盾する
+	storeLogs(1, 1, 10)
+	require.Greater(t, len(ls.segments), 2)
+	require.NoError(t, ls.DeleteRange(7, 10))
+	requireRange(1, 6)
+	var out raft.Log
+	require.Equal(t, raft.ErrLogNotFound, ls.GetLog(7, &out))
+	storeLogs(2, 7, 12)
+	requireLog(6, 1)
+	requireLog(7, 2)
+	requireLog(12, 2)
+
+	// 途中の範囲は削除できない
+	require.Error(t, ls.DeleteRange(3, 5))
+
+	// スナップショットに保存した先頭の範囲を削除する
+	require.NoError(t, ls.DeleteRange(1, 8))
+	first, err := ls.FirstIndex()
+	require.NoError(t, err)
+	require.LessOrEqual(t, first, uint64(9))
+	require.Equal(t, raft.ErrLogNotFound, ls.GetLog(1, &out))
+	requireLog(9, 2)
+
+	// すべてを削除した後は、続きのインデックスから書き込む
+	require.NoError(t, ls.DeleteRange(first, 12))
+	requireRange(13, 12)
+	storeLogs(3, 13, 14)
+	requireLog(13, 3)
+	requireRange(13, 14)
+}
@@ -0,0 +1,168 @@
+package log
+
+import (
+	"strconv"
+
+	"github.com/hashicorp/raft"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ログのメトリクスを識別するための記述子を定義
+var (
+	segmentsDesc = prometheus.NewDesc(
+		"proglog_log_segments",
+		"Number of segments held by the log.",
+		nil, nil,
+	)
+	bytesDesc = prometheus.NewDesc(
+		"proglog_log_bytes",
+		"Bytes on disk used by the store and index files of the log.",
+		nil, nil,
+	)
+	remoteSegmentsDesc = prometheus.NewDesc(
+		"proglog_log_remote_segments",
+		"Number of segments offloaded to remote storage.",
+		nil, nil,
+	)
+	commitIndexDesc = prometheus.NewDesc(
+		"proglog_raft_commit_index",
+		"Index of the latest log entry known to be committed.",
+		nil, nil,
+	)
+	appliedIndexDesc = prometheus.NewDesc(
+		"proglog_raft_applied_index",
+		"Index of the latest log entry applied to the FSM.",
+		nil, nil,
+	)
+	lastLogIndexDesc = prometheus.NewDesc(
+		"proglog_raft_last_log_index",
+		"Index of the latest log entry stored in the Raft log.",
+		nil, nil,
+	)
+	applyLagDesc = prometheus.NewDesc(
+		"proglog_raft_apply_lag",
+		"Number of committed entries not yet applied to the FSM.",
+		nil, nil,
+	)
+	isLeaderDesc = prometheus.NewDesc(
+		"proglog_raft_is_leader",
+		"Whether this server is the Raft leader (1) or not (0).",
+		nil, nil,
+	)
+)
+
+// logMetrics はログへの書き込みに関するレイテンシを保持する。
+type logMetrics struct {
+	appendLatency   prometheus.Histogram
+	fsyncLatency    prometheus.Histogram
+	offloadFailures prometheus.Counter
+}
+
+func newLogMetrics() *logMetrics {
+	return &logMetrics{
+		appendLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "proglog_log_append_duration_seconds",
+			Help:    "Latency of appending a record to the log.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}),
+		fsyncLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "proglog_log_fsync_duration_seconds",
+			Help:    "Latency of syncing segment files to stable storage.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		offloadFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proglog_log_offload_failures_total",
+			Help: "Number of failed attempts to offload closed segments to remote storage.",
+		}),
+	}
+}
+
+var _ prometheus.Collector = (*Log)(nil)
+
+// Describe はログが収集するメトリクスの記述子を送信する。
+func (l *Log) Describe(ch chan<- *prometheus.Desc) {
+	ch <- segmentsDesc
+	ch <- bytesDesc
+	ch <- remoteSegmentsDesc
+	l.metrics.appendLatency.Describe(ch)
+	l.metrics.fsyncLatency.Describe(ch)
+	l.metrics.offloadFailures.Describe(ch)
+}
+
+// Collect はスクレイプ時点でのセグメント数とディスク使用量、外部に移したセグメント数、および書き込みレイテンシを送信する。
+func (l *Log) Collect(ch chan<- prometheus.Metric) {
+	l.mu.RLock()
+	var size uint64
+	for _, s := range l.segments {
+		size += s.store.size + s.index.size
+	}
+	segments, remote := len(l.segments), len(l.remote)
+	l.mu.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(segmentsDesc, prometheus.GaugeValue, float64(segments))
+	ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.GaugeValue, float64(size))
+	ch <- prometheus.MustNewConstMetric(remoteSegmentsDesc, prometheus.GaugeValue, float64(remote))
+	l.metrics.appendLatency.Collect(ch)
+	l.metrics.fsyncLatency.Collect(ch)
+	l.metrics.offloadFailures.Collect(ch)
+}
+
+var _ prometheus.Collector = (*DistributedLog)(nil)
+
+// Register はユーザのログ、Raftのログ、およびRaftの状態に関するメトリクスをレジストリに登録する。
+// 2つのログは同じメトリクス名を持つため、log ラベルで区別する。
+func (l *DistributedLog) Register(reg prometheus.Registerer) error {
+	for name, c := range map[string]prometheus.Collector{
+		"data": l.log,
+		"raft": l.raftLog.Log,
+	} {
+		wrapped := prometheus.WrapRegistererWith(prometheus.Labels{"log": name}, reg)
+		if err := wrapped.Register(c); err != nil {
+			return err
+		}
+	}
+	return reg.Register(l)
+}
+
+// Describe はRaftの状態に関するメトリクスの記述子を送信する。
+func (l *DistributedLog) Describe(ch chan<- *prometheus.Desc) {
+	ch <- commitIndexDesc
+	ch <- appliedIndexDesc
+	ch <- lastLogIndexDesc
+	ch <- applyLagDesc
+	ch <- isLeaderDesc
+	l.applyLatency.Describe(ch)
+	l.replicationLatency.Describe(ch)
+}
+
+// Collect はRaftの統計情報からコミット済インデックスや適用の遅れを算出して送信する。
+func (l *DistributedLog) Collect(ch chan<- prometheus.Metric) {
+	stats := l.raft.Stats()
+	commitIndex := parseStat(stats, "commit_index")
+	appliedIndex := parseStat(stats, "applied_index")
+	var lag uint64
+	if commitIndex > appliedIndex {
+		lag = commitIndex - appliedIndex
+	}
+	var isLeader float64
+	if l.raft.State() == raft.Leader {
+		isLeader = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(commitIndexDesc, prometheus.GaugeValue, float64(commitIndex))
+	ch <- prometheus.MustNewConstMetric(appliedIndexDesc, prometheus.GaugeValue, float64(appliedIndex))
+	ch <- prometheus.MustNewConstMetric(lastLogIndexDesc, prometheus.GaugeValue, float64(parseStat(stats, "last_log_index")))
+	ch <- prometheus.MustNewConstMetric(applyLagDesc, prometheus.GaugeValue, float64(lag))
+	ch <- prometheus.MustNewConstMetric(isLeaderDesc, prometheus.GaugeValue, isLeader)
+	l.applyLatency.Collect(ch)
+	l.replicationLatency.Collect(ch)
+}
+
+// parseStat はRaftの統計情報から数値の項目を取得する。値が数値でない場合は0を返却する。
+func parseStat(stats map[string]string, key string) uint64 {
+	v, err := strconv.ParseUint(stats[key], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
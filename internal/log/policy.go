@@ -0,0 +1,175 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// policyFrameMarker はスナップショット内でポリシーのフレームを識別するための値である。
+// レコード長の位置にこの値を書き込み、その後にポリシー一覧の長さとデータを続ける。
+// レコード長として取り得ない値のため、ポリシーを含まない以前の形式のスナップショットと区別できる。
+const policyFrameMarker = math.MaxUint64
+
+// maxPolicyFrameBytes はポリシーのフレームの長さの上限である。
+// 壊れたスナップショットの長さをそのまま確保しないよう、読み出す前に検証する。
+const maxPolicyFrameBytes = 64 << 20
+
+// PolicyHandler はRaftにより複製されたACLのポリシーを受け取る。
+// ポリシーが変更されるたびに、すべてのポリシーを引数として呼び出される。
+type PolicyHandler interface {
+	SetPolicies([]*api.Policy) error
+}
+
+// AddPolicy はACLのポリシーを追加し、Raftによりクラスタ内のすべてのサーバに複製する。
+func (l *DistributedLog) AddPolicy(ctx context.Context, policy *api.Policy) error {
+	_, err := l.apply(ctx, AddPolicyRequestType, &api.AddPolicyRequest{Policy: policy})
+	return err
+}
+
+// RemovePolicy はACLのポリシーを削除し、Raftによりクラスタ内のすべてのサーバに複製する。
+func (l *DistributedLog) RemovePolicy(ctx context.Context, policy *api.Policy) error {
+	_, err := l.apply(ctx, RemovePolicyRequestType, &api.RemovePolicyRequest{Policy: policy})
+	return err
+}
+
+// ListPolicies は当該サーバのFSMに適用済みのポリシー一覧を返却する。
+// ファイルから読み込んだポリシーは含まない。
+func (l *DistributedLog) ListPolicies() []*api.Policy {
+	return l.fsm.policies.list()
+}
+
+// applyPolicy はポリシーを追加または削除し、変更を通知する。
+func (f *fsm) applyPolicy(reqType RequestType, b []byte) interface{} {
+	var changed bool
+	switch reqType {
+	case AddPolicyRequestType:
+		var req api.AddPolicyRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		changed = f.policies.add(req.Policy)
+	case RemovePolicyRequestType:
+		var req api.RemovePolicyRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		changed = f.policies.remove(req.Policy)
+	}
+	if !changed {
+		return nil
+	}
+	if err := f.notifyPolicies(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// notifyPolicies はハンドラにポリシー一覧を通知する。
+func (f *fsm) notifyPolicies() error {
+	if f.handler == nil {
+		return nil
+	}
+	return f.handler.SetPolicies(f.policies.list())
+}
+
+// policySet は重複のないポリシーを追加された順に保持する。
+type policySet struct {
+	mu       sync.RWMutex
+	policies []*api.Policy
+}
+
+func newPolicySet() *policySet {
+	return &policySet{}
+}
+
+// policyKey はポリシーの同一性を判定するためのキーを返却する。
+func policyKey(p *api.Policy) string {
+	return p.Ptype + "\x00" + strings.Join(p.Values, "\x00")
+}
+
+func (s *policySet) add(p *api.Policy) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := policyKey(p)
+	for _, q := range s.policies {
+		if policyKey(q) == key {
+			return false
+		}
+	}
+	s.policies = append(s.policies, p)
+	return true
+}
+
+func (s *policySet) remove(p *api.Policy) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := policyKey(p)
+	for i, q := range s.policies {
+		if policyKey(q) == key {
+			s.policies = append(s.policies[:i:i], s.policies[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// list はポリシー一覧の複製を返却する。
+func (s *policySet) list() []*api.Policy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	policies := make([]*api.Policy, len(s.policies))
+	for i, p := range s.policies {
+		policies[i] = proto.Clone(p).(*api.Policy)
+	}
+	return policies
+}
+
+func (s *policySet) replace(policies []*api.Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies = policies
+}
+
+// frame はスナップショットに書き込むポリシーのフレームを作成する。
+func (s *policySet) frame() ([]byte, error) {
+	b, err := proto.Marshal(&api.ListPoliciesResponse{Policies: s.list()})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	header := make([]byte, 2*lenWidth)
+	enc.PutUint64(header[:lenWidth], policyFrameMarker)
+	enc.PutUint64(header[lenWidth:], uint64(len(b)))
+	buf.Write(header)
+	buf.Write(b)
+	return buf.Bytes(), nil
+}
+
+// readPolicyFrame は目印に続くポリシーのフレームを読み出す。
+func readPolicyFrame(r io.Reader) ([]*api.Policy, error) {
+	b := make([]byte, lenWidth)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("failed to read policy frame: %w", err)
+	}
+	size := enc.Uint64(b)
+	if size > maxPolicyFrameBytes {
+		return nil, fmt.Errorf("invalid policy frame length: %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("failed to read policy frame: %w", err)
+	}
+	var res api.ListPoliciesResponse
+	if err := proto.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return res.Policies, nil
+}
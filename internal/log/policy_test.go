@@ -0,0 +1,106 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"testing"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestPolicySnapshot はポリシーがスナップショットを経由して復元されること、
+// およびポリシーを含まない以前の形式のスナップショットも復元できることを検証する。
+func TestPolicySnapshot(t *testing.T) {
+	newFSM := func() (*fsm, *policyRecorder) {
+		dir, err := os.MkdirTemp("", "policy-snapshot-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		log, err := NewLog(dir, Config{})
+		require.NoError(t, err)
+		h := &policyRecorder{}
+		return &fsm{log: log, policies: newPolicySet(), handler: h}, h
+	}
+
+	src, _ := newFSM()
+	policy := &api.Policy{Ptype: "p", Values: []string{"alice", "*", "produce"}}
+	b, err := proto.Marshal(&api.AddPolicyRequest{Policy: policy})
+	require.NoError(t, err)
+	require.Nil(t, src.applyPolicy(AddPolicyRequestType, b))
+	// 重複したポリシーは追加されない
+	require.Nil(t, src.applyPolicy(AddPolicyRequestType, b))
+	_, err = src.log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	snap, err := src.Snapshot()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, snap.(*snapshot).Persist(&sink{Buffer: &buf}))
+	data := buf.Bytes()
+
+	dst, h := newFSM()
+	require.NoError(t, dst.Restore(io.NopCloser(bytes.NewReader(data))))
+	require.Equal(t, 1, len(dst.policies.list()))
+	require.True(t, proto.Equal(policy, dst.policies.list()[0]))
+	require.Equal(t, 1, len(h.policies))
+	record, err := dst.log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+
+	// ポリシーのフレームを取り除いた以前の形式
+	frame, err := src.policies.frame()
+	require.NoError(t, err)
+	legacy, _ := newFSM()
+	require.NoError(t, legacy.Restore(io.NopCloser(bytes.NewReader(data[len(frame):]))))
+	require.Equal(t, 0, len(legacy.policies.list()))
+	record, err = legacy.log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+
+	// ポリシーのみを含むスナップショットでも、既存のレコードは破棄する
+	stale, _ := newFSM()
+	_, err = stale.log.Append(&api.Record{Value: []byte("stale")})
+	require.NoError(t, err)
+	require.NoError(t, stale.Restore(io.NopCloser(bytes.NewReader(frame))))
+	require.Equal(t, 1, len(stale.policies.list()))
+	_, err = stale.log.Read(0)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	// ポリシーのフレームが壊れている場合は、確保や読み出しの前にエラーとする
+	corrupt := func(size uint64, body string) []byte {
+		b := make([]byte, 2*lenWidth)
+		enc.PutUint64(b, policyFrameMarker)
+		enc.PutUint64(b[lenWidth:], size)
+		return append(b, body...)
+	}
+	for _, b := range [][]byte{
+		corrupt(1, "")[:lenWidth+3],        // 長さが切り詰められている
+		corrupt(math.MaxUint64, ""),        // 長さが巨大
+		corrupt(maxPolicyFrameBytes+1, ""), // 長さが上限を超える
+		corrupt(16, "x"),                   // データが切り詰められている
+	} {
+		f, _ := newFSM()
+		require.Error(t, f.Restore(io.NopCloser(bytes.NewReader(b))))
+	}
+}
+
+type policyRecorder struct {
+	policies []*api.Policy
+}
+
+func (r *policyRecorder) SetPolicies(policies []*api.Policy) error {
+	r.policies = policies
+	return nil
+}
+
+// sink はスナップショットをメモリ上に書き込む raft.SnapshotSink である。
+type sink struct {
+	*bytes.Buffer
+}
+
+func (s *sink) ID() string    { return "test" }
+func (s *sink) Cancel() error { return nil }
+func (s *sink) Close() error  { return nil }
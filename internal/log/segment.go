@@ -1,7 +1,9 @@
 package log
 
 import (
+	"crypto/cipher"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -16,6 +18,12 @@ type segment struct {
 	index                  *index
 	baseOffset, nextOffset uint64 // base:相対的なオフセット計算用, next:新規レコード追加時のオフセット
 	config                 Config // セグメントサイズにおける最大を比較して検知するための制限値
+
+	keyID string      // レコードを暗号化する鍵のID
+	aead  cipher.AEAD // 平文のセグメントの場合はnil
+	pos   uint64      // 最初のレコードの位置 (鍵IDのフレームの直後)
+
+	indexedPos uint64 // インデックスの最後のエントリのレコードの位置
 }
 
 // newSegment はsegmentを生成して返却する。
@@ -40,9 +48,17 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.store, err = newStore(storeFile); err != nil {
 		return nil, err
 	}
+	if err = s.setupEncryption(); err != nil {
+		return nil, err
+	}
 	// インデックスファイルを開いて、セグメントにポインタを設定
+	// 以前の形式のインデックスは、開く前に現在の形式に移行する
+	indexName := filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index"))
+	if err = migrateIndex(indexName, c); err != nil {
+		return nil, err
+	}
 	indexFile, err := os.OpenFile(
-		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+		indexName,
 		// インデックスの場合はメモリマップされたファイルを用いる(ストレージに永続化しない)ためO_APPENDは不要
 		os.O_RDWR|os.O_CREATE,
 		0600,
@@ -53,36 +69,115 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
-	// 設定対象である次に追加されるオフセットを評価
-	if off, _, err := s.index.Read(-1); err != nil {
-		// インデックスが空の場合、ベースオフセットを次のオフセットとする
-		s.nextOffset = baseOffset
-	} else {
-		// インデックスに少なくとも1つのエントリが存在する場合、ベースオフセットと相対オフセットの和に1を加算
-		s.nextOffset = baseOffset + uint64(off) + 1
+	if err = s.setupNextOffset(); err != nil {
+		return nil, err
 	}
 	return s, nil
 }
 
+// setupNextOffset は次に追加されるオフセットを評価する。
+// インデックスの最後のエントリ (空の場合は最初のレコード) からストアの末尾までレコードを数え、
+// ベースオフセットと相対オフセットの和に加算する。
+// 書き込みの途中で停止したために末尾のレコードが欠けている場合は、ストアを直前のレコードまで切り詰める。
+// インデックスはバッファを介さずに書き込まれるため、ストアに存在しないレコードを指すエントリも削除する。
+func (s *segment) setupNextOffset() error {
+	s.index.truncatePos(s.store.size)
+	off, pos, err := s.index.Read(-1)
+	if err == io.EOF {
+		off, pos = 0, s.pos
+	} else if err != nil {
+		return err
+	}
+	size := make([]byte, lenWidth)
+	for pos < s.store.size {
+		if pos+lenWidth > s.store.size {
+			break
+		}
+		if _, err = s.store.ReadAt(size, int64(pos)); err != nil {
+			return err
+		}
+		next := pos + lenWidth + enc.Uint64(size)
+		if next > s.store.size {
+			break
+		}
+		pos = next
+		off++
+	}
+	if pos < s.store.size {
+		if err = s.store.truncate(pos); err != nil {
+			return err
+		}
+		// 欠けたレコードを指すエントリは削除する
+		s.index.truncatePos(pos)
+	}
+	s.nextOffset = s.baseOffset + off
+	s.indexedPos = s.pos
+	if _, indexedPos, err := s.index.Read(-1); err == nil {
+		s.indexedPos = indexedPos
+	}
+	return nil
+}
+
+// setupEncryption はセグメントの暗号化に用いる鍵を設定する。
+// 新たなセグメントはKeyringの現在の鍵で暗号化し、その鍵IDをストアの先頭に記録する。
+// 既存のセグメントは記録された鍵IDの鍵で読み書きするため、鍵をローテーションしても古いセグメントを読み出せる。
+// Keyringを設定する前に作成された平文のセグメントは、平文のまま読み書きする。
+func (s *segment) setupEncryption() error {
+	keyring := s.config.Keyring
+	if s.store.size == 0 {
+		if keyring == nil {
+			return nil
+		}
+		s.keyID, s.aead = keyring.Active()
+		if err := writeKeyFrame(s.store, s.keyID); err != nil {
+			return err
+		}
+		s.pos = s.store.size
+		return nil
+	}
+	id, pos, ok, err := readKeyFrame(s.store)
+	if err != nil || !ok {
+		return err
+	}
+	if keyring == nil {
+		return fmt.Errorf("segment %d is encrypted with key %q but no keyring is configured", s.baseOffset, id)
+	}
+	if s.aead, err = keyring.Key(id); err != nil {
+		return err
+	}
+	s.keyID, s.pos = id, pos
+	return nil
+}
+
 // Append はセグメントにレコードを書き込み、新たに追加されたレコードのオフセットを返却する。
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	cur := s.nextOffset
+	// 最初のレコードと、直前のエントリから IndexIntervalBytes 以上離れたレコードのみインデックスに書き込む
+	// インデックスに空きがない場合は、ストアに書き込む前にエラーとする
+	indexed := s.index.entries() == 0 || s.store.size-s.indexedPos >= s.config.Segment.IndexIntervalBytes
+	if indexed && s.index.isMaxed() {
+		return 0, io.EOF
+	}
 	record.Offset = cur
 	p, err := proto.Marshal(record)
 	if err != nil {
 		return 0, err
 	}
+	if s.aead != nil {
+		if p, err = seal(s.aead, p, cur); err != nil {
+			return 0, err
+		}
+	}
 	_, pos, err := s.store.Append(p)
 	if err != nil {
 		return 0, err
 	}
-	if err = s.index.Write(
+	if indexed {
 		// インデックスのオフセットは、ベースオフセットに対する相対的な値のため減算で求める
-		uint32(s.nextOffset-s.baseOffset),
-		pos,
-	); err != nil {
-		// WARNING: s.store.Append(p)で追加されたレコードはゴミとして残ったままとなる
-		return 0, err
+		if err = s.index.Write(s.nextOffset-s.baseOffset, pos); err != nil {
+			return 0, err
+		}
+		s.indexedPos = pos
 	}
 	s.nextOffset++
 	return cur, nil
@@ -90,8 +185,7 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 
 // Read は指定されたオフセットのレコードを返却する。
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	// 絶対オフセットから算出した相対オフセットを引数として渡して、インデックスエントリを取得
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	pos, err := s.position(off)
 	if err != nil {
 		return nil, err
 	}
@@ -100,9 +194,73 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	if err != nil {
 		return nil, err
 	}
+	if s.aead != nil {
+		if b, err = open(s.aead, b, off); err != nil {
+			return nil, err
+		}
+	}
 	record := &api.Record{}
 	err = proto.Unmarshal(b, record)
-	return record, nil
+	return record, err
+}
+
+// position は指定されたオフセットのレコードのストア内の位置を返却する。
+// 絶対オフセットから算出した相対オフセット以下の直近のインデックスエントリを取得し、
+// そのレコードからストアのレコード長をたどって位置を求める。
+func (s *segment) position(off uint64) (uint64, error) {
+	if off < s.baseOffset || off >= s.nextOffset {
+		return 0, io.EOF
+	}
+	rel, pos, err := s.index.Find(off - s.baseOffset)
+	if err != nil {
+		return 0, err
+	}
+	size := make([]byte, lenWidth)
+	for ; rel < off-s.baseOffset; rel++ {
+		if _, err = s.store.ReadAt(size, int64(pos)); err != nil {
+			return 0, err
+		}
+		pos += lenWidth + enc.Uint64(size)
+	}
+	return pos, nil
+}
+
+// truncate はオフセットoff以降のレコードをストアとインデックスから削除し、offから再び書き込めるようにする。
+// offがnextOffsetと等しい場合はレコードを削除せず、seal したストアを書き込めるようにする。
+func (s *segment) truncate(off uint64) error {
+	if off < s.baseOffset || off > s.nextOffset {
+		return fmt.Errorf("offset %d is out of segment %d-%d", off, s.baseOffset, s.nextOffset)
+	}
+	pos := s.store.size
+	if off < s.nextOffset {
+		var err error
+		if pos, err = s.position(off); err != nil {
+			return err
+		}
+	}
+	s.index.truncate(off - s.baseOffset)
+	if err := s.store.truncate(pos); err != nil {
+		return err
+	}
+	s.nextOffset = off
+	s.indexedPos = s.pos
+	if _, indexedPos, err := s.index.Read(-1); err == nil {
+		s.indexedPos = indexedPos
+	}
+	return nil
+}
+
+// reader はセグメントのレコードを、レコード長を付与した平文の形式で先頭から読み出すio.Readerを返却する。
+func (s *segment) reader() io.Reader {
+	if s.aead == nil {
+		return &originReader{store: s.store}
+	}
+	return &plaintextReader{segment: s, pos: s.pos, off: s.baseOffset}
+}
+
+// seal はセグメントへの書き込みを終え、ストアをメモリにマップして読み出すようにする。
+func (s *segment) seal() error {
+	return s.store.seal()
 }
 
 // isMaxed はセグメントが最大サイズに達したか(ストアまたはインデックスへの書き込みが一杯になったか)を判定する。
@@ -128,6 +286,14 @@ func (s *segment) Remove() error {
 	return nil
 }
 
+// Sync はセグメントで保持しているストアとインデックスをストレージに同期する。
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	return s.index.file.Sync()
+}
+
 // Close はセグメントで保持しているインデックスとストアを閉じる。
 func (s *segment) Close() error {
 	if err := s.index.Close(); err != nil {
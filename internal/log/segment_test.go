@@ -1,8 +1,10 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 
 	api "github.com/ac0mz/proglog/api/v1"
@@ -21,8 +23,8 @@ func TestSegment(t *testing.T) {
 	baseOff := uint64(16)
 
 	c := Config{}
-	c.Segment.MaxStoreBytes = 1024         // 検証用として十分なサイズを確保
-	c.Segment.MaxIndexBytes = entWidth * 3 // 3件までのエントリサイズ (36B)
+	c.Segment.MaxStoreBytes = 1024                          // 検証用として十分なサイズを確保
+	c.Segment.MaxIndexBytes = indexHeaderWidth + entWidth*3 // ヘッダと3件までのエントリサイズ (56B)
 
 	s, err := newSegment(dir, baseOff, c)
 	require.NoError(t, err)
@@ -48,15 +50,16 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, s.Close())
 
 	p, _ := proto.Marshal(want)
-	c.Segment.MaxStoreBytes = uint64(len(p)+lenWidth) * 4 // 境界値検証用サイズとして92B
+	c.Segment.MaxStoreBytes = uint64(len(p)+lenWidth) * 3 // 境界値検証用サイズとして69B
 	c.Segment.MaxIndexBytes = 1024                        // 検証用として十分なサイズを確保
 	// 既存のセグメントを再構築
 	s, err = newSegment(dir, baseOff, c)
 	require.NoError(t, err)
 	// ストアが最大であること
-	// ※再構築前におけるClose直前のAppendにてインデックス追加は失敗したが、
-	// ストアは追加された状態のため、Append前のサイズ69Bに対して1レコード分の+23Bで結果92Bとなる
+	// ※再構築前におけるClose直前のAppendはインデックスに空きがないため、ストアに書き込む前に失敗した
+	// そのためストアは3レコード分の69Bとなる
 	// 1レコードにおける23Bの内訳は、15(バイナリワイヤ形式によるwantのサイズ) + 8(lenWidth)である
+	require.Equal(t, baseOff+3, s.nextOffset)
 	require.True(t, s.isMaxed())
 	// インデックスとストアのファイルを物理削除
 	require.NoError(t, s.Remove())
@@ -67,3 +70,136 @@ func TestSegment(t *testing.T) {
 	require.False(t, s.isMaxed())
 	require.NoError(t, s.Close())
 }
+
+// TestSparseSegment は疎なインデックスのセグメントから、エントリのないレコードもストアをたどって読み出せること、
+// および再構築時にインデックスの最後のエントリ以降のレコードを数えて次のオフセットを求めることを検証する。
+func TestSparseSegment(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexIntervalBytes = 64 // 約20Bのレコード4件ごとにエントリを書き込む
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := s.Append(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+		require.NoError(t, err)
+	}
+	require.Equal(t, uint64(3), s.index.entries())
+	readAll := func(s *segment) {
+		t.Helper()
+		for off := uint64(0); off < 10; off++ {
+			got, err := s.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("record-%d", off), string(got.Value))
+		}
+		_, err := s.Read(10)
+		require.Equal(t, io.EOF, err)
+	}
+	readAll(s)
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), s.nextOffset)
+	readAll(s)
+	size := s.store.size
+	require.NoError(t, s.Close())
+
+	// 書き込みの途中で停止した場合を再現するため、ストアの末尾に欠けたレコードを残す
+	f, err := os.OpenFile(filepath.Join(dir, "0.store"), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 100, 'x'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, uint64(10), s.nextOffset)
+	require.Equal(t, size, s.store.size)
+	off, err := s.Append(&api.Record{Value: []byte("record-10")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	got, err := s.Read(10)
+	require.NoError(t, err)
+	require.Equal(t, "record-10", string(got.Value))
+}
+
+// TestRecoverIndexBeyondStore は、ストアに書き込まれる前に停止したレコードのエントリがインデックスに残っていても、
+// 再構築時にそのエントリを削除して、ストアに存在するレコードの続きから書き込むことを検証する。
+func TestRecoverIndexBeyondStore(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := s.Append(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+		require.NoError(t, err)
+	}
+	size := s.store.size
+	// 欠けたレコードと、ストアの末尾を超えるレコードを指すエントリを残す
+	require.NoError(t, s.index.Write(3, size))
+	require.NoError(t, s.index.Write(4, size+100))
+	require.NoError(t, s.Close())
+	f, err := os.OpenFile(filepath.Join(dir, "0.store"), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 100, 'x'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, uint64(3), s.nextOffset)
+	require.Equal(t, size, s.store.size)
+	require.Equal(t, uint64(3), s.index.entries())
+	off, err := s.Append(&api.Record{Value: []byte("record-3")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	for off := uint64(0); off < 4; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record-%d", off), string(got.Value))
+	}
+}
+
+// TestMigrateSegment はバージョン1のインデックスのセグメントを開くと、移行して読み書きできることを検証する。
+func TestMigrateSegment(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	// バージョン1のセグメントとして、レコードごとに32ビットの相対オフセットのエントリを書き込む
+	var store, index []byte
+	for i := 0; i < 5; i++ {
+		p, err := proto.Marshal(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i)), Offset: uint64(100 + i)})
+		require.NoError(t, err)
+		e := make([]byte, v1EntWidth)
+		enc.PutUint32(e[:v1OffWidth], uint32(i))
+		enc.PutUint64(e[v1OffWidth:], uint64(len(store)))
+		index = append(index, e...)
+		store = append(store, make([]byte, lenWidth)...)
+		enc.PutUint64(store[len(store)-lenWidth:], uint64(len(p)))
+		store = append(store, p...)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "100.store"), store, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "100.index"), index, 0600))
+
+	s, err := newSegment(dir, 100, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, uint64(105), s.nextOffset)
+	off, err := s.Append(&api.Record{Value: []byte("record-5")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(105), off)
+	for i := uint64(0); i < 6; i++ {
+		got, err := s.Read(100 + i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record-%d", i), string(got.Value))
+	}
+}
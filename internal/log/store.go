@@ -3,8 +3,12 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
 var (
@@ -16,11 +20,69 @@ const (
 )
 
 // store はファイルを保持し、ファイルにバイトを追加および読み出しを行うAPIを備える。
+//
+// 書き込みはバッファしてまとめてファイルに書き込み、ファイルに書き込み済みのサイズを committed として公開する。
+// committed までの範囲の読み出しはロックを獲得せずにファイルから直接読み出すため、
+// 複数の読み出しが書き込みと並行して実行できる。バッファにのみ存在する範囲を読み出す場合に限り、
+// ロックを獲得してバッファを書き込む。seal 後は、メモリにマップしたファイルから読み出す。
 type store struct {
 	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
-	size uint64
+	mu        sync.Mutex
+	buf       *bufio.Writer
+	size      uint64                  // バッファを含めたストアのサイズ
+	end       atomic.Uint64           // size をロックを獲得せずに参照するための値
+	committed atomic.Uint64           // ファイルに書き込み済みのサイズ
+	mmap      atomic.Pointer[mapping] // seal 後のメモリマップされたファイル
+}
+
+// mapping はメモリにマップしたストアのファイルである。
+//
+// 読み出しはロックを獲得せずにマップからコピーするため、クローズや切り詰めと並行して実行されうる。
+// コピー中にマップが解除されないよう参照を数え、ストア自身の参照と読み出し中の参照が
+// すべて解放されたときにマップを解除する。
+type mapping struct {
+	data []byte
+	refs atomic.Int64
+}
+
+// newMapping はストア自身の参照を保持したマップを作成する。
+func newMapping(data []byte) *mapping {
+	m := &mapping{data: data}
+	m.refs.Store(1)
+	return m
+}
+
+// acquire はマップの参照を獲得する。マップが解除済みの場合はfalseを返却する。
+func (m *mapping) acquire() bool {
+	for {
+		n := m.refs.Load()
+		if n == 0 {
+			return false
+		}
+		if m.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// release はマップの参照を解放し、最後の参照であればマップを解除する。
+func (m *mapping) release() error {
+	if m.refs.Add(-1) == 0 {
+		return syscall.Munmap(m.data)
+	}
+	return nil
+}
+
+// readAt はマップのオフセット位置から始まるバイトデータを読み込む。
+func (m *mapping) readAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
 }
 
 // newStore は与えられたファイルに対するstoreを作成する。
@@ -33,17 +95,23 @@ func newStore(f *os.File) (*store, error) {
 	// ファイルの現在のサイズを取得
 	// (サービス再起動等により既存ファイルからstoreを再作成する場合にこのサイズ情報を利用)
 	size := uint64(fi.Size())
-	return &store{
+	s := &store{
 		File: f,
 		size: size,
 		buf:  bufio.NewWriter(f),
-	}, nil
+	}
+	s.end.Store(size)
+	s.committed.Store(size)
+	return s, nil
 }
 
 // Append は与えられたバイトデータをストアに永続化し、レコードサイズとレコード開始位置を返却する。
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.mmap.Load() != nil {
+		return 0, 0, errors.New("store is sealed")
+	}
 	pos = s.size
 
 	// レコード読み出し時に何バイト読めば良いか分かるようにするため、レコードの長さを書き込み
@@ -59,6 +127,9 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	// 書き込んだバイト数とレコード長の合計値をサイズとする
 	w += lenWidth
 	s.size += uint64(w)
+	s.end.Store(s.size)
+	// バッファが一杯になり書き込まれた範囲は、ロックなしで読み出せるよう公開する
+	s.committed.Store(s.size - uint64(s.buf.Buffered()))
 	// レコードサイズ、およびストアがファイル内で保持するレコード開始位置(※)を返却
 	// ※このレコードに関連するインデックスエントリを作成する際に、セグメントは当該レコード位置を利用する
 	return uint64(w), pos, nil
@@ -66,41 +137,141 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 
 // Read は指定された位置に格納されているレコードを返却する。
 func (s *store) Read(pos uint64) ([]byte, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	// バッファ内に残っているファイル未永続化のデータを書き込み
-	if err := s.buf.Flush(); err != nil {
-		return nil, err
-	}
-
 	size := make([]byte, lenWidth)
 	// レコード全体を読み取るために必要なバイト数を取得
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+	if _, err := s.ReadAt(size, int64(pos)); err != nil {
 		return nil, err
 	}
 	b := make([]byte, enc.Uint64(size))
 	// レコードを取得
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+	if _, err := s.ReadAt(b, int64(pos+lenWidth)); err != nil {
 		return nil, err
 	}
 	return b, nil
 }
 
 // ReadAt はストアにおけるファイルのオフセット位置から始まるバイトデータを読み込み、バイト数を返却する。
+// committed までの範囲はロックを獲得せずに読み出し、残りの範囲がバッファに存在する場合のみ
+// バッファを書き込んでから読み出す。
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
+	// 参照の獲得に失敗したマップは既にストアから外されているため、読み込み直すと nil か新しいマップが得られる
+	for m := s.mmap.Load(); m != nil; m = s.mmap.Load() {
+		if !m.acquire() {
+			continue
+		}
+		n, err := m.readAt(p, off)
+		m.release()
+		return n, err
+	}
+	n, err := s.readCommitted(p, off)
+	if n == len(p) || err != nil {
+		return n, err
+	}
+	if uint64(off)+uint64(n) >= s.end.Load() {
+		// 末尾を超える範囲は書き込まれていないため、ロックを獲得せずに終える
+		return n, io.EOF
+	}
+	if err = s.flush(); err != nil {
+		return n, err
+	}
+	m, err := s.File.ReadAt(p[n:], off+int64(n))
+	return n + m, err
+}
+
+// readCommitted はファイルに書き込み済みの範囲に限って、ロックを獲得せずに読み出す。
+func (s *store) readCommitted(p []byte, off int64) (int, error) {
+	committed := s.committed.Load()
+	if uint64(off) >= committed {
+		return 0, nil
+	}
+	if rest := committed - uint64(off); uint64(len(p)) > rest {
+		p = p[:rest]
+	}
+	return s.File.ReadAt(p, off)
+}
+
+// flush はバッファされたデータをファイルに書き込み、読み出せる範囲として公開する。
+func (s *store) flush() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.flushLocked()
+}
+
+// flushLocked は flush と同じ処理を行う。呼び出し元でロックを獲得すること。
+func (s *store) flushLocked() error {
 	if err := s.buf.Flush(); err != nil {
-		return 0, err
+		return err
 	}
-	return s.File.ReadAt(p, off)
+	s.committed.Store(s.size)
+	return nil
+}
+
+// seal は以降書き込まないストアのファイルをメモリにマップし、読み出しをシステムコールなしで行えるようにする。
+// seal 後の書き込みはエラーとなる。空のストアはマップしない。
+func (s *store) seal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushLocked(); err != nil {
+		return err
+	}
+	if s.size == 0 || s.mmap.Load() != nil {
+		return nil
+	}
+	m, err := syscall.Mmap(int(s.File.Fd()), 0, int(s.size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	s.mmap.Store(newMapping(m))
+	return nil
+}
+
+// unmap はストアからマップを外し、ストア自身の参照を解放する。
+// 読み出し中のマップは、最後の読み出しが参照を解放したときに解除される。
+func (s *store) unmap() error {
+	if m := s.mmap.Swap(nil); m != nil {
+		return m.release()
+	}
+	return nil
+}
+
+// truncate はストアをsizeバイトに切り詰める。seal 後のストアは、再び書き込めるようメモリへのマップを解除する。
+func (s *store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushLocked(); err != nil {
+		return err
+	}
+	if err := s.unmap(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	s.end.Store(size)
+	s.committed.Store(size)
+	return nil
+}
+
+// Sync はバッファされたデータを書き込み、ファイルをストレージに同期する。
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushLocked(); err != nil {
+		return err
+	}
+	return s.File.Sync()
 }
 
 // Close はファイルをクローズする。ただしクローズ前にバッファされたデータを永続化する。
+// クローズ後の読み出しはエラーとなる。
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
+	if err := s.flushLocked(); err != nil {
+		return err
+	}
+	if err := s.unmap(); err != nil {
 		return err
 	}
 	return s.File.Close()
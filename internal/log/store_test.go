@@ -1,8 +1,12 @@
 package log
 
 import (
+	"bytes"
+	"io"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -83,6 +87,143 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+// TestStoreReadWithoutFlush ファイルに書き込み済みの範囲の読み出しでは、バッファを書き込まないことを確認する。
+func TestStoreReadWithoutFlush(t *testing.T) {
+	f, err := os.CreateTemp("", "store_read_without_flush_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), s.committed.Load())
+	// バッファにのみ存在するレコードは、バッファを書き込んでから読み出す
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	require.Equal(t, width, s.committed.Load())
+
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	read, err = s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	require.Equal(t, int(width), s.buf.Buffered())
+
+	// ファイルに書き込み済みの範囲は、書き込み中 (ロックを獲得中) でも待たずに読み出せる。
+	// 末尾を超えて読み出す場合も、バッファに残りの範囲がなければ待たない
+	require.NoError(t, s.flush())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	type result struct {
+		n   int
+		err error
+	}
+	for _, size := range []uint64{width, iteratorChunkBytes} {
+		done := make(chan result)
+		go func() {
+			n, err := s.ReadAt(make([]byte, size), int64(pos))
+			done <- result{n, err}
+		}()
+		select {
+		case res := <-done:
+			if size > 2*width {
+				require.Equal(t, int(2*width), res.n)
+				require.Equal(t, io.EOF, res.err)
+			} else {
+				require.Equal(t, int(size), res.n)
+				require.NoError(t, res.err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("read of %d bytes waited for the store lock", size)
+		}
+	}
+}
+
+// TestStoreSeal メモリにマップしたストアから読み出せること、および以降の書き込みがエラーとなることを確認する。
+func TestStoreSeal(t *testing.T) {
+	f, err := os.CreateTemp("", "store_seal_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+
+	require.NoError(t, s.seal())
+	require.NotNil(t, s.mmap.Load())
+	testRead(t, s)
+	testReadAt(t, s)
+	_, err = s.ReadAt(make([]byte, 1), int64(width*3))
+	require.Equal(t, io.EOF, err)
+	_, _, err = s.Append(write)
+	require.Error(t, err)
+	require.NoError(t, s.Close())
+}
+
+// TestStoreConcurrentRead 書き込みと並行して、複数の読み出しが書き込み済みのレコードを読み出せることを確認する。
+func TestStoreConcurrentRead(t *testing.T) {
+	f, err := os.CreateTemp("", "store_concurrent_read_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+
+	const records = 1000
+	positions := make(chan uint64, records)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pos := range positions {
+				// 読み出し用のゴルーチンでは require を利用できないため、エラーを記録して終える
+				read, err := s.Read(pos)
+				if err != nil || !bytes.Equal(write, read) {
+					t.Errorf("read at %d: %q, %v", pos, read, err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < records; i++ {
+		_, pos, err := s.Append(write)
+		require.NoError(t, err)
+		positions <- pos
+	}
+	close(positions)
+	wg.Wait()
+}
+
+// TestStoreReadDuringClose メモリにマップしたストアの読み出しと並行してクローズしても、
+// 読み出し中のマップが解除されず、クローズ後の読み出しがエラーとなることを確認する。
+func TestStoreReadDuringClose(t *testing.T) {
+	f, err := os.CreateTemp("", "store_read_during_close_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.seal())
+
+	m := s.mmap.Load()
+	require.True(t, m.acquire())
+	require.NoError(t, s.Close())
+	require.Nil(t, s.mmap.Load())
+	// 読み出し中の参照が残るためマップは解除されていない
+	p := make([]byte, len(write))
+	_, err = m.readAt(p, lenWidth)
+	require.NoError(t, err)
+	require.Equal(t, write, p)
+	require.NoError(t, m.release())
+	require.False(t, m.acquire())
+
+	_, err = s.ReadAt(p, lenWidth)
+	require.ErrorIs(t, err, os.ErrClosed)
+}
+
 // TestStoreClose 正常にファイルをクローズすることを確認する。
 func TestStoreClose(t *testing.T) {
 	f, err := os.CreateTemp("", "store_close_test")
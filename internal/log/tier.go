@@ -0,0 +1,535 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+)
+
+// RemoteStorage はクローズ済みのセグメントを保存する外部のストレージである。
+// オブジェクトは "/" 区切りの名前で識別し、書き込んだ後は変更しない。
+type RemoteStorage interface {
+	// Put はsizeバイトのオブジェクトを保存する。
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Get はオブジェクトを読み出す。存在しない場合は fs.ErrNotExist を満たすエラーを返却する。
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List は名前がprefixで始まるオブジェクトの名前を返却する。
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete はオブジェクトを削除する。存在しない場合も成功とする。
+	Delete(ctx context.Context, name string) error
+}
+
+const (
+	cacheDirName         = "remote-cache"   // 外部から取得したセグメントを置く、ログのディレクトリ内のディレクトリ
+	defaultCacheSegments = 4                // CacheSegments が未設定の場合に保持するセグメント数
+	offloadRetryInterval = 30 * time.Second // 外部への移動に失敗した場合に再試行する間隔
+	remoteDeleteTimeout  = 30 * time.Second // 外部のストレージからセグメントを削除する際の期限
+)
+
+// remoteFrameMarker はスナップショット内で、外部に移したセグメントを参照するフレームを識別するための値である。
+// ポリシーのフレームと同じく、レコード長の位置にこの値を書き込み、その後にフレームの長さとデータを続ける。
+const remoteFrameMarker = policyFrameMarker - 1
+
+// remoteRefs はスナップショットが参照する、外部に移したセグメントである。
+type remoteRefs struct {
+	prefix string   // セグメントを移したログのオブジェクトの接頭辞
+	bases  []uint64 // セグメントのベースオフセット (古い順)
+	next   uint64   // 外部に移した最後のセグメントの次のオフセット
+}
+
+// frame は目印を付与したフレームを作成する。
+// データは next、ベースオフセットの数、ベースオフセット、接頭辞の順に並べる。
+func (r remoteRefs) frame() []byte {
+	size := 2*lenWidth + lenWidth*len(r.bases) + len(r.prefix)
+	b := make([]byte, 2*lenWidth, 2*lenWidth+size)
+	enc.PutUint64(b[:lenWidth], remoteFrameMarker)
+	enc.PutUint64(b[lenWidth:], uint64(size))
+	b = enc.AppendUint64(b, r.next)
+	b = enc.AppendUint64(b, uint64(len(r.bases)))
+	for _, base := range r.bases {
+		b = enc.AppendUint64(b, base)
+	}
+	return append(b, r.prefix...)
+}
+
+// maxRemotePrefixBytes はフレームに含む接頭辞の長さの上限である。
+const maxRemotePrefixBytes = 1024
+
+// readRemoteFrame は目印に続く、外部に移したセグメントを参照するフレームを読み出す。
+// 壊れたスナップショットで巨大な領域を確保しないよう、フレームの長さはベースオフセットの数と
+// 接頭辞の上限から検証し、ベースオフセットは読み出した分だけ確保する。
+func readRemoteFrame(r io.Reader) (remoteRefs, error) {
+	b := make([]byte, 3*lenWidth)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return remoteRefs{}, fmt.Errorf("failed to read remote frame: %w", err)
+	}
+	size := enc.Uint64(b[:lenWidth])
+	refs := remoteRefs{next: enc.Uint64(b[lenWidth : 2*lenWidth])}
+	n := enc.Uint64(b[2*lenWidth:])
+	if size < 2*lenWidth || (size-2*lenWidth)/lenWidth < n ||
+		size-2*lenWidth-n*lenWidth > maxRemotePrefixBytes {
+		return remoteRefs{}, fmt.Errorf("invalid remote frame length: %d", size)
+	}
+	for i := uint64(0); i < n; i++ {
+		if _, err := io.ReadFull(r, b[:lenWidth]); err != nil {
+			return remoteRefs{}, fmt.Errorf("failed to read remote frame: %w", err)
+		}
+		refs.bases = append(refs.bases, enc.Uint64(b[:lenWidth]))
+	}
+	prefix := make([]byte, size-2*lenWidth-n*lenWidth)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return remoteRefs{}, fmt.Errorf("failed to read remote frame: %w", err)
+	}
+	refs.prefix = string(prefix)
+	return refs, nil
+}
+
+// remoteName はセグメントのファイルに対応するオブジェクトの名前を返却する。
+func (l *Log) remoteName(base uint64, ext string) string {
+	return fmt.Sprintf("%s%d%s", l.Config.Tier.Prefix, base, ext)
+}
+
+// setupRemote は外部のストレージに移したセグメントの一覧を取得し、外部への移動を開始する。
+// インデックスのオブジェクトはストアの後に保存するため、インデックスが存在するセグメントのみを移動済みとする。
+// ローカルにも残っているセグメント (移動の途中で停止した場合) はローカルのものを用いる。
+func (l *Log) setupRemote() error {
+	l.remote = nil
+	if l.Config.Tier.Storage == nil {
+		return nil
+	}
+	// 前回の起動時に取得したセグメントは、外部で削除されている可能性があるため破棄する
+	cacheDir := filepath.Join(l.Dir, cacheDirName)
+	if err := os.RemoveAll(cacheDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+	max := l.Config.Tier.CacheSegments
+	if max == 0 {
+		max = defaultCacheSegments
+	}
+	l.cache = &segmentCache{dir: cacheDir, max: max, fetch: l.fetch}
+
+	ctx := context.Background()
+	names, err := l.Config.Tier.Storage.List(ctx, l.Config.Tier.Prefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		name = strings.TrimPrefix(name, l.Config.Tier.Prefix)
+		if !strings.HasSuffix(name, ".index") {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, ".index"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(l.segments) == 0 || base < l.segments[0].baseOffset {
+			l.remote = append(l.remote, base)
+		}
+	}
+	sort.Slice(l.remote, func(i, j int) bool { return l.remote[i] < l.remote[j] })
+	return nil
+}
+
+// restoreRemote はスナップショットが参照する外部のセグメントをログに付け直し、ローカルのセグメントを破棄する。
+//
+// 他のサーバが移したセグメントは、同じストレージ上で自身の接頭辞にコピーする。参照されない自身のオブジェクトは削除し、
+// ローカルのセグメントは参照したセグメントの続きから作成し直す。セグメントは暗号化されたままコピーするため、
+// スナップショットを作成したサーバと同じキーリングが必要となる。
+func (l *Log) restoreRemote(refs remoteRefs) error {
+	storage := l.Config.Tier.Storage
+	if storage == nil {
+		return errors.New("snapshot refers to offloaded segments but no remote storage is configured")
+	}
+	if err := l.Close(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	keep := make(map[string]bool)
+	for _, base := range refs.bases {
+		for _, ext := range []string{".store", ".index"} {
+			keep[l.remoteName(base, ext)] = true
+		}
+	}
+	names, err := storage.List(ctx, l.Config.Tier.Prefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if keep[name] {
+			continue
+		}
+		if err = storage.Delete(ctx, name); err != nil {
+			return err
+		}
+	}
+	if err = os.RemoveAll(l.Dir); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	if refs.prefix != l.Config.Tier.Prefix {
+		for _, base := range refs.bases {
+			// インデックスの存在をもって移動済みとみなすため、ストアを先にコピーする
+			for _, ext := range []string{".store", ".index"} {
+				src := fmt.Sprintf("%s%d%s", refs.prefix, base, ext)
+				if err = l.copyRemote(ctx, src, l.remoteName(base, ext)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	l.Config.Segment.InitialOffset = refs.next
+	l.segments, l.activeSegment = nil, nil
+	return l.setup()
+}
+
+// copyRemote は外部のストレージのオブジェクトを、ログのディレクトリの一時ファイルを介してコピーする。
+func (l *Log) copyRemote(ctx context.Context, src, dst string) error {
+	rc, err := l.Config.Tier.Storage.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.CreateTemp(l.Dir, "copy-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, rc)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return l.Config.Tier.Storage.Put(ctx, dst, f, size)
+}
+
+// remoteEnd は外部に移した最後のセグメントを一時的に取得し、その次のオフセットを求める。
+// ローカルのセグメントを失った場合に、外部のセグメントに続くオフセットから書き込みを再開するために用いる。
+// インデックスは疎なため、インデックスのサイズからはレコード数を求められない。
+func (l *Log) remoteEnd() (uint64, error) {
+	dir, err := os.MkdirTemp(filepath.Join(l.Dir, cacheDirName), "end-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	s, err := l.fetch(dir, l.remote[len(l.remote)-1])
+	if err != nil {
+		return 0, err
+	}
+	return s.nextOffset, s.Close()
+}
+
+// startOffload はセグメントが最大サイズに達するたびに、クローズ済みのセグメントを外部に移すゴルーチンを開始する。
+// 失敗した場合は、次にセグメントが最大サイズに達したときか offloadRetryInterval 後に再試行する。
+func (l *Log) startOffload() {
+	if l.Config.Tier.Storage == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	l.offloadc = make(chan struct{}, 1)
+	l.stopOffload = func() {
+		cancel()
+		<-done
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(offloadRetryInterval)
+		defer ticker.Stop()
+		for {
+			if err := l.Offload(ctx); err != nil && ctx.Err() == nil {
+				l.metrics.offloadFailures.Inc()
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-l.offloadc:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// notifyOffload は外部への移動を開始するよう通知する。移動中の場合は、完了後にもう一度移動する。
+func (l *Log) notifyOffload() {
+	if l.offloadc == nil {
+		return
+	}
+	select {
+	case l.offloadc <- struct{}{}:
+	default:
+	}
+}
+
+// Offload はローカルに残す数を超えたクローズ済みのセグメントを、古い順に外部のストレージに移す。
+// アップロードが完了したセグメントからローカルのファイルを削除する。アップロード中も読み書きは妨げない。
+func (l *Log) Offload(ctx context.Context) error {
+	if l.Config.Tier.Storage == nil {
+		return nil
+	}
+	l.offloadMu.Lock()
+	defer l.offloadMu.Unlock()
+	for {
+		l.mu.RLock()
+		var s *segment
+		if len(l.segments)-1 > l.Config.Tier.LocalSegments {
+			s = l.segments[0]
+		}
+		l.mu.RUnlock()
+		if s == nil {
+			return nil
+		}
+		if err := l.upload(ctx, s); err != nil {
+			return err
+		}
+
+		// Read はロックを獲得したままセグメントを読み出すため、ローカルのファイルはロックの範囲で削除する。
+		// 外部のストレージからの削除は時間がかかるため、ロックを解放してから行う
+		l.mu.Lock()
+		offloaded := len(l.segments) > 1 && l.segments[0] == s
+		if offloaded {
+			l.gen.Add(1)
+			l.remote = append(l.remote, s.baseOffset)
+			l.segments = l.segments[1:]
+			if err := s.Remove(); err != nil {
+				l.mu.Unlock()
+				return err
+			}
+		}
+		l.mu.Unlock()
+		if !offloaded {
+			// アップロード中に Truncate で削除されたセグメントは外部にも残さない
+			if err := l.deleteUploaded(ctx, s.baseOffset); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// deleteUploaded はアップロードしたものの、ログから削除されていたセグメントを外部のストレージから削除する。
+func (l *Log) deleteUploaded(ctx context.Context, base uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, remoteDeleteTimeout)
+	defer cancel()
+	return l.deleteRemote(ctx, base)
+}
+
+// upload はセグメントのストアとインデックスをアップロードする。
+// クローズ済みのセグメントは書き込まれないため、ロックを獲得せずにファイルから読み出す。
+func (l *Log) upload(ctx context.Context, s *segment) error {
+	for _, f := range []struct {
+		name string
+		ext  string
+		size uint64
+	}{
+		// インデックスの存在をもって移動済みとみなすため、ストアを先にアップロードする
+		{s.store.Name(), ".store", s.store.size},
+		{s.index.Name(), ".index", s.index.size},
+	} {
+		file, err := os.Open(f.name)
+		if err != nil {
+			return err
+		}
+		// インデックスのファイルはメモリマップのために最大サイズまで拡張されているため、実際のサイズまで読み出す
+		err = l.Config.Tier.Storage.Put(ctx, l.remoteName(s.baseOffset, f.ext),
+			io.NewSectionReader(file, 0, int64(f.size)), int64(f.size))
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRemote は外部に移したセグメントを削除する。
+func (l *Log) deleteRemote(ctx context.Context, base uint64) error {
+	if l.cache != nil {
+		l.cache.evict(base)
+	}
+	for _, ext := range []string{".index", ".store"} {
+		if err := l.Config.Tier.Storage.Delete(ctx, l.remoteName(base, ext)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remoteSegmentOf はオフセットのレコードを含む、外部に移したセグメントのベースオフセットを返却する。
+// 呼び出し元でロックを獲得すること。
+func (l *Log) remoteSegmentOf(off uint64) (uint64, bool) {
+	if len(l.remote) == 0 || off < l.remote[0] || off >= l.segments[0].baseOffset {
+		return 0, false
+	}
+	i := sort.Search(len(l.remote), func(i int) bool { return l.remote[i] > off })
+	return l.remote[i-1], true
+}
+
+// readRemote は外部に移したセグメントを取得し、オフセットのレコードを読み出す。
+func (l *Log) readRemote(base, off uint64) (*api.Record, error) {
+	record, err := l.cache.read(base, off)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, io.EOF) {
+		// 読み出しの途中で Truncate により削除された
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return record, err
+}
+
+// fetch は外部に移したセグメントをダウンロードし、dirに開く。
+func (l *Log) fetch(dir string, base uint64) (*segment, error) {
+	ctx := context.Background()
+	for _, ext := range []string{".store", ".index"} {
+		rc, err := l.Config.Tier.Storage.Get(ctx, l.remoteName(base, ext))
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%d%s", base, ext)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err == nil {
+			_, err = io.Copy(f, rc)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	s, err := newSegment(dir, base, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	return s, s.seal()
+}
+
+// remoteReader は外部に移したセグメントを、最初に読み出すときに一時的なディレクトリにダウンロードして読み出す。
+// 読み出し中にキャッシュから追い出されないよう、キャッシュとは別に取得し、最後まで読み出した時点で削除する。
+type remoteReader struct {
+	log    *Log
+	base   uint64
+	dir    string
+	seg    *segment
+	reader io.Reader
+}
+
+func (r *remoteReader) Read(p []byte) (int, error) {
+	if r.reader == nil {
+		dir, err := os.MkdirTemp(filepath.Join(r.log.Dir, cacheDirName), "reader-")
+		if err != nil {
+			return 0, err
+		}
+		r.dir = dir
+		if r.seg, err = r.log.fetch(dir, r.base); err != nil {
+			os.RemoveAll(dir)
+			return 0, err
+		}
+		r.reader = r.seg.reader()
+	}
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		if rerr := r.seg.Remove(); rerr != nil {
+			return n, rerr
+		}
+		if rerr := os.RemoveAll(r.dir); rerr != nil {
+			return n, rerr
+		}
+	}
+	return n, err
+}
+
+// segmentCache は外部から取得したセグメントを、最近読み出した順に最大max個まで保持する。
+//
+//	NOTE:
+//	 ダウンロードと読み出しは1つのロックで直列化する。外部に移すのは読み出される頻度の低いセグメントのため、
+//	 並行性よりも追い出し中のセグメントを読み出さないことを優先する。
+type segmentCache struct {
+	mu       sync.Mutex
+	dir      string
+	max      int
+	fetch    func(dir string, base uint64) (*segment, error)
+	segments map[uint64]*segment
+	order    []uint64 // 読み出した順のベースオフセット (末尾が最新)
+}
+
+// read はセグメントを取得していなければ取得し、オフセットのレコードを読み出す。
+func (c *segmentCache) read(base, off uint64) (*api.Record, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.segments[base]
+	if !ok {
+		var err error
+		if s, err = c.fetch(c.dir, base); err != nil {
+			return nil, err
+		}
+		if c.segments == nil {
+			c.segments = make(map[uint64]*segment)
+		}
+		c.segments[base] = s
+		for len(c.order) >= c.max {
+			c.remove(c.order[0])
+		}
+	}
+	c.touch(base)
+	return s.Read(off)
+}
+
+// touch はセグメントを最近読み出したものとする。
+func (c *segmentCache) touch(base uint64) {
+	for i, b := range c.order {
+		if b == base {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, base)
+}
+
+// evict はセグメントを保持していれば削除する。
+func (c *segmentCache) evict(base uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(base)
+}
+
+func (c *segmentCache) remove(base uint64) {
+	if s, ok := c.segments[base]; ok {
+		_ = s.Remove()
+		delete(c.segments, base)
+	}
+	for i, b := range c.order {
+		if b == base {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// close は保持しているセグメントをすべて閉じる。ファイルはログのディレクトリとともに削除される。
+func (c *segmentCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for base, s := range c.segments {
+		if err := s.Close(); err != nil {
+			return err
+		}
+		delete(c.segments, base)
+	}
+	c.order = nil
+	return nil
+}
@@ -0,0 +1,260 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/objstore"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestTier はクローズ済みのセグメントを外部のストレージに移した後も、ログ全体を読み書きできることを検証する。
+func TestTier(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log, storage *objstore.Local){
+		"offload keeps records readable":       testOffloadRead,
+		"restart lists remote segments":        testOffloadRestart,
+		"reader includes remote segments":      testOffloadReader,
+		"iterator reads remote segments":       testOffloadIterator,
+		"truncate deletes remote segments":     testOffloadTruncate,
+		"lost local segments resume after end": testOffloadLostLocal,
+		"remove deletes remote segments":       testOffloadRemove,
+		"snapshot refers to remote segments":   testOffloadSnapshot,
+		"restore own snapshot keeps segments":  testOffloadRestoreOwn,
+		"corrupt remote frame fails restore":   testOffloadCorruptFrame,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			storage, err := objstore.NewLocal(t.TempDir())
+			require.NoError(t, err)
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32 // 1つのセグメントにつき、2つのレコードまで書き込み可能
+			c.Tier.Storage = storage
+			c.Tier.Prefix = "node-1/"
+			c.Tier.LocalSegments = 1
+			c.Tier.CacheSegments = 1
+			log, err := NewLog(t.TempDir(), c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			// オフセット0, 2, 4, 6, 8 から始まる5つのセグメントのうち、アクティブセグメントとローカルに残す
+			// 1つを除いた3つを外部に移す
+			for i := 0; i < 10; i++ {
+				_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+				require.NoError(t, err)
+			}
+			require.NoError(t, log.Offload(context.Background()))
+
+			fn(t, log, storage)
+		})
+	}
+}
+
+func testOffloadRead(t *testing.T, log *Log, storage *objstore.Local) {
+	require.Equal(t, []uint64{0, 2, 4}, log.remote)
+	_, err := os.Stat(filepath.Join(log.Dir, "0.store"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	names, err := storage.List(context.Background(), "node-1/")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"node-1/0.index", "node-1/0.store",
+		"node-1/2.index", "node-1/2.store",
+		"node-1/4.index", "node-1/4.store",
+	}, names)
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	// キャッシュは1つのセグメントしか保持しないため、セグメントをまたいで取得し直す
+	for _, off := range []uint64{0, 5, 1, 9, 3, 2} {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record-%d", off), string(record.Value))
+		require.Equal(t, off, record.Offset)
+	}
+	require.Len(t, log.cache.segments, 1)
+	_, err = log.Read(10)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+func testOffloadRestart(t *testing.T, log *Log, _ *objstore.Local) {
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+
+	lowest, err := n.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	highest, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), highest)
+	record, err := n.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, "record-1", string(record.Value))
+}
+
+func testOffloadReader(t *testing.T, log *Log, _ *objstore.Local) {
+	b, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+	for i := 0; len(b) > 0; i++ {
+		size := enc.Uint64(b[:lenWidth])
+		record := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[lenWidth:lenWidth+size], record))
+		require.Equal(t, fmt.Sprintf("record-%d", i), string(record.Value))
+		b = b[lenWidth+size:]
+	}
+	// 読み出しのために取得したセグメントは残さない
+	entries, err := os.ReadDir(filepath.Join(log.Dir, cacheDirName))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func testOffloadIterator(t *testing.T, log *Log, _ *objstore.Local) {
+	it := log.Iterator(1)
+	for off := uint64(1); off < 10; off++ {
+		requireNext(t, it, off)
+	}
+	_, err := it.Next()
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+func testOffloadTruncate(t *testing.T, log *Log, storage *objstore.Local) {
+	_, err := log.Read(0)
+	require.NoError(t, err)
+	require.NoError(t, log.Truncate(3))
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lowest)
+	_, err = log.Read(0)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	require.Empty(t, log.cache.segments)
+	names, err := storage.List(context.Background(), "node-1/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"node-1/4.index", "node-1/4.store"}, names)
+}
+
+func testOffloadLostLocal(t *testing.T, log *Log, _ *objstore.Local) {
+	require.NoError(t, log.Close())
+	require.NoError(t, os.RemoveAll(log.Dir))
+	require.NoError(t, os.MkdirAll(log.Dir, 0755))
+
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	off, err := n.Append(&api.Record{Value: []byte("record-6")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	record, err := n.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, "record-5", string(record.Value))
+}
+
+func testOffloadRemove(t *testing.T, log *Log, storage *objstore.Local) {
+	require.NoError(t, log.Remove())
+	names, err := storage.List(context.Background(), "node-1/")
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+// persistSnapshot はログのスナップショットを作成し、保存したバイト列を返却する。
+func persistSnapshot(t *testing.T, log *Log) []byte {
+	t.Helper()
+	snap, err := (&fsm{log: log, policies: newPolicySet()}).Snapshot()
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, snap.(*snapshot).Persist(&sink{Buffer: &buf}))
+	return buf.Bytes()
+}
+
+// requireRecords はログのオフセット0から9までのレコードを読み出せることを検証する。
+func requireRecords(t *testing.T, log *Log) {
+	t.Helper()
+	for off := uint64(0); off < 10; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record-%d", off), string(record.Value))
+	}
+}
+
+func testOffloadSnapshot(t *testing.T, log *Log, storage *objstore.Local) {
+	data := persistSnapshot(t, log)
+	// 外部に移したセグメントのレコードはスナップショットに含めない
+	require.False(t, bytes.Contains(data, []byte("record-5")))
+	require.True(t, bytes.Contains(data, []byte("record-6")))
+
+	c := log.Config
+	c.Tier.Prefix = "node-2/"
+	n, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer n.Close()
+	_, err = n.Append(&api.Record{Value: []byte("stale")})
+	require.NoError(t, err)
+	require.NoError(t, (&fsm{log: n, policies: newPolicySet()}).Restore(io.NopCloser(bytes.NewReader(data))))
+
+	require.Equal(t, []uint64{0, 2, 4}, n.remote)
+	requireRecords(t, n)
+	off, err := n.Append(&api.Record{Value: []byte("record-10")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	names, err := storage.List(context.Background(), "node-2/")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"node-2/0.index", "node-2/0.store",
+		"node-2/2.index", "node-2/2.store",
+		"node-2/4.index", "node-2/4.store",
+	}, names)
+}
+
+func testOffloadRestoreOwn(t *testing.T, log *Log, storage *objstore.Local) {
+	data := persistSnapshot(t, log)
+	// スナップショットの作成後に外部に移したセグメントのレコードは、スナップショットから追加し直す
+	for i := 10; i < 12; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record-%d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Offload(context.Background()))
+	require.Equal(t, []uint64{0, 2, 4, 6}, log.remote)
+
+	require.NoError(t, (&fsm{log: log, policies: newPolicySet()}).Restore(io.NopCloser(bytes.NewReader(data))))
+	require.Equal(t, []uint64{0, 2, 4}, log.remote)
+	requireRecords(t, log)
+	_, err := log.Read(10)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	names, err := storage.List(context.Background(), "node-1/")
+	require.NoError(t, err)
+	require.Len(t, names, 6)
+}
+
+func testOffloadCorruptFrame(t *testing.T, log *Log, _ *objstore.Local) {
+	frame := remoteRefs{prefix: "node-1/", bases: []uint64{0, 2, 4}, next: 6}.frame()
+	refs, err := readRemoteFrame(bytes.NewReader(frame[lenWidth:]))
+	require.NoError(t, err)
+	require.Equal(t, remoteRefs{prefix: "node-1/", bases: []uint64{0, 2, 4}, next: 6}, refs)
+
+	// フレームが壊れている場合は、確保や読み出しの前にエラーとする
+	corrupt := func(size, n uint64) []byte {
+		b := append([]byte(nil), frame...)
+		enc.PutUint64(b[lenWidth:], size)
+		enc.PutUint64(b[3*lenWidth:], n)
+		return b
+	}
+	for _, b := range [][]byte{
+		frame[:3*lenWidth],                            // ヘッダが切り詰められている
+		frame[:len(frame)-1],                          // 接頭辞が切り詰められている
+		corrupt(math.MaxUint64, 3),                    // 長さが巨大
+		corrupt(5*lenWidth+7, math.MaxUint64),         // ベースオフセットの数が巨大
+		corrupt(lenWidth, 0),                          // ヘッダより短い
+		corrupt(5*lenWidth+maxRemotePrefixBytes+1, 3), // 接頭辞が上限を超える
+	} {
+		err := (&fsm{log: log, policies: newPolicySet()}).Restore(io.NopCloser(bytes.NewReader(b)))
+		require.Error(t, err)
+	}
+}
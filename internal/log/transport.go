@@ -0,0 +1,376 @@
+package log
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/yamux"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+// StreamLayer はRaftサーバと接続するにあたって低レベルなストリーム抽象化を提供するための、
+// トランスポートのStreamLayerインタフェースを満たすメソッドを実装する。
+//
+// 多重化を有効にした場合、ピアごとに1つのTLSコネクションを維持し、トランスポートが要求するコネクションを
+// その上のyamuxのストリームとして作成する。コネクションの確立とTLSのハンドシェイクはピアごとに1度で済む。
+// 受信側はいずれの方式のコネクションも受け入れるため、多重化の有無が異なるサーバが混在してもよい。
+type StreamLayer struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config // サーバ間の暗号化通信における受信コネクションを受け入れるためのTLS設定
+	peerTLSConfig   *tls.Config // サーバ間の暗号化通信における送信コネクションを作成するためのTLS設定
+	multiplex       bool        // 送信コネクションを多重化するか (setupRaftでConfig.Raft.Multiplexを設定する)
+	// dialTCP はピアにTCPで接続する (テストで応答しないピアを再現するために差し替える)
+	dialTCP func(addr string, timeout time.Duration) (net.Conn, error)
+
+	mu       sync.Mutex
+	sessions map[raft.ServerAddress]*yamux.Session // ピアごとの多重化されたコネクション
+	dialing  map[raft.ServerAddress]*sessionDial   // ピアごとの接続中の多重化されたコネクション
+
+	acceptOnce sync.Once
+	accepted   chan net.Conn
+	closed     chan struct{}
+	closeOnce  sync.Once
+	acceptErr  error
+}
+
+func NewStreamLayer(ln net.Listener, serverTLSConfig, peerTLSConfig *tls.Config) *StreamLayer {
+	return &StreamLayer{
+		ln:              ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+		dialTCP:         dialTCP,
+		sessions:        make(map[raft.ServerAddress]*yamux.Session),
+		dialing:         make(map[raft.ServerAddress]*sessionDial),
+		accepted:        make(chan net.Conn),
+		closed:          make(chan struct{}),
+	}
+}
+
+func dialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	return (&net.Dialer{Timeout: timeout}).Dial("tcp", addr)
+}
+
+// コネクション種別を識別するバイト
+const (
+	RaftRPC    = 1 // 1つのRPCのストリームとして使うコネクション
+	RaftMuxRPC = 2 // yamuxで多重化するコネクション
+)
+
+// Dial はRaftクラスタ内における他サーバへの新たな発信コネクションを作成する。
+//
+//	NOTE:
+//	 サーバ接続の際、コネクション種別を識別するためにRaftRPCバイトを書き込み、
+//	 ログのgRPCリクエストと同じポートでRaftを多重化できる。
+//	 ストリームレイヤをピアTLSで設定することで、TLSクライアント側の接続が行われる。
+func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	if s.multiplex {
+		return s.openStream(addr, timeout)
+	}
+	return s.dial(addr, RaftRPC, timeout)
+}
+
+func (s *StreamLayer) dial(addr raft.ServerAddress, kind byte, timeout time.Duration) (net.Conn, error) {
+	conn, err := s.dialTCP(string(addr), timeout)
+	if err != nil {
+		return nil, err
+	}
+	// Raft RPC であることを特定する
+	_, err = conn.Write([]byte{kind})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if s.peerTLSConfig != nil {
+		tlsConfig := s.peerTLSConfig
+		// tls.Dial と同様に、接続先の名前が未設定の場合はアドレスのホスト名でサーバ証明書を検証する
+		if tlsConfig.ServerName == "" {
+			host, _, err := net.SplitHostPort(string(addr))
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = host
+		}
+		conn = tls.Client(conn, tlsConfig)
+	}
+	return conn, nil
+}
+
+// openStream はピアとの多重化されたコネクション上に新たなストリームを作成する。
+// コネクションが切断されている場合は接続し直す。
+func (s *StreamLayer) openStream(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	session, err := s.session(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.Open()
+	if err != nil {
+		session.Close()
+		s.mu.Lock()
+		if s.sessions[addr] == session {
+			delete(s.sessions, addr)
+		}
+		s.mu.Unlock()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// sessionDial はピアとの多重化されたコネクションの接続の結果を、同じピアに並行して接続しようとした呼び出し元に共有する。
+type sessionDial struct {
+	done    chan struct{}
+	session *yamux.Session
+	err     error
+}
+
+// session はピアとの多重化されたコネクションを返却し、存在しない場合は接続する。
+// 応答しないピアへの接続が他のピアへのストリームの作成を妨げないよう、接続はロックを解放して行い、
+// 同じピアへの並行した接続は1つにまとめる。
+func (s *StreamLayer) session(addr raft.ServerAddress, timeout time.Duration) (*yamux.Session, error) {
+	s.mu.Lock()
+	if session, ok := s.sessions[addr]; ok && !session.IsClosed() {
+		s.mu.Unlock()
+		return session, nil
+	}
+	d, ok := s.dialing[addr]
+	if ok {
+		s.mu.Unlock()
+		<-d.done
+		return d.session, d.err
+	}
+	d = &sessionDial{done: make(chan struct{})}
+	s.dialing[addr] = d
+	s.mu.Unlock()
+
+	d.session, d.err = s.dialSession(addr, timeout)
+
+	s.mu.Lock()
+	delete(s.dialing, addr)
+	if d.err == nil {
+		select {
+		case <-s.closed:
+			// 接続中にストリームレイヤが閉じられた場合は破棄する
+			d.session.Close()
+			d.session, d.err = nil, s.acceptErr
+		default:
+			s.sessions[addr] = d.session
+		}
+	}
+	s.mu.Unlock()
+	close(d.done)
+	return d.session, d.err
+}
+
+// dialSession はピアに接続し、多重化されたコネクションを作成する。
+func (s *StreamLayer) dialSession(addr raft.ServerAddress, timeout time.Duration) (*yamux.Session, error) {
+	conn, err := s.dial(addr, RaftMuxRPC, timeout)
+	if err != nil {
+		return nil, err
+	}
+	session, err := yamux.Client(conn, muxConfig(timeout))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// muxConfig はyamuxの設定を作成する。yamuxのログは他のログと同じくzapに出力する。
+func muxConfig(timeout time.Duration) *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.LogOutput = nil
+	config.Logger = zap.NewStdLog(zap.L().Named("yamux"))
+	if timeout > 0 {
+		config.ConnectionWriteTimeout = timeout
+		config.StreamOpenTimeout = timeout
+	}
+	return config
+}
+
+// Accept はDialメソッドに対応し、入ってくるコネクションを受け入れ、
+// コネクション種別を識別するバイトを読み出し、サーバ側のTLS接続を作成する。
+// 多重化されたコネクションの場合は、その上に作成されたストリームを受け入れる。
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	s.acceptOnce.Do(func() { go s.acceptLoop() })
+	select {
+	case conn := <-s.accepted:
+		return conn, nil
+	case <-s.closed:
+		return nil, s.acceptErr
+	}
+}
+
+// acceptLoop はリスナーが閉じられるまでコネクションを受け入れる。
+// 識別バイトの受信とTLSのハンドシェイクはコネクションごとのゴルーチンで行い、遅いピアが他のピアの接続を妨げないようにする。
+func (s *StreamLayer) acceptLoop() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			s.close(err)
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *StreamLayer) handle(conn net.Conn) {
+	b := make([]byte, 1)
+	if _, err := conn.Read(b); err != nil {
+		conn.Close()
+		return
+	}
+	if b[0] != RaftRPC && b[0] != RaftMuxRPC {
+		conn.Close()
+		return
+	}
+	if s.serverTLSConfig != nil {
+		conn = tls.Server(conn, s.serverTLSConfig)
+	}
+	if b[0] == RaftRPC {
+		s.deliver(conn)
+		return
+	}
+	session, err := yamux.Server(conn, muxConfig(0))
+	if err != nil {
+		conn.Close()
+		return
+	}
+	// ストリームレイヤが閉じられた場合にコネクションを閉じる。コネクションが先に閉じられた場合は終了する
+	go func() {
+		select {
+		case <-s.closed:
+			session.Close()
+		case <-session.CloseChan():
+		}
+	}()
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			session.Close()
+			return
+		}
+		s.deliver(stream)
+	}
+}
+
+// deliver は受け入れたコネクションをAcceptに渡す。ストリームレイヤが閉じられた場合は破棄する。
+func (s *StreamLayer) deliver(conn net.Conn) {
+	select {
+	case s.accepted <- conn:
+	case <-s.closed:
+		conn.Close()
+	}
+}
+
+func (s *StreamLayer) close(err error) {
+	s.closeOnce.Do(func() {
+		s.acceptErr = err
+		close(s.closed)
+	})
+}
+
+// Close はリスナーと、多重化されたピアとのコネクションをクローズする。
+func (s *StreamLayer) Close() error {
+	err := s.ln.Close()
+	s.close(errors.New("stream layer closed"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, session := range s.sessions {
+		session.Close()
+		delete(s.sessions, addr)
+	}
+	return err
+}
+
+// Addr はリスナーのアドレスを返却する。
+func (s *StreamLayer) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// replicationTransport はリーダーからフォロワーへのAppendEntriesの所要時間をピアごとに計測する。
+// パイプライン化されたAppendEntriesは、送信から応答を受信するまでの時間を計測する。
+type replicationTransport struct {
+	raft.Transport
+	latency *prometheus.HistogramVec
+}
+
+func (t *replicationTransport) AppendEntries(
+	id raft.ServerID,
+	target raft.ServerAddress,
+	args *raft.AppendEntriesRequest,
+	resp *raft.AppendEntriesResponse,
+) error {
+	start := time.Now()
+	err := t.Transport.AppendEntries(id, target, args, resp)
+	if err == nil {
+		t.latency.WithLabelValues(string(id)).Observe(time.Since(start).Seconds())
+	}
+	return err
+}
+
+func (t *replicationTransport) AppendEntriesPipeline(id raft.ServerID, target raft.ServerAddress) (raft.AppendPipeline, error) {
+	p, err := t.Transport.AppendEntriesPipeline(id, target)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := &replicationPipeline{
+		AppendPipeline: p,
+		consumer:       make(chan raft.AppendFuture),
+		done:           make(chan struct{}),
+		observer:       t.latency.WithLabelValues(string(id)),
+	}
+	go pipeline.observe()
+	return pipeline, nil
+}
+
+// Close はRaftの停止時にトランスポートを閉じる。
+func (t *replicationTransport) Close() error {
+	if c, ok := t.Transport.(raft.WithClose); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type replicationPipeline struct {
+	raft.AppendPipeline
+	consumer  chan raft.AppendFuture
+	done      chan struct{}
+	closeOnce sync.Once
+	observer  prometheus.Observer
+}
+
+// observe は完了したAppendEntriesの所要時間を記録し、Raftに渡す。
+func (p *replicationPipeline) observe() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case future := <-p.AppendPipeline.Consumer():
+			if future.Error() == nil {
+				p.observer.Observe(time.Since(future.Start()).Seconds())
+			}
+			select {
+			case p.consumer <- future:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+func (p *replicationPipeline) Consumer() <-chan raft.AppendFuture {
+	return p.consumer
+}
+
+func (p *replicationPipeline) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	return p.AppendPipeline.Close()
+}
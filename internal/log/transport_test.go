@@ -0,0 +1,76 @@
+package log
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStreamLayerDialOutsideLock は応答しないピアへの接続中も他のピアへのストリームを作成でき、
+// 同じピアへの並行した接続が1つにまとめられることを検証する。
+func TestStreamLayerDialOutsideLock(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	peer := NewStreamLayer(ln, nil, nil)
+	defer peer.Close()
+	go func() {
+		for {
+			conn, err := peer.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewStreamLayer(ln, nil, nil)
+	defer s.Close()
+	s.multiplex = true
+	const unreachable = "192.0.2.1:8400"
+	release := make(chan struct{})
+	var dials, unreachableDials atomic.Int32
+	s.dialTCP = func(addr string, timeout time.Duration) (net.Conn, error) {
+		if addr == unreachable {
+			unreachableDials.Add(1)
+			<-release
+			return nil, errors.New("unreachable")
+		}
+		dials.Add(1)
+		return dialTCP(addr, timeout)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Dial(unreachable, time.Second)
+			errs <- err
+		}()
+	}
+	require.Eventually(t, func() bool { return unreachableDials.Load() == 1 }, time.Second, time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		conn, err := s.Dial(raft.ServerAddress(peer.Addr().String()), time.Second)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	}
+	require.Equal(t, int32(1), dials.Load())
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Error(t, err)
+	}
+	require.Equal(t, int32(1), unreachableDials.Load())
+}
@@ -0,0 +1,62 @@
+package mirror
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// ミラーのメトリクスを識別するための記述子を定義
+var (
+	mirrorLabels = []string{"mirror"}
+
+	nextOffsetDesc = prometheus.NewDesc(
+		"proglog_mirror_next_offset",
+		"Next source offset to mirror.",
+		mirrorLabels, nil,
+	)
+	sourceEndDesc = prometheus.NewDesc(
+		"proglog_mirror_source_end_offset",
+		"Offset the source log will write next, as last probed.",
+		mirrorLabels, nil,
+	)
+	lagDesc = prometheus.NewDesc(
+		"proglog_mirror_lag_records",
+		"Number of source records not yet mirrored, as of the last probe.",
+		mirrorLabels, nil,
+	)
+	recordsDesc = prometheus.NewDesc(
+		"proglog_mirror_records_total",
+		"Number of records mirrored since the mirror started.",
+		mirrorLabels, nil,
+	)
+	failuresDesc = prometheus.NewDesc(
+		"proglog_mirror_failures_total",
+		"Number of times mirroring was interrupted since the mirror started.",
+		mirrorLabels, nil,
+	)
+)
+
+var _ prometheus.Collector = (*Mirror)(nil)
+
+// Describe はミラーが収集するメトリクスの記述子を送信する。
+func (m *Mirror) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{nextOffsetDesc, sourceEndDesc, lagDesc, recordsDesc, failuresDesc} {
+		ch <- desc
+	}
+}
+
+// Collect はスクレイプ時点での複製の進捗と遅延を送信する。
+// 遅延は LagInterval ごとに調べた複製元の末尾のオフセットから算出する。
+func (m *Mirror) Collect(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	next, end, mirrored, failures := m.next, m.end, m.mirrored, m.failures
+	m.mu.Unlock()
+
+	labels := []string{m.Name}
+	var lag uint64
+	if end > next {
+		lag = end - next
+	}
+	ch <- prometheus.MustNewConstMetric(nextOffsetDesc, prometheus.GaugeValue, float64(next), labels...)
+	ch <- prometheus.MustNewConstMetric(sourceEndDesc, prometheus.GaugeValue, float64(end), labels...)
+	ch <- prometheus.MustNewConstMetric(lagDesc, prometheus.GaugeValue, float64(lag), labels...)
+	ch <- prometheus.MustNewConstMetric(recordsDesc, prometheus.CounterValue, float64(mirrored), labels...)
+	ch <- prometheus.MustNewConstMetric(failuresDesc, prometheus.CounterValue, float64(failures), labels...)
+}
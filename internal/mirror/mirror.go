@@ -0,0 +1,464 @@
+// Package mirror はあるクラスタのログのレコードを、別のクラスタのログに複製する。
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/loadbalance"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// ErrDiverged はオフセットを保つ複製で、複製先の次のオフセットが複製元と一致しなかったことを示す。
+// 複製先に他のクライアントが書き込んだ場合などに発生し、再試行しても解消しないため複製を停止する。
+var ErrDiverged = errors.New("target offset diverged from source")
+
+// Config はミラーの設定を保持する。
+type Config struct {
+	// SourceAddr と TargetAddr は、複製元と複製先のクラスタのサーバのアドレスである。
+	// カンマ区切りで複数のサーバを指定でき、いずれかに接続できればクラスタを発見する。
+	SourceAddr string
+	TargetAddr string
+	// SourceTLSConfig と TargetTLSConfig は、それぞれのクラスタへの接続に用いるTLSの設定である。
+	// 未設定の場合は暗号化せずに接続する。
+	SourceTLSConfig *tls.Config
+	TargetTLSConfig *tls.Config
+	// SourceCredentials と TargetCredentials は、クライアント証明書の代わりにトークンやAPIキーで認証する場合の
+	// RPCごとの認証情報 (auth.BearerToken, auth.APIKey) である。サーバの発見にも用いる。
+	SourceCredentials credentials.PerRPCCredentials
+	TargetCredentials credentials.PerRPCCredentials
+	// Name はメトリクスとログでミラーを識別する名前である。未設定の場合は "default" とする。
+	// 各クラスタは1つのログのみを保持するため、複製元と複製先のログを名前で選ぶことはできない。
+	Name string
+	// CheckpointFile は次に複製する複製元のオフセットを保存するファイルである。
+	// ミラーは再起動後にチェックポイントから複製を再開する。
+	CheckpointFile string
+	// StartOffset はチェックポイントが存在しない場合に複製を開始するオフセットである。
+	StartOffset uint64
+	// PreserveOffsets を有効にすると、複製先のレコードを複製元と同じオフセットに書き込む。
+	// 複製先のサーバはオフセットを指定した書き込みを、ログの次のオフセットと一致する場合のみ受け付ける。
+	// 複製先のログが空の場合は複製を開始したオフセットから書き込み、一致しない場合は ErrDiverged で停止する。
+	PreserveOffsets bool
+	// Topics は複製元のトピックを、複製先に書き込むトピックに置き換える対応である。
+	// 含まれないトピックのレコードは、同じトピックのまま複製する。
+	Topics map[string]string
+	// MaxInFlight は複製先の確認応答を待たずに送信するレコードの最大数である。未設定の場合は256とする。
+	MaxInFlight int
+	// CheckpointInterval はチェックポイントを保存する間隔である。未設定の場合は1秒とする。
+	CheckpointInterval time.Duration
+	// LagInterval は複製元の末尾のオフセットを調べ、遅延を更新する間隔である。未設定の場合は10秒とする。
+	LagInterval time.Duration
+	// RetryInterval は複製が中断した後、再開するまでの待機時間である。未設定の場合は1秒とする。
+	RetryInterval time.Duration
+}
+
+// Mirror は複製元のログを ConsumeStream で読み出し、複製先のログに書き込む。
+type Mirror struct {
+	Config
+
+	source *grpc.ClientConn
+	target *grpc.ClientConn
+
+	mu       sync.Mutex
+	next     uint64 // 次に複製する複製元のオフセット
+	saved    uint64 // チェックポイントに保存済みのオフセット
+	end      uint64 // 直近に調べた複製元の末尾のオフセット (次に書き込まれるオフセット)
+	mirrored uint64 // 起動してから複製したレコード数
+	failures uint64 // 起動してから複製が中断した回数
+	err      error  // 複製を停止したエラー
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	logger *zap.Logger
+}
+
+// New はチェックポイントを読み込み、複製を開始する。
+func New(config Config) (*Mirror, error) {
+	if config.SourceAddr == "" || config.TargetAddr == "" {
+		return nil, errors.New("source and target addresses are required")
+	}
+	if config.CheckpointFile == "" {
+		return nil, errors.New("checkpoint file is required")
+	}
+	if config.Name == "" {
+		config.Name = "default"
+	}
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = 256
+	}
+	if config.CheckpointInterval == 0 {
+		config.CheckpointInterval = time.Second
+	}
+	if config.LagInterval == 0 {
+		config.LagInterval = 10 * time.Second
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = time.Second
+	}
+	m := &Mirror{
+		Config: config,
+		logger: zap.L().Named("mirror").With(zap.String("name", config.Name)),
+	}
+
+	next, err := m.readCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	m.next, m.saved = next, next
+
+	if m.source, err = dial(config.SourceAddr, config.SourceTLSConfig, config.SourceCredentials); err != nil {
+		return nil, err
+	}
+	if m.target, err = dial(config.TargetAddr, config.TargetTLSConfig, config.TargetCredentials); err != nil {
+		m.source.Close()
+		return nil, err
+	}
+
+	var ctx context.Context
+	ctx, m.cancel = context.WithCancel(context.Background())
+	m.wg.Add(3)
+	go m.run(ctx)
+	go m.every(ctx, m.CheckpointInterval, m.checkpoint)
+	go m.every(ctx, m.LagInterval, m.updateLag)
+	return m, nil
+}
+
+// dial はクラスタのサーバを発見し、読み出しをフォロワー、書き込みをリーダーに振り分けるコネクションを作成する。
+// RPCごとの認証情報は、サーバを発見するリゾルバのコネクションにも付与する。
+func dial(addr string, tlsConfig *tls.Config, perRPC credentials.PerRPCCredentials) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if perRPC != nil {
+		opts = append(opts,
+			grpc.WithPerRPCCredentials(perRPC),
+			grpc.WithResolvers(loadbalance.NewResolver(grpc.WithPerRPCCredentials(perRPC))),
+		)
+	}
+	return grpc.Dial(fmt.Sprintf("%s:///%s", loadbalance.Name, addr), opts...)
+}
+
+// Next は次に複製する複製元のオフセットを返却する。
+func (m *Mirror) Next() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.next
+}
+
+// Err は複製を停止したエラーを返却する。複製を継続している場合はnilを返却する。
+func (m *Mirror) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Close は複製を停止し、チェックポイントを保存してからコネクションを閉じる。
+func (m *Mirror) Close() error {
+	m.cancel()
+	m.wg.Wait()
+	err := m.checkpoint(context.Background())
+	if cerr := m.source.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := m.target.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// run は停止するまで複製を続ける。複製が中断した場合は、RetryInterval 待機してから
+// 複製済みのオフセットの次から再開する。
+func (m *Mirror) run(ctx context.Context) {
+	defer m.wg.Done()
+	for {
+		err := m.mirror(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		m.mu.Lock()
+		m.failures++
+		m.mu.Unlock()
+		if errors.Is(err, ErrDiverged) {
+			m.logger.Error("stopped mirroring", zap.Error(err))
+			m.mu.Lock()
+			m.err = err
+			m.mu.Unlock()
+			return
+		}
+		m.logger.Warn("mirroring interrupted", zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.RetryInterval):
+		}
+	}
+}
+
+// mirror は複製元から次のオフセット以降のレコードを受信し、複製先に書き込む。
+// 確認応答を待たずに MaxInFlight 件まで送信し、書き込みの確認応答を受けたレコードのみを複製済みとする。
+func (m *Mirror) mirror(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	next := m.Next()
+	if m.PreserveOffsets {
+		// 前回の停止前に書き込んだがチェックポイントに保存していないレコードを、再び書き込まないよう読み飛ばす
+		skipped, err := m.skipMirrored(ctx, next)
+		if err != nil {
+			return err
+		}
+		if skipped != next {
+			m.logger.Info("skipped records already mirrored",
+				zap.Uint64("from", next), zap.Uint64("to", skipped))
+			next = skipped
+			m.setNext(next, 0)
+		}
+	}
+
+	consume, err := api.NewLogClient(m.source).ConsumeStream(ctx, &api.ConsumeRequest{Offset: next})
+	if err != nil {
+		return err
+	}
+	produce, err := api.NewLogClient(m.target).ProduceStream(ctx)
+	if err != nil {
+		return err
+	}
+	// 送信済みで確認応答を待つ複製元のオフセット。容量により送信中のレコード数を制限する
+	inflight := make(chan uint64, m.MaxInFlight)
+	sendErr := make(chan error, 1)
+	go func() {
+		err := m.send(ctx, consume, produce, inflight)
+		// 確認応答の受信を止めるためにキャンセルする
+		cancel()
+		sendErr <- err
+	}()
+	err = m.acknowledge(produce, inflight)
+	cancel()
+	serr := <-sendErr
+	// 一方が失敗すると他方はキャンセルにより失敗するため、キャンセル以外の原因を返却する
+	if status.Code(err) == codes.Canceled && serr != nil {
+		return serr
+	}
+	return err
+}
+
+// send は複製元から受信したレコードを、確認応答を待たずに複製先へ送信する。
+// 複製先は受信した順に書き込んで確認応答を返すため、送信したオフセットを順に inflight へ積む。
+func (m *Mirror) send(
+	ctx context.Context,
+	consume api.Log_ConsumeStreamClient,
+	produce api.Log_ProduceStreamClient,
+	inflight chan<- uint64,
+) error {
+	for {
+		res, err := consume.Recv()
+		if err != nil {
+			return err
+		}
+		// 確認応答が送信より先に届いても対応を取れるよう、送信前に積む
+		select {
+		case inflight <- res.Record.Offset:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		req := &api.ProduceRequest{Record: &api.Record{
+			Value: res.Record.Value,
+			Topic: m.topic(res.Record.Topic),
+		}}
+		if m.PreserveOffsets {
+			req.Offset = &res.Record.Offset
+		}
+		if err = produce.Send(req); err != nil {
+			return err
+		}
+	}
+}
+
+// acknowledge は複製先の確認応答を受信し、送信した順のオフセットと対応させて複製済みのオフセットを進める。
+func (m *Mirror) acknowledge(produce api.Log_ProduceStreamClient, inflight <-chan uint64) error {
+	for {
+		out, err := produce.Recv()
+		if api.IsOffsetMismatch(err) {
+			return fmt.Errorf("%w: %s", ErrDiverged, status.Convert(err).Message())
+		}
+		if err != nil {
+			return err
+		}
+		offset := <-inflight
+		// オフセットの指定に対応しないサーバは、指定を無視して書き込むため確認応答でも検証する
+		if m.PreserveOffsets && out.Offset != offset {
+			return fmt.Errorf("%w: source %d, target %d", ErrDiverged, offset, out.Offset)
+		}
+		m.setNext(offset+1, 1)
+	}
+}
+
+// topic は複製元のトピックを、複製先に書き込むトピックに置き換える。
+func (m *Mirror) topic(topic string) string {
+	if renamed, ok := m.Topics[topic]; ok {
+		return renamed
+	}
+	return topic
+}
+
+// skipMirrored は複製先にレコードが存在するオフセットを読み飛ばし、複製先の末尾のオフセットを返却する。
+// 複製先のフォロワーは遅れている可能性があるため、リーダーから読み出す。
+func (m *Mirror) skipMirrored(ctx context.Context, next uint64) (uint64, error) {
+	client := api.NewLogClient(m.target)
+	return searchEnd(next, func(off uint64) (bool, error) {
+		return exists(ctx, client, &api.ConsumeRequest{Offset: off, MaxStaleness: durationpb.New(0)})
+	})
+}
+
+func (m *Mirror) setNext(next, mirrored uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next = next
+	m.mirrored += mirrored
+	if m.end < next {
+		m.end = next
+	}
+}
+
+// every は停止するまで、interval ごとに fn を呼び出す。
+func (m *Mirror) every(ctx context.Context, interval time.Duration, fn func(context.Context) error) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := fn(ctx); err != nil && ctx.Err() == nil {
+				m.logger.Warn("mirror task failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+// updateLag は複製元の末尾のオフセットを調べ、遅延の算出に用いる。
+func (m *Mirror) updateLag(ctx context.Context) error {
+	client := api.NewLogClient(m.source)
+	end, err := searchEnd(m.Next(), func(off uint64) (bool, error) {
+		return exists(ctx, client, &api.ConsumeRequest{Offset: off})
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.end = end
+	m.mu.Unlock()
+	return nil
+}
+
+// exists はリクエストのオフセットのレコードを読み出せるかを返却する。
+func exists(ctx context.Context, client api.LogClient, req *api.ConsumeRequest) (bool, error) {
+	_, err := client.Consume(ctx, req)
+	if status.Code(err) == codes.OutOfRange {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// searchEnd は lo 以降で読み出せない最初のオフセット (ログの末尾) を返却する。
+//
+// ログの末尾を問い合わせるRPCは存在しないため、lo から読み出せるオフセットを倍々に探した後、
+// 読み出せない最初のオフセットを二分探索する。
+func searchEnd(lo uint64, exists func(uint64) (bool, error)) (uint64, error) {
+	ok, err := exists(lo)
+	if err != nil || !ok {
+		return lo, err
+	}
+	// lo は読み出せ、hi は読み出せない
+	hi, step := lo+1, uint64(1)
+	for {
+		if ok, err = exists(hi); err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		lo, step = hi, step*2
+		hi = lo + step
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if ok, err = exists(mid); err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi, nil
+}
+
+// readCheckpoint はチェックポイントから次に複製するオフセットを読み込む。
+// チェックポイントが存在しない場合は StartOffset を返却する。
+func (m *Mirror) readCheckpoint() (uint64, error) {
+	b, err := os.ReadFile(m.CheckpointFile)
+	if os.IsNotExist(err) {
+		return m.StartOffset, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	next, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid checkpoint %s: %w", m.CheckpointFile, err)
+	}
+	return next, nil
+}
+
+// checkpoint は次に複製するオフセットが変化していれば、チェックポイントに保存する。
+// 保存中に停止してもチェックポイントが壊れないよう、一時ファイルに書き込んでから置き換える。
+func (m *Mirror) checkpoint(context.Context) error {
+	m.mu.Lock()
+	next, saved := m.next, m.saved
+	m.mu.Unlock()
+	if next == saved {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.CheckpointFile), filepath.Base(m.CheckpointFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(tmp, "%d\n", next)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), m.CheckpointFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	m.mu.Lock()
+	m.saved = next
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,265 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/bits"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/auth"
+	"github.com/ac0mz/proglog/internal/config"
+	"github.com/ac0mz/proglog/internal/log"
+	"github.com/ac0mz/proglog/internal/server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// TestMirror はレコードを複製先に複製し、再起動後はチェックポイントから重複なく複製を再開すること、
+// およびトピックを対応に従って置き換えることを検証する。
+func TestMirror(t *testing.T) {
+	source, target := setupServer(t), setupServer(t)
+	topics := []string{"orders", "payments", ""}
+	for i := 0; i < 3; i++ {
+		source.produceRecord(t, &api.Record{Value: []byte(fmt.Sprintf("record-%d", i)), Topic: topics[i]})
+	}
+
+	cfg := Config{
+		SourceAddr:         source.addr,
+		SourceTLSConfig:    clientTLSConfig(t),
+		TargetAddr:         target.addr,
+		TargetTLSConfig:    clientTLSConfig(t),
+		Name:               "orders",
+		Topics:             map[string]string{"orders": "dr.orders"},
+		MaxInFlight:        2,
+		CheckpointFile:     filepath.Join(t.TempDir(), "checkpoint"),
+		CheckpointInterval: 10 * time.Millisecond,
+	}
+	m, err := New(cfg)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return m.Next() == 3 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, m.Close())
+	b, err := os.ReadFile(cfg.CheckpointFile)
+	require.NoError(t, err)
+	require.Equal(t, "3\n", string(b))
+
+	for i := 3; i < 5; i++ {
+		source.produce(t, fmt.Sprintf("record-%d", i))
+	}
+	m, err = New(cfg)
+	require.NoError(t, err)
+	defer m.Close()
+	require.Eventually(t, func() bool { return m.Next() == 5 }, 5*time.Second, 10*time.Millisecond)
+	for i := uint64(0); i < 5; i++ {
+		record, err := target.clog.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record-%d", i), string(record.Value))
+	}
+	// 対応に含まれるトピックのみを置き換える
+	for i, topic := range []string{"dr.orders", "payments", ""} {
+		record, err := target.clog.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, topic, record.Topic)
+	}
+	_, err = target.clog.Read(5)
+	require.Error(t, err)
+	require.NoError(t, testutil.CollectAndCompare(m, strings.NewReader(`
+# HELP proglog_mirror_records_total Number of records mirrored since the mirror started.
+# TYPE proglog_mirror_records_total counter
+proglog_mirror_records_total{mirror="orders"} 2
+`), "proglog_mirror_records_total"))
+}
+
+// TestPreserveOffsets は複製先に書き込み済みのレコードを読み飛ばし、同じオフセットに複製すること、
+// 空の複製先には複製を開始したオフセットから書き込むこと、オフセットが一致しない場合は複製を停止することを検証する。
+func TestPreserveOffsets(t *testing.T) {
+	source, target := setupServer(t), setupServer(t)
+	for i := 0; i < 3; i++ {
+		source.produce(t, fmt.Sprintf("record-%d", i))
+	}
+	// チェックポイントに保存する前に停止した複製を模す
+	target.produce(t, "record-0")
+
+	m, err := New(Config{
+		SourceAddr:      source.addr,
+		SourceTLSConfig: clientTLSConfig(t),
+		TargetAddr:      target.addr,
+		TargetTLSConfig: clientTLSConfig(t),
+		CheckpointFile:  filepath.Join(t.TempDir(), "checkpoint"),
+		PreserveOffsets: true,
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return m.Next() == 3 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, m.Close())
+	for i := uint64(0); i < 3; i++ {
+		record, err := target.clog.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record-%d", i), string(record.Value))
+	}
+
+	// 空の複製先にオフセット2から複製すると、複製先もオフセット2から書き込む
+	empty := setupServer(t)
+	m, err = New(Config{
+		SourceAddr:      source.addr,
+		SourceTLSConfig: clientTLSConfig(t),
+		TargetAddr:      empty.addr,
+		TargetTLSConfig: clientTLSConfig(t),
+		CheckpointFile:  filepath.Join(t.TempDir(), "checkpoint"),
+		StartOffset:     2,
+		PreserveOffsets: true,
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return m.Next() == 3 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, m.Close())
+	record, err := empty.clog.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, "record-2", string(record.Value))
+	_, err = empty.clog.Read(1)
+	require.Error(t, err)
+
+	// 他のクライアントが書き込んだ複製先とはオフセットが一致しないため、書き込まずに停止する
+	other := setupServer(t)
+	other.produce(t, "other")
+	m, err = New(Config{
+		SourceAddr:      source.addr,
+		SourceTLSConfig: clientTLSConfig(t),
+		TargetAddr:      other.addr,
+		TargetTLSConfig: clientTLSConfig(t),
+		CheckpointFile:  filepath.Join(t.TempDir(), "checkpoint"),
+		StartOffset:     2,
+		PreserveOffsets: true,
+	})
+	require.NoError(t, err)
+	defer m.Close()
+	require.Eventually(t, func() bool { return m.Err() != nil }, 5*time.Second, 10*time.Millisecond)
+	require.ErrorIs(t, m.Err(), ErrDiverged)
+	require.Equal(t, uint64(2), m.Next())
+	_, err = other.clog.Read(1)
+	require.Error(t, err)
+}
+
+// TestLag は複製先に書き込めない間、複製元の末尾との差を遅延として報告することを検証する。
+func TestLag(t *testing.T) {
+	source := setupServer(t)
+	for i := 0; i < 10; i++ {
+		source.produce(t, fmt.Sprintf("record-%d", i))
+	}
+	// 接続できない複製先
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+
+	m, err := New(Config{
+		SourceAddr:      source.addr,
+		SourceTLSConfig: clientTLSConfig(t),
+		TargetAddr:      ln.Addr().String(),
+		TargetTLSConfig: clientTLSConfig(t),
+		CheckpointFile:  filepath.Join(t.TempDir(), "checkpoint"),
+		StartOffset:     3,
+		LagInterval:     10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer m.Close()
+	require.Eventually(t, func() bool {
+		return testutil.CollectAndCompare(m, strings.NewReader(`
+# HELP proglog_mirror_lag_records Number of source records not yet mirrored, as of the last probe.
+# TYPE proglog_mirror_lag_records gauge
+proglog_mirror_lag_records{mirror="default"} 7
+`), "proglog_mirror_lag_records") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(3), m.Next())
+}
+
+// TestSearchEnd はログの末尾を、オフセットの数に対して対数回の読み出しで探すことを検証する。
+func TestSearchEnd(t *testing.T) {
+	for _, tc := range []struct{ lo, end uint64 }{{0, 0}, {0, 1}, {3, 3}, {3, 4}, {0, 1000}, {17, 1025}} {
+		var probes int
+		got, err := searchEnd(tc.lo, func(off uint64) (bool, error) {
+			probes++
+			return off < tc.end, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, tc.end, got)
+		require.LessOrEqual(t, probes, 2*bits.Len64(tc.end-tc.lo)+2)
+	}
+}
+
+type testServer struct {
+	addr string
+	clog *log.Log
+	conn *grpc.ClientConn
+}
+
+func (s *testServer) produce(t *testing.T, value string) {
+	t.Helper()
+	s.produceRecord(t, &api.Record{Value: []byte(value)})
+}
+
+func (s *testServer) produceRecord(t *testing.T, record *api.Record) {
+	t.Helper()
+	_, err := api.NewLogClient(s.conn).Produce(context.Background(), &api.ProduceRequest{Record: record})
+	require.NoError(t, err)
+}
+
+// setupServer は単独でリーダーとして振る舞うサーバを起動する。サーバはテストの終了時に停止する。
+func setupServer(t *testing.T) *testServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+
+	srvTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog:      clog,
+		OffsetAppender: clog,
+		Authorizer:     authorizer,
+		GetServerer:    servers{{Id: "leader", RpcAddr: l.Addr().String(), IsLeader: true}},
+	}, grpc.Creds(credentials.NewTLS(srvTLSConfig)))
+	require.NoError(t, err)
+	go srv.Serve(l)
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(clientTLSConfig(t))))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Stop()
+		clog.Remove()
+	})
+	return &testServer{addr: l.Addr().String(), clog: clog, conn: conn}
+}
+
+func clientTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	return tlsConfig
+}
+
+type servers []*api.Server
+
+func (s servers) GetServers() ([]*api.Server, error) {
+	return s, nil
+}
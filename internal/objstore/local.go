@@ -0,0 +1,119 @@
+// Package objstore はログのクローズ済みのセグメントを保存するオブジェクトストレージの実装を提供する。
+// オブジェクトは "/" 区切りの名前で識別し、書き込んだ後は変更しない。
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// tmpPrefix は書き込み中のオブジェクトの一時ファイルに付与する接頭辞
+const tmpPrefix = ".tmp-"
+
+// Local はローカルのファイルシステムのディレクトリにオブジェクトを保存する。
+// NFSなどの共有ファイルシステムをマウントしたディレクトリを、外部のストレージとして利用できる。
+type Local struct {
+	Dir string
+}
+
+// NewLocal はディレクトリを作成し、そのディレクトリにオブジェクトを保存するLocalを返却する。
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Local{Dir: dir}, nil
+}
+
+// Put はオブジェクトを保存する。書き込みの途中で失敗しても不完全なオブジェクトが残らないよう、
+// 一時ファイルに書き込んでから置き換える。
+func (l *Local) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), tmpPrefix+filepath.Base(p))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("wrote %d bytes to %s, want %d", n, name, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Get はオブジェクトを読み出す。オブジェクトが存在しない場合は fs.ErrNotExist を返却する。
+func (l *Local) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	p, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// List は名前がprefixで始まるオブジェクトの名前を、辞書順で返却する。
+func (l *Local) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(l.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), tmpPrefix) {
+			return err
+		}
+		rel, err := filepath.Rel(l.Dir, p)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	sort.Strings(names)
+	return names, err
+}
+
+// Delete はオブジェクトを削除する。オブジェクトが存在しない場合も成功とする。
+func (l *Local) Delete(ctx context.Context, name string) error {
+	p, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// path はオブジェクトの名前をファイルのパスに変換する。ディレクトリの外を指す名前は拒否する。
+func (l *Local) path(name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if name == "" || clean != "/"+name {
+		return "", fmt.Errorf("invalid object name: %q", name)
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(name)), nil
+}
@@ -0,0 +1,211 @@
+package objstore
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// storage はテスト対象のオブジェクトストレージの共通のメソッド。
+type storage interface {
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, name string) error
+}
+
+func TestStorage(t *testing.T) {
+	for name, setup := range map[string]func(t *testing.T) storage{
+		"local": func(t *testing.T) storage {
+			l, err := NewLocal(t.TempDir())
+			require.NoError(t, err)
+			return l
+		},
+		"s3": func(t *testing.T) storage {
+			return setupS3(t, &fakeS3{maxKeys: 2}, testBucket)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testStorage(t, setup(t))
+		})
+	}
+}
+
+func testStorage(t *testing.T, s storage) {
+	ctx := context.Background()
+	for _, name := range []string{"node-1/2.store", "node-1/0.store", "node-1/0.index", "node-2/0.store"} {
+		require.NoError(t, s.Put(ctx, name, strings.NewReader(name), int64(len(name))))
+	}
+	// 空のオブジェクトも保存できる
+	require.NoError(t, s.Put(ctx, "node-1/empty", strings.NewReader(""), 0))
+
+	names, err := s.List(ctx, "node-1/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"node-1/0.index", "node-1/0.store", "node-1/2.store", "node-1/empty"}, names)
+
+	rc, err := s.Get(ctx, "node-1/0.store")
+	require.NoError(t, err)
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, "node-1/0.store", string(b))
+
+	require.NoError(t, s.Delete(ctx, "node-1/0.store"))
+	require.NoError(t, s.Delete(ctx, "node-1/0.store"))
+	_, err = s.Get(ctx, "node-1/0.store")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	names, err = s.List(ctx, "node-")
+	require.NoError(t, err)
+	require.Equal(t, []string{"node-1/0.index", "node-1/2.store", "node-1/empty", "node-2/0.store"}, names)
+}
+
+func TestLocalRejectsEscapingNames(t *testing.T) {
+	l, err := NewLocal(t.TempDir())
+	require.NoError(t, err)
+	for _, name := range []string{"", "../x", "a/../../x", "/x"} {
+		require.Error(t, l.Put(context.Background(), name, strings.NewReader("x"), 1), name)
+	}
+}
+
+// TestS3Errors は存在しないバケットを、オブジェクトが存在しないことと区別することを検証する。
+func TestS3Errors(t *testing.T) {
+	s := setupS3(t, &fakeS3{}, "missing")
+	_, err := s.Get(context.Background(), "x")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, fs.ErrNotExist)
+	require.Error(t, s.Delete(context.Background(), "x"))
+}
+
+const (
+	testAccessKeyID     = "AKIDEXAMPLE"
+	testSecretAccessKey = "secret"
+	testBucket          = "segments"
+)
+
+func setupS3(t *testing.T, fake *fakeS3, bucket string) *S3 {
+	t.Helper()
+	// 平文のHTTPではSDKがペイロードをチャンクごとに署名するため、偽のストレージはTLSで提供する
+	srv := httptest.NewTLSServer(fake)
+	t.Cleanup(srv.Close)
+	s, err := NewS3(S3Config{
+		Endpoint:        srv.URL,
+		Region:          "ap-northeast-1",
+		Bucket:          bucket,
+		AccessKeyID:     testAccessKeyID,
+		SecretAccessKey: testSecretAccessKey,
+		Transport:       srv.Client().Transport,
+	})
+	require.NoError(t, err)
+	return s
+}
+
+// fakeS3 はパス形式のS3のAPIのうち、S3が利用する操作のみを実装する。
+// 署名の検証はSDKに任せ、設定した認証情報で署名されていることのみを確認する。
+// ListObjectsV2 は maxKeys ごとに応答を分割する。
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	maxKeys int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.objects == nil {
+		f.objects = map[string][]byte{}
+	}
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential="+testAccessKeyID+"/") {
+		writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path != testBucket && !strings.HasPrefix(path, testBucket+"/") {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(path, testBucket), "/")
+	switch {
+	case r.Method == http.MethodPut:
+		b, _ := io.ReadAll(r.Body)
+		f.objects[key] = b
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r)
+	case r.Method == http.MethodGet:
+		b, ok := f.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		// SDKが応答のオブジェクトの情報として解析するヘッダ
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(b)))
+		w.Write(b)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if token := r.URL.Query().Get("continuation-token"); token != "" {
+		i := sort.SearchStrings(keys, token)
+		keys = keys[i:]
+	}
+	var result listResult
+	if f.maxKeys > 0 && len(keys) > f.maxKeys {
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[f.maxKeys]
+		keys = keys[:f.maxKeys]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, struct {
+			Key string `xml:"Key"`
+		}{key})
+	}
+	b, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		listResult
+	}{listResult: result})
+	w.Write(b)
+}
+
+// listResult は ListObjectsV2 の応答のうち、S3が利用する要素を保持する。
+type listResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>`)
+	b, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: http.StatusText(status)})
+	w.Write(b)
+}
@@ -0,0 +1,124 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config はS3互換のオブジェクトストレージへの接続の設定を保持する。
+type S3Config struct {
+	// Endpoint はストレージのURLである (例: https://s3.ap-northeast-1.amazonaws.com, http://localhost:9000)。
+	// バケットはパスで指定するため、仮想ホスト形式に対応しないストレージも利用できる。
+	Endpoint string
+	Region   string
+	Bucket   string
+	// 署名に用いる認証情報。SessionToken は一時的な認証情報の場合のみ設定する。
+	// AccessKeyID が未設定の場合は、環境変数 (AWS_ACCESS_KEY_ID など)、共有の認証情報ファイル、
+	// インスタンスのIAMロールの順に認証情報を探す。
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Transport はリクエストの送信に用いる。未設定の場合はSDKの既定のトランスポートを利用する。
+	Transport http.RoundTripper
+}
+
+// S3 はS3互換のオブジェクトストレージのバケットにオブジェクトを保存する。
+type S3 struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3 はバケットにオブジェクトを保存するS3を返却する。
+func NewS3(config S3Config) (*S3, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" ||
+		(endpoint.Path != "" && endpoint.Path != "/") {
+		return nil, fmt.Errorf("invalid endpoint: %q", config.Endpoint)
+	}
+	creds := credentials.NewStaticV4(config.AccessKeyID, config.SecretAccessKey, config.SessionToken)
+	if config.AccessKeyID == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:        creds,
+		Secure:       endpoint.Scheme == "https",
+		Region:       config.Region,
+		Transport:    config.Transport,
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3{client: client, bucket: config.Bucket}, nil
+}
+
+// Put はオブジェクトを保存する。大きなセグメントはSDKがマルチパートでアップロードする。
+func (s *S3) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, name, r, size, minio.PutObjectOptions{})
+	return err
+}
+
+// Get はオブジェクトを読み出す。オブジェクトが存在しない場合は fs.ErrNotExist を満たすエラーを返却する。
+func (s *S3) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	// Client.GetObject は最初の読み出しまでリクエストを送信しないため、存在しないオブジェクトを
+	// 呼び出し時に検知できるよう、リクエストを即座に送信する Core の GetObject を用いる
+	body, _, _, err := minio.Core{Client: s.client}.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if isNotExist(err) {
+		return nil, &fs.PathError{Op: "get", Path: name, Err: fs.ErrNotExist}
+	}
+	return body, err
+}
+
+// List は名前がprefixで始まるオブジェクトの名前を、辞書順で返却する。
+func (s *S3) List(ctx context.Context, prefix string) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var names []string
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		names = append(names, obj.Key)
+	}
+	return names, nil
+}
+
+// Delete はオブジェクトを削除する。オブジェクトが存在しない場合も成功とする。
+func (s *S3) Delete(ctx context.Context, name string) error {
+	err := s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{})
+	if isNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// isNotExist はオブジェクトが存在しないことを示すエラーかを判定する。
+// バケットが存在しない場合は設定の誤りのため含めない。
+func isNotExist(err error) bool {
+	if err == nil {
+		return false
+	}
+	res := minio.ToErrorResponse(err)
+	return res.Code == "NoSuchKey" || (res.StatusCode == http.StatusNotFound && res.Code != "NoSuchBucket")
+}
@@ -0,0 +1,278 @@
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Limits はクライアント1件あたりの上限値を定義する。0の項目は無制限とする。
+type Limits struct {
+	ProduceBytesPerSec float64 `json:"produce_bytes_per_sec"`
+	ConsumeBytesPerSec float64 `json:"consume_bytes_per_sec"`
+	RequestsPerSec     float64 `json:"requests_per_sec"`
+}
+
+// Config はすべてのクライアントに適用する上限値と、サブジェクトごとに上書きする上限値を定義する。
+type Config struct {
+	Default  Limits            `json:"default"`
+	Subjects map[string]Limits `json:"subjects"`
+}
+
+// limits はサブジェクトに適用する上限値を返却する。
+func (c Config) limits(subject string) Limits {
+	if l, ok := c.Subjects[subject]; ok {
+		return l
+	}
+	return c.Default
+}
+
+// LoadConfig はJSON形式の設定ファイルを読み込む。
+func LoadConfig(path string) (Config, error) {
+	var c Config
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err = json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("invalid quota config %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// sweepInterval はトークンが満たされたクライアントを削除する間隔である。
+const sweepInterval = time.Minute
+
+// Quotas はサブジェクト(クライアント証明書のCN)ごとに、リクエスト数と読み書きのバイト数を制限する。
+type Quotas struct {
+	mu        sync.Mutex
+	config    Config
+	clients   map[string]*client
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// client はサブジェクトごとのトークンバケットを保持する。
+type client struct {
+	requests *bucket
+	produce  *bucket
+	consume  *bucket
+}
+
+// New は設定された上限値を適用するQuotasを作成する。
+func New(config Config) *Quotas {
+	return &Quotas{
+		config:  config,
+		clients: map[string]*client{},
+		now:     time.Now,
+	}
+}
+
+// Update は上限値を置き換える。各クライアントの消費済みトークンは引き継ぐため、
+// 再読み込みを契機に上限を超えたリクエストが許可されることはない。
+func (q *Quotas) Update(config Config) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.config = config
+	now := q.now()
+	for subject, c := range q.clients {
+		l := config.limits(subject)
+		c.requests.setRate(now, l.RequestsPerSec)
+		c.produce.setRate(now, l.ProduceBytesPerSec)
+		c.consume.setRate(now, l.ConsumeBytesPerSec)
+	}
+}
+
+// Reload は設定ファイルを読み込み直して上限値を置き換える。
+func (q *Quotas) Reload(path string) error {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	q.Update(config)
+	return nil
+}
+
+// client はサブジェクトのトークンバケットを返却する。
+// サブジェクトの種類はJWTやSPIFFE IDにより際限なく増え得るため、sweepInterval ごとに
+// すべてのトークンが満たされたクライアントを削除する。満たされたバケットは新たに作成したものと同じ状態のため、
+// 削除しても上限値の判定は変わらない。
+func (q *Quotas) client(subject string, now time.Time) *client {
+	if now.Sub(q.lastSweep) >= sweepInterval {
+		for s, c := range q.clients {
+			if c.requests.full(now) && c.produce.full(now) && c.consume.full(now) {
+				delete(q.clients, s)
+			}
+		}
+		q.lastSweep = now
+	}
+	c, ok := q.clients[subject]
+	if !ok {
+		l := q.config.limits(subject)
+		c = &client{
+			requests: newBucket(now, l.RequestsPerSec),
+			produce:  newBucket(now, l.ProduceBytesPerSec),
+			consume:  newBucket(now, l.ConsumeBytesPerSec),
+		}
+		q.clients[subject] = c
+	}
+	return c
+}
+
+// AllowProduce はリクエスト1件とnバイトの書き込みを消費する。上限を超えている場合はエラーを返却する。
+func (q *Quotas) AllowProduce(subject string, n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	c := q.client(subject, now)
+	if err := c.requests.allow(now, "requests"); err != nil {
+		return err
+	}
+	if err := c.produce.allow(now, "produce bytes"); err != nil {
+		return err
+	}
+	c.requests.charge(now, 1)
+	c.produce.charge(now, float64(n))
+	return nil
+}
+
+// AllowConsume はリクエスト1件を消費し、読み出しの上限に余裕があるかを判定する。
+// 読み出すバイト数はレコードを読み出すまで分からないため、読み出し後に ChargeConsume で消費する。
+func (q *Quotas) AllowConsume(subject string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	c := q.client(subject, now)
+	if err := c.requests.allow(now, "requests"); err != nil {
+		return err
+	}
+	if err := c.consume.allow(now, "consume bytes"); err != nil {
+		return err
+	}
+	c.requests.charge(now, 1)
+	return nil
+}
+
+// ChargeConsume は読み出したnバイトを消費する。
+func (q *Quotas) ChargeConsume(subject string, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	q.client(subject, now).consume.charge(now, float64(n))
+}
+
+// AllowRequest は読み書き以外のリクエスト1件を消費する。
+func (q *Quotas) AllowRequest(subject string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	c := q.client(subject, now)
+	if err := c.requests.allow(now, "requests"); err != nil {
+		return err
+	}
+	c.requests.charge(now, 1)
+	return nil
+}
+
+// bucket は1秒あたりrateのトークンを補充するトークンバケットである。
+//
+//	NOTE:
+//	 トークンが残っていれば、要求量がそれを上回っていても消費を許可して負債として記録する。
+//	 これにより、バースト量より大きなレコードも拒否せずに扱え、
+//	 負債を返済するまでの間は後続のリクエストを拒否することで平均レートを守る。
+type bucket struct {
+	rate   float64 // 0の場合は無制限
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(now time.Time, rate float64) *bucket {
+	b := &bucket{last: now}
+	b.setRate(now, rate)
+	b.tokens = b.burst
+	return b
+}
+
+// setRate は補充のレートを変更する。バースト量は1秒分のトークンとする。
+func (b *bucket) setRate(now time.Time, rate float64) {
+	b.refill(now)
+	b.rate = rate
+	b.burst = math.Max(rate, 1)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// allow はトークンが残っているかを判定する。
+// 残っていない場合は、トークンが補充されるまでの待ち時間を含むエラーを返却する。
+func (b *bucket) allow(now time.Time, kind string) error {
+	if b.rate <= 0 {
+		return nil
+	}
+	b.refill(now)
+	if b.tokens > 0 {
+		return nil
+	}
+	// 負債を返済し、トークンが1つ以上補充されるまで待つ
+	wait := time.Duration(math.Ceil((1 - b.tokens) / b.rate * float64(time.Second)))
+	return errExhausted(kind, wait)
+}
+
+// full はトークンがバースト量まで補充されているかを判定する。
+func (b *bucket) full(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+func (b *bucket) charge(now time.Time, n float64) {
+	if b.rate <= 0 {
+		return
+	}
+	b.refill(now)
+	b.tokens -= n
+}
+
+// errExhausted はクライアントが再試行するまで待つべき時間を付与した ResourceExhausted エラーを作成する。
+func errExhausted(kind string, wait time.Duration) error {
+	st := status.New(codes.ResourceExhausted, fmt.Sprintf("%s quota exceeded, retry after %s", kind, wait))
+	d, err := st.WithDetails(
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)},
+		&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{{
+			Subject:     kind,
+			Description: fmt.Sprintf("%s per second", kind),
+		}}},
+	)
+	if err != nil {
+		return st.Err()
+	}
+	return d.Err()
+}
+
+// RetryDelay はエラーに付与された再試行までの待ち時間を返却する。
+func RetryDelay(err error) (time.Duration, bool) {
+	for _, d := range status.Convert(err).Details() {
+		if ri, ok := d.(*errdetails.RetryInfo); ok {
+			return ri.RetryDelay.AsDuration(), true
+		}
+	}
+	return 0, false
+}
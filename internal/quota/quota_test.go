@@ -0,0 +1,80 @@
+package quota
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestQuotas はトークンの消費と補充、負債の返済までの待ち時間、上限値の更新を検証する。
+func TestQuotas(t *testing.T) {
+	now := time.Unix(0, 0)
+	q := New(Config{
+		Default: Limits{ProduceBytesPerSec: 100, RequestsPerSec: 10},
+		Subjects: map[string]Limits{
+			"consumer": {ConsumeBytesPerSec: 10},
+		},
+	})
+	q.now = func() time.Time { return now }
+
+	// バースト量(1秒分)を超えるレコードも、トークンが残っていれば許可される
+	require.NoError(t, q.AllowProduce("producer", 300))
+	err := q.AllowProduce("producer", 1)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	// 負債200バイトを返済し、さらに1バイト補充されるまで待つ
+	delay, ok := RetryDelay(err)
+	require.True(t, ok)
+	require.Equal(t, 2010*time.Millisecond, delay)
+
+	now = now.Add(delay)
+	require.NoError(t, q.AllowProduce("producer", 1))
+
+	// 読み出しはレコードを読み出した後に消費する
+	require.NoError(t, q.AllowConsume("consumer"))
+	q.ChargeConsume("consumer", 20)
+	require.Equal(t, codes.ResourceExhausted, status.Code(q.AllowConsume("consumer")))
+	// サブジェクトごとの設定ではリクエスト数は無制限
+	for i := 0; i < 100; i++ {
+		require.NoError(t, q.AllowRequest("consumer"))
+	}
+	// デフォルトの設定ではリクエスト数を制限
+	for i := 0; i < 10; i++ {
+		require.NoError(t, q.AllowRequest("other"))
+	}
+	require.Equal(t, codes.ResourceExhausted, status.Code(q.AllowRequest("other")))
+
+	// 設定ファイルを読み込み直すと、既存のクライアントにも新しい上限値が適用される
+	path := filepath.Join(t.TempDir(), "quota.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"default": {"requests_per_sec": 0}}`), 0644))
+	require.NoError(t, q.Reload(path))
+	require.NoError(t, q.AllowRequest("other"))
+	require.NoError(t, q.AllowConsume("consumer"))
+
+	require.NoError(t, os.WriteFile(path, []byte(`{`), 0644))
+	require.Error(t, q.Reload(path))
+}
+
+// TestQuotasEvictFullClients はトークンが満たされたクライアントのみを削除し、
+// 負債を返済中のクライアントの制限は維持されることを検証する。
+func TestQuotasEvictFullClients(t *testing.T) {
+	now := time.Unix(0, 0)
+	q := New(Config{Default: Limits{RequestsPerSec: 1, ProduceBytesPerSec: 1}})
+	q.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, q.AllowRequest(fmt.Sprintf("client-%d", i)))
+	}
+	// 返済に sweepInterval より長くかかる負債を抱える
+	require.NoError(t, q.AllowProduce("producer", 300))
+	require.Equal(t, 101, len(q.clients))
+
+	now = now.Add(sweepInterval)
+	require.Equal(t, codes.ResourceExhausted, status.Code(q.AllowProduce("producer", 1)))
+	require.Equal(t, 1, len(q.clients))
+}
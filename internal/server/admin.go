@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"time"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PolicyManager はRaftにより複製されるACLのポリシーを管理する。
+type PolicyManager interface {
+	AddPolicy(context.Context, *api.Policy) error
+	RemovePolicy(context.Context, *api.Policy) error
+	ListPolicies() []*api.Policy
+}
+
+// KeyManager はクラスタのメンバーシップのゴシップを暗号化する鍵を管理する。
+type KeyManager interface {
+	InstallKey(key string) error
+	UseKey(key string) error
+	RemoveKey(key string) error
+	ListKeys() (keys map[string]int, numNodes int, err error)
+}
+
+// Querier はクラスタのすべてのメンバーにクエリを送信し、各メンバーの応答を返却する。
+type Querier interface {
+	Query(name string, payload []byte, timeout time.Duration) ([]*api.QueryResult, error)
+}
+
+// Backuper はログ全体の point-in-time のコピーをアーカイブとして書き込む。
+type Backuper interface {
+	Backup(w io.Writer) error
+}
+
+const adminAction = "admin"
+
+var _ api.AdminServer = (*adminServer)(nil)
+
+type adminServer struct {
+	api.UnimplementedAdminServer
+	*Config
+}
+
+// AddPolicy はポリシーを追加する。ポリシーはリーダーに対してのみ追加できる。
+func (s *adminServer) AddPolicy(ctx context.Context, req *api.AddPolicyRequest) (
+	*api.AddPolicyResponse, error) {
+
+	if err := s.authorizePolicies(ctx); err != nil {
+		return nil, err
+	}
+	if err := validatePolicy(req.Policy); err != nil {
+		return nil, err
+	}
+	err := s.PolicyManager.AddPolicy(ctx, req.Policy)
+	s.auditAdmin(ctx, "add_policy", policyString(req.Policy), err)
+	if err != nil {
+		return nil, err
+	}
+	return &api.AddPolicyResponse{}, nil
+}
+
+// RemovePolicy はポリシーを削除する。ポリシーはリーダーに対してのみ削除できる。
+func (s *adminServer) RemovePolicy(ctx context.Context, req *api.RemovePolicyRequest) (
+	*api.RemovePolicyResponse, error) {
+
+	if err := s.authorizePolicies(ctx); err != nil {
+		return nil, err
+	}
+	if err := validatePolicy(req.Policy); err != nil {
+		return nil, err
+	}
+	err := s.PolicyManager.RemovePolicy(ctx, req.Policy)
+	s.auditAdmin(ctx, "remove_policy", policyString(req.Policy), err)
+	if err != nil {
+		return nil, err
+	}
+	return &api.RemovePolicyResponse{}, nil
+}
+
+// ListPolicies は当該サーバに適用済みの複製されたポリシー一覧を返却する。
+func (s *adminServer) ListPolicies(ctx context.Context, req *api.ListPoliciesRequest) (
+	*api.ListPoliciesResponse, error) {
+
+	if err := s.authorizePolicies(ctx); err != nil {
+		return nil, err
+	}
+	return &api.ListPoliciesResponse{Policies: s.PolicyManager.ListPolicies()}, nil
+}
+
+// authorizePolicies はサブジェクトがポリシーの管理を許可されているかを検証する。
+func (s *adminServer) authorizePolicies(ctx context.Context) error {
+	if s.PolicyManager == nil {
+		return status.Error(codes.Unimplemented, "policy management is not enabled")
+	}
+	return s.authorize(ctx, auth.PolicyObject, adminAction)
+}
+
+// InstallGossipKey はクラスタのすべてのメンバーにゴシップを暗号化する鍵を追加する。
+func (s *adminServer) InstallGossipKey(ctx context.Context, req *api.GossipKeyRequest) (
+	*api.GossipKeyResponse, error) {
+
+	return s.changeGossipKey(ctx, "install_gossip_key", req.Key, s.KeyManager.InstallKey)
+}
+
+// UseGossipKey はクラスタのすべてのメンバーで、ゴシップの暗号化に用いる主鍵を切り替える。
+func (s *adminServer) UseGossipKey(ctx context.Context, req *api.GossipKeyRequest) (
+	*api.GossipKeyResponse, error) {
+
+	return s.changeGossipKey(ctx, "use_gossip_key", req.Key, s.KeyManager.UseKey)
+}
+
+// RemoveGossipKey はクラスタのすべてのメンバーからゴシップを暗号化する鍵を削除する。
+func (s *adminServer) RemoveGossipKey(ctx context.Context, req *api.GossipKeyRequest) (
+	*api.GossipKeyResponse, error) {
+
+	return s.changeGossipKey(ctx, "remove_gossip_key", req.Key, s.KeyManager.RemoveKey)
+}
+
+// changeGossipKey は鍵を変更し、監査ログには鍵自体ではなく鍵のフィンガープリントを記録する。
+func (s *adminServer) changeGossipKey(ctx context.Context, action, key string, change func(string) error) (
+	*api.GossipKeyResponse, error) {
+
+	if err := s.authorizeKeys(ctx); err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is required")
+	}
+	err := change(key)
+	s.auditAdmin(ctx, action, keyFingerprint(key), err)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &api.GossipKeyResponse{}, nil
+}
+
+// ListGossipKeys はクラスタで用いられている鍵と、それぞれの鍵を保持するメンバー数を返却する。
+func (s *adminServer) ListGossipKeys(ctx context.Context, req *api.ListGossipKeysRequest) (
+	*api.ListGossipKeysResponse, error) {
+
+	if err := s.authorizeKeys(ctx); err != nil {
+		return nil, err
+	}
+	keys, numNodes, err := s.KeyManager.ListKeys()
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	res := &api.ListGossipKeysResponse{Keys: map[string]int32{}, NumNodes: int32(numNodes)}
+	for key, n := range keys {
+		res.Keys[key] = int32(n)
+	}
+	return res, nil
+}
+
+// authorizeKeys はサブジェクトがゴシップの鍵の管理を許可されているかを検証する。
+func (s *adminServer) authorizeKeys(ctx context.Context) error {
+	if s.KeyManager == nil {
+		return status.Error(codes.Unimplemented, "gossip key management is not enabled")
+	}
+	return s.authorize(ctx, auth.KeyringObject, adminAction)
+}
+
+// Query はクラスタのすべてのメンバーにクエリを送信し、タイムアウトまでに得られた応答を返却する。
+func (s *adminServer) Query(ctx context.Context, req *api.QueryRequest) (*api.QueryResponse, error) {
+	if s.Querier == nil {
+		return nil, status.Error(codes.Unimplemented, "cluster queries are not enabled")
+	}
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "query name is required")
+	}
+	object := auth.QueryObject(req.Name)
+	if err := s.authorize(ctx, object, adminAction); err != nil {
+		return nil, err
+	}
+	results, err := s.Querier.Query(req.Name, req.Payload, time.Duration(req.TimeoutMs)*time.Millisecond)
+	s.auditAdmin(ctx, "query", object, err)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &api.QueryResponse{Results: results}, nil
+}
+
+// Backup はログ全体のバックアップを取得し、アーカイブを分割してストリーミングする。
+func (s *adminServer) Backup(req *api.BackupRequest, stream api.Admin_BackupServer) error {
+	if s.Backuper == nil {
+		return status.Error(codes.Unimplemented, "backup is not enabled")
+	}
+	ctx := stream.Context()
+	if err := s.authorize(ctx, auth.BackupObject, adminAction); err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(&chunkWriter{stream: stream}, backupChunkSize)
+	err := s.Backuper.Backup(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	s.auditAdmin(ctx, "backup", auth.BackupObject, err)
+	return err
+}
+
+// backupChunkSize はバックアップを分割して送信する際の1メッセージあたりの最大バイト数
+const backupChunkSize = 64 * 1024
+
+// chunkWriter は書き込まれたバイト列をバックアップの一部としてストリームに送信する。
+type chunkWriter struct {
+	stream api.Admin_BackupServer
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	for off := 0; off < len(p); off += backupChunkSize {
+		end := off + backupChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := w.stream.Send(&api.BackupChunk{Data: p[off:end]}); err != nil {
+			return off, err
+		}
+	}
+	return len(p), nil
+}
+
+// policyString はポリシーをCSVの1行と同じ形式で表す。
+func policyString(p *api.Policy) string {
+	if p == nil {
+		return ""
+	}
+	return strings.Join(append([]string{p.Ptype}, p.Values...), ", ")
+}
+
+// keyFingerprint は鍵を特定するためのSHA-256ハッシュの先頭8バイトを返却する。
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// validatePolicy は複製する前にポリシーの形式を検証する。
+// 複製後に適用できないポリシーは各サーバで読み飛ばされる。
+func validatePolicy(p *api.Policy) error {
+	if p == nil || len(p.Values) == 0 {
+		return status.Error(codes.InvalidArgument, "policy is required")
+	}
+	if p.Ptype == "" || (p.Ptype[0] != 'p' && p.Ptype[0] != 'g') {
+		return status.Errorf(codes.InvalidArgument, "invalid ptype: %q", p.Ptype)
+	}
+	return nil
+}
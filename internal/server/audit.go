@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+
+	"github.com/ac0mz/proglog/internal/audit"
+	"github.com/ac0mz/proglog/internal/auth"
+)
+
+// authorize はサブジェクトにオブジェクトへのアクションを認可し、その判定を監査ログに記録する。
+func (c *Config) authorize(ctx context.Context, object, action string) error {
+	sub := subject(ctx)
+	err := c.Authorizer.Authorize(sub, object, action)
+	e := audit.Event{
+		Kind:    audit.KindAuthorization,
+		Subject: sub,
+		Action:  action,
+		Object:  object,
+		Outcome: audit.OutcomeAllow,
+	}
+	if err != nil {
+		e.Outcome = audit.OutcomeDeny
+		e.Error = err.Error()
+	}
+	c.Auditor.Record(ctx, e)
+	return err
+}
+
+// auditRecord はレコードの書き込み・読み出しの結果を監査ログに記録する。
+// 書き込みに失敗した場合、オフセットは確定しないため記録しない。
+func (c *Config) auditRecord(ctx context.Context, action string, offset uint64, err error) {
+	e := audit.Event{
+		Kind:    audit.KindRecord,
+		Subject: subject(ctx),
+		Action:  action,
+		Object:  auth.LogObject(c.LogName),
+		Offset:  &offset,
+		Outcome: audit.OutcomeSuccess,
+	}
+	if err != nil {
+		e.Outcome = audit.OutcomeFailure
+		e.Error = err.Error()
+		if action == produceAction {
+			e.Offset = nil
+		}
+	}
+	c.Auditor.Record(ctx, e)
+}
+
+// auditAdmin はポリシーやゴシップの鍵の変更を監査ログに記録する。
+func (c *Config) auditAdmin(ctx context.Context, action, object string, err error) {
+	e := audit.Event{
+		Kind:    audit.KindAdmin,
+		Subject: subject(ctx),
+		Action:  action,
+		Object:  object,
+		Outcome: audit.OutcomeSuccess,
+	}
+	if err != nil {
+		e.Outcome = audit.OutcomeFailure
+		e.Error = err.Error()
+	}
+	c.Auditor.Record(ctx, e)
+}
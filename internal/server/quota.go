@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/quota"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// quotaUnaryServerInterceptor はサブジェクトごとのリクエスト数と読み書きのバイト数を制限する。
+// サブジェクトを参照するため、認証のインタセプタより後に設定する必要がある。
+func quotaUnaryServerInterceptor(q *quota.Quotas) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		sub := subject(ctx)
+		switch r := req.(type) {
+		case *api.ProduceRequest:
+			if err := q.AllowProduce(sub, proto.Size(r)); err != nil {
+				return nil, err
+			}
+		case *api.ConsumeRequest:
+			if err := q.AllowConsume(sub); err != nil {
+				return nil, err
+			}
+		default:
+			if err := q.AllowRequest(sub); err != nil {
+				return nil, err
+			}
+		}
+		res, err := handler(ctx, req)
+		if r, ok := res.(*api.ConsumeResponse); ok && err == nil {
+			q.ChargeConsume(sub, proto.Size(r))
+		}
+		return res, err
+	}
+}
+
+// quotaStreamServerInterceptor はストリーム上で送受信するメッセージごとに上限を適用する。
+func quotaStreamServerInterceptor(q *quota.Quotas) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		return handler(srv, &quotaServerStream{
+			WrappedServerStream: grpc_middleware.WrapServerStream(ss),
+			quotas:              q,
+			subject:             subject(ss.Context()),
+		})
+	}
+}
+
+type quotaServerStream struct {
+	*grpc_middleware.WrappedServerStream
+	quotas  *quota.Quotas
+	subject string
+}
+
+// RecvMsg は受信したリクエストを書き込みとして消費する。上限を超えた場合はストリームを終了させる。
+func (s *quotaServerStream) RecvMsg(m interface{}) error {
+	if err := s.WrappedServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if r, ok := m.(*api.ProduceRequest); ok {
+		return s.quotas.AllowProduce(s.subject, proto.Size(r))
+	}
+	return s.quotas.AllowRequest(s.subject)
+}
+
+// SendMsg は送信するレコードを読み出しとして消費する。上限を超えた場合はストリームを終了させる。
+func (s *quotaServerStream) SendMsg(m interface{}) error {
+	r, ok := m.(*api.ConsumeResponse)
+	if !ok {
+		return s.WrappedServerStream.SendMsg(m)
+	}
+	if err := s.quotas.AllowConsume(s.subject); err != nil {
+		return err
+	}
+	if err := s.WrappedServerStream.SendMsg(m); err != nil {
+		return err
+	}
+	s.quotas.ChargeConsume(s.subject, proto.Size(r))
+	return nil
+}
@@ -5,21 +5,23 @@ import (
 	"time"
 
 	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/audit"
+	"github.com/ac0mz/proglog/internal/auth"
+	"github.com/ac0mz/proglog/internal/quota"
+	"github.com/ac0mz/proglog/internal/tracing"
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
-	"go.opencensus.io/plugin/ocgrpc"
-	"go.opencensus.io/stats/view"
-	"go.opencensus.io/trace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
@@ -29,21 +31,81 @@ type Config struct {
 	CommitLog   CommitLog
 	Authorizer  Authorizer
 	GetServerer GetServerer
+	Metrics     *Metrics // 未設定の場合、RPCのメトリクスは収集しない
+	// Quotas はサブジェクトごとのリクエスト数と読み書きのバイト数を制限する。未設定の場合は制限しない。
+	Quotas *quota.Quotas
+	// PolicyManager はACLのポリシーを管理する。
+	// PolicyManagerとKeyManagerがいずれも未設定の場合、管理者用のサービスは登録しない。
+	PolicyManager PolicyManager
+	// KeyManager はゴシップを暗号化する鍵を管理する。
+	KeyManager KeyManager
+	// MemberGetter はメンバーシップから見たクラスタのメンバーを返却する。未設定の場合、GetMembersは利用できない。
+	MemberGetter MemberGetter
+	// Querier はクラスタのすべてのメンバーにクエリを送信する。未設定の場合、Queryは利用できない。
+	Querier Querier
+	// Backuper はログ全体のバックアップを取得する。未設定の場合、Backupは利用できない。
+	Backuper Backuper
+	// TracerProvider はRPCごとのスパンを作成する。未設定の場合はグローバルなTracerProviderを利用する。
+	TracerProvider trace.TracerProvider
+	// Authenticator はRPCのサブジェクトを識別する。未設定の場合はクライアント証明書のCNをサブジェクトとする。
+	Authenticator auth.Authenticator
+	// LogName は認可の対象となるログの名前である。未設定の場合は DefaultLogName とする。
+	LogName string
+	// Auditor は認可の判定とレコードの読み書き、管理操作を記録する。未設定の場合は記録しない。
+	Auditor *audit.Auditor
+	// WatchInterval はWatchServersがサーバの変化を確認する間隔である。未設定の場合は1秒とする。
+	WatchInterval time.Duration
+	// StalenessReporter はローカルのログの古さを返却する。未設定の場合、max_stalenessを指定した読み出しも拒否しない。
+	StalenessReporter StalenessReporter
+	// Iterable はConsumeStreamでレコードを順に読み出すイテレータを作成する。
+	// 未設定の場合、ConsumeStreamはレコードごとに CommitLog から読み出す。
+	Iterable Iterable
+	// OffsetAppender はオフセットを指定したレコードを、そのオフセットに書き込む。
+	// 未設定の場合、オフセットを指定した書き込みは Unimplemented として拒否する。
+	OffsetAppender OffsetAppender
 }
 
+// DefaultLogName はLogNameが未設定の場合のログの名前である。
+const DefaultLogName = "default"
+
 type CommitLog interface {
-	Append(*api.Record) (uint64, error)
+	// AppendContext はコンテキストのトレース情報を引き継いでレコードを追加する。
+	AppendContext(context.Context, *api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
 }
 
+// RecordIterator はあるオフセットから順にレコードを読み出す。
+type RecordIterator interface {
+	// Next は次のレコードを返却する。レコードが未書き込みの場合は api.ErrOffsetOutOfRange を返却し、
+	// 再び呼び出すと同じオフセットから読み出す。
+	Next() (*api.Record, error)
+}
+
+// OffsetAppender はレコードを指定したオフセットに書き込む。
+type OffsetAppender interface {
+	// AppendAtContext はレコードをオフセットに書き込む。ログの次のオフセットと一致しない場合は
+	// api.ErrOffsetMismatch を返却する。ログが空の場合はそのオフセットから書き込みを開始する。
+	AppendAtContext(ctx context.Context, record *api.Record, offset uint64) (uint64, error)
+}
+
+// Iterable はオフセットから順にレコードを読み出すイテレータを作成する。
+type Iterable interface {
+	Iterate(offset uint64) RecordIterator
+}
+
+// StalenessReporter はローカルのログから読み出すレコードが、リーダーに対してどれだけ古い可能性があるかを返却する。
+type StalenessReporter interface {
+	Staleness() time.Duration
+}
+
 type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
 
 const (
-	objectWildcard = "*"
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	discoverAction = "discover"
 )
 
 var _ api.LogServer = (*grpcServer)(nil)
@@ -61,40 +123,41 @@ func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server,
 			return zap.Int64("grpc.time_ns", duration.Nanoseconds()) // 各リクエストの持続時間をナノ秒単位で記録
 		}),
 	}
-	// OpenCensusによるメトリクスとトレースの設定
-	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()}) // 全リクエストにおけるトレースを常にサンプリング
-	// NOTE:
-	//  本番環境においてはパフォーマンスへの悪影響や機密データの追跡を避けるために、すべてのリクエストを追跡することは避けたい。
-	//  この対策として、ProbabilitySamplerメソッドで生成したサンプラーを指定することで、一部のリクエストのみサンプリングできる。
-	//  上記かつ、重要なリクエストを常にトレースしたい場合は独自のサンプラーを定義することも可能。
-	err := view.Register(ocgrpc.DefaultServerViews...)
-	// NOTE:
-	//  DefaultServerViewsを指定した場合、次の統計情報を収集する。
-	//  RPC毎の受信・送信バイト数, レイテンシ, 完了したRPC
-	if err != nil {
-		return nil, err
+	// OpenTelemetryによるトレースの設定
+	// サンプリングの割合やエクスポート先は、TracerProviderの作成時に設定する
+	tp := config.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
 	}
 
 	// サーバが各RPCのサブジェクトを識別して認可処理を開始できるようミドルウェアを設定
+	// ストリーミングに関するミドルウェア設定
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		grpc_ctxtags.StreamServerInterceptor(),
+		tracing.StreamServerInterceptor(tp),
+		grpc_zap.StreamServerInterceptor(logger, zapOpts...),
+		grpc_auth.StreamServerInterceptor(authenticate(config.Authenticator)),
+	}
+	// ストリーミング以外に関するミドルウェア設定
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		grpc_ctxtags.UnaryServerInterceptor(),
+		tracing.UnaryServerInterceptor(tp),
+		grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
+		grpc_auth.UnaryServerInterceptor(authenticate(config.Authenticator)),
+	}
+	if config.Quotas != nil {
+		// サブジェクトごとに制限するため、認証の後に設定
+		streamInterceptors = append(streamInterceptors, quotaStreamServerInterceptor(config.Quotas))
+		unaryInterceptors = append(unaryInterceptors, quotaUnaryServerInterceptor(config.Quotas))
+	}
+	if config.Metrics != nil {
+		// 認証の失敗を含むすべてのRPCを計測するため、チェーンの先頭に設定
+		streamInterceptors = append([]grpc.StreamServerInterceptor{config.Metrics.StreamServerInterceptor()}, streamInterceptors...)
+		unaryInterceptors = append([]grpc.UnaryServerInterceptor{config.Metrics.UnaryServerInterceptor()}, unaryInterceptors...)
+	}
 	grpcOpts = append(grpcOpts,
-		// ストリーミングに関するミドルウェア設定
-		grpc.StreamInterceptor(
-			grpc_middleware.ChainStreamServer(
-				grpc_ctxtags.StreamServerInterceptor(),
-				grpc_zap.StreamServerInterceptor(logger, zapOpts...),
-				grpc_auth.StreamServerInterceptor(authenticate),
-			),
-		),
-		// ストリーミング以外に関するミドルウェア設定
-		grpc.UnaryInterceptor(
-			grpc_middleware.ChainUnaryServer(
-				grpc_ctxtags.UnaryServerInterceptor(),
-				grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
-				grpc_auth.UnaryServerInterceptor(authenticate),
-			),
-		),
-		// サーバのリクエスト処理に関する統計情報ハンドラの設定
-		grpc.StatsHandler(&ocgrpc.ServerHandler{}),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamInterceptors...)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryInterceptors...)),
 	)
 
 	gsrv := grpc.NewServer(grpcOpts...)
@@ -110,10 +173,16 @@ func NewGRPCServer(config *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server,
 		return nil, err
 	}
 	api.RegisterLogServer(gsrv, srv)
+	if config.PolicyManager != nil || config.KeyManager != nil || config.Querier != nil || config.Backuper != nil {
+		api.RegisterAdminServer(gsrv, &adminServer{Config: config})
+	}
 	return gsrv, nil
 }
 
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
+	if config.LogName == "" {
+		config.LogName = DefaultLogName
+	}
 	srv = &grpcServer{
 		Config: config,
 	}
@@ -125,15 +194,27 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 	*api.ProduceResponse, error) {
 
 	// 書き込みの認可
-	if err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		produceAction,
-	); err != nil {
+	if err := s.authorize(ctx, auth.LogObject(s.LogName), produceAction); err != nil {
 		return nil, err
 	}
+	return s.produce(ctx, req)
+}
+
+// produce は認可済みのリクエストのレコードをログに書き込む。オフセットが指定された場合はそのオフセットに書き込む。
+func (s *grpcServer) produce(ctx context.Context, req *api.ProduceRequest) (
+	*api.ProduceResponse, error) {
 
-	offset, err := s.CommitLog.Append(req.Record)
+	var offset uint64
+	var err error
+	switch {
+	case req.Offset == nil:
+		offset, err = s.CommitLog.AppendContext(ctx, req.Record)
+	case s.OffsetAppender == nil:
+		return nil, status.Error(codes.Unimplemented, "producing at a given offset is not supported")
+	default:
+		offset, err = s.OffsetAppender.AppendAtContext(ctx, req.Record, *req.Offset)
+	}
+	s.auditRecord(ctx, produceAction, offset, err)
 	if err != nil {
 		return nil, err
 	}
@@ -144,16 +225,28 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	*api.ConsumeResponse, error) {
 
-	// 読み出しの認可
-	if err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		consumeAction,
-	); err != nil {
+	// 読み出しの認可 (オフセットの範囲を指定したポリシーを判定するため、オフセットごとに認可する)
+	if err := s.authorize(ctx, auth.RecordObject(s.LogName, req.Offset), consumeAction); err != nil {
 		return nil, err
 	}
+	res, err := s.consume(req, s.CommitLog.Read)
+	s.auditRecord(ctx, consumeAction, req.Offset, err)
+	return res, err
+}
 
-	record, err := s.CommitLog.Read(req.Offset)
+// consume は認可済みのオフセットのレコードをreadで読み出す。
+// 許容する古さの上限が指定され、ローカルのログがそれを超えて古い可能性がある場合は読み出しを拒否する。
+func (s *grpcServer) consume(
+	req *api.ConsumeRequest,
+	read func(uint64) (*api.Record, error),
+) (*api.ConsumeResponse, error) {
+	if req.MaxStaleness != nil && s.StalenessReporter != nil {
+		max := req.MaxStaleness.AsDuration()
+		if staleness := s.StalenessReporter.Staleness(); staleness > max {
+			return nil, api.ErrStaleRead{Staleness: staleness, MaxStaleness: max}
+		}
+	}
+	record, err := read(req.Offset)
 	if err != nil {
 		return nil, err
 	}
@@ -162,13 +255,18 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 
 // ProduceStream は双方向ストリーミングRPCの実装である。
 // クライアントは複数リクエストをサーバにストリーミングし、サーバは各リクエストの成否をクライアントに伝える。
+// 書き込みの対象はストリーム内で変わらないため、認可はストリームの開始時に一度だけ行う。
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	ctx := stream.Context()
+	if err := s.authorize(ctx, auth.LogObject(s.LogName), produceAction); err != nil {
+		return err
+	}
 	for {
 		req, err := stream.Recv()
 		if err != nil {
 			return err
 		}
-		res, err := s.Produce(stream.Context(), req)
+		res, err := s.produce(ctx, req)
 		if err != nil {
 			return err
 		}
@@ -181,37 +279,60 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 // ConsumeStream はサーバ側ストリーミングRPCの実装である。
 // クライアントはサーバにログ内のどのレコードを読み出すか指示し、
 // サーバはそのレコード以降のすべて(未書き込み含む)のレコードをストリーミングする。
+// 認可はオフセットごとに一度だけ行い、新たなレコードを待つ間は繰り返さない。
+// Iterable を設定した場合は、レコードごとにオフセットからログの位置を求め直さずに順に読み出す。
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest,
 	stream api.Log_ConsumeStreamServer) error {
 
+	ctx := stream.Context()
+	read := s.CommitLog.Read
+	if s.Iterable != nil {
+		it := s.Iterable.Iterate(req.Offset)
+		read = func(uint64) (*api.Record, error) { return it.Next() }
+	}
+	authorized := false
 	for {
 		select {
-		case <-stream.Context().Done():
+		case <-ctx.Done():
 			return nil
 		default:
-			res, err := s.Consume(stream.Context(), req)
+			if !authorized {
+				if err := s.authorize(ctx, auth.RecordObject(s.LogName, req.Offset), consumeAction); err != nil {
+					return err
+				}
+				authorized = true
+			}
+			res, err := s.consume(req, read)
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
 				// 新たなレコードが入力されるまでポーリングしているためスリープを挟む
+				// 未書き込みのレコードを待つ間は監査ログに記録しない
 				time.Sleep(time.Second)
 				continue
 			default:
+				s.auditRecord(ctx, consumeAction, req.Offset, err)
 				return err
 			}
+			s.auditRecord(ctx, consumeAction, req.Offset, nil)
 
 			if err = stream.Send(res); err != nil {
 				return err
 			}
 			req.Offset++
+			authorized = false
 		}
 	}
 }
 
+// GetServers はクラスタのサーバ一覧を返却する。
 func (s *grpcServer) GetServers(
 	ctx context.Context,
 	req *api.GetServersRequest,
 ) (*api.GetServersResponse, error) {
+	if err := s.authorize(ctx, auth.ServersObject, discoverAction); err != nil {
+		return nil, err
+	}
 	servers, err := s.GetServerer.GetServers()
 	if err != nil {
 		return nil, err
@@ -223,24 +344,86 @@ type GetServerer interface {
 	GetServers() ([]*api.Server, error)
 }
 
-// authenticate はクライアント証明書からサブジェクトを読み取り、RPCのコンテキストに書き込むミドルウェア。
-// ミドルウェア(別名インタセプタ)により、各RPC呼び出しの実行を途中で変更する。
-func authenticate(ctx context.Context) (context.Context, error) {
-	p, ok := peer.FromContext(ctx)
-	if !ok {
-		return ctx, status.New(codes.Unknown, "couldn't find peer info").Err()
+// WatchServers はクラスタのサーバ一覧を返却し、以降はWatchIntervalごとに確認して変化した場合に返却する。
+// リゾルバはこのストリームを購読し、リーダーの交代やサーバの追加・除去を即座にクライアントに反映する。
+func (s *grpcServer) WatchServers(
+	req *api.WatchServersRequest,
+	stream api.Log_WatchServersServer,
+) error {
+	ctx := stream.Context()
+	if err := s.authorize(ctx, auth.ServersObject, discoverAction); err != nil {
+		return err
 	}
-	if p.AuthInfo == nil {
-		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	interval := s.WatchInterval
+	if interval == 0 {
+		interval = time.Second
 	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last *api.GetServersResponse
+	for {
+		servers, err := s.GetServerer.GetServers()
+		if err != nil {
+			return err
+		}
+		res := &api.GetServersResponse{Servers: servers}
+		if last == nil || !proto.Equal(last, res) {
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+			last = res
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
 
-	tlsInfo := p.AuthInfo.(credentials.TLSInfo)
-	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
-	ctx = context.WithValue(ctx, subjectContextKey{}, subject)
-	return ctx, nil
+// GetMembers はSerfのメンバーシップから見たクラスタのメンバーと、各ノードが公開するタグを返却する。
+// Raftを経由しないため、リーダーが不在の間もクラスタを発見できる。
+func (s *grpcServer) GetMembers(
+	ctx context.Context,
+	req *api.GetMembersRequest,
+) (*api.GetMembersResponse, error) {
+	if s.MemberGetter == nil {
+		return nil, status.Error(codes.Unimplemented, "membership is not enabled")
+	}
+	if err := s.authorize(ctx, auth.MembersObject, discoverAction); err != nil {
+		return nil, err
+	}
+	members, err := s.MemberGetter.GetMembers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetMembersResponse{Members: members}, nil
+}
+
+type MemberGetter interface {
+	GetMembers() ([]*api.Member, error)
+}
+
+// authenticate はAuthenticatorで識別したサブジェクトを、RPCのコンテキストに書き込むミドルウェアを返却する。
+// ミドルウェア(別名インタセプタ)により、各RPC呼び出しの実行を途中で変更する。
+func authenticate(authenticator auth.Authenticator) grpc_auth.AuthFunc {
+	if authenticator == nil {
+		authenticator = auth.CommonName{}
+	}
+	if _, ok := authenticator.(auth.Chain); !ok {
+		// 認証情報を含まないRPCを空のサブジェクトとして扱うため、Chainで包む
+		authenticator = auth.Chain{authenticator}
+	}
+	return func(ctx context.Context) (context.Context, error) {
+		subject, err := authenticator.Authenticate(ctx)
+		if err != nil {
+			return ctx, err
+		}
+		return context.WithValue(ctx, subjectContextKey{}, subject), nil
+	}
 }
 
-// subject はクライアント証明書のサブジェクトを返却する。
+// subject は認証されたサブジェクトを返却する。
 func subject(ctx context.Context) string {
 	return ctx.Value(subjectContextKey{}).(string)
 }
@@ -1,24 +1,37 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	api "github.com/ac0mz/proglog/api/v1"
+	"github.com/ac0mz/proglog/internal/audit"
 	"github.com/ac0mz/proglog/internal/auth"
 	"github.com/ac0mz/proglog/internal/config"
 	"github.com/ac0mz/proglog/internal/log"
+	"github.com/ac0mz/proglog/internal/quota"
+	"github.com/ac0mz/proglog/internal/tracing"
 	"github.com/stretchr/testify/require"
-	"go.opencensus.io/examples/exporter"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 var debug = flag.Bool("debug", false, "Enable observability for debugging.")
@@ -47,17 +60,18 @@ func TestServer(t *testing.T) {
 		"unauthorized fails":                                 testUnauthorized,
 	} {
 		t.Run(scenario, func(t *testing.T) {
-			rootClient, nobodyClient, cfg, teardown := setupTest(t, nil)
+			rootConn, nobodyConn, cfg, teardown := setupTest(t, nil)
 			defer teardown()
-			fn(t, rootClient, nobodyClient, cfg)
+			fn(t, api.NewLogClient(rootConn), api.NewLogClient(nobodyConn), cfg)
 		})
 	}
 }
 
 // setupTest は各テストケースを設定するヘルパー関数である。
 // サーバとクライアントのコネクションがTLS暗号化されるよう設定する。
+// クライアントは書き込みと読み出しが許可されたユーザと、未許可であるユーザのコネクションを返却する。
 func setupTest(t *testing.T, fn func(*Config)) (
-	rootCli api.LogClient, nobodyCli api.LogClient, cfg *Config, teardown func()) {
+	rootConn, nobodyConn *grpc.ClientConn, cfg *Config, teardown func()) {
 	t.Helper()
 
 	// サーバが動作するローカルのアドレスに対してリスナーを作成(0番ポート指定により空きポートが割り当てられる)
@@ -65,7 +79,7 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	require.NoError(t, err)
 
 	// クライアントのTLS認証情報に、クライアントのRoot CA(サーバ確認用)として独自のCAを使うよう設定
-	newCli := func(crtPath, keyPath string) (*grpc.ClientConn, api.LogClient, []grpc.DialOption) {
+	newConn := func(crtPath, keyPath string) *grpc.ClientConn {
 		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
 			CertFile: crtPath,
 			KeyFile:  keyPath,
@@ -77,14 +91,11 @@ func setupTest(t *testing.T, fn func(*Config)) (
 		opts := []grpc.DialOption{grpc.WithTransportCredentials(tlsCreds)}
 		conn, err := grpc.Dial(l.Addr().String(), opts...)
 		require.NoError(t, err)
-		cli := api.NewLogClient(conn)
-		return conn, cli, opts
+		return conn
 	}
 
-	var rootConn *grpc.ClientConn // 書き込みと読み出しが許可されたユーザのコネクション
-	rootConn, rootCli, _ = newCli(config.RootClientCertFile, config.RootClientKeyFile)
-	var nobodyConn *grpc.ClientConn // 未許可であるユーザのコネクション
-	nobodyConn, nobodyCli, _ = newCli(config.NobodyClientCertFile, config.NobodyClientKeyFile)
+	rootConn = newConn(config.RootClientCertFile, config.RootClientKeyFile)
+	nobodyConn = newConn(config.NobodyClientCertFile, config.NobodyClientKeyFile)
 
 	dir, err := os.MkdirTemp("", "server-test")
 	require.NoError(t, err)
@@ -93,31 +104,28 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	clog, err := log.NewLog(dir, log.Config{})
 	require.NoError(t, err)
 
-	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
-	var telemetryExporter *exporter.LogExporter
+	authorizer, err := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, err)
+	var tp *sdktrace.TracerProvider
 	if *debug {
-		// 2つのファイル(テストケース毎に個別で作成される)に書き込むテレメトリエクスポータの設定と起動を実行
-		metricsLogFile, err := os.CreateTemp("", "metrics-*.log")
-		require.NoError(t, err)
-		t.Logf("metrics log file: %s", metricsLogFile.Name())
-
+		// テストケース毎に個別で作成されるファイルに、すべてのリクエストのトレースを書き込む
 		tracesLogFile, err := os.CreateTemp("", "traces-*.log")
 		require.NoError(t, err)
 		t.Logf("traces log file: %s", tracesLogFile.Name())
 
-		telemetryExporter, err = exporter.NewLogExporter(exporter.Options{
-			MetricsLogFile:    metricsLogFile.Name(),
-			TracesLogFile:     tracesLogFile.Name(),
-			ReportingInterval: time.Second,
+		tp, err = tracing.NewTracerProvider(tracing.Config{
+			SampleRatio: 1,
+			Writer:      tracesLogFile,
 		})
 		require.NoError(t, err)
-		err = telemetryExporter.Start()
-		require.NoError(t, err)
 	}
 	cfg = &Config{
 		CommitLog:  clog,
 		Authorizer: authorizer,
 	}
+	if tp != nil {
+		cfg.TracerProvider = tp
+	}
 	if fn != nil {
 		fn(cfg)
 	}
@@ -141,16 +149,15 @@ func setupTest(t *testing.T, fn func(*Config)) (
 		server.Serve(l)
 	}()
 
-	return rootCli, nobodyCli, cfg, func() {
+	return rootConn, nobodyConn, cfg, func() {
 		// 後処理
 		rootConn.Close()
 		nobodyConn.Close()
 		server.Stop()
 		l.Close()
-		if telemetryExporter != nil {
-			time.Sleep(1500 * time.Millisecond) // ストレージにログデータをフラッシュするまでに十分な時間で待機
-			telemetryExporter.Stop()
-			telemetryExporter.Close()
+		if tp != nil {
+			// バッファされているスパンをファイルに書き込んでから停止
+			_ = tp.Shutdown(context.Background())
 		}
 	}
 }
@@ -269,3 +276,550 @@ func testUnauthorized(t *testing.T, _, cli api.LogClient, cnf *Config) {
 		t.Fatalf("want code: %d, got code: %d", wantCode, gotCode)
 	}
 }
+
+// TestQuota はサブジェクトごとの上限を超えたリクエストが、再試行までの待ち時間とともに拒否されることを検証する。
+func TestQuota(t *testing.T) {
+	q := quota.New(quota.Config{
+		Subjects: map[string]quota.Limits{
+			"root": {ProduceBytesPerSec: 1},
+		},
+	})
+	rootConn, nobodyConn, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.Quotas = q
+	})
+	defer teardown()
+	rootCli, nobodyCli := api.NewLogClient(rootConn), api.NewLogClient(nobodyConn)
+	ctx := context.Background()
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+
+	// 1件目は残りのトークンで許可され、超過分は負債として後続のリクエストを拒否する
+	_, err := rootCli.Produce(ctx, req)
+	require.NoError(t, err)
+	_, err = rootCli.Produce(ctx, req)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	delay, ok := quota.RetryDelay(err)
+	require.True(t, ok)
+	require.Greater(t, delay, time.Duration(0))
+
+	// 上限は他のサブジェクトに影響しない
+	_, err = nobodyCli.Produce(ctx, req)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// ストリームでも同様に拒否され、ストリームが終了する
+	stream, err := rootCli.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(req))
+	_, err = stream.Recv()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// 上限の変更は再起動せずに反映される
+	q.Update(quota.Config{})
+	_, err = rootCli.Produce(ctx, req)
+	require.NoError(t, err)
+}
+
+// TestAdmin は管理者用のサービスで追加したポリシーが即座に認可に反映されること、
+// およびポリシーファイルの再読み込みが再起動せずに反映されることを検証する。
+func TestAdmin(t *testing.T) {
+	// ポリシーファイルを書き換えるため、一時ファイルに複製して利用する
+	b, err := os.ReadFile(config.ACLPolicyFile)
+	require.NoError(t, err)
+	policyFile := filepath.Join(t.TempDir(), "policy.csv")
+	require.NoError(t, os.WriteFile(policyFile, b, 0644))
+	authorizer, err := auth.New(config.ACLModelFile, policyFile)
+	require.NoError(t, err)
+
+	rootConn, nobodyConn, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.Authorizer = authorizer
+		cfg.PolicyManager = &policyManager{handler: authorizer}
+	})
+	defer teardown()
+	rootCli, nobodyCli := api.NewLogClient(rootConn), api.NewLogClient(nobodyConn)
+	ctx := context.Background()
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+	nobodyProduce := &api.Policy{Ptype: "p", Values: []string{"nobody", "*", "produce"}}
+
+	// 管理者用のサービスはLogと同じコネクションで呼び出せる
+	rootAdmin, nobodyAdmin := api.NewAdminClient(rootConn), api.NewAdminClient(nobodyConn)
+
+	_, err = nobodyAdmin.AddPolicy(ctx, &api.AddPolicyRequest{Policy: nobodyProduce})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = rootAdmin.AddPolicy(ctx, &api.AddPolicyRequest{Policy: &api.Policy{Ptype: "x"}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = rootAdmin.AddPolicy(ctx, &api.AddPolicyRequest{Policy: nobodyProduce})
+	require.NoError(t, err)
+	_, err = nobodyCli.Produce(ctx, req)
+	require.NoError(t, err)
+	res, err := rootAdmin.ListPolicies(ctx, &api.ListPoliciesRequest{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res.Policies))
+
+	_, err = rootAdmin.RemovePolicy(ctx, &api.RemovePolicyRequest{Policy: nobodyProduce})
+	require.NoError(t, err)
+	_, err = nobodyCli.Produce(ctx, req)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// ファイルから権限を取り消す
+	require.NoError(t, os.WriteFile(policyFile, []byte("p, root, admin/*, admin\n"), 0644))
+	require.NoError(t, authorizer.Reload())
+	_, err = rootCli.Produce(ctx, req)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 読み込みに失敗した場合は変更前のポリシーを使い続ける
+	require.NoError(t, os.Remove(policyFile))
+	require.Error(t, authorizer.Reload())
+	_, err = rootAdmin.ListPolicies(ctx, &api.ListPoliciesRequest{})
+	require.NoError(t, err)
+}
+
+// policyManager はRaftを介さずにポリシーをAuthorizerへ反映する。
+type policyManager struct {
+	mu       sync.Mutex
+	policies []*api.Policy
+	handler  *auth.Authorizer
+}
+
+func (m *policyManager) AddPolicy(_ context.Context, p *api.Policy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policies = append(m.policies, p)
+	return m.handler.SetPolicies(m.policies)
+}
+
+func (m *policyManager) RemovePolicy(_ context.Context, p *api.Policy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var policies []*api.Policy
+	for _, q := range m.policies {
+		if !proto.Equal(p, q) {
+			policies = append(policies, q)
+		}
+	}
+	m.policies = policies
+	return m.handler.SetPolicies(m.policies)
+}
+
+func (m *policyManager) ListPolicies() []*api.Policy {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.policies
+}
+
+// TestScopedAuthorization はオフセットの範囲を指定したポリシーが、単項RPCとストリーミングRPCの両方に適用されること、
+// およびサーバの発見も認可されることを検証する。
+func TestScopedAuthorization(t *testing.T) {
+	var pm *policyManager
+	rootConn, nobodyConn, _, teardown := setupTest(t, func(cfg *Config) {
+		pm = &policyManager{handler: cfg.Authorizer.(*auth.Authorizer)}
+		cfg.PolicyManager = pm
+	})
+	defer teardown()
+	rootCli, nobodyCli := api.NewLogClient(rootConn), api.NewLogClient(nobodyConn)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := rootCli.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, pm.AddPolicy(ctx, &api.Policy{
+		Ptype:  "p",
+		Values: []string{"nobody", auth.LogObject(DefaultLogName) + "@0-0", consumeAction},
+	}))
+
+	_, err := nobodyCli.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = nobodyCli.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// 範囲外のオフセットに到達した時点でストリームは拒否される
+	stream, err := nobodyCli.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = nobodyCli.GetServers(ctx, &api.GetServersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// TestAuthenticator はメタデータで提示されたAPIキーが、クライアント証明書よりも優先されることを検証する。
+func TestAuthenticator(t *testing.T) {
+	digest := sha256.Sum256([]byte("nobody-key"))
+	keyFile := filepath.Join(t.TempDir(), "api-keys.csv")
+	require.NoError(t, os.WriteFile(keyFile, []byte("nobody, "+hex.EncodeToString(digest[:])+"\n"), 0644))
+	apiKeys, err := auth.NewAPIKeys(keyFile)
+	require.NoError(t, err)
+
+	rootConn, _, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.Authenticator = auth.Chain{apiKeys, auth.CommonName{}}
+	})
+	defer teardown()
+	rootCli := api.NewLogClient(rootConn)
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}}
+
+	_, err = rootCli.Produce(context.Background(), req)
+	require.NoError(t, err)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), auth.APIKeyHeader, "nobody-key")
+	_, err = rootCli.Produce(ctx, req)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), auth.APIKeyHeader, "wrong-key")
+	_, err = rootCli.Produce(ctx, req)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestAudit(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := audit.NewFileSink(audit.FileConfig{Dir: dir})
+	require.NoError(t, err)
+	auditor := audit.New(sink)
+	rootConn, nobodyConn, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.Auditor = auditor
+		cfg.PolicyManager = &policyManager{handler: cfg.Authorizer.(*auth.Authorizer)}
+	})
+	defer teardown()
+	rootCli, nobodyCli := api.NewLogClient(rootConn), api.NewLogClient(nobodyConn)
+	ctx := context.Background()
+
+	produce, err := rootCli.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	_, err = nobodyCli.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	policy := &api.Policy{Ptype: "g", Values: []string{"nobody", "consumer"}}
+	_, err = api.NewAdminClient(rootConn).AddPolicy(ctx, &api.AddPolicyRequest{Policy: policy})
+	require.NoError(t, err)
+	_, err = nobodyCli.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.NoError(t, auditor.Close())
+
+	var events []audit.Event
+	require.NoError(t, audit.Query(dir, audit.Filter{}, func(e audit.Event) error {
+		events = append(events, e)
+		return nil
+	}))
+	normalize := func(e audit.Event) audit.Event {
+		require.False(t, e.Time.IsZero())
+		require.NotEmpty(t, e.Peer)
+		e.Time, e.Peer = time.Time{}, ""
+		return e
+	}
+	off := produce.Offset
+	expected := []audit.Event{
+		{Kind: audit.KindAuthorization, Subject: "root", Method: "/log.v1.Log/Produce", Action: produceAction, Object: "log/default", Outcome: audit.OutcomeAllow},
+		{Kind: audit.KindRecord, Subject: "root", Method: "/log.v1.Log/Produce", Action: produceAction, Object: "log/default", Offset: &off, Outcome: audit.OutcomeSuccess},
+		{Kind: audit.KindAuthorization, Subject: "nobody", Method: "/log.v1.Log/Consume", Action: consumeAction, Object: "log/default@0", Outcome: audit.OutcomeDeny},
+		{Kind: audit.KindAuthorization, Subject: "root", Method: "/log.v1.Admin/AddPolicy", Action: adminAction, Object: auth.PolicyObject, Outcome: audit.OutcomeAllow},
+		{Kind: audit.KindAdmin, Subject: "root", Method: "/log.v1.Admin/AddPolicy", Action: "add_policy", Object: "g, nobody, consumer", Outcome: audit.OutcomeSuccess},
+		{Kind: audit.KindAuthorization, Subject: "nobody", Method: "/log.v1.Log/Consume", Action: consumeAction, Object: "log/default@0", Outcome: audit.OutcomeAllow},
+		{Kind: audit.KindRecord, Subject: "nobody", Method: "/log.v1.Log/Consume", Action: consumeAction, Object: "log/default", Offset: &off, Outcome: audit.OutcomeSuccess},
+	}
+	require.Equal(t, len(expected), len(events))
+	for i := range expected {
+		actual := normalize(events[i])
+		if expected[i].Kind == audit.KindAuthorization && expected[i].Outcome == audit.OutcomeDeny {
+			require.NotEmpty(t, actual.Error)
+			actual.Error = ""
+		}
+		require.Equal(t, expected[i], actual)
+	}
+}
+
+func TestGossipKeys(t *testing.T) {
+	km := &keyManager{keys: map[string]int{"old": 3}}
+	rootConn, nobodyConn, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.KeyManager = km
+	})
+	defer teardown()
+	root, nobody := api.NewAdminClient(rootConn), api.NewAdminClient(nobodyConn)
+	ctx := context.Background()
+
+	_, err := nobody.InstallGossipKey(ctx, &api.GossipKeyRequest{Key: "new"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = root.InstallGossipKey(ctx, &api.GossipKeyRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = root.InstallGossipKey(ctx, &api.GossipKeyRequest{Key: "new"})
+	require.NoError(t, err)
+	_, err = root.UseGossipKey(ctx, &api.GossipKeyRequest{Key: "new"})
+	require.NoError(t, err)
+	_, err = root.RemoveGossipKey(ctx, &api.GossipKeyRequest{Key: "old"})
+	require.NoError(t, err)
+	res, err := root.ListGossipKeys(ctx, &api.ListGossipKeysRequest{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int32{"new": 3}, res.Keys)
+	require.Equal(t, int32(3), res.NumNodes)
+	require.Equal(t, "new", km.primary)
+
+	// 主鍵は削除できない
+	_, err = root.RemoveGossipKey(ctx, &api.GossipKeyRequest{Key: "new"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	// ポリシーの管理は有効でない
+	_, err = root.ListPolicies(ctx, &api.ListPoliciesRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+// keyManager は3つのノードのクラスタの鍵を管理する KeyManager の偽物である。
+type keyManager struct {
+	keys    map[string]int
+	primary string
+}
+
+func (m *keyManager) InstallKey(key string) error {
+	m.keys[key] = 3
+	return nil
+}
+
+func (m *keyManager) UseKey(key string) error {
+	m.primary = key
+	return nil
+}
+
+func (m *keyManager) RemoveKey(key string) error {
+	if key == m.primary {
+		return errors.New("removing the primary key is not allowed")
+	}
+	delete(m.keys, key)
+	return nil
+}
+
+func (m *keyManager) ListKeys() (map[string]int, int, error) {
+	return m.keys, 3, nil
+}
+
+func TestMembersAndQueries(t *testing.T) {
+	cluster := &cluster{}
+	rootConn, nobodyConn, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.MemberGetter = cluster
+		cfg.Querier = cluster
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := api.NewLogClient(nobodyConn).GetMembers(ctx, &api.GetMembersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	members, err := api.NewLogClient(rootConn).GetMembers(ctx, &api.GetMembersRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "true", members.Members[0].Tags["leader"])
+
+	root, nobody := api.NewAdminClient(rootConn), api.NewAdminClient(nobodyConn)
+	_, err = nobody.Query(ctx, &api.QueryRequest{Name: "snapshot"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = root.Query(ctx, &api.QueryRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	res, err := root.Query(ctx, &api.QueryRequest{Name: "snapshot", TimeoutMs: 100})
+	require.NoError(t, err)
+	require.Equal(t, "0", res.Results[0].Node)
+	require.Equal(t, 100*time.Millisecond, cluster.timeout)
+}
+
+// cluster は1つのノードのクラスタのメンバーを返却し、クエリに応答する偽物である。
+type cluster struct {
+	timeout time.Duration
+}
+
+func (c *cluster) GetMembers() ([]*api.Member, error) {
+	return []*api.Member{{
+		Name:   "0",
+		Addr:   "127.0.0.1:8401",
+		Status: "alive",
+		Tags:   map[string]string{"leader": "true"},
+	}}, nil
+}
+
+func (c *cluster) Query(name string, payload []byte, timeout time.Duration) ([]*api.QueryResult, error) {
+	c.timeout = timeout
+	return []*api.QueryResult{{Node: "0"}}, nil
+}
+
+func TestMaxStaleness(t *testing.T) {
+	staleness := &staleness{}
+	rootConn, _, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.StalenessReporter = staleness
+	})
+	defer teardown()
+	ctx := context.Background()
+	client := api.NewLogClient(rootConn)
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+
+	staleness.set(2 * time.Second)
+	// 上限を指定しない読み出しは古さを問わない
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:       produce.Offset,
+		MaxStaleness: durationpb.New(5 * time.Second),
+	})
+	require.NoError(t, err)
+	// 上限を超えて古い場合は、他のサーバで再試行できるエラーを返却する
+	_, err = client.Consume(ctx, &api.ConsumeRequest{
+		Offset:       produce.Offset,
+		MaxStaleness: durationpb.New(time.Second),
+	})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.True(t, api.IsStaleRead(err))
+}
+
+// staleness は設定した古さを返却する偽物である。
+type staleness struct {
+	mu sync.Mutex
+	d  time.Duration
+}
+
+func (s *staleness) set(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.d = d
+}
+
+func (s *staleness) Staleness() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.d
+}
+
+func TestBackup(t *testing.T) {
+	backuper := &backuper{data: bytes.Repeat([]byte("backup"), 50000)}
+	rootConn, nobodyConn, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.Backuper = backuper
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	stream, err := api.NewAdminClient(nobodyConn).Backup(ctx, &api.BackupRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	stream, err = api.NewAdminClient(rootConn).Backup(ctx, &api.BackupRequest{})
+	require.NoError(t, err)
+	var got []byte
+	chunks := 0
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(chunk.Data), backupChunkSize)
+		got = append(got, chunk.Data...)
+		chunks++
+	}
+	require.Equal(t, backuper.data, got)
+	require.Equal(t, (len(got)+backupChunkSize-1)/backupChunkSize, chunks)
+}
+
+// backuper は固定のバイト列をバックアップとして書き込む偽物である。
+type backuper struct {
+	data []byte
+}
+
+func (b *backuper) Backup(w io.Writer) error {
+	// 小さな書き込みに分けても、送信時にまとめられることを確認する
+	for off := 0; off < len(b.data); off += 1000 {
+		end := off + 1000
+		if end > len(b.data) {
+			end = len(b.data)
+		}
+		if _, err := w.Write(b.data[off:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TestConsumeStreamIterator はイテレータを設定した場合も、ConsumeStreamが指定したオフセットから
+// 後から書き込まれたレコードまで順に読み出すことを検証する。
+func TestConsumeStreamIterator(t *testing.T) {
+	var iterable *logIterable
+	rootConn, nobodyConn, _, teardown := setupTest(t, func(cfg *Config) {
+		iterable = &logIterable{log: cfg.CommitLog.(*log.Log)}
+		cfg.Iterable = iterable
+	})
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rootCli := api.NewLogClient(rootConn)
+
+	produce := func(value string) {
+		_, err := rootCli.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		require.NoError(t, err)
+	}
+	for _, value := range []string{"first", "second", "third"} {
+		produce(value)
+	}
+	stream, err := rootCli.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	for i, value := range []string{"second", "third"} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i+1), res.Record.Offset)
+		require.Equal(t, value, string(res.Record.Value))
+	}
+	// 未書き込みのレコードは書き込まれるまで待つ
+	produce("fourth")
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), res.Record.Offset)
+	require.Equal(t, "fourth", string(res.Record.Value))
+	require.Equal(t, 1, iterable.count())
+
+	// イテレータを用いる場合も、オフセットごとに認可する
+	stream, err = api.NewLogClient(nobodyConn).ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// logIterable はログのイテレータを返却し、作成したイテレータの数を数える。
+type logIterable struct {
+	log *log.Log
+	mu  sync.Mutex
+	n   int
+}
+
+func (i *logIterable) Iterate(offset uint64) RecordIterator {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.n++
+	return i.log.Iterator(offset)
+}
+
+func (i *logIterable) count() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.n
+}
+
+// TestProduceAtOffset はオフセットを指定した書き込みが、OffsetAppender を設定した場合のみ受け付けられ、
+// ログの次のオフセットと一致しない場合は FailedPrecondition として拒否されることを検証する。
+func TestProduceAtOffset(t *testing.T) {
+	ctx := context.Background()
+	at := func(off uint64) *api.ProduceRequest {
+		return &api.ProduceRequest{Record: &api.Record{Value: []byte("hello"), Topic: "orders"}, Offset: &off}
+	}
+
+	rootConn, _, _, teardown := setupTest(t, nil)
+	_, err := api.NewLogClient(rootConn).Produce(ctx, at(0))
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	teardown()
+
+	rootConn, _, _, teardown = setupTest(t, func(cfg *Config) {
+		cfg.OffsetAppender = cfg.CommitLog.(*log.Log)
+	})
+	defer teardown()
+	cli := api.NewLogClient(rootConn)
+	res, err := cli.Produce(ctx, at(5))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), res.Offset)
+	_, err = cli.Produce(ctx, at(5))
+	require.True(t, api.IsOffsetMismatch(err), err)
+	consume, err := cli.Consume(ctx, &api.ConsumeRequest{Offset: 5})
+	require.NoError(t, err)
+	require.Equal(t, "orders", consume.Record.Topic)
+}
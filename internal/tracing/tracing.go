@@ -0,0 +1,125 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/ac0mz/proglog"
+
+// Config はトレースのサンプリングとエクスポート先を設定する。
+type Config struct {
+	ServiceName string
+	// SampleRatio は親スパンを持たないトレースをサンプリングする割合 (0〜1) である。
+	// 親スパンを持つ場合は親のサンプリング判定に従う。
+	SampleRatio float64
+	// Endpoint はOTLP/HTTPでスパンを受け付けるコレクタのURL (例: http://localhost:4318) である。
+	Endpoint string
+	// Writer はスパンをJSON形式で書き込む出力先である。デバッグ用途を想定する。
+	Writer io.Writer
+}
+
+// NewTracerProvider は設定されたサンプリング割合でトレースを収集し、
+// コレクタまたはWriterにエクスポートするTracerProviderを作成する。
+// エクスポート先が未設定の場合、スパンは収集されるがエクスポートされない。
+//
+//	NOTE:
+//	 本番環境においてはパフォーマンスへの悪影響や機密データの追跡を避けるため、
+//	 SampleRatioに1未満の値を指定して一部のリクエストのみをサンプリングする。
+func NewTracerProvider(cfg Config) (*sdktrace.TracerProvider, error) {
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "proglog"
+	}
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	}
+	if cfg.Endpoint != "" {
+		exporter, err := newOTLPExporter(cfg.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	if cfg.Writer != nil {
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(cfg.Writer))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	return sdktrace.NewTracerProvider(opts...), nil
+}
+
+// newOTLPExporter はコレクタのURLにOTLP/HTTPでスパンを送信するエクスポータを作成する。
+// URLのスキームがhttpの場合はTLSを利用せず、パスを省略した場合は /v1/traces に送信する。
+func newOTLPExporter(endpoint string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithCompression(otlptracehttp.GzipCompression),
+	}
+	switch u.Scheme {
+	case "http":
+		opts = append(opts, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return nil, fmt.Errorf("unsupported tracing endpoint scheme: %s", endpoint)
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	return otlptracehttp.New(context.Background(), opts...)
+}
+
+// Start はコンテキストに含まれるスパンと同じTracerProviderで子スパンを開始する。
+// コンテキストがサンプリング対象のスパンを含まない場合、記録されないスパンを返却する。
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(instrumentationName)
+	return tracer.Start(ctx, name, opts...)
+}
+
+var propagator = propagation.TraceContext{}
+
+// Inject はコンテキストのトレース情報を、Raftのログエントリ等に埋め込めるバイト列に変換する。
+// コンテキストがトレース情報を含まない場合はnilを返却する。
+func Inject(ctx context.Context) []byte {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(carrier)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// Extract はInjectで作成されたバイト列からトレース情報を復元し、コンテキストに設定する。
+// バイト列が空、または不正な場合は引数のコンテキストをそのまま返却する。
+func Extract(ctx context.Context, b []byte) context.Context {
+	if len(b) == 0 {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{}
+	if err := json.Unmarshal(b, &carrier); err != nil {
+		return ctx
+	}
+	return propagator.Extract(ctx, carrier)
+}
@@ -0,0 +1,128 @@
+package tracing
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestExportToCollector はコレクタの代わりとなるHTTPサーバに対して、
+// 親子関係を保ったスパンがOTLP/HTTPでエクスポートされることを検証する。
+func TestExportToCollector(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	tp, err := NewTracerProvider(Config{
+		ServiceName: "proglog-test",
+		SampleRatio: 1,
+		Endpoint:    srv.URL,
+	})
+	require.NoError(t, err)
+	ctx, root := tp.Tracer("test").Start(context.Background(), "root")
+
+	// Raftのログエントリを経由する場合と同様に、トレース情報をバイト列で引き渡す
+	b := Inject(ctx)
+	require.NotNil(t, b)
+	remote := Extract(context.Background(), b)
+	_, child := tp.Tracer("test").Start(remote, "child")
+	child.End()
+	root.End()
+	require.NoError(t, tp.Shutdown(context.Background()))
+
+	spans := c.spans()
+	require.Equal(t, 2, len(spans))
+	byName := map[string]*tracepb.Span{}
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	require.Equal(t, byName["root"].TraceId, byName["child"].TraceId)
+	require.Equal(t, byName["root"].SpanId, byName["child"].ParentSpanId)
+	traceID := root.SpanContext().TraceID()
+	require.Equal(t, traceID[:], byName["root"].TraceId)
+}
+
+// TestSampling はサンプリング割合が0の場合にスパンが記録されず、
+// 親スパンのサンプリング判定が子スパンに引き継がれることを検証する。
+func TestSampling(t *testing.T) {
+	tp, err := NewTracerProvider(Config{SampleRatio: 0})
+	require.NoError(t, err)
+	ctx, span := tp.Tracer("test").Start(context.Background(), "root")
+	require.False(t, span.SpanContext().IsSampled())
+	require.Nil(t, Inject(context.Background()))
+
+	_, child := Start(ctx, "child")
+	require.False(t, child.IsRecording())
+
+	sampled := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+	}))
+	_, child = tp.Tracer("test").Start(sampled, "child")
+	require.True(t, child.SpanContext().IsSampled())
+}
+
+// collector はOTLP/HTTPのコレクタの代わりに、受信したスパンを保持する。
+type collector struct {
+	mu  sync.Mutex
+	req []*coltracepb.ExportTraceServiceRequest
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &coltracepb.ExportTraceServiceRequest{}
+	if err := proto.Unmarshal(b, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	c.req = append(c.req, req)
+	c.mu.Unlock()
+
+	res, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(res)
+}
+
+func (c *collector) spans() []*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var spans []*tracepb.Span
+	for _, req := range c.req {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}